@@ -1,48 +0,0 @@
-#!/bin/bash
-INDEX_NAME=crons004
-ALIAS_NAME=$1
-ES_IP=$2
-TESTING=$3
-
-CronMapping='
-	"Cron": {
-		"dynamic": "strict",
-		"properties": {
-			"eventTypeId": {
-				"type": "string",
-				"index": "not_analyzed"
-			},
-			"eventId": {
-				"type": "string",
-				"index": "not_analyzed"
-			},
-			"data": {
-				"dynamic": "false",
-				"type": "object"
-			},
-			"createdBy": {
-				"type": "string",
-				"index": "not_analyzed"
-			},
-			"createdOn": {
-				"type": "date",
-				"format": "yyyy-MM-dd'\''T'\''HH:mm:ssZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSSSZZ"
-			},
-			"cronSchedule": {
-				"type": "string",
-				"index": "not_analyzed"
-			}
-		}
-	}'
-IndexSettings="
-{
-	"\""settings"\"": {
-		"\""index.mapping.coerce"\"": false
-	},
-	"\""mappings"\"": {
-		$CronMapping
-	}
-}"
-
-
-bash db/CreateIndex.sh $INDEX_NAME $ALIAS_NAME $ES_IP "$IndexSettings" "$CronMapping" $TESTING
\ No newline at end of file
@@ -15,8 +15,11 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	piazza "github.com/venicegeo/pz-gocommon/gocommon"
 	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
@@ -24,16 +27,34 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	log.Printf("pz-workflow starting...")
 
-	sys, logWriter, auditWriter := makeClients()
+	// with a store directory, the resources are kept there rather than in
+	// Elasticsearch
+	storeDir := os.Getenv("PZ_WORKFLOW_STORE")
+
+	sys, logWriter, auditWriter := makeClients(storeDir == "")
 
 	pzPen := os.Getenv("PZ_PEN")
 	if pzPen == "" {
 		log.Fatal("Environment Variable PZ_PEN not found")
 	}
 
-	kit, err := pzworkflow.NewKit(sys, logWriter, auditWriter, false, pzPen)
+	var kit *pzworkflow.Kit
+	var err error
+	if storeDir != "" {
+		log.Printf("pz-workflow keeping its resources in %s", storeDir)
+		kit, err = pzworkflow.NewEmbeddedKit(sys, logWriter, auditWriter, storeDir, pzPen)
+	} else {
+		kit, err = pzworkflow.NewKit(sys, logWriter, auditWriter, false, pzPen)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -43,27 +64,51 @@ func main() {
 		log.Fatal(err)
 	}
 
-	err = kit.Wait()
-	if err != nil {
-		log.Fatal(err)
+	// on SIGTERM or SIGINT, the triggers being fired are finished, or put in
+	// the outbox, before exiting
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	served := make(chan error, 1)
+	go func() {
+		served <- kit.Wait()
+	}()
+
+	select {
+	case err = <-served:
+		if err != nil {
+			log.Fatal(err)
+		}
+	case sig := <-signals:
+		log.Printf("pz-workflow stopping on %s...", sig)
+		if err = kit.Stop(); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("pz-workflow stopped")
 	}
 }
 
-func makeClients() (
+func makeClients(elasticsearch bool) (
 	*piazza.SystemConfig,
 	pzsyslog.Writer,
 	pzsyslog.Writer) {
 
 	required := []piazza.ServiceName{
-		piazza.PzElasticSearch,
 		piazza.PzRabbitMQ,
 	}
+	if elasticsearch {
+		required = append(required, piazza.PzElasticSearch)
+	}
 
 	sys, err := piazza.NewSystemConfig(piazza.PzWorkflow, required)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// the logs go to Elasticsearch only when there is one
+	if !elasticsearch {
+		return sys, &pzsyslog.StderrWriter{}, &pzsyslog.StdoutWriter{}
+	}
+
 	loggerIndex, err := pzsyslog.GetRequiredEnvVars()
 	if err != nil {
 		log.Fatal(err)
@@ -76,3 +121,51 @@ func makeClients() (
 
 	return sys, logWriter, auditWriter
 }
+
+// migrate runs "pz-workflow migrate status|up", for bringing the indices up
+// to date without starting the service
+func migrate(args []string) error {
+	if len(args) != 1 || (args[0] != "status" && args[0] != "up") {
+		return fmt.Errorf("usage: pz-workflow migrate status|up")
+	}
+
+	sys, err := piazza.NewSystemConfig(piazza.PzWorkflow, []piazza.ServiceName{piazza.PzElasticSearch})
+	if err != nil {
+		return err
+	}
+	admin, err := pzworkflow.NewEsIndexAdmin(sys)
+	if err != nil {
+		return err
+	}
+	migrator, err := pzworkflow.NewMigrator(admin, pzworkflow.Migrations)
+	if err != nil {
+		return err
+	}
+
+	if args[0] == "up" {
+		applied, err := migrator.Up()
+		for _, record := range applied {
+			fmt.Printf("applied %d: %s -> %s\n", record.Version, record.Alias, record.Index)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("up to date")
+		}
+		return nil
+	}
+
+	status, err := migrator.Status()
+	if err != nil {
+		return err
+	}
+	for _, s := range status {
+		appliedOn := "pending"
+		if s.AppliedOn != nil {
+			appliedOn = s.AppliedOn.String()
+		}
+		fmt.Printf("%4d  %-20s %-24s %s\n", s.Version, s.Alias, s.Index, appliedOn)
+	}
+	return nil
+}
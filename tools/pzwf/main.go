@@ -0,0 +1,198 @@
+// Copyright 2017, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// pzwf is a command-line client for pz-workflow.
+//
+// The service is found from -url, else $PZWORKFLOW_URL, else from $PZSERVER.
+// The API key is taken from -key, else $PZKEY, else $HOME/.pzkey.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+	"github.com/venicegeo/pz-workflow/workflow"
+)
+
+const usage = `usage: pzwf [-url URL] [-key KEY] COMMAND [ARGS]
+
+commands:
+  eventtypes|events|triggers|alerts list [-perPage N] [-page N]
+  eventtypes|events|triggers|alerts get ID
+  eventtypes|events|triggers|alerts create FILE
+  eventtypes|events|triggers|alerts delete ID
+  trigger test ID FILE
+  export [FILE]
+  import FILE
+  purge [-createdBy USER] [-olderThan DURATION] [-eventType NAME|ID] [-dry-run] [alert|trigger|cron|event|eventType ...]
+  reindex [-settings FILE] ALIAS INDEX
+
+FILE may be "-" to read from (or write to) the console.
+`
+
+func main() {
+	flags := flag.NewFlagSet("pzwf", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+	url := flags.String("url", os.Getenv("PZWORKFLOW_URL"), "pz-workflow URL (default $PZWORKFLOW_URL, or from $PZSERVER)")
+	key := flags.String("key", "", "API key (default $PZKEY or $HOME/.pzkey)")
+	_ = flags.Parse(os.Args[1:])
+
+	args := flags.Args()
+	if len(args) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	client, err := makeClient(*url, *key)
+	if err != nil {
+		fail(err)
+	}
+
+	if err = run(client, args[0], args[1:]); err != nil {
+		fail(err)
+	}
+}
+
+func run(client *workflow.Client, command string, args []string) error {
+	switch command {
+	case "trigger":
+		if len(args) != 3 || args[0] != "test" {
+			return fmt.Errorf("usage: pzwf trigger test ID FILE")
+		}
+		return testTrigger(client, piazza.Ident(args[1]), args[2])
+	case "export":
+		return export(client, args)
+	case "import":
+		return importFile(client, args)
+	case "purge":
+		return purge(client, args)
+	case "reindex":
+		return reindex(client, args)
+	}
+
+	res, ok := resources(client)[command]
+	if !ok {
+		return fmt.Errorf("unknown command: %s", command)
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("usage: pzwf %s list|get|create|delete", command)
+	}
+	return res.run(command, args[0], args[1:])
+}
+
+func makeClient(url string, apiKey string) (*workflow.Client, error) {
+	var err error
+
+	if url == "" {
+		url, err = piazza.GetPiazzaServiceUrl(piazza.PzWorkflow)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if apiKey == "" {
+		apiKey, err = piazza.GetApiKey(url)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	logger := pzsyslog.NewLogger(&pzsyslog.NilWriter{}, &pzsyslog.NilWriter{}, "pz-workflow/pzwf", "")
+	return workflow.NewClient(url, apiKey, logger)
+}
+
+func testTrigger(client *workflow.Client, id piazza.Ident, file string) error {
+	event := &workflow.Event{}
+	if err := readJSON(file, event); err != nil {
+		return err
+	}
+	result, err := client.TestTrigger(id, event)
+	if err != nil {
+		return err
+	}
+	return printJSON(result)
+}
+
+func export(client *workflow.Client, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: pzwf export [FILE]")
+	}
+	byts, err := client.Export()
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 || args[0] == "-" {
+		_, err = os.Stdout.Write(byts)
+		return err
+	}
+	return ioutil.WriteFile(args[0], byts, 0644)
+}
+
+func importFile(client *workflow.Client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: pzwf import FILE")
+	}
+	r, err := openInput(args[0])
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	report, err := client.Import(r)
+	if err != nil {
+		return err
+	}
+	return printJSON(report)
+}
+
+//---------------------------------------------------------------------
+
+func openInput(file string) (io.ReadCloser, error) {
+	if file == "-" {
+		return ioutil.NopCloser(os.Stdin), nil
+	}
+	return os.Open(file)
+}
+
+func readJSON(file string, out interface{}) error {
+	r, err := openInput(file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return json.NewDecoder(r).Decode(out)
+}
+
+func printJSON(obj interface{}) error {
+	byts, err := json.MarshalIndent(obj, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(byts))
+	return nil
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "pzwf: %s\n", err)
+	os.Exit(1)
+}
@@ -0,0 +1,85 @@
+// Copyright 2017, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	"github.com/venicegeo/pz-workflow/workflow"
+)
+
+// how often the progress of a purge is shown
+const purgePollInterval = 2 * time.Second
+
+func purge(client *workflow.Client, args []string) error {
+	flags := flag.NewFlagSet("purge", flag.ExitOnError)
+	createdBy := flags.String("createdBy", "", "only objects created by this user")
+	olderThan := flags.Duration("olderThan", 0, "only objects created at least this long ago, e.g. 720h")
+	eventType := flags.String("eventType", "", "only objects of this eventType, by name or id")
+	dryRun := flags.Bool("dry-run", false, "count what would be deleted, without deleting it")
+	_ = flags.Parse(args)
+
+	request := &workflow.PurgeRequest{CreatedBy: *createdBy, Kinds: flags.Args(), DryRun: *dryRun}
+	if *olderThan > 0 {
+		before := piazza.TimeStamp(time.Now().Add(-*olderThan))
+		request.CreatedBefore = &before
+	}
+	if *eventType != "" {
+		id, err := resolveEventType(client, *eventType)
+		if err != nil {
+			return err
+		}
+		request.EventTypeID = id
+	}
+
+	job, err := client.PostPurge(request)
+	if err != nil {
+		return err
+	}
+	for job.Status == workflow.PurgeStatusRunning {
+		fmt.Fprintf(os.Stderr, "purging %s: deleted %v\n", job.Stage, job.Deleted)
+		time.Sleep(purgePollInterval)
+		if job, err = client.GetPurge(job.PurgeID); err != nil {
+			return err
+		}
+	}
+
+	if err = printJSON(job); err != nil {
+		return err
+	}
+	if job.Status != workflow.PurgeStatusDone {
+		return fmt.Errorf("purge %s", job.Status)
+	}
+	if len(job.Failed) > 0 {
+		return fmt.Errorf("some objects could not be deleted: %v", job.Failed)
+	}
+	return nil
+}
+
+// resolveEventType takes an eventType id, or failing that, a name
+func resolveEventType(client *workflow.Client, nameOrID string) (piazza.Ident, error) {
+	if eventType, err := client.GetEventType(piazza.Ident(nameOrID)); err == nil {
+		return eventType.EventTypeID, nil
+	}
+	eventType, err := client.GetEventTypeByName(nameOrID)
+	if err != nil {
+		return "", fmt.Errorf("eventType %s could not be found: %s", nameOrID, err)
+	}
+	return eventType.EventTypeID, nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2017, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/venicegeo/pz-workflow/workflow"
+)
+
+func reindex(client *workflow.Client, args []string) error {
+	flags := flag.NewFlagSet("reindex", flag.ExitOnError)
+	settingsFile := flags.String("settings", "", "settings of the new index, instead of those of the latest migration")
+	_ = flags.Parse(args)
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage: pzwf reindex [-settings FILE] ALIAS INDEX")
+	}
+
+	request := &workflow.ReindexRequest{Alias: flags.Arg(0), Index: flags.Arg(1)}
+	if *settingsFile != "" {
+		r, err := openInput(*settingsFile)
+		if err != nil {
+			return err
+		}
+		byts, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		request.Settings = string(byts)
+	}
+
+	job, err := client.PostReindex(request)
+	if err != nil {
+		return err
+	}
+	for job.Status == workflow.ReindexStatusRunning {
+		fmt.Fprintf(os.Stderr, "reindexing %s: copied %d\n", job.Stage, job.Copied)
+		time.Sleep(purgePollInterval)
+		if job, err = client.GetReindex(job.ReindexID); err != nil {
+			return err
+		}
+	}
+
+	if err = printJSON(job); err != nil {
+		return err
+	}
+	if job.Status != workflow.ReindexStatusDone {
+		return fmt.Errorf("reindex %s", job.Status)
+	}
+	return nil
+}
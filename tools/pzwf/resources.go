@@ -0,0 +1,123 @@
+// Copyright 2017, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	"github.com/venicegeo/pz-workflow/workflow"
+)
+
+// resource is the list/get/create/delete verbs of one kind of object
+type resource struct {
+	list   func(perPage int, page int) (interface{}, error)
+	get    func(id piazza.Ident) (interface{}, error)
+	create func(file string) (interface{}, error)
+	delete func(id piazza.Ident) error
+}
+
+func resources(client *workflow.Client) map[string]*resource {
+	return map[string]*resource{
+		"eventtypes": {
+			list: func(perPage int, page int) (interface{}, error) { return client.GetAllEventTypes(perPage, page) },
+			get:  func(id piazza.Ident) (interface{}, error) { return client.GetEventType(id) },
+			create: func(file string) (interface{}, error) {
+				eventType := &workflow.EventType{}
+				if err := readJSON(file, eventType); err != nil {
+					return nil, err
+				}
+				return client.PostEventType(eventType)
+			},
+			delete: client.DeleteEventType,
+		},
+		"events": {
+			list: func(perPage int, page int) (interface{}, error) { return client.GetAllEvents(perPage, page) },
+			get:  func(id piazza.Ident) (interface{}, error) { return client.GetEvent(id) },
+			create: func(file string) (interface{}, error) {
+				event := &workflow.Event{}
+				if err := readJSON(file, event); err != nil {
+					return nil, err
+				}
+				return client.PostEvent(event)
+			},
+			delete: client.DeleteEvent,
+		},
+		"triggers": {
+			list: func(perPage int, page int) (interface{}, error) { return client.GetAllTriggers(perPage, page) },
+			get:  func(id piazza.Ident) (interface{}, error) { return client.GetTrigger(id) },
+			create: func(file string) (interface{}, error) {
+				trigger := &workflow.Trigger{}
+				if err := readJSON(file, trigger); err != nil {
+					return nil, err
+				}
+				return client.PostTrigger(trigger)
+			},
+			delete: client.DeleteTrigger,
+		},
+		"alerts": {
+			list: func(perPage int, page int) (interface{}, error) { return client.GetAllAlerts(perPage, page) },
+			get:  func(id piazza.Ident) (interface{}, error) { return client.GetAlert(id) },
+			create: func(file string) (interface{}, error) {
+				alert := &workflow.Alert{}
+				if err := readJSON(file, alert); err != nil {
+					return nil, err
+				}
+				return client.PostAlert(alert)
+			},
+			delete: client.DeleteAlert,
+		},
+	}
+}
+
+func (res *resource) run(name string, verb string, args []string) error {
+	switch verb {
+	case "list":
+		flags := flag.NewFlagSet(name+" list", flag.ExitOnError)
+		perPage := flags.Int("perPage", 100, "objects per page")
+		page := flags.Int("page", 0, "page number, from 0")
+		_ = flags.Parse(args)
+		objs, err := res.list(*perPage, *page)
+		if err != nil {
+			return err
+		}
+		return printJSON(objs)
+	case "get":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: pzwf %s get ID", name)
+		}
+		obj, err := res.get(piazza.Ident(args[0]))
+		if err != nil {
+			return err
+		}
+		return printJSON(obj)
+	case "create":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: pzwf %s create FILE", name)
+		}
+		obj, err := res.create(args[0])
+		if err != nil {
+			return err
+		}
+		return printJSON(obj)
+	case "delete":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: pzwf %s delete ID", name)
+		}
+		return res.delete(piazza.Ident(args[0]))
+	}
+	return fmt.Errorf("unknown %s command: %s", name, verb)
+}
@@ -0,0 +1,78 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// ACLDB keeps in Elasticsearch the ACLs that have been set; a resource
+// without one has the default its creator gets
+type ACLDB struct {
+	*ResourceDB
+	mapping string
+}
+
+func NewACLDB(service *Service, esi elasticsearch.IIndex) (*ACLDB, error) {
+	rdb, err := NewResourceDB(service, esi)
+	if err != nil {
+		return nil, err
+	}
+	return &ACLDB{ResourceDB: rdb, mapping: ACLDBMapping}, nil
+}
+
+func (db *ACLDB) PutData(acl *ACL) error {
+	if _, err := db.Esi.PutData(db.mapping, acl.ResourceID.String(), acl); err != nil {
+		return LoggedError("ACLDB.PutData failed: %s", err)
+	}
+	return nil
+}
+
+func (db *ACLDB) GetOne(id piazza.Ident) (*ACL, bool, error) {
+	exists, err := db.Esi.ItemExists(db.mapping, id.String())
+	if err != nil || !exists {
+		return nil, false, err
+	}
+	getResult, err := db.Esi.GetByID(db.mapping, id.String())
+	if err != nil {
+		return nil, false, LoggedError("ACLDB.GetOne failed: %s", err)
+	}
+	if getResult == nil || getResult.Source == nil {
+		return nil, false, LoggedError("ACLDB.GetOne failed: no getResult")
+	}
+	var acl ACL
+	if err = json.Unmarshal(*getResult.Source, &acl); err != nil {
+		return nil, getResult.Found, err
+	}
+	return &acl, getResult.Found, nil
+}
+
+func (db *ACLDB) DeleteByID(id piazza.Ident, actor string) (bool, error) {
+	exists, err := db.Esi.ItemExists(db.mapping, id.String())
+	if err != nil || !exists {
+		return false, err
+	}
+	deleteResult, err := db.Esi.DeleteByID(db.mapping, id.String())
+	if err != nil {
+		return false, LoggedError("ACLDB.DeleteById failed: %s", err)
+	}
+	if deleteResult == nil {
+		return false, LoggedError("ACLDB.DeleteById failed: no deleteResult")
+	}
+	return deleteResult.Found, nil
+}
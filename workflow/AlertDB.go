@@ -37,6 +37,8 @@ func NewAlertDB(service *Service, esi elasticsearch.IIndex) (*AlertDB, error) {
 }
 
 func (db *AlertDB) PostData(alert *Alert) error {
+	// the index gives the version
+	alert.Version = 0
 	indexResult, err := db.Esi.PostData(db.mapping, alert.AlertID.String(), alert)
 	if err != nil {
 		return LoggedError("AlertDB.PostData failed: %s", err)
@@ -44,10 +46,27 @@ func (db *AlertDB) PostData(alert *Alert) error {
 	if !indexResult.Created {
 		return LoggedError("AlertDB.PostData failed: not created")
 	}
+	alert.Version = int64(indexResult.Version)
 
 	return nil
 }
 
+// PutData writes the alert over the version of it, or over any if that is
+// 0, and gives it the version it now is
+func (db *AlertDB) PutData(alert *Alert, version int64) error {
+	stored := *alert
+	stored.Version = 0
+	newVersion, err := db.putVersioned(db.mapping, alert.AlertID, &stored, version)
+	if err == errVersionConflict {
+		return err
+	}
+	if err != nil {
+		return LoggedError("AlertDB.PutData failed: %s", err)
+	}
+	alert.Version = newVersion
+	return nil
+}
+
 func (db *AlertDB) GetAll(format *piazza.JsonPagination, actor string) ([]Alert, int64, error) {
 	alerts := []Alert{}
 
@@ -153,21 +172,18 @@ func (db *AlertDB) GetAllByTrigger(format *piazza.JsonPagination, triggerID piaz
 }
 
 func (db *AlertDB) GetOne(id piazza.Ident, actor string) (*Alert, bool, error) {
-	getResult, err := db.Esi.GetByID(db.mapping, id.String())
+	src, version, found, err := db.getVersioned(db.mapping, id)
 	if err != nil {
 		return nil, false, fmt.Errorf("AlertDB.GetOne failed: %s", err)
 	}
-	if getResult == nil {
-		return nil, true, fmt.Errorf("AlertDB.GetOne failed: %s no getResult", id.String())
-	}
 
-	src := getResult.Source
 	var alert Alert
 	if err = json.Unmarshal(*src, &alert); err != nil {
-		return nil, getResult.Found, err
+		return nil, found, err
 	}
+	alert.Version = version
 
-	return &alert, getResult.Found, nil
+	return &alert, found, nil
 }
 
 func (db *AlertDB) DeleteByID(id piazza.Ident, actor string) (bool, error) {
@@ -185,3 +201,30 @@ func (db *AlertDB) DeleteByID(id piazza.Ident, actor string) (bool, error) {
 
 	return deleteResult.Found, nil
 }
+
+// deleteAtVersion deletes the alert at the version, or at any if that is 0
+func (db *AlertDB) deleteAtVersion(id piazza.Ident, version int64) (bool, error) {
+	found, err := db.deleteVersioned(db.mapping, id, version)
+	if err == errVersionConflict {
+		return found, err
+	}
+	if err != nil {
+		return found, fmt.Errorf("AlertDB.DeleteById failed: %s", err)
+	}
+	if !found {
+		return false, fmt.Errorf("AlertDB.DeleteById failed: not found")
+	}
+	return true, nil
+}
+
+func (db *AlertDB) DeleteByIDs(ids []piazza.Ident, actor string) (int, error) {
+	deleted, err := db.deleteByIDs(db.mapping, ids)
+	if err != nil {
+		return deleted, LoggedError("AlertDB.DeleteByIDs failed: %s", err)
+	}
+	return deleted, nil
+}
+
+func (db *AlertDB) itemExists(id piazza.Ident, actor string) (bool, error) {
+	return db.Esi.ItemExists(db.mapping, id.String())
+}
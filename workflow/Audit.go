@@ -0,0 +1,147 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/venicegeo/pz-gocommon/gocommon"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+// anonymousActor is who the audit messages of a request without a caller
+// say acted
+const anonymousActor = "anonymous"
+
+// actorOf is who the audit messages of the caller's request say acted
+func actorOf(caller string) string {
+	if caller == "" {
+		return anonymousActor
+	}
+	return caller
+}
+
+// AuditWriter keeps each audit message in the audit store, and writes it on
+// to the writer it wraps. Messages audited before the store is open are
+// only written on.
+type AuditWriter struct {
+	pzsyslog.Writer
+	service *Service
+}
+
+func (w *AuditWriter) Write(mssg *pzsyslog.Message, async bool) error {
+	if mssg.AuditData != nil && w.service.auditDB != nil {
+		record := &AuditRecord{
+			AuditID:    w.service.newIdent(),
+			Actor:      mssg.AuditData.Actor,
+			Action:     mssg.AuditData.Action,
+			ResourceID: mssg.AuditData.Actee,
+			Message:    mssg.Message,
+			HostName:   mssg.HostName,
+			CreatedOn:  mssg.TimeStamp,
+		}
+		store := func() {
+			if err := w.service.auditDB.PostData(record); err != nil {
+				log.Printf("Audit error: [%s] not stored: %s", record.Action, err)
+			}
+		}
+		if async {
+			go store()
+		} else {
+			store()
+		}
+	}
+	return w.Writer.Write(mssg, async)
+}
+
+//---------------------------------------------------------------------------
+
+// GetAudit returns a page of the audit messages, newest first by default.
+// They can be narrowed by:
+//
+//	actor           who acted: the caller of the request, or pz-workflow
+//	action          e.g. updatedTrigger
+//	resourceId      what was acted on
+//	after, before   RFC3339 bounds on createdOn
+func (service *Service) GetAudit(params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	defer service.handlePanic()
+	format, err := piazza.NewJsonPagination(params)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+
+	filters := []interface{}{}
+	for _, field := range []string{"action", "resourceId"} {
+		value, err := params.GetAsString(field, "")
+		if err != nil {
+			return service.statusBadRequest(err)
+		}
+		if value != "" {
+			filters = append(filters, map[string]interface{}{"term": map[string]interface{}{field: value}})
+		}
+	}
+	actor, err := params.GetAsString("actor", "")
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	if actor != "" {
+		filters = append(filters, map[string]interface{}{"term": map[string]interface{}{"actor": actor}})
+	}
+	after, err := params.GetAfter(time.Time{})
+	if err != nil {
+		return service.statusBadRequest(fmt.Errorf("after must be an RFC3339 time: %s", err))
+	}
+	before, err := params.GetBefore(time.Time{})
+	if err != nil {
+		return service.statusBadRequest(fmt.Errorf("before must be an RFC3339 time: %s", err))
+	}
+	if !after.IsZero() || !before.IsZero() {
+		bounds := map[string]interface{}{}
+		if !after.IsZero() {
+			bounds["gte"] = after.Format(eventSearchTimeFormat)
+		}
+		if !before.IsZero() {
+			bounds["lte"] = before.Format(eventSearchTimeFormat)
+		}
+		filters = append(filters, map[string]interface{}{"range": map[string]interface{}{"createdOn": bounds}})
+	}
+
+	byts, err := json.Marshal(map[string]interface{}{
+		"query": map[string]interface{}{"bool": map[string]interface{}{"filter": filters}},
+	})
+	if err != nil {
+		return service.statusInternalError(err)
+	}
+	dsl, err := format.SyncPagination(string(byts))
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+
+	records, totalHits, err := service.auditDB.GetAuditByDslQuery(dsl, "pz-workflow")
+	if err != nil {
+		return service.statusInternalError(err)
+	} else if records == nil {
+		return service.statusInternalError(errors.New("GetAudit returned nil"))
+	}
+
+	resp := service.statusOK(records)
+	format.Count = int(totalHits)
+	resp.Pagination = format
+	return resp
+}
@@ -0,0 +1,77 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+)
+
+// AuditDB keeps the audit messages in Elasticsearch
+type AuditDB struct {
+	*ResourceDB
+	mapping string
+}
+
+func NewAuditDB(service *Service, esi elasticsearch.IIndex) (*AuditDB, error) {
+	rdb, err := NewResourceDB(service, esi)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditDB{ResourceDB: rdb, mapping: AuditDBMapping}, nil
+}
+
+func (db *AuditDB) PostData(record *AuditRecord) error {
+	indexResult, err := db.Esi.PostData(db.mapping, record.AuditID.String(), record)
+	if err != nil {
+		return LoggedError("AuditDB.PostData failed: %s", err)
+	} else if !indexResult.Created {
+		return LoggedError("AuditDB.PostData failed: not created")
+	}
+	return nil
+}
+
+func (db *AuditDB) GetAuditByDslQuery(dslString string, actor string) ([]AuditRecord, int64, error) {
+	records := []AuditRecord{}
+
+	exists, err := db.Esi.TypeExists(db.mapping)
+	if err != nil {
+		return records, 0, err
+	}
+	if !exists {
+		return records, 0, nil
+	}
+
+	searchResult, err := db.Esi.SearchByJSON(db.mapping, dslString)
+	if err != nil {
+		return nil, 0, LoggedError("AuditDB.GetAuditByDslQuery failed: %s", err)
+	}
+	if searchResult == nil {
+		return nil, 0, LoggedError("AuditDB.GetAuditByDslQuery failed: no searchResult")
+	}
+
+	if searchResult.GetHits() != nil {
+		for _, hit := range *searchResult.GetHits() {
+			var record AuditRecord
+			if err := json.Unmarshal(*hit.Source, &record); err != nil {
+				return nil, 0, err
+			}
+			records = append(records, record)
+		}
+	}
+
+	return records, searchResult.TotalHits(), nil
+}
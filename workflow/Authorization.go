@@ -0,0 +1,678 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// The actions a caller is authorized for. Creating, and the admin endpoints,
+// concern no resource, so have no ACL.
+const (
+	ActionRead   = "read"
+	ActionWrite  = "write"
+	ActionOwn    = "own"
+	ActionCreate = "create"
+	ActionAdmin  = "admin"
+)
+
+// CallerHeader names the user a request is from, for a TrustedAuthorizer
+const CallerHeader = "X-Pz-User"
+
+// Authorizer says who requests are from, and what they may do. A caller of
+// "" is a request that says nobody.
+type Authorizer interface {
+	Identify(req *http.Request) (string, error)
+	// IsAdmin says whether the caller may do anything, without the ACLs
+	// being looked up
+	IsAdmin(caller string) bool
+	// Authorize fails if the caller may not act on a resource with the ACL,
+	// which is nil for ActionCreate and ActionAdmin
+	Authorize(caller string, action string, acl *ACL) error
+}
+
+// allows says whether the ACL lets the caller act on the resource. An
+// anonymous caller is only one of everyone.
+func (acl *ACL) allows(caller string, action string) bool {
+	listed := func(names []string) bool {
+		for _, name := range names {
+			if name == ACLEveryone || (caller != "" && name == caller) {
+				return true
+			}
+		}
+		return false
+	}
+	if caller != "" && caller == acl.Owner {
+		return true
+	}
+	switch action {
+	case ActionRead:
+		return listed(acl.Readers) || listed(acl.Writers)
+	case ActionWrite:
+		return listed(acl.Writers)
+	}
+	return false
+}
+
+// authorizeByACL is the policy of the Authorizers here: anyone identified
+// may create, only admins use the admin endpoints, and the ACL says the rest
+func authorizeByACL(caller string, action string, acl *ACL) error {
+	switch action {
+	case ActionCreate:
+		if caller == "" {
+			return errors.New("anonymous callers may not create resources")
+		}
+		return nil
+	case ActionAdmin:
+		return fmt.Errorf("user %q is not an admin", caller)
+	}
+	if acl == nil {
+		return fmt.Errorf("user %q may not %s", caller, action)
+	}
+	if !acl.allows(caller, action) {
+		return fmt.Errorf("user %q may not %s %s", caller, action, acl.ResourceID)
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------------
+
+// TrustedAuthorizer believes the CallerHeader, as the gateway in front of
+// the service sets it, and is only used if asked for. Requests without one
+// are anonymous, as for the other Authorizers.
+type TrustedAuthorizer struct {
+	admins []string
+}
+
+func (a *TrustedAuthorizer) Identify(req *http.Request) (string, error) {
+	return req.Header.Get(CallerHeader), nil
+}
+
+func (a *TrustedAuthorizer) IsAdmin(caller string) bool {
+	return isListed(caller, a.admins)
+}
+
+func (a *TrustedAuthorizer) Authorize(caller string, action string, acl *ACL) error {
+	if a.IsAdmin(caller) {
+		return nil
+	}
+	return authorizeByACL(caller, action, acl)
+}
+
+// isListed says whether a caller, who is not anonymous, is one of the names
+func isListed(caller string, names []string) bool {
+	for _, name := range names {
+		if caller != "" && caller == name {
+			return true
+		}
+	}
+	return false
+}
+
+//---------------------------------------------------------------------------
+
+// idamUserTTL is how long IdamAuthorizer believes what pz-idam said of a key
+const idamUserTTL = 5 * time.Minute
+
+type idamUser struct {
+	name    string
+	expires time.Time
+}
+
+// IdamAuthorizer identifies callers by the API key, sent as the basic auth
+// user name as the Client does, asking pz-idam whose it is. It is the
+// Authorizer unless another is asked for.
+type IdamAuthorizer struct {
+	url    string
+	admins []string
+	lock   sync.Mutex
+	users  map[string]idamUser
+}
+
+func NewIdamAuthorizer(idamURL string, admins []string) *IdamAuthorizer {
+	return &IdamAuthorizer{url: idamURL, admins: admins, users: map[string]idamUser{}}
+}
+
+func (a *IdamAuthorizer) Identify(req *http.Request) (string, error) {
+	key, _, ok := req.BasicAuth()
+	if !ok || key == "" {
+		return "", nil
+	}
+
+	a.lock.Lock()
+	user, ok := a.users[key]
+	a.lock.Unlock()
+	if ok && time.Now().Before(user.expires) {
+		return user.name, nil
+	}
+
+	if a.url == "" {
+		return "", errors.New("there is no pz-idam to check the API key with")
+	}
+	out := struct {
+		IsAuthSuccess bool `json:"isAuthSuccess"`
+		UserProfile   struct {
+			Username string `json:"username"`
+		} `json:"userProfile"`
+	}{}
+	h := &piazza.Http{BaseUrl: a.url}
+	code, err := h.Post("/authn", map[string]string{"uuid": key}, &out)
+	if err != nil {
+		return "", fmt.Errorf("pz-idam: %s", err)
+	}
+	if code != http.StatusOK || !out.IsAuthSuccess || out.UserProfile.Username == "" {
+		return "", errors.New("unknown API key")
+	}
+
+	a.lock.Lock()
+	a.users[key] = idamUser{name: out.UserProfile.Username, expires: time.Now().Add(idamUserTTL)}
+	a.lock.Unlock()
+	return out.UserProfile.Username, nil
+}
+
+func (a *IdamAuthorizer) IsAdmin(caller string) bool {
+	return isListed(caller, a.admins)
+}
+
+func (a *IdamAuthorizer) Authorize(caller string, action string, acl *ACL) error {
+	if a.IsAdmin(caller) {
+		return nil
+	}
+	return authorizeByACL(caller, action, acl)
+}
+
+//---------------------------------------------------------------------------
+
+// Policy is the file a PolicyFileAuthorizer reads: whose the API keys are,
+// who the admins are, and whether requests without a key may read what
+// everyone may
+type Policy struct {
+	APIKeys       map[string]string `json:"apiKeys"`
+	Admins        []string          `json:"admins"`
+	AnonymousRead bool              `json:"anonymousRead"`
+}
+
+// PolicyFileAuthorizer identifies callers by the API key, sent as the basic
+// auth user name as the Client does, and trusts no header. It is for testing
+// without pz-idam.
+type PolicyFileAuthorizer struct {
+	policy Policy
+}
+
+func NewPolicyFileAuthorizer(path string) (*PolicyFileAuthorizer, error) {
+	byts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	a := &PolicyFileAuthorizer{}
+	if err = json.Unmarshal(byts, &a.policy); err != nil {
+		return nil, fmt.Errorf("policy file %s: %s", path, err)
+	}
+	return a, nil
+}
+
+func (a *PolicyFileAuthorizer) Identify(req *http.Request) (string, error) {
+	key, _, ok := req.BasicAuth()
+	if !ok || key == "" {
+		return "", nil
+	}
+	caller, ok := a.policy.APIKeys[key]
+	if !ok {
+		return "", errors.New("unknown API key")
+	}
+	return caller, nil
+}
+
+func (a *PolicyFileAuthorizer) IsAdmin(caller string) bool {
+	return isListed(caller, a.policy.Admins)
+}
+
+func (a *PolicyFileAuthorizer) Authorize(caller string, action string, acl *ACL) error {
+	if a.IsAdmin(caller) {
+		return nil
+	}
+	if caller == "" && !(a.policy.AnonymousRead && action == ActionRead) {
+		return errors.New("an API key is required")
+	}
+	return authorizeByACL(caller, action, acl)
+}
+
+// newAuthorizerFromEnv reads the policy file $PZ_WORKFLOW_POLICY names, if
+// any. Otherwise the callers $PZ_WORKFLOW_ADMINS lists, separated by commas,
+// are the admins, and callers are named by the CallerHeader if
+// $PZ_WORKFLOW_TRUST_CALLER_HEADER is true, or else by pz-idam. A policy
+// that cannot be read lets nobody do anything.
+func (service *Service) newAuthorizerFromEnv() Authorizer {
+	if path := os.Getenv("PZ_WORKFLOW_POLICY"); path != "" {
+		authorizer, err := NewPolicyFileAuthorizer(path)
+		if err != nil {
+			service.syslogger.Error("Authorization error: %s; every request will be refused", err)
+			return &PolicyFileAuthorizer{}
+		}
+		return authorizer
+	}
+
+	admins := []string{}
+	for _, admin := range strings.Split(os.Getenv("PZ_WORKFLOW_ADMINS"), ",") {
+		if admin = strings.TrimSpace(admin); admin != "" {
+			admins = append(admins, admin)
+		}
+	}
+
+	if trust, _ := strconv.ParseBool(os.Getenv("PZ_WORKFLOW_TRUST_CALLER_HEADER")); trust {
+		return &TrustedAuthorizer{admins: admins}
+	}
+	idamURL, err := service.sys.GetURL(piazza.PzIdam)
+	if err != nil {
+		service.syslogger.Warning("Authorization error: %s; requests with an API key will be refused", err)
+		idamURL = ""
+	}
+	return NewIdamAuthorizer(idamURL, admins)
+}
+
+//---------------------------------------------------------------------------
+
+// The resources an ACL can be looked up for. aclAny is whichever an ID is of.
+const (
+	aclEventType = "eventType"
+	aclEvent     = "event"
+	aclTrigger   = "trigger"
+	aclAlert     = "alert"
+	aclGeofence  = "geofence"
+	aclAny       = "any"
+)
+
+// resourceACL returns the ACL of a resource, and whether there is one
+func (service *Service) resourceACL(kind string, id piazza.Ident) (*ACL, bool, error) {
+	switch kind {
+	case aclEventType:
+		eventType, found, err := service.eventTypeDB.GetOne(id, "pz-workflow")
+		if !found {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, true, err
+		}
+		return service.aclOf(id, eventType.CreatedBy)
+	case aclTrigger:
+		trigger, found, err := service.triggerDB.GetOne(id, "pz-workflow")
+		if !found {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, true, err
+		}
+		return service.aclOf(id, trigger.CreatedBy)
+	case aclGeofence:
+		geofence, found, err := service.geofenceDB.GetOne(id, "pz-workflow")
+		if !found {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, true, err
+		}
+		return service.aclOf(id, geofence.CreatedBy)
+	case aclEvent:
+		mapping, _ := service.eventDB.lookupEventTypeNameByEventID(id, "pz-workflow")
+		if mapping == "" {
+			return nil, false, nil
+		}
+		event, found, err := service.eventDB.GetOne(mapping, id, "pz-workflow")
+		if !found {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, true, err
+		}
+		return service.resourceACL(aclEventType, event.EventTypeID)
+	case aclAlert:
+		alert, found, err := service.alertDB.GetOne(id, "pz-workflow")
+		if !found {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, true, err
+		}
+		return service.resourceACL(aclTrigger, alert.TriggerID)
+	case aclAny:
+		for _, kind := range []string{aclEvent, aclAlert, aclTrigger, aclEventType, aclGeofence} {
+			if acl, found, err := service.resourceACL(kind, id); found || err != nil {
+				return acl, found, err
+			}
+		}
+	}
+	return nil, false, nil
+}
+
+// aclOf returns the ACL set for a resource, or else the default one
+func (service *Service) aclOf(id piazza.Ident, createdBy string) (*ACL, bool, error) {
+	acl, found, err := service.aclDB.GetOne(id)
+	if err != nil {
+		return nil, true, err
+	}
+	if !found {
+		acl = &ACL{ResourceID: id, Owner: createdBy, Readers: []string{ACLEveryone}, Writers: []string{}}
+	}
+	return acl, true, nil
+}
+
+func (service *Service) deleteACL(id piazza.Ident) {
+	if _, err := service.aclDB.DeleteByID(id, "pz-workflow"); err != nil {
+		service.syslogger.Warning("Authorization error: ACL of %s: %s", string(id), err)
+	}
+}
+
+// authorize returns a 403 if the caller may not act on the resource, or nil.
+// A resource not found is left to the caller to report.
+func (service *Service) authorize(caller string, action string, kind string, id piazza.Ident) *piazza.JsonResponse {
+	if service.authorizer.IsAdmin(caller) {
+		return nil
+	}
+	var acl *ACL
+	if kind != "" {
+		var found bool
+		var err error
+		if acl, found, err = service.resourceACL(kind, id); err != nil {
+			return service.statusInternalError(err)
+		} else if !found {
+			return nil
+		}
+	}
+	if err := service.authorizer.Authorize(caller, action, acl); err != nil {
+		service.syslogger.Audit(caller, "authorizationFailure", id, "Service.authorize: User [%s] was refused %s of %s [%s]: %s", caller, action, kind, id, err)
+		return service.statusForbidden(err)
+	}
+	return nil
+}
+
+// authorizeCascade refuses, with a 403, to delete the EventType with what
+// depends on it unless the caller may write every trigger of it. Its events
+// go by its own ACL, and the alerts of its triggers by theirs.
+func (service *Service) authorizeCascade(caller string, id piazza.Ident) *piazza.JsonResponse {
+	if service.authorizer.IsAdmin(caller) {
+		return nil
+	}
+	triggerIDs := []piazza.Ident{}
+	err := exportPages("triggerId", termQuery("eventTypeId", id.String()), func(dsl string) (int, string, error) {
+		page, _, err := service.triggerDB.GetTriggersByDslQuery(dsl, "pz-workflow")
+		last := ""
+		for _, trigger := range page {
+			triggerIDs = append(triggerIDs, trigger.TriggerID)
+			last = trigger.TriggerID.String()
+		}
+		return len(page), last, err
+	})
+	if err != nil {
+		return service.statusInternalError(err)
+	}
+	for _, triggerID := range triggerIDs {
+		if resp := service.authorize(caller, ActionWrite, aclTrigger, triggerID); resp != nil {
+			return resp
+		}
+	}
+	return nil
+}
+
+// readableBy returns a test of whether the caller may read a resource,
+// which looks each ACL up once
+func (service *Service) readableBy(caller string) func(kind string, id piazza.Ident) (bool, error) {
+	allowed := map[string]bool{}
+	return func(kind string, id piazza.Ident) (bool, error) {
+		if service.authorizer.IsAdmin(caller) {
+			return true, nil
+		}
+		key := kind + ":" + id.String()
+		if ok, seen := allowed[key]; seen {
+			return ok, nil
+		}
+		acl, found, err := service.resourceACL(kind, id)
+		if err != nil {
+			return false, err
+		}
+		allowed[key] = found && service.authorizer.Authorize(caller, ActionRead, acl) == nil
+		return allowed[key], nil
+	}
+}
+
+// readable drops, from a page of resources, those the caller may not read.
+// The page's count stays that of them all, readable or not, so is only an
+// upper bound of what the caller can page through.
+func (service *Service) readable(caller string, data interface{}) (interface{}, error) {
+	if service.authorizer.IsAdmin(caller) {
+		return data, nil
+	}
+	may := service.readableBy(caller)
+
+	var err error
+	var ok bool
+	switch items := data.(type) {
+	case []EventType:
+		kept := []EventType{}
+		for _, item := range items {
+			if ok, err = may(aclEventType, item.EventTypeID); ok {
+				kept = append(kept, item)
+			}
+		}
+		return kept, err
+	case []Event:
+		kept := []Event{}
+		for _, item := range items {
+			if ok, err = may(aclEventType, item.EventTypeID); ok {
+				kept = append(kept, item)
+			}
+		}
+		return kept, err
+	case []Trigger:
+		kept := []Trigger{}
+		for _, item := range items {
+			if ok, err = may(aclTrigger, item.TriggerID); ok {
+				kept = append(kept, item)
+			}
+		}
+		return kept, err
+	case []Alert:
+		kept := []Alert{}
+		for _, item := range items {
+			if ok, err = may(aclTrigger, item.TriggerID); ok {
+				kept = append(kept, item)
+			}
+		}
+		return kept, err
+	case []AlertExt:
+		kept := []AlertExt{}
+		for _, item := range items {
+			if ok, err = may(aclTrigger, item.Trigger.TriggerID); ok {
+				kept = append(kept, item)
+			}
+		}
+		return kept, err
+	case []Geofence:
+		kept := []Geofence{}
+		for _, item := range items {
+			if ok, err = may(aclGeofence, item.GeofenceID); ok {
+				kept = append(kept, item)
+			}
+		}
+		return kept, err
+	}
+	return data, nil
+}
+
+// GetACL returns the ACL of an EventType, trigger or geofence
+func (service *Service) GetACL(kind string, id piazza.Ident) *piazza.JsonResponse {
+	defer service.handlePanic()
+	acl, found, err := service.resourceACL(kind, id)
+	if err != nil {
+		return service.statusInternalError(err)
+	}
+	if !found {
+		return service.statusNotFound(fmt.Errorf("%s %s not found", kind, id))
+	}
+	return service.statusOK(acl)
+}
+
+// PutACL sets the ACL of an EventType, trigger or geofence. An empty owner
+// keeps the one it has.
+func (service *Service) PutACL(kind string, id piazza.Ident, update *ACL, actor string) *piazza.JsonResponse {
+	defer service.handlePanic()
+	acl, found, err := service.resourceACL(kind, id)
+	if err != nil {
+		return service.statusInternalError(err)
+	}
+	if !found {
+		return service.statusNotFound(fmt.Errorf("%s %s not found", kind, id))
+	}
+
+	if update.Owner != "" {
+		acl.Owner = update.Owner
+	}
+	acl.Readers = update.Readers
+	if acl.Readers == nil {
+		acl.Readers = []string{}
+	}
+	acl.Writers = update.Writers
+	if acl.Writers == nil {
+		acl.Writers = []string{}
+	}
+
+	service.syslogger.Audit(actor, "updatingACL", id, "Service.PutACL: User is updating the ACL of %s [%s]", kind, id)
+	if err = service.aclDB.PutData(acl); err != nil {
+		service.syslogger.Audit(actor, "updatingACLFailure", id, "Service.PutACL: User failed to update the ACL of %s [%s]", kind, id)
+		return service.statusInternalError(err)
+	}
+	service.syslogger.Audit(actor, "updatedACL", id, "Service.PutACL: User successfully updated the ACL of %s [%s]", kind, id)
+	return service.statusOK(acl)
+}
+
+//---------------------------------------------------------------------------
+
+// callerKey is where authorizeRoute leaves the caller in the gin.Context
+const callerKey = "pz-workflow.caller"
+
+type routeGuard struct {
+	kind   string
+	action string
+}
+
+// routeGuards say what the caller of a route must be allowed: for the
+// resource :id names, if there is a kind. Resources in request bodies are
+// checked by the handlers.
+var routeGuards = map[string]routeGuard{
+	"GET /eventType/:id":                {aclEventType, ActionRead},
+	"GET /eventType/:id/stats":          {aclEventType, ActionRead},
+	"GET /eventType/:id/acl":            {aclEventType, ActionRead},
+	"POST /eventType":                   {"", ActionCreate},
+	"PUT /eventType/:id":                {aclEventType, ActionWrite},
+	"PUT /eventType/:id/acl":            {aclEventType, ActionOwn},
+	"DELETE /eventType/:id":             {aclEventType, ActionWrite},
+	"GET /event/:id":                    {aclEvent, ActionRead},
+	"DELETE /event/:id":                 {aclEvent, ActionWrite},
+	"GET /trigger/:id":                  {aclTrigger, ActionRead},
+	"GET /trigger/:id/stats":            {aclTrigger, ActionRead},
+	"GET /trigger/:id/acl":              {aclTrigger, ActionRead},
+	"POST /trigger":                     {"", ActionCreate},
+	"POST /trigger/test/:id":            {aclTrigger, ActionRead},
+	"PUT /trigger/:id":                  {aclTrigger, ActionWrite},
+	"PUT /trigger/:id/acl":              {aclTrigger, ActionOwn},
+	"DELETE /trigger/:id":               {aclTrigger, ActionWrite},
+	"GET /alert/:id":                    {aclAlert, ActionRead},
+	"PUT /alert/:id":                    {aclAlert, ActionWrite},
+	"DELETE /alert/:id":                 {aclAlert, ActionWrite},
+	"GET /lineage/:id":                  {aclAny, ActionRead},
+	"GET /namespace/:id/stats":          {"", ActionAdmin},
+	"GET /usage/namespace/:id":          {"", ActionAdmin},
+	"GET /geofence/:id":                 {aclGeofence, ActionRead},
+	"GET /geofence/:id/acl":             {aclGeofence, ActionRead},
+	"POST /geofence":                    {"", ActionCreate},
+	"PUT /geofence/:id":                 {aclGeofence, ActionWrite},
+	"PUT /geofence/:id/acl":             {aclGeofence, ActionOwn},
+	"DELETE /geofence/:id":              {aclGeofence, ActionWrite},
+	"GET /admin/stats":                  {"", ActionAdmin},
+	"GET /audit":                        {"", ActionAdmin},
+	"GET /admin/export":                 {"", ActionAdmin},
+	"POST /admin/import":                {"", ActionAdmin},
+	"POST /admin/purge":                 {"", ActionAdmin},
+	"GET /admin/purge/:id":              {"", ActionAdmin},
+	"POST /admin/sweep":                 {"", ActionAdmin},
+	"POST /admin/reindex":               {"", ActionAdmin},
+	"GET /admin/reindex/:id":            {"", ActionAdmin},
+	"GET /admin/outbox":                 {"", ActionAdmin},
+	"DELETE /admin/outbox/:id":          {"", ActionAdmin},
+	"GET /admin/consistency":            {"", ActionAdmin},
+	"POST /admin/consistency/repair":    {"", ActionAdmin},
+	"GET /metrics":                      {"", ActionAdmin},
+	"GET /_test/elasticsearch/version":  {"", ActionAdmin},
+	"GET /_test/elasticsearch/data/:id": {"", ActionAdmin},
+	"POST /_test/elasticsearch/data":    {"", ActionAdmin},
+}
+
+// authorizeRoute identifies the caller of a route, and refuses it what its
+// guard does not allow
+func (server *Server) authorizeRoute(route piazza.RouteData) gin.HandlerFunc {
+	handler := route.Handler
+	guard, guarded := routeGuards[route.Verb+" "+route.Path]
+	return func(c *gin.Context) {
+		caller, err := server.service.authorizer.Identify(c.Request)
+		if err != nil {
+			piazza.GinReturnJson(c, server.service.statusUnauthorized(err))
+			return
+		}
+		c.Set(callerKey, caller)
+		if guarded {
+			resp := server.service.authorize(caller, guard.action, guard.kind, piazza.Ident(c.Param("id")))
+			if resp != nil {
+				piazza.GinReturnJson(c, resp)
+				return
+			}
+		}
+		handler(c)
+	}
+}
+
+func (server *Server) caller(c *gin.Context) string {
+	caller, _ := c.Get(callerKey)
+	s, _ := caller.(string)
+	return s
+}
+
+// actor is who the audit messages of a request say acted
+func (server *Server) actor(c *gin.Context) string {
+	return actorOf(server.caller(c))
+}
+
+// readable drops from the page in resp what the caller may not read
+func (server *Server) readable(c *gin.Context, resp *piazza.JsonResponse) *piazza.JsonResponse {
+	if resp.IsError() {
+		return resp
+	}
+	data, err := server.service.readable(server.caller(c), resp.Data)
+	if err != nil {
+		return server.service.statusInternalError(err)
+	}
+	resp.Data = data
+	return resp
+}
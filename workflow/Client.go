@@ -15,8 +15,12 @@
 package workflow
 
 import (
+	"bytes"
 	"encoding/json"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 
 	"fmt"
 
@@ -140,6 +144,92 @@ func (c *Client) deleteObject(endpoint string) error {
 	return nil
 }
 
+// doRaw is for the endpoints whose bodies are not a JsonResponse. Errors
+// still come back as one.
+func (c *Client) doRaw(verb string, endpoint string, body io.Reader, contentType string, accept string) ([]byte, error) {
+	req, err := http.NewRequest(verb, c.url+endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", accept)
+	if c.h.ApiKey != "" {
+		req.SetBasicAuth(c.h.ApiKey, "")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	byts, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		jsonResp := &piazza.JsonResponse{StatusCode: resp.StatusCode}
+		if err = json.Unmarshal(byts, jsonResp); err != nil {
+			jsonResp.Message = string(byts)
+		}
+		return nil, jsonResp.ToError()
+	}
+	return byts, nil
+}
+
+// doIfMatch makes a change only if the resource is still at the ETag; one
+// that has changed since is refused with a 412
+func (c *Client) doIfMatch(verb string, endpoint string, obj interface{}, etag string, out interface{}) error {
+	var body io.Reader
+	if obj != nil {
+		byts, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(byts)
+	}
+	req, err := http.NewRequest(verb, c.url+endpoint, body)
+	if err != nil {
+		return err
+	}
+	if obj != nil {
+		req.Header.Set("Content-Type", piazza.ContentTypeJSON)
+	}
+	req.Header.Set("If-Match", etag)
+	if c.h.ApiKey != "" {
+		req.SetBasicAuth(c.h.ApiKey, "")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	byts, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	jsonResp := &piazza.JsonResponse{}
+	if err = json.Unmarshal(byts, jsonResp); err != nil {
+		jsonResp.Message = string(byts)
+	}
+	jsonResp.StatusCode = resp.StatusCode
+	if resp.StatusCode != http.StatusOK {
+		return jsonResp.ToError()
+	}
+	if out == nil {
+		return nil
+	}
+	return jsonResp.ExtractData(out)
+}
+
 //------------------------------------------------------------------------------
 
 func (c *Client) GetVersion() (*piazza.Version, error) {
@@ -148,6 +238,26 @@ func (c *Client) GetVersion() (*piazza.Version, error) {
 	return out, err
 }
 
+func (c *Client) GetHealthLive() (*HealthReport, error) {
+	out := &HealthReport{}
+	err := c.getObject("/health/live", out)
+	return out, err
+}
+
+// GetHealthReady returns the report even when the service is not ready,
+// along with the error
+func (c *Client) GetHealthReady() (*HealthReport, error) {
+	resp := c.h.PzGet("/health/ready")
+	out := &HealthReport{}
+	if err := resp.ExtractData(out); err != nil && !resp.IsError() {
+		return nil, err
+	}
+	if resp.IsError() {
+		return out, resp.ToError()
+	}
+	return out, nil
+}
+
 //------------------------------------------------------------------------------
 
 func (c *Client) GetEventType(id piazza.Ident) (*EventType, error) {
@@ -174,6 +284,14 @@ func (c *Client) GetAllEventTypes(perPage, page int) (*[]EventType, error) {
 	return out, err
 }
 
+// GetNamespaceEventTypes gets the EventTypes of the namespace
+func (c *Client) GetNamespaceEventTypes(namespace string, perPage, page int) (*[]EventType, error) {
+	out := &[]EventType{}
+	path := fmt.Sprintf("/eventType?namespace=%s&perPage=%d&page=%d", url.QueryEscape(namespace), perPage, page)
+	err := c.getObject(path, out)
+	return out, err
+}
+
 func (c *Client) PostEventType(eventType *EventType) (*EventType, error) {
 	out := &EventType{}
 	err := c.postObject(eventType, "/eventType", out)
@@ -186,9 +304,9 @@ func (c *Client) QueryEventTypes(query map[string]interface{}) (*[]EventType, er
 	return out, err
 }
 
-func (c *Client) PutEventType(eventType *EventType) (*EventType, error) {
+func (c *Client) PutEventType(id piazza.Ident, update *EventTypeUpdate) (*EventType, error) {
 	out := &EventType{}
-	err := c.putObject(eventType, "/eventType", out)
+	err := c.putObject(update, "/eventType/"+id.String(), out)
 	return out, err
 }
 
@@ -197,6 +315,67 @@ func (c *Client) DeleteEventType(id piazza.Ident) error {
 	return err
 }
 
+// PutEventTypeIfMatch changes the EventType only if it is still at the ETag
+func (c *Client) PutEventTypeIfMatch(id piazza.Ident, update *EventTypeUpdate, etag string) (*EventType, error) {
+	out := &EventType{}
+	err := c.doIfMatch("PUT", "/eventType/"+id.String(), update, etag, out)
+	return out, err
+}
+
+// DeleteEventTypeIfMatch deletes the EventType only if it is still at the ETag
+func (c *Client) DeleteEventTypeIfMatch(id piazza.Ident, etag string) error {
+	return c.doIfMatch("DELETE", "/eventType/"+id.String(), nil, etag, nil)
+}
+
+func (c *Client) DeleteEventTypeCascade(id piazza.Ident, withAlerts bool) (*EventTypeCascade, error) {
+	resp := c.h.PzDelete(fmt.Sprintf("/eventType/%s?cascade=true&alerts=%t", id, withAlerts))
+	if resp.IsError() {
+		return nil, resp.ToError()
+	}
+	out := &EventTypeCascade{}
+	err := resp.ExtractData(out)
+	return out, err
+}
+
+// GetEventTypeStats gets the EventType's events of each of the last hours
+func (c *Client) GetEventTypeStats(id piazza.Ident, hours int) (*EventTypeStats, error) {
+	out := &EventTypeStats{}
+	err := c.getObject(fmt.Sprintf("/eventType/%s/stats?hours=%d", id, hours), out)
+	return out, err
+}
+
+// GetNamespaceStats gets the namespace's counts, and its events of each of
+// the last hours
+func (c *Client) GetNamespaceStats(namespace string, hours int) (*NamespaceStats, error) {
+	out := &NamespaceStats{}
+	err := c.getObject(fmt.Sprintf("/namespace/%s/stats?hours=%d", namespace, hours), out)
+	return out, err
+}
+
+func (c *Client) GetOwnerUsage(owner string) (*Usage, error) {
+	out := &Usage{}
+	err := c.getObject("/usage/owner/"+url.PathEscape(owner), out)
+	return out, err
+}
+
+func (c *Client) GetNamespaceUsage(namespace string) (*Usage, error) {
+	out := &Usage{}
+	err := c.getObject("/usage/namespace/"+namespace, out)
+	return out, err
+}
+
+func (c *Client) GetEventTypeACL(id piazza.Ident) (*ACL, error) {
+	out := &ACL{}
+	err := c.getObject("/eventType/"+id.String()+"/acl", out)
+	return out, err
+}
+
+func (c *Client) PutEventTypeACL(id piazza.Ident, acl *ACL) (*ACL, error) {
+	out := &ACL{}
+	err := c.putObject(acl, "/eventType/"+id.String()+"/acl", out)
+	return out, err
+}
+
 //------------------------------------------------------------------------------
 
 func (c *Client) GetEvent(id piazza.Ident) (*Event, error) {
@@ -222,6 +401,20 @@ func (c *Client) GetAllEventsByEventType(eventTypeID piazza.Ident) (*[]Event, er
 	return out, err
 }
 
+// SearchEvents takes the query parameters of GET /event, e.g. eventTypeName,
+// after, before, createdBy, bbox and lat/lon/radius
+func (c *Client) SearchEvents(query url.Values) (*[]Event, error) {
+	out := &[]Event{}
+	err := c.getObject("/event?"+query.Encode(), out)
+	return out, err
+}
+
+// ExportEvents is SearchEvents answering in another media type, i.e.
+// ContentTypeGeoJSON or ContentTypeCSV
+func (c *Client) ExportEvents(query url.Values, contentType string) ([]byte, error) {
+	return c.doRaw("GET", "/event?"+query.Encode(), nil, "", contentType)
+}
+
 func (c *Client) PostEvent(event *Event) (*Event, error) {
 	out := &Event{}
 	err := c.postObject(event, "/event", out)
@@ -253,6 +446,24 @@ func (c *Client) GetTrigger(id piazza.Ident) (*Trigger, error) {
 	return out, err
 }
 
+func (c *Client) GetTriggerStats(id piazza.Ident) (*TriggerStats, error) {
+	out := &TriggerStats{}
+	err := c.getObject("/trigger/"+id.String()+"/stats", out)
+	return out, err
+}
+
+func (c *Client) GetTriggerACL(id piazza.Ident) (*ACL, error) {
+	out := &ACL{}
+	err := c.getObject("/trigger/"+id.String()+"/acl", out)
+	return out, err
+}
+
+func (c *Client) PutTriggerACL(id piazza.Ident, acl *ACL) (*ACL, error) {
+	out := &ACL{}
+	err := c.putObject(acl, "/trigger/"+id.String()+"/acl", out)
+	return out, err
+}
+
 func (c *Client) GetNumTriggers() (int, error) {
 	path := fmt.Sprintf("/trigger")
 	return c.getObjectCount(path)
@@ -265,6 +476,14 @@ func (c *Client) GetAllTriggers(perPage int, page int) (*[]Trigger, error) {
 	return out, err
 }
 
+// GetNamespaceTriggers gets the triggers of the namespace
+func (c *Client) GetNamespaceTriggers(namespace string, perPage, page int) (*[]Trigger, error) {
+	out := &[]Trigger{}
+	path := fmt.Sprintf("/trigger?namespace=%s&perPage=%d&page=%d", url.QueryEscape(namespace), perPage, page)
+	err := c.getObject(path, out)
+	return out, err
+}
+
 func (c *Client) PostTrigger(trigger *Trigger) (*Trigger, error) {
 	out := &Trigger{}
 	err := c.postObject(trigger, "/trigger", out)
@@ -283,11 +502,28 @@ func (c *Client) PutTrigger(id piazza.Ident, triggerUpdate *TriggerUpdate) error
 	return err
 }
 
+// TestTrigger tells whether the event would fire the trigger, without posting it
+func (c *Client) TestTrigger(id piazza.Ident, event *Event) (*TriggerTestResult, error) {
+	out := &TriggerTestResult{}
+	err := c.postObject(event, "/trigger/test/"+id.String(), out)
+	return out, err
+}
+
 func (c *Client) DeleteTrigger(id piazza.Ident) error {
 	err := c.deleteObject("/trigger/" + id.String())
 	return err
 }
 
+// PutTriggerIfMatch changes the trigger only if it is still at the ETag
+func (c *Client) PutTriggerIfMatch(id piazza.Ident, triggerUpdate *TriggerUpdate, etag string) error {
+	return c.doIfMatch("PUT", "/trigger/"+id.String(), triggerUpdate, etag, nil)
+}
+
+// DeleteTriggerIfMatch deletes the trigger only if it is still at the ETag
+func (c *Client) DeleteTriggerIfMatch(id piazza.Ident, etag string) error {
+	return c.doIfMatch("DELETE", "/trigger/"+id.String(), nil, etag, nil)
+}
+
 //------------------------------------------------------------------------------
 
 func (c *Client) GetAlert(id piazza.Ident) (*Alert, error) {
@@ -326,9 +562,9 @@ func (c *Client) QueryAlerts(query map[string]interface{}) (*[]Alert, error) {
 	return out, err
 }
 
-func (c *Client) PutAlert(alert *Alert) (*Alert, error) {
+func (c *Client) PutAlert(id piazza.Ident, update *AlertUpdate) (*Alert, error) {
 	out := &Alert{}
-	err := c.putObject(alert, "/alert", out)
+	err := c.putObject(update, "/alert/"+id.String(), out)
 	return out, err
 }
 
@@ -336,6 +572,78 @@ func (c *Client) DeleteAlert(id piazza.Ident) error {
 	return c.deleteObject("/alert/" + id.String())
 }
 
+// PutAlertIfMatch changes the alert only if it is still at the ETag
+func (c *Client) PutAlertIfMatch(id piazza.Ident, update *AlertUpdate, etag string) (*Alert, error) {
+	out := &Alert{}
+	err := c.doIfMatch("PUT", "/alert/"+id.String(), update, etag, out)
+	return out, err
+}
+
+// DeleteAlertIfMatch deletes the alert only if it is still at the ETag
+func (c *Client) DeleteAlertIfMatch(id piazza.Ident, etag string) error {
+	return c.doIfMatch("DELETE", "/alert/"+id.String(), nil, etag, nil)
+}
+
+//------------------------------------------------------------------------------
+
+func (c *Client) GetGeofence(id piazza.Ident) (*Geofence, error) {
+	out := &Geofence{}
+	err := c.getObject("/geofence/"+id.String(), out)
+	return out, err
+}
+
+func (c *Client) GetNumGeofences() (int, error) {
+	return c.getObjectCount("/geofence")
+}
+
+func (c *Client) GetAllGeofences(perPage int, page int) (*[]Geofence, error) {
+	out := &[]Geofence{}
+	path := fmt.Sprintf("/geofence?perPage=%d&page=%d", perPage, page)
+	err := c.getObject(path, out)
+	return out, err
+}
+
+func (c *Client) PostGeofence(geofence *Geofence) (*Geofence, error) {
+	out := &Geofence{}
+	err := c.postObject(geofence, "/geofence", out)
+	return out, err
+}
+
+func (c *Client) PutGeofence(id piazza.Ident, geofence *Geofence) (*Geofence, error) {
+	out := &Geofence{}
+	err := c.putObject(geofence, "/geofence/"+id.String(), out)
+	return out, err
+}
+
+func (c *Client) GetGeofenceACL(id piazza.Ident) (*ACL, error) {
+	out := &ACL{}
+	err := c.getObject("/geofence/"+id.String()+"/acl", out)
+	return out, err
+}
+
+func (c *Client) PutGeofenceACL(id piazza.Ident, acl *ACL) (*ACL, error) {
+	out := &ACL{}
+	err := c.putObject(acl, "/geofence/"+id.String()+"/acl", out)
+	return out, err
+}
+
+func (c *Client) DeleteGeofence(id piazza.Ident) error {
+	return c.deleteObject("/geofence/" + id.String())
+}
+
+//------------------------------------------------------------------------------
+
+func (c *Client) GetLineage(id piazza.Ident) (*Lineage, error) {
+	out := &Lineage{}
+	err := c.getObject("/lineage/"+id.String(), out)
+	return out, err
+}
+
+// GetLineageDot is GetLineage in the Graphviz DOT language
+func (c *Client) GetLineageDot(id piazza.Ident) ([]byte, error) {
+	return c.doRaw("GET", "/lineage/"+id.String(), nil, "", ContentTypeGraphviz)
+}
+
 //------------------------------------------------------------------------------
 
 func (c *Client) TestElasticsearchGetVersion() (*string, error) {
@@ -359,9 +667,94 @@ func (c *Client) TestElasticsearchPost(body *TestElasticsearchBody) (*TestElasti
 
 //------------------------------------------------------------------------------
 
+// GetAudit takes the query parameters of GET /audit: actor, action,
+// resourceId, after and before
+func (c *Client) GetAudit(query url.Values) (*[]AuditRecord, error) {
+	out := &[]AuditRecord{}
+	err := c.getObject("/audit?"+query.Encode(), out)
+	return out, err
+}
+
 func (c *Client) GetStats() (*Stats, error) {
 	out := &Stats{}
 	err := c.getObject("/admin/stats", out)
 	return out, err
 
 }
+
+// GetMetrics returns GET /metrics, in the Prometheus text format
+func (c *Client) GetMetrics() ([]byte, error) {
+	return c.doRaw("GET", "/metrics", nil, "", ContentTypePrometheus)
+}
+
+func (c *Client) Sweep() (*SweepResult, error) {
+	out := &SweepResult{}
+	err := c.postObject(nil, "/admin/sweep", out)
+	return out, err
+}
+
+// Export returns the NDJSON of GET /admin/export. Check its last record for
+// an ExportKindError.
+func (c *Client) Export() ([]byte, error) {
+	return c.doRaw("GET", "/admin/export", nil, "", ContentTypeNDJSON)
+}
+
+func (c *Client) Import(ndjson io.Reader) (*ImportReport, error) {
+	byts, err := c.doRaw("POST", "/admin/import", ndjson, ContentTypeNDJSON, piazza.ContentTypeJSON)
+	if err != nil {
+		return nil, err
+	}
+	resp := &piazza.JsonResponse{}
+	if err = json.Unmarshal(byts, resp); err != nil {
+		return nil, err
+	}
+	out := &ImportReport{}
+	err = resp.ExtractData(out)
+	return out, err
+}
+
+func (c *Client) PostPurge(request *PurgeRequest) (*PurgeJob, error) {
+	out := &PurgeJob{}
+	err := c.postObject(request, "/admin/purge", out)
+	return out, err
+}
+
+func (c *Client) GetPurge(id piazza.Ident) (*PurgeJob, error) {
+	out := &PurgeJob{}
+	err := c.getObject("/admin/purge/"+id.String(), out)
+	return out, err
+}
+
+func (c *Client) PostReindex(request *ReindexRequest) (*ReindexJob, error) {
+	out := &ReindexJob{}
+	err := c.postObject(request, "/admin/reindex", out)
+	return out, err
+}
+
+func (c *Client) GetReindex(id piazza.Ident) (*ReindexJob, error) {
+	out := &ReindexJob{}
+	err := c.getObject("/admin/reindex/"+id.String(), out)
+	return out, err
+}
+
+func (c *Client) GetOutbox(perPage int, page int) (*[]OutboxEntry, error) {
+	out := &[]OutboxEntry{}
+	err := c.getObject(fmt.Sprintf("/admin/outbox?perPage=%d&page=%d", perPage, page), out)
+	return out, err
+}
+
+func (c *Client) DeleteOutboxEntry(id piazza.Ident) error {
+	return c.deleteObject("/admin/outbox/" + id.String())
+}
+
+func (c *Client) GetConsistency() (*ConsistencyReport, error) {
+	out := &ConsistencyReport{}
+	err := c.getObject("/admin/consistency", out)
+	return out, err
+}
+
+func (c *Client) RepairConsistency() (*ConsistencyReport, error) {
+	out := &ConsistencyReport{}
+	err := c.postObject(nil, "/admin/consistency/repair", out)
+	return out, err
+}
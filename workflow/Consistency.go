@@ -0,0 +1,421 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"fmt"
+
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// GetConsistency reports what operations that failed part way have left
+// behind, without changing anything
+func (service *Service) GetConsistency(actor string) *piazza.JsonResponse {
+	defer service.handlePanic()
+	service.syslogger.Audit(actor, "checkingConsistency", keyEvents, "Service.GetConsistency: User is checking consistency")
+	return service.statusOK(service.checkConsistency(false))
+}
+
+// PostConsistencyRepair reports the same, and repairs each problem it can.
+// Each is looked at again just before it is repaired, but a resource being
+// written at the time can still look broken, so repairs are best made while
+// nothing else is writing.
+func (service *Service) PostConsistencyRepair(actor string) *piazza.JsonResponse {
+	defer service.handlePanic()
+
+	service.reindexLock.Lock()
+	reindexing := service.reindexing
+	service.reindexLock.Unlock()
+	if reindexing {
+		return service.statusConflict(fmt.Errorf("cannot repair while a reindex is running"))
+	}
+
+	service.syslogger.Audit(actor, "repairingConsistency", keyEvents, "Service.PostConsistencyRepair: User is repairing consistency")
+	report := service.checkConsistency(true)
+	repaired := 0
+	for _, problem := range report.Problems {
+		if problem.Repaired {
+			repaired++
+		}
+	}
+	service.syslogger.Audit(actor, "repairedConsistency", keyEvents, "Service.PostConsistencyRepair: User repaired %d of %d problems", repaired, len(report.Problems))
+	return service.statusOK(report)
+}
+
+// consistencyCheck gathers the problems of one report, repairing them as it
+// finds them if asked to
+type consistencyCheck struct {
+	service *Service
+	report  *ConsistencyReport
+	repair  bool
+}
+
+// found records a problem, and repairs it if this is a repair. The repair
+// says whether the problem is still there, and fixes it if so.
+func (c *consistencyCheck) found(kind string, id piazza.Ident, detail string, repair func() (bool, error)) {
+	problem := ConsistencyProblem{Kind: kind, ID: id, Detail: detail}
+	if c.repair {
+		var err error
+		if problem.Repaired, err = repair(); err != nil {
+			c.error(fmt.Errorf("repairing %s %s: %s", kind, id, err))
+		}
+	}
+	c.report.Problems = append(c.report.Problems, problem)
+}
+
+func (c *consistencyCheck) error(err error) {
+	if len(c.report.Errors) < purgeMaxErrors {
+		c.report.Errors = append(c.report.Errors, err.Error())
+	}
+}
+
+func (service *Service) checkConsistency(repair bool) *ConsistencyReport {
+	c := &consistencyCheck{
+		service: service,
+		report:  &ConsistencyReport{Repair: repair, Problems: []ConsistencyProblem{}, CheckedOn: piazza.NewTimeStamp()},
+		repair:  repair,
+	}
+	for _, check := range []func() error{
+		c.checkEventTypes,
+		c.checkTriggers,
+		c.checkPercolations,
+		c.checkCrons,
+		c.checkAlerts,
+	} {
+		if err := check(); err != nil {
+			c.error(err)
+		}
+	}
+	return c.report
+}
+
+// checkEventTypes finds EventTypes whose mapping was never added to the
+// events index, and adds it
+func (c *consistencyCheck) checkEventTypes() error {
+	eventTypes := []EventType{}
+	err := exportPages("eventTypeId", nil, func(dsl string) (int, string, error) {
+		page, _, err := c.service.eventTypeDB.GetEventTypesByDslQuery(dsl, "pz-workflow")
+		last := ""
+		for _, eventType := range page {
+			eventTypes = append(eventTypes, eventType)
+			last = eventType.EventTypeID.String()
+		}
+		return len(page), last, err
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range eventTypes {
+		eventType := &eventTypes[i]
+		exists, err := c.service.eventDB.NameExists(eventType.typeName(), "pz-workflow")
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		c.found(ConsistencyEventTypeWithoutMapping, eventType.EventTypeID, fmt.Sprintf("eventType %s has no mapping", eventType.typeName()), func() (bool, error) {
+			if exists, err := c.service.eventDB.NameExists(eventType.typeName(), "pz-workflow"); err != nil || exists {
+				return false, err
+			}
+			mapping := c.service.addUniqueParams(eventType.typeName(), c.service.removeUniqueParams(eventType.typeName(), eventType.Mapping))
+			if err := c.service.eventDB.AddMapping(eventType.typeName(), mapping, "pz-workflow"); err != nil {
+				return false, err
+			}
+			return true, nil
+		})
+	}
+	return nil
+}
+
+// checkTriggers finds triggers whose EventType is gone, which are deleted,
+// and those without a percolation query, which get theirs again
+func (c *consistencyCheck) checkTriggers() error {
+	percolations, err := c.percolationIDs()
+	if err != nil {
+		return err
+	}
+
+	triggers := []Trigger{}
+	err = exportPages("triggerId", nil, func(dsl string) (int, string, error) {
+		page, _, err := c.service.triggerDB.GetTriggersByDslQuery(dsl, "pz-workflow")
+		last := ""
+		for _, trigger := range page {
+			triggers = append(triggers, trigger)
+			last = trigger.TriggerID.String()
+		}
+		return len(page), last, err
+	})
+	if err != nil {
+		return err
+	}
+
+	eventTypes := map[piazza.Ident]*EventType{}
+	for i := range triggers {
+		trigger := &triggers[i]
+		eventType, ok := eventTypes[trigger.EventTypeID]
+		if !ok {
+			got, found, err := c.service.eventTypeDB.GetOne(trigger.EventTypeID, "pz-workflow")
+			if found && err != nil {
+				return err
+			}
+			if found {
+				eventType = got
+			}
+			eventTypes[trigger.EventTypeID] = eventType
+		}
+
+		if eventType == nil {
+			c.found(ConsistencyTriggerWithoutEventType, trigger.TriggerID, fmt.Sprintf("eventType %s does not exist", trigger.EventTypeID), func() (bool, error) {
+				if exists, err := c.service.eventTypeDB.itemExists(trigger.EventTypeID, "pz-workflow"); err != nil || exists {
+					return false, err
+				}
+				// the percolation query may be missing too, which is no
+				// reason to keep the trigger
+				_, err := c.service.triggerDB.DeleteTrigger(trigger.TriggerID, 0, "pz-workflow")
+				exists, err2 := c.service.triggerDB.itemExists(trigger.TriggerID, "pz-workflow")
+				if err2 != nil || exists {
+					return false, err
+				}
+				return true, nil
+			})
+			continue
+		}
+
+		if percolations[trigger.percolationID()] {
+			continue
+		}
+		c.found(ConsistencyTriggerWithoutPercolation, trigger.TriggerID, "trigger has no percolation query", func() (bool, error) {
+			condition, ok := prefixCondition(trigger.Condition, eventType.typeName())
+			if !ok {
+				return false, fmt.Errorf("failed to parse query of trigger %s", trigger.TriggerID)
+			}
+			if err := c.service.refreshPercolation(trigger, condition); err != nil {
+				return false, err
+			}
+			return true, nil
+		})
+	}
+	return nil
+}
+
+// percolationID is the id the trigger's percolation query is registered
+// under, which is its own unless it says otherwise
+func (trigger *Trigger) percolationID() piazza.Ident {
+	if trigger.PercolationID != "" {
+		return trigger.PercolationID
+	}
+	return trigger.TriggerID
+}
+
+func (c *consistencyCheck) percolationIDs() (map[piazza.Ident]bool, error) {
+	ids, err := c.service.eventDB.GetPercolationIDs("pz-workflow")
+	if err != nil {
+		return nil, err
+	}
+	percolations := map[piazza.Ident]bool{}
+	for _, id := range ids {
+		percolations[id] = true
+	}
+	return percolations, nil
+}
+
+// checkPercolations finds percolation queries that no trigger has, and
+// deletes them
+func (c *consistencyCheck) checkPercolations() error {
+	percolations, err := c.percolationIDs()
+	if err != nil {
+		return err
+	}
+
+	used := map[piazza.Ident]bool{}
+	err = exportPages("triggerId", nil, func(dsl string) (int, string, error) {
+		page, _, err := c.service.triggerDB.GetTriggersByDslQuery(dsl, "pz-workflow")
+		last := ""
+		for i := range page {
+			used[page[i].percolationID()] = true
+			last = page[i].TriggerID.String()
+		}
+		return len(page), last, err
+	})
+	if err != nil {
+		return err
+	}
+
+	for id := range percolations {
+		if used[id] {
+			continue
+		}
+		id := id
+		c.found(ConsistencyPercolationWithoutTrigger, id, "no trigger has this percolation query", func() (bool, error) {
+			// a trigger being posted has its query registered first
+			if exists, err := c.service.triggerDB.itemExists(id, "pz-workflow"); err != nil || exists {
+				return false, err
+			}
+			return c.service.eventDB.DeletePercolationQuery(id)
+		})
+	}
+	return nil
+}
+
+// checkCrons finds repeating events whose event is gone, which are deleted,
+// and those the cron has no job for, which are scheduled
+func (c *consistencyCheck) checkCrons() error {
+	crons := []Event{}
+	err := exportPages("eventId", nil, func(dsl string) (int, string, error) {
+		page, _, err := c.service.cronDB.GetCronsByDslQuery(dsl, "pz-workflow")
+		last := ""
+		for _, event := range page {
+			crons = append(crons, event)
+			last = event.EventID.String()
+		}
+		return len(page), last, err
+	})
+	if err != nil {
+		return err
+	}
+
+	ids := make([]piazza.Ident, len(crons))
+	for i := range crons {
+		ids[i] = crons[i].EventID
+	}
+	mappings, err := c.eventTypeNames(ids)
+	if err != nil {
+		return err
+	}
+
+	for i := range crons {
+		event := &crons[i]
+		mapping, ok := mappings[event.EventID]
+		if !ok {
+			c.found(ConsistencyCronWithoutEvent, event.EventID, "repeating event has no event", func() (bool, error) {
+				if exists, err := c.eventExists(event.EventID); err != nil || exists {
+					return false, err
+				}
+				if _, err := c.service.cronDB.DeleteByID(event.EventID, "pz-workflow"); err != nil {
+					return false, err
+				}
+				c.service.removeCronJob(event.EventID)
+				return true, nil
+			})
+			continue
+		}
+
+		if c.service.cronJobExists(event.EventID) {
+			continue
+		}
+		c.found(ConsistencyCronNotScheduled, event.EventID, fmt.Sprintf("repeating event of %s is not scheduled", mapping), func() (bool, error) {
+			if c.service.cronJobExists(event.EventID) {
+				return false, nil
+			}
+			if err := c.service.addCronJob(event, mapping); err != nil {
+				return false, err
+			}
+			return true, nil
+		})
+	}
+	return nil
+}
+
+// checkAlerts finds alerts whose trigger is gone, and unresolved alerts
+// whose event is gone, and deletes them. Retention keeps only the events of
+// unresolved alerts, so a resolved alert without its event is left alone.
+func (c *consistencyCheck) checkAlerts() error {
+	alerts := []Alert{}
+	err := exportPages("alertId", nil, func(dsl string) (int, string, error) {
+		page, _, err := c.service.alertDB.GetAlertsByDslQuery(dsl, "pz-workflow")
+		last := ""
+		for _, alert := range page {
+			alerts = append(alerts, alert)
+			last = alert.AlertID.String()
+		}
+		return len(page), last, err
+	})
+	if err != nil {
+		return err
+	}
+
+	triggers := map[piazza.Ident]bool{}
+	eventIDs := []piazza.Ident{}
+	seen := map[piazza.Ident]bool{}
+	for i := range alerts {
+		alert := &alerts[i]
+		if _, ok := triggers[alert.TriggerID]; !ok {
+			if triggers[alert.TriggerID], err = c.service.triggerDB.itemExists(alert.TriggerID, "pz-workflow"); err != nil {
+				return err
+			}
+		}
+		if triggers[alert.TriggerID] && !alert.Resolved && !seen[alert.EventID] {
+			seen[alert.EventID] = true
+			eventIDs = append(eventIDs, alert.EventID)
+		}
+	}
+	events, err := c.eventTypeNames(eventIDs)
+	if err != nil {
+		return err
+	}
+
+	for i := range alerts {
+		alert := &alerts[i]
+		kind, detail := "", ""
+		if !triggers[alert.TriggerID] {
+			kind, detail = ConsistencyAlertWithoutTrigger, fmt.Sprintf("trigger %s does not exist", alert.TriggerID)
+		} else if _, ok := events[alert.EventID]; !ok && !alert.Resolved {
+			kind, detail = ConsistencyAlertWithoutEvent, fmt.Sprintf("event %s does not exist", alert.EventID)
+		}
+		if kind == "" {
+			continue
+		}
+		c.found(kind, alert.AlertID, detail, func() (bool, error) {
+			var exists bool
+			var err error
+			if kind == ConsistencyAlertWithoutTrigger {
+				exists, err = c.service.triggerDB.itemExists(alert.TriggerID, "pz-workflow")
+			} else {
+				exists, err = c.eventExists(alert.EventID)
+			}
+			if err != nil || exists {
+				return false, err
+			}
+			return c.service.alertDB.DeleteByID(alert.AlertID, "pz-workflow")
+		})
+	}
+	return nil
+}
+
+// eventTypeNames finds the EventType names of those of the events that
+// exist, a batch at a time
+func (c *consistencyCheck) eventTypeNames(ids []piazza.Ident) (map[piazza.Ident]string, error) {
+	mappings := map[piazza.Ident]string{}
+	err := inBatches(ids, func(batch []piazza.Ident) error {
+		found, err := c.service.eventDB.lookupEventTypeNamesByEventIDs(batch, "pz-workflow")
+		for id, mapping := range found {
+			mappings[id] = mapping
+		}
+		return err
+	})
+	return mappings, err
+}
+
+// eventExists looks for the event again, just before a repair
+func (c *consistencyCheck) eventExists(id piazza.Ident) (bool, error) {
+	mappings, err := c.service.eventDB.lookupEventTypeNamesByEventIDs([]piazza.Ident{id}, "pz-workflow")
+	if err != nil {
+		return false, err
+	}
+	_, ok := mappings[id]
+	return ok, nil
+}
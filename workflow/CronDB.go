@@ -81,6 +81,73 @@ func (db *CronDB) GetAll(actor string) (*[]Event, error) {
 	return &events, nil
 }
 
+// GetPage returns one page of the cron events, with the total count
+func (db *CronDB) GetPage(format *piazza.JsonPagination, actor string) ([]Event, int64, error) {
+	events := []Event{}
+
+	exists, err := db.Exists(actor)
+	if err != nil {
+		return events, 0, err
+	}
+	if !exists {
+		return events, 0, nil
+	}
+
+	searchResult, err := db.Esi.FilterByMatchAll(db.mapping, format)
+	if err != nil {
+		return nil, 0, LoggedError("CronDB.GetPage failed: %s", err)
+	}
+	if searchResult == nil {
+		return nil, 0, LoggedError("CronDB.GetPage failed: no searchResult")
+	}
+
+	if searchResult != nil && searchResult.GetHits() != nil {
+		for _, hit := range *searchResult.GetHits() {
+			var event Event
+			if err := json.Unmarshal(*hit.Source, &event); err != nil {
+				return nil, 0, LoggedError("CronDB.GetPage failed: %s", err)
+			}
+			events = append(events, event)
+		}
+	}
+
+	return events, searchResult.TotalHits(), nil
+}
+
+// GetCronsByDslQuery returns the cron events a search body finds, with the
+// number it matched
+func (db *CronDB) GetCronsByDslQuery(dslString string, actor string) ([]Event, int64, error) {
+	events := []Event{}
+
+	exists, err := db.Exists(actor)
+	if err != nil {
+		return events, 0, err
+	}
+	if !exists {
+		return events, 0, nil
+	}
+
+	searchResult, err := db.Esi.SearchByJSON(db.mapping, dslString)
+	if err != nil {
+		return nil, 0, LoggedError("CronDB.GetCronsByDslQuery failed: %s", err)
+	}
+	if searchResult == nil {
+		return nil, 0, LoggedError("CronDB.GetCronsByDslQuery failed: no searchResult")
+	}
+
+	if searchResult != nil && searchResult.GetHits() != nil {
+		for _, hit := range *searchResult.GetHits() {
+			var event Event
+			if err := json.Unmarshal(*hit.Source, &event); err != nil {
+				return nil, 0, LoggedError("CronDB.GetCronsByDslQuery failed: %s", err)
+			}
+			events = append(events, event)
+		}
+	}
+
+	return events, searchResult.TotalHits(), nil
+}
+
 // Exists checks to see if the database exists
 func (db *CronDB) Exists(actor string) (bool, error) {
 	exists, err := db.Esi.IndexExists()
@@ -0,0 +1,105 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// EventTypes, triggers and alerts are at the version their store gives
+// the document: Elasticsearch's _version, or the FileStore's count of its
+// writes. A change asked for with If-Match is written only over the
+// version it was checked against, so it fails, rather than overwrite
+// another, if a change through any instance came between. Reindexing
+// copies the documents, which starts their versions again at 1.
+
+// errVersionConflict is what a store answers a write over a version the
+// document is no longer at
+var errVersionConflict = errors.New("version conflict")
+
+// VersionETag is the ETag of a resource at the version
+func VersionETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// matchesETag says whether an If-Match header allows a change to a resource
+// at the version. Without the header, anything goes.
+func matchesETag(ifMatch string, version int64) bool {
+	if ifMatch == "" {
+		return true
+	}
+	etag := VersionETag(version)
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func (service *Service) statusPreconditionFailed(err error) *piazza.JsonResponse {
+	return &piazza.JsonResponse{
+		StatusCode: http.StatusPreconditionFailed,
+		Message:    err.Error(),
+		Origin:     service.origin,
+	}
+}
+
+// checkETag refuses, with a 412, a change to a resource that has changed
+// since the If-Match header was read
+func (service *Service) checkETag(ifMatch string, kind string, id piazza.Ident, version int64) *piazza.JsonResponse {
+	if matchesETag(ifMatch, version) {
+		return nil
+	}
+	return service.statusPreconditionFailed(fmt.Errorf("%s %s has changed: it is at ETag %s, not %s", kind, id, VersionETag(version), ifMatch))
+}
+
+// ifMatchVersion is the version a change is to be written over: the one
+// the If-Match header was checked against, or 0, for any, if it names none
+func ifMatchVersion(ifMatch string, version int64) int64 {
+	if ifMatch == "" || strings.TrimSpace(ifMatch) == "*" {
+		return 0
+	}
+	return version
+}
+
+// versionConflict refuses, with a 412, a change that lost the race to
+// another after its If-Match header was checked
+func (service *Service) versionConflict(kind string, id piazza.Ident, ifMatch string) *piazza.JsonResponse {
+	return service.statusPreconditionFailed(fmt.Errorf("%s %s has changed: it is no longer at ETag %s", kind, id, ifMatch))
+}
+
+// setETag heads the response with the ETag of the resource it holds
+func (server *Server) setETag(c *gin.Context, resp *piazza.JsonResponse) {
+	if resp.IsError() {
+		return
+	}
+	switch obj := resp.Data.(type) {
+	case *EventType:
+		c.Header("ETag", VersionETag(obj.Version))
+	case *Trigger:
+		c.Header("ETag", VersionETag(obj.Version))
+	case *Alert:
+		c.Header("ETag", VersionETag(obj.Version))
+	}
+}
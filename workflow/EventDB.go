@@ -26,6 +26,9 @@ type EventDB struct {
 	*ResourceDB
 }
 
+// percolatorType is the type Elasticsearch keeps percolation queries under
+const percolatorType = ".percolator"
+
 func NewEventDB(service *Service, esi elasticsearch.IIndex) (*EventDB, error) {
 	rdb, err := NewResourceDB(service, esi)
 	if err != nil {
@@ -36,7 +39,7 @@ func NewEventDB(service *Service, esi elasticsearch.IIndex) (*EventDB, error) {
 }
 
 func (db *EventDB) PostData(event *Event, typ string) error {
-	if err := db.verifyEventReadyToPost(event); err != nil {
+	if err := db.service.verifyEventReadyToPost(event); err != nil {
 		return err
 	}
 
@@ -51,65 +54,6 @@ func (db *EventDB) PostData(event *Event, typ string) error {
 	return nil
 }
 
-func (db *EventDB) verifyEventReadyToPost(event *Event) error {
-	eventTypeJson := db.service.GetEventType(event.EventTypeID, event.CreatedBy)
-	eventTypeObj := eventTypeJson.Data
-	eventType, ok := eventTypeObj.(*EventType)
-	if !ok {
-		return LoggedError("EventDB.PostData failed: unable to obtain specified eventtype")
-	}
-	eventTypeMapping := eventType.Mapping
-	eventTypeMappingVars, err := piazza.GetVarsFromStruct(eventTypeMapping)
-	if err != nil {
-		return LoggedError("EventDB.PostData failed: %s", err)
-	}
-	exclude := map[string]bool{}
-	for k, v := range eventTypeMappingVars {
-		if fmt.Sprint(v) == string(elasticsearch.MappingElementTypeGeoPoint) || fmt.Sprint(v) == string(elasticsearch.MappingElementTypeGeoShape) {
-			exclude[k] = false
-		}
-	}
-	eventdata := db.service.removeUniqueParams(eventType.Name, event.Data)
-	eventDataVars, err := piazza.GetVarsFromStructSkip(eventdata, exclude)
-	if err != nil {
-		return LoggedError("EventDB.PostData failed: %s", err)
-	}
-	if len(eventTypeMappingVars) > len(eventDataVars) {
-		notFound := []string{}
-		for k, _ := range eventTypeMappingVars {
-			if _, ok := eventDataVars[k]; !ok {
-				notFound = append(notFound, k)
-			}
-		}
-		return LoggedError("EventDB.PostData failed: the variables %s were specified in the EventType but were not found in the Event", notFound)
-	} else if len(eventTypeMappingVars) < len(eventDataVars) {
-		extra := []string{}
-		for k, _ := range eventDataVars {
-			if _, ok := eventTypeMappingVars[k]; !ok {
-				extra = append(extra, k)
-			}
-		}
-		return LoggedError("EventDB.PostData failed: the variables %s were not specified in the EventType but were found in the Event", extra)
-	}
-	for k, v := range eventTypeMappingVars {
-		for k2, v2 := range eventDataVars {
-			if k2 == k {
-				if !elasticsearch.IsValidArrayTypeMapping(v) {
-					if piazza.ValueIsValidArray(v2) {
-						return LoggedError("EventDB.PostData failed: an array was passed into the non-array field %s", k)
-					}
-				} else {
-					if !piazza.ValueIsValidArray(v2) {
-						return LoggedError("EventDB.PostData failed: a non-array was pasted into the array field %s", k)
-					}
-				}
-				break
-			}
-		}
-	}
-	return nil
-}
-
 func (db *EventDB) GetAll(mapping string, format *piazza.JsonPagination, actor string) ([]Event, int64, error) {
 	events := []Event{}
 	var err error
@@ -240,12 +184,56 @@ func (db *EventDB) lookupEventTypeNameByEventID(id piazza.Ident, actor string) (
 	return mapping, nil
 }
 
+// eventIDsSearchResponse is what a search across the types of the index
+// answers, as far as lookupEventTypeNamesByEventIDs reads it
+type eventIDsSearchResponse struct {
+	Hits struct {
+		Hits []struct {
+			ID   string `json:"_id"`
+			Type string `json:"_type"`
+		} `json:"hits"`
+	} `json:"hits"`
+	Error interface{} `json:"error"`
+}
+
+// lookupEventTypeNamesByEventIDs finds the EventType names of the events in
+// one search across the types; those that do not exist are left out, so an
+// error is only ever a failure to look
+func (db *EventDB) lookupEventTypeNamesByEventIDs(ids []piazza.Ident, actor string) (map[piazza.Ident]string, error) {
+	mappings := map[piazza.Ident]string{}
+	if len(ids) == 0 {
+		return mappings, nil
+	}
+	query := map[string]interface{}{
+		"query":   map[string]interface{}{"ids": map[string]interface{}{"values": ids}},
+		"size":    len(ids),
+		"_source": false,
+	}
+	out := &eventIDsSearchResponse{}
+	if err := db.Esi.DirectAccess("POST", "/"+db.Esi.IndexName()+"/_search", query, out); err != nil {
+		return nil, LoggedError("EventDB.lookupEventTypeNamesByEventIDs failed: %s", err)
+	}
+	if out.Error != nil {
+		return nil, LoggedError("EventDB.lookupEventTypeNamesByEventIDs failed: %v", out.Error)
+	}
+	for _, hit := range out.Hits.Hits {
+		if hit.Type != percolatorType {
+			mappings[piazza.Ident(hit.ID)] = hit.Type
+		}
+	}
+	return mappings, nil
+}
+
 // NameExists checks if an EventType name exists.
 // This is easier to check in EventDB, as the mappings use the EventType.Name.
 func (db *EventDB) NameExists(name string, actor string) (bool, error) {
 	return db.Esi.TypeExists(name)
 }
 
+func (db *EventDB) itemExists(mapping string, id piazza.Ident, actor string) (bool, error) {
+	return db.Esi.ItemExists(mapping, id.String())
+}
+
 func (db *EventDB) GetOne(mapping string, id piazza.Ident, actor string) (*Event, bool, error) {
 	getResult, err := db.Esi.GetByID(mapping, id.String())
 	if err != nil {
@@ -276,6 +264,14 @@ func (db *EventDB) DeleteByID(mapping string, id piazza.Ident, actor string) (bo
 	return deleteResult.Found, nil
 }
 
+func (db *EventDB) DeleteByIDs(mapping string, ids []piazza.Ident, actor string) (int, error) {
+	deleted, err := db.deleteByIDs(mapping, ids)
+	if err != nil {
+		return deleted, LoggedError("EventDB.DeleteByIDs failed: %s", err)
+	}
+	return deleted, nil
+}
+
 func (db *EventDB) AddMapping(name string, mapping map[string]interface{}, actor string) error {
 	jsn, err := ConstructEventMappingSchema(name, mapping)
 	if err != nil {
@@ -288,6 +284,16 @@ func (db *EventDB) AddMapping(name string, mapping map[string]interface{}, actor
 	return nil
 }
 
+// RemoveMapping drops an EventType's mapping from the events index, so that
+// its name can be used again. Not every Elasticsearch version can do this.
+func (db *EventDB) RemoveMapping(name string, actor string) error {
+	endpoint := fmt.Sprintf("/%s/_mapping/%s", db.Esi.IndexName(), name)
+	if err := db.Esi.DirectAccess("DELETE", endpoint, nil, nil); err != nil {
+		return LoggedError("EventDB.RemoveMapping failed: %s", err)
+	}
+	return nil
+}
+
 func ConstructEventMappingSchema(name string, mapping map[string]interface{}) (piazza.JsonString, error) {
 	const template string = `{
 		"%s":{
@@ -378,3 +384,57 @@ func (db *EventDB) PercolateEventData(eventType string, data map[string]interfac
 
 	return &ids, nil
 }
+
+// AddPercolationQuery registers a trigger's query, returning the id it was
+// registered under. A query registered again replaces the old one, which
+// Elasticsearch reports as not created.
+func (db *EventDB) AddPercolationQuery(id piazza.Ident, query piazza.JsonString) (piazza.Ident, error) {
+	indexResult, err := db.Esi.AddPercolationQuery(id.String(), query)
+	if err != nil {
+		return "", err
+	}
+	if indexResult == nil {
+		return "", fmt.Errorf("no indexResult")
+	}
+	return piazza.Ident(indexResult.ID), nil
+}
+
+// GetPercolationIDs pages through the registered percolation queries,
+// returning their ids
+func (db *EventDB) GetPercolationIDs(actor string) ([]piazza.Ident, error) {
+	ids := []piazza.Ident{}
+	exists, err := db.Esi.TypeExists(percolatorType)
+	if err != nil {
+		return nil, LoggedError("EventDB.GetPercolationIDs failed: %s", err)
+	}
+	if !exists {
+		return ids, nil
+	}
+	err = exportPages("_uid", nil, func(dsl string) (int, string, error) {
+		searchResult, err := db.Esi.SearchByJSON(percolatorType, dsl)
+		if err != nil {
+			return 0, "", err
+		}
+		last := ""
+		for _, hit := range *searchResult.GetHits() {
+			ids = append(ids, piazza.Ident(hit.ID))
+			last = percolatorType + "#" + hit.ID
+		}
+		return searchResult.NumHits(), last, nil
+	})
+	if err != nil {
+		return nil, LoggedError("EventDB.GetPercolationIDs failed: %s", err)
+	}
+	return ids, nil
+}
+
+func (db *EventDB) DeletePercolationQuery(id piazza.Ident) (bool, error) {
+	deleteResult, err := db.Esi.DeletePercolationQuery(id.String())
+	if err != nil {
+		return false, err
+	}
+	if deleteResult == nil {
+		return false, fmt.Errorf("no deleteResult")
+	}
+	return deleteResult.Found, nil
+}
@@ -0,0 +1,258 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// the columns of an exported event that do not come from its data
+var eventExportColumns = []string{"eventId", "eventTypeId", "eventTypeName", "createdBy", "createdOn"}
+
+// eventExportDataPrefix heads the columns that do come from its data, so
+// that a variable named like one of the others cannot hide it
+const eventExportDataPrefix = "data."
+
+var geoJSONTypes = map[string]string{
+	"point":           "Point",
+	"multipoint":      "MultiPoint",
+	"linestring":      "LineString",
+	"multilinestring": "MultiLineString",
+	"polygon":         "Polygon",
+	"multipolygon":    "MultiPolygon",
+}
+
+// eventExportFormat picks the media type to answer with from an Accept
+// header, in the order the header lists them. JSON, the default, is "".
+func eventExportFormat(accept string) string {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType := strings.ToLower(strings.TrimSpace(strings.Split(part, ";")[0]))
+		switch mediaType {
+		case ContentTypeGeoJSON, "application/vnd.geo+json":
+			return ContentTypeGeoJSON
+		case ContentTypeCSV:
+			return ContentTypeCSV
+		case piazza.ContentTypeJSON, "application/*", "*/*":
+			return ""
+		}
+	}
+	return ""
+}
+
+// lookupEventTypes fetches, once each, the EventTypes of the events
+func (service *Service) lookupEventTypes(events []Event) (map[piazza.Ident]*EventType, error) {
+	eventTypes := map[piazza.Ident]*EventType{}
+	for _, event := range events {
+		if _, ok := eventTypes[event.EventTypeID]; ok {
+			continue
+		}
+		eventType, found, err := service.eventTypeDB.GetOne(event.EventTypeID, "pz-workflow")
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, fmt.Errorf("eventType %s could not be found", event.EventTypeID)
+		}
+		eventTypes[event.EventTypeID] = eventType
+	}
+	return eventTypes, nil
+}
+
+// EventsAsGeoJSON turns (un-nested) events into a FeatureCollection. Each
+// event is located by the first geo_point or geo_shape variable of its
+// EventType, or else by the minX/minY/maxX/maxY variables of ingest events.
+// Its variables are the properties named "data." and their dotted path.
+func (service *Service) EventsAsGeoJSON(events []Event) (*GeoJSONFeatureCollection, error) {
+	eventTypes, err := service.lookupEventTypes(events)
+	if err != nil {
+		return nil, err
+	}
+
+	collection := &GeoJSONFeatureCollection{Type: "FeatureCollection", Features: []GeoJSONFeature{}}
+	for _, event := range events {
+		eventType := eventTypes[event.EventTypeID]
+		mapping := service.removeUniqueParams(eventType.typeName(), eventType.Mapping)
+
+		var geometry interface{}
+		if field, kind, err := resolveGeofenceField("", mapping); err == nil {
+			// an event without a (valid) location still gets its properties exported
+			if g, err := eventGeometry(event.Data, field, kind); err == nil {
+				geometry = g
+			}
+		}
+
+		vars, err := piazza.GetVarsFromStruct(mapping)
+		if err != nil {
+			return nil, err
+		}
+		properties := map[string]interface{}{}
+		for name := range vars {
+			if v, ok := getDataValue(event.Data, name); ok {
+				properties[eventExportDataPrefix+name] = v
+			}
+		}
+		for i, v := range eventExportRow(&event, eventType) {
+			properties[eventExportColumns[i]] = v
+		}
+
+		collection.Features = append(collection.Features, GeoJSONFeature{
+			Type:       "Feature",
+			ID:         event.EventID,
+			Geometry:   geometry,
+			Properties: properties,
+		})
+	}
+	return collection, nil
+}
+
+// EventsAsCSV flattens (un-nested) events into CSV, one column per variable
+// of their EventTypes' mappings. Those columns are named "data." and the
+// dotted path of the variable; geo values and arrays are written as JSON.
+func (service *Service) EventsAsCSV(events []Event) ([]byte, error) {
+	eventTypes, err := service.lookupEventTypes(events)
+	if err != nil {
+		return nil, err
+	}
+
+	columnSet := map[string]bool{}
+	for _, eventType := range eventTypes {
+		vars, err := piazza.GetVarsFromStruct(service.removeUniqueParams(eventType.typeName(), eventType.Mapping))
+		if err != nil {
+			return nil, err
+		}
+		for name := range vars {
+			columnSet[name] = true
+		}
+	}
+	columns := []string{}
+	for name := range columnSet {
+		columns = append(columns, name)
+	}
+	sort.Strings(columns)
+
+	header := append([]string{}, eventExportColumns...)
+	for _, name := range columns {
+		header = append(header, eventExportDataPrefix+name)
+	}
+	buf := &bytes.Buffer{}
+	w := csv.NewWriter(buf)
+	if err = w.Write(header); err != nil {
+		return nil, err
+	}
+	for _, event := range events {
+		record := eventExportRow(&event, eventTypes[event.EventTypeID])
+		for _, name := range columns {
+			v, _ := getDataValue(event.Data, name)
+			s, err := csvValue(v)
+			if err != nil {
+				return nil, err
+			}
+			record = append(record, s)
+		}
+		if err = w.Write(record); err != nil {
+			return nil, err
+		}
+	}
+	w.Flush()
+	if err = w.Error(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// eventExportRow is the values of the eventExportColumns for the event
+func eventExportRow(event *Event, eventType *EventType) []string {
+	return []string{
+		event.EventID.String(),
+		event.EventTypeID.String(),
+		eventType.Name,
+		event.CreatedBy,
+		event.CreatedOn.String(),
+	}
+}
+
+func csvValue(v interface{}) (string, error) {
+	switch t := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return t, nil
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), nil
+	case map[string]interface{}, []interface{}:
+		byts, err := json.Marshal(t)
+		if err != nil {
+			return "", err
+		}
+		return string(byts), nil
+	}
+	return fmt.Sprint(v), nil
+}
+
+// eventGeometry is the event's location as a GeoJSON geometry
+func eventGeometry(data map[string]interface{}, field string, kind string) (map[string]interface{}, error) {
+	switch kind {
+	case geofenceFieldBbox:
+		shape, err := eventLocation(data, field, kind)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"type": "Polygon", "coordinates": polygonCoordinates(shape.polygons[0])}, nil
+	case string(elasticsearch.MappingElementTypeGeoPoint):
+		shape, err := eventLocation(data, field, kind)
+		if err != nil {
+			return nil, err
+		}
+		p := shape.points[0]
+		return map[string]interface{}{"type": "Point", "coordinates": []float64{p.x, p.y}}, nil
+	}
+
+	v, ok := getDataValue(data, field)
+	if !ok {
+		return nil, fmt.Errorf("event has no [%s] value", field)
+	}
+	shape, err := parseGeoShapeValue(v)
+	if err != nil {
+		return nil, err
+	}
+	geometry := v.(map[string]interface{})
+	typ := strings.ToLower(fmt.Sprint(geometry["type"]))
+	if typ == "envelope" {
+		return map[string]interface{}{"type": "Polygon", "coordinates": polygonCoordinates(shape.polygons[0])}, nil
+	}
+	// Elasticsearch takes the type in any case, GeoJSON readers do not
+	return map[string]interface{}{"type": geoJSONTypes[typ], "coordinates": geometry["coordinates"]}, nil
+}
+
+func polygonCoordinates(polygon geoPolygon) [][][]float64 {
+	rings := [][][]float64{}
+	for _, ring := range polygon {
+		positions := [][]float64{}
+		for _, p := range ring {
+			positions = append(positions, []float64{p.x, p.y})
+		}
+		rings = append(rings, positions)
+	}
+	return rings
+}
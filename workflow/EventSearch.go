@@ -0,0 +1,257 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// the format Elasticsearch expects for createdOn ranges
+const eventSearchTimeFormat = "2006-01-02T15:04:05.999-07:00"
+
+var eventSearchDistance = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?([a-zA-Z]*)$`)
+
+// eventSearch holds the filters GET /event accepts besides the eventType:
+//
+//	after, before           RFC3339 bounds on createdOn
+//	createdBy               exact match
+//	bbox                    minX,minY,maxX,maxY
+//	lat, lon, radius        a circle; the radius is in meters unless it has a unit, e.g. "5km"
+//	geoField                the variable bbox and radius apply to; by default the
+//	                        first geo_point or geo_shape variable, or the
+//	                        minX/minY/maxX/maxY box of ingest events
+//
+// A search scoped to a namespace also has the IDs of its eventTypes.
+type eventSearch struct {
+	after     time.Time
+	before    time.Time
+	createdBy string
+	bbox      []float64
+	lat       float64
+	lon       float64
+	radius    string
+	geoField  string
+
+	eventTypeIDs []piazza.Ident
+}
+
+func parseEventSearch(params *piazza.HttpQueryParams) (*eventSearch, error) {
+	search := &eventSearch{}
+	var err error
+
+	if search.after, err = params.GetAfter(time.Time{}); err != nil {
+		return nil, fmt.Errorf("after must be an RFC3339 time: %s", err)
+	}
+	if search.before, err = params.GetBefore(time.Time{}); err != nil {
+		return nil, fmt.Errorf("before must be an RFC3339 time: %s", err)
+	}
+	if search.createdBy, err = params.GetAsString("createdBy", ""); err != nil {
+		return nil, err
+	}
+	if search.geoField, err = params.GetAsString("geoField", ""); err != nil {
+		return nil, err
+	}
+
+	bbox, err := params.GetAsString("bbox", "")
+	if err != nil {
+		return nil, err
+	}
+	if bbox != "" {
+		parts := strings.Split(bbox, ",")
+		if len(parts) != 4 {
+			return nil, errors.New("bbox must be of the form minX,minY,maxX,maxY")
+		}
+		for _, part := range parts {
+			f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil {
+				return nil, fmt.Errorf("bbox must be of the form minX,minY,maxX,maxY: %s", err)
+			}
+			search.bbox = append(search.bbox, f)
+		}
+		if search.bbox[0] > search.bbox[2] || search.bbox[1] > search.bbox[3] {
+			return nil, errors.New("bbox minimums must not exceed its maximums")
+		}
+	}
+
+	lat, err := params.GetAsString("lat", "")
+	if err != nil {
+		return nil, err
+	}
+	lon, err := params.GetAsString("lon", "")
+	if err != nil {
+		return nil, err
+	}
+	if search.radius, err = params.GetAsString("radius", ""); err != nil {
+		return nil, err
+	}
+	if lat != "" || lon != "" || search.radius != "" {
+		if lat == "" || lon == "" || search.radius == "" {
+			return nil, errors.New("lat, lon and radius must be given together")
+		}
+		if search.lat, err = strconv.ParseFloat(lat, 64); err != nil {
+			return nil, fmt.Errorf("lat must be a number: %s", err)
+		}
+		if search.lon, err = strconv.ParseFloat(lon, 64); err != nil {
+			return nil, fmt.Errorf("lon must be a number: %s", err)
+		}
+		match := eventSearchDistance.FindStringSubmatch(search.radius)
+		if match == nil {
+			return nil, fmt.Errorf("radius [%s] must be a distance such as 500 or 5km", search.radius)
+		}
+		if match[2] == "" {
+			search.radius += "m"
+		}
+	}
+
+	return search, nil
+}
+
+func (search *eventSearch) isEmpty() bool {
+	return search.after.IsZero() && search.before.IsZero() && search.createdBy == "" && !search.isSpatial() && search.eventTypeIDs == nil
+}
+
+func (search *eventSearch) isSpatial() bool {
+	return search.bbox != nil || search.radius != ""
+}
+
+// query builds the Elasticsearch query for the search. The eventType's name and
+// (un-nested) mapping are only needed, and must then be given, for the spatial filters.
+func (search *eventSearch) query(eventTypeName string, mapping map[string]interface{}) (map[string]interface{}, error) {
+	filters := []interface{}{}
+
+	if !search.after.IsZero() || !search.before.IsZero() {
+		bounds := map[string]interface{}{}
+		if !search.after.IsZero() {
+			bounds["gte"] = search.after.Format(eventSearchTimeFormat)
+		}
+		if !search.before.IsZero() {
+			bounds["lte"] = search.before.Format(eventSearchTimeFormat)
+		}
+		filters = append(filters, map[string]interface{}{
+			"range": map[string]interface{}{"createdOn": bounds},
+		})
+	}
+
+	if search.createdBy != "" {
+		filters = append(filters, map[string]interface{}{
+			"term": map[string]interface{}{"createdBy": search.createdBy},
+		})
+	}
+
+	if search.eventTypeIDs != nil {
+		filters = append(filters, map[string]interface{}{
+			"terms": map[string]interface{}{"eventTypeId": search.eventTypeIDs},
+		})
+	}
+
+	if search.isSpatial() {
+		if eventTypeName == "" {
+			return nil, errors.New("bbox and radius searches need an eventTypeId or eventTypeName")
+		}
+		field, kind, err := resolveGeofenceField(search.geoField, mapping)
+		if err != nil {
+			return nil, err
+		}
+		prefix := "data." + eventTypeName + "."
+
+		if search.bbox != nil {
+			filter, err := search.bboxFilter(prefix, field, kind)
+			if err != nil {
+				return nil, err
+			}
+			filters = append(filters, filter...)
+		}
+		if search.radius != "" {
+			filter, err := search.radiusFilter(prefix, field, kind)
+			if err != nil {
+				return nil, err
+			}
+			filters = append(filters, filter)
+		}
+	}
+
+	return map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{"filter": filters},
+		},
+	}, nil
+}
+
+func (search *eventSearch) bboxFilter(prefix string, field string, kind string) ([]interface{}, error) {
+	minX, minY, maxX, maxY := search.bbox[0], search.bbox[1], search.bbox[2], search.bbox[3]
+	switch kind {
+	case string(elasticsearch.MappingElementTypeGeoPoint):
+		return []interface{}{map[string]interface{}{
+			"geo_bounding_box": map[string]interface{}{
+				prefix + field: map[string]interface{}{
+					"top_left":     map[string]interface{}{"lat": maxY, "lon": minX},
+					"bottom_right": map[string]interface{}{"lat": minY, "lon": maxX},
+				},
+			},
+		}}, nil
+	case string(elasticsearch.MappingElementTypeGeoShape):
+		return []interface{}{geoShapeFilter(prefix+field, map[string]interface{}{
+			"type":        "envelope",
+			"coordinates": []interface{}{[]interface{}{minX, maxY}, []interface{}{maxX, minY}},
+		})}, nil
+	case geofenceFieldBbox:
+		// the boxes overlap unless one lies wholly to one side of the other
+		rng := func(k string, op string, v float64) interface{} {
+			return map[string]interface{}{
+				"range": map[string]interface{}{prefix + k: map[string]interface{}{op: v}},
+			}
+		}
+		return []interface{}{
+			rng("minX", "lte", maxX), rng("maxX", "gte", minX),
+			rng("minY", "lte", maxY), rng("maxY", "gte", minY),
+		}, nil
+	}
+	return nil, fmt.Errorf("field [%s] cannot be searched by bbox", field)
+}
+
+func (search *eventSearch) radiusFilter(prefix string, field string, kind string) (interface{}, error) {
+	switch kind {
+	case string(elasticsearch.MappingElementTypeGeoPoint):
+		return map[string]interface{}{
+			"geo_distance": map[string]interface{}{
+				"distance":     search.radius,
+				prefix + field: map[string]interface{}{"lat": search.lat, "lon": search.lon},
+			},
+		}, nil
+	case string(elasticsearch.MappingElementTypeGeoShape):
+		return geoShapeFilter(prefix+field, map[string]interface{}{
+			"type":        "circle",
+			"coordinates": []interface{}{search.lon, search.lat},
+			"radius":      search.radius,
+		}), nil
+	}
+	return nil, fmt.Errorf("field [%s] cannot be searched by radius", field)
+}
+
+func geoShapeFilter(field string, shape map[string]interface{}) interface{} {
+	return map[string]interface{}{
+		"geo_shape": map[string]interface{}{
+			field: map[string]interface{}{"shape": shape, "relation": "intersects"},
+		},
+	}
+}
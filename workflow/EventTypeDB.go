@@ -16,6 +16,7 @@ package workflow
 
 import (
 	"encoding/json"
+	"fmt"
 
 	"github.com/venicegeo/pz-gocommon/elasticsearch"
 	"github.com/venicegeo/pz-gocommon/gocommon"
@@ -36,15 +37,11 @@ func NewEventTypeDB(service *Service, esi elasticsearch.IIndex) (*EventTypeDB, e
 }
 
 func (db *EventTypeDB) PostData(eventType *EventType) error {
-	vars, err := piazza.GetVarsFromStruct(eventType.Mapping)
-	if err != nil {
+	if err := checkEventTypeMapping(eventType.Mapping); err != nil {
 		return LoggedError("EventTypeDB.PostData failed: %s", err)
 	}
-	for _, v := range vars {
-		if !elasticsearch.IsValidMappingType(v) {
-			return LoggedError("EventTypeDB.PostData failed: %v was not recognized as a valid mapping type", v)
-		}
-	}
+	// the index gives the version
+	eventType.Version = 0
 	indexResult, err := db.Esi.PostData(db.mapping, eventType.EventTypeID.String(), eventType)
 	if err != nil {
 		return LoggedError("EventTypeDB.PostData failed: %s", err)
@@ -52,10 +49,42 @@ func (db *EventTypeDB) PostData(eventType *EventType) error {
 	if !indexResult.Created {
 		return LoggedError("EventTypeDB.PostData failed: not created")
 	}
+	eventType.Version = int64(indexResult.Version)
 
 	return nil
 }
 
+// checkEventTypeMapping makes sure every variable has a type events can be
+// mapped with
+func checkEventTypeMapping(mapping map[string]interface{}) error {
+	vars, err := piazza.GetVarsFromStruct(mapping)
+	if err != nil {
+		return err
+	}
+	for _, v := range vars {
+		if !elasticsearch.IsValidMappingType(v) {
+			return fmt.Errorf("%v was not recognized as a valid mapping type", v)
+		}
+	}
+	return nil
+}
+
+// PutData writes the eventType over the version of it, or over any if that
+// is 0, and gives it the version it now is
+func (db *EventTypeDB) PutData(eventType *EventType, version int64) error {
+	stored := *eventType
+	stored.Version = 0
+	newVersion, err := db.putVersioned(db.mapping, eventType.EventTypeID, &stored, version)
+	if err == errVersionConflict {
+		return err
+	}
+	if err != nil {
+		return LoggedError("EventTypeDB.PutData failed: %s", err)
+	}
+	eventType.Version = newVersion
+	return nil
+}
+
 func (db *EventTypeDB) GetAll(format *piazza.JsonPagination, actor string) ([]EventType, int64, error) {
 	eventTypes := []EventType{}
 
@@ -121,49 +150,46 @@ func (db *EventTypeDB) GetEventTypesByDslQuery(dslString string, actor string) (
 }
 
 func (db *EventTypeDB) GetOne(id piazza.Ident, actor string) (*EventType, bool, error) {
-	getResult, err := db.Esi.GetByID(db.mapping, id.String())
+	src, version, found, err := db.getVersioned(db.mapping, id)
 	if err != nil {
-		return nil, getResult.Found, LoggedError("EventTypeDB.GetOne failed: %s", err.Error())
-	}
-	if getResult == nil {
-		return nil, true, LoggedError("EventTypeDB.GetOne failed: no getResult")
+		return nil, found, LoggedError("EventTypeDB.GetOne failed: %s", err.Error())
 	}
 
-	src := getResult.Source
 	var eventType EventType
 	if err = json.Unmarshal(*src, &eventType); err != nil {
-		return nil, getResult.Found, err
+		return nil, found, err
 	}
+	eventType.Version = version
 
-	return &eventType, getResult.Found, nil
+	return &eventType, found, nil
 }
 
-func (db *EventTypeDB) GetIDByName(format *piazza.JsonPagination, name string, actor string) (*piazza.Ident, bool, error) {
-
-	getResult, err := db.Esi.FilterByTermQuery(db.mapping, "name", name, format)
-	if err != nil {
-		return nil, getResult.Found, LoggedError("EventTypeDB.GetIDByName failed: %s", err.Error())
-	}
-	if getResult == nil {
-		return nil, true, LoggedError("EventTypeDB.GetIDByName failed: no getResult")
-	}
-
-	// This should not happen once we have 1 to 1 mappings of EventTypes to names
-	if getResult.NumHits() > 1 {
-		return nil, true, LoggedError("EventTypeDB.GetIDByName failed: matched more than one EventType!")
-	}
-
-	if getResult.NumHits() == 0 {
-		return nil, false, nil
-	}
-
-	src := getResult.GetHit(0).Source
-	var eventType EventType
-	if err = json.Unmarshal(*src, &eventType); err != nil {
-		return nil, getResult.Found, err
-	}
-
-	return &eventType.EventTypeID, getResult.Found, nil
+// GetIDByName finds the EventType of the name in the namespace, looking
+// through every page of the EventTypes the name is a term of, whatever the
+// format
+func (db *EventTypeDB) GetIDByName(format *piazza.JsonPagination, namespace string, name string, actor string) (*piazza.Ident, bool, error) {
+	var id *piazza.Ident
+	err := exportPages("eventTypeId", nameQuery(namespace, name), func(dsl string) (int, string, error) {
+		eventTypes, _, err := db.GetEventTypesByDslQuery(dsl, actor)
+		if err != nil {
+			return 0, "", err
+		}
+		last := ""
+		for i := range eventTypes {
+			last = eventTypes[i].EventTypeID.String()
+			// the term query also matches by word, which a name must not
+			if eventTypes[i].Name != name {
+				continue
+			}
+			// This should not happen once we have 1 to 1 mappings of EventTypes to names
+			if id != nil {
+				return 0, "", LoggedError("EventTypeDB.GetIDByName failed: matched more than one EventType!")
+			}
+			id = &eventTypes[i].EventTypeID
+		}
+		return len(eventTypes), last, nil
+	})
+	return id, id != nil, err
 }
 
 func (db *EventTypeDB) DeleteByID(id piazza.Ident, actor string) (bool, error) {
@@ -177,3 +203,20 @@ func (db *EventTypeDB) DeleteByID(id piazza.Ident, actor string) (bool, error) {
 
 	return deleteResult.Found, nil
 }
+
+// deleteAtVersion deletes the eventType at the version, or at any if that
+// is 0
+func (db *EventTypeDB) deleteAtVersion(id piazza.Ident, version int64) (bool, error) {
+	found, err := db.deleteVersioned(db.mapping, id, version)
+	if err == errVersionConflict {
+		return found, err
+	}
+	if err != nil {
+		return found, LoggedError("EventTypeDB.DeleteById failed: %s", err)
+	}
+	return found, nil
+}
+
+func (db *EventTypeDB) itemExists(id piazza.Ident, actor string) (bool, error) {
+	return db.Esi.ItemExists(db.mapping, id.String())
+}
@@ -0,0 +1,415 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+const exportPerPage = 100
+
+// exportPages calls get with the search body of each page in turn of what the
+// query matches, or of everything if it is nil, sorted by the given field,
+// which must be unique, until a page comes back short. get returns how many
+// came back and the field of the last. A page starts after the last of the
+// one before, as search_after does, rather than at an offset, which an index
+// refuses past its max_result_window.
+func exportPages(sortBy string, query interface{}, get func(dsl string) (int, string, error)) error {
+	after := ""
+	for {
+		dsl, err := exportDsl(sortBy, query, after)
+		if err != nil {
+			return err
+		}
+		n, last, err := get(dsl)
+		if err != nil {
+			return err
+		}
+		if n < exportPerPage {
+			return nil
+		}
+		after = last
+	}
+}
+
+// exportDsl is the search body of the page of exportPages that starts after
+// the given value of the field, or at the first if it is ""
+func exportDsl(sortBy string, query interface{}, after string) (string, error) {
+	if query == nil {
+		query = map[string]interface{}{"match_all": map[string]interface{}{}}
+	}
+	if after != "" {
+		query = map[string]interface{}{"bool": map[string]interface{}{
+			"must":   query,
+			"filter": map[string]interface{}{"range": map[string]interface{}{sortBy: map[string]interface{}{"gt": after}}},
+		}}
+	}
+	byts, err := json.Marshal(map[string]interface{}{
+		"query": query,
+		"sort":  []interface{}{map[string]interface{}{sortBy: "asc"}},
+		"size":  exportPerPage,
+	})
+	return string(byts), err
+}
+
+// Export writes every EventType, geofence, trigger, cron entry, event and
+// alert to w as NDJSON, in that order, so that Import can recreate each
+// before anything refers to it. The response has already started by the
+// time most errors can happen, so an error is written as a final record.
+func (service *Service) Export(w io.Writer, actor string) error {
+	defer service.handlePanic()
+	service.syslogger.Audit(actor, "exportingAll", keyEvents, "Service.Export: User is exporting all resources")
+
+	encoder := json.NewEncoder(w)
+	write := func(kind string, obj interface{}) error {
+		byts, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		return encoder.Encode(&ExportRecord{Kind: kind, Data: byts})
+	}
+
+	err := service.export(write)
+	if err != nil {
+		service.syslogger.Audit(actor, "exportingAllFailure", keyEvents, "Service.Export: User failed to export all resources")
+		if err2 := write(ExportKindError, err.Error()); err2 != nil {
+			return err2
+		}
+		return err
+	}
+
+	service.syslogger.Audit(actor, "exportedAll", keyEvents, "Service.Export: User successfully exported all resources")
+	return nil
+}
+
+func (service *Service) export(write func(string, interface{}) error) error {
+	eventTypes := []EventType{}
+	err := exportPages("eventTypeId", nil, func(dsl string) (int, string, error) {
+		page, _, err := service.eventTypeDB.GetEventTypesByDslQuery(dsl, "pz-workflow")
+		last := ""
+		for _, eventType := range page {
+			eventTypes = append(eventTypes, eventType)
+			last = eventType.EventTypeID.String()
+		}
+		return len(page), last, err
+	})
+	if err != nil {
+		return err
+	}
+	names := map[piazza.Ident]string{}
+	for _, eventType := range eventTypes {
+		names[eventType.EventTypeID] = eventType.typeName()
+		eventType.Mapping = service.removeUniqueParams(eventType.typeName(), eventType.Mapping)
+		if err = write(ExportKindEventType, &eventType); err != nil {
+			return err
+		}
+	}
+
+	err = exportPages("geofenceId", nil, func(dsl string) (int, string, error) {
+		page, _, err := service.geofenceDB.GetGeofencesByDslQuery(dsl, "pz-workflow")
+		last := ""
+		for i := 0; err == nil && i < len(page); i++ {
+			err = write(ExportKindGeofence, &page[i])
+			last = page[i].GeofenceID.String()
+		}
+		return len(page), last, err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = exportPages("triggerId", nil, func(dsl string) (int, string, error) {
+		page, _, err := service.triggerDB.GetTriggersByDslQuery(dsl, "pz-workflow")
+		last := ""
+		for i := 0; err == nil && i < len(page); i++ {
+			err = write(ExportKindTrigger, &page[i])
+			last = page[i].TriggerID.String()
+		}
+		return len(page), last, err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = exportPages("eventId", nil, func(dsl string) (int, string, error) {
+		page, _, err := service.cronDB.GetCronsByDslQuery(dsl, "pz-workflow")
+		last := ""
+		for i := 0; err == nil && i < len(page); i++ {
+			last = page[i].EventID.String()
+			page[i].Data = service.removeUniqueParams(names[page[i].EventTypeID], page[i].Data)
+			err = write(ExportKindCron, &page[i])
+		}
+		return len(page), last, err
+	})
+	if err != nil {
+		return err
+	}
+
+	// by eventType, to know how to un-nest the data
+	for _, eventType := range eventTypes {
+		exists, err := service.eventDB.NameExists(eventType.typeName(), "pz-workflow")
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		err = exportPages("eventId", nil, func(dsl string) (int, string, error) {
+			page, _, err := service.eventDB.GetEventsByDslQuery(eventType.typeName(), dsl, "pz-workflow")
+			last := ""
+			for i := 0; err == nil && i < len(page); i++ {
+				last = page[i].EventID.String()
+				page[i].Data = service.removeUniqueParams(eventType.typeName(), page[i].Data)
+				err = write(ExportKindEvent, &page[i])
+			}
+			return len(page), last, err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return exportPages("alertId", nil, func(dsl string) (int, string, error) {
+		page, _, err := service.alertDB.GetAlertsByDslQuery(dsl, "pz-workflow")
+		last := ""
+		for i := 0; err == nil && i < len(page); i++ {
+			err = write(ExportKindAlert, &page[i])
+			last = page[i].AlertID.String()
+		}
+		return len(page), last, err
+	})
+}
+
+// Import reads the NDJSON written by Export and recreates what it lists,
+// keeping the ids. Event mappings, percolation queries and cron jobs are
+// registered again; imported events do not fire triggers. Resources whose
+// id already exists are skipped, so a failed import can be run again. The
+// first bad record stops the import.
+func (service *Service) Import(r io.Reader, actor string) *piazza.JsonResponse {
+	defer service.handlePanic()
+	service.syslogger.Audit(actor, "importingAll", keyEvents, "Service.Import: User is importing resources")
+
+	report := &ImportReport{Created: map[string]int{}, Skipped: map[string]int{}}
+
+	decoder := json.NewDecoder(r)
+	for n := 1; ; n++ {
+		var record ExportRecord
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			var created bool
+			if created, err = service.importRecord(&record); err == nil {
+				if created {
+					report.Created[record.Kind]++
+				} else {
+					report.Skipped[record.Kind]++
+				}
+				continue
+			}
+		}
+		service.syslogger.Audit(actor, "importingAllFailure", keyEvents, "Service.Import: User failed to import record %d", n)
+		return service.statusBadRequest(LoggedError("Service.Import failed at record %d: %s", n, err))
+	}
+
+	service.syslogger.Audit(actor, "importedAll", keyEvents, "Service.Import: User successfully imported resources")
+
+	return service.statusOK(report)
+}
+
+// importRecord creates the resource of the record, and returns false if it
+// already existed
+func (service *Service) importRecord(record *ExportRecord) (bool, error) {
+	switch record.Kind {
+	case ExportKindEventType:
+		eventType := &EventType{}
+		if err := json.Unmarshal(record.Data, eventType); err != nil {
+			return false, err
+		}
+		return service.importEventType(eventType)
+	case ExportKindGeofence:
+		geofence := &Geofence{}
+		if err := json.Unmarshal(record.Data, geofence); err != nil {
+			return false, err
+		}
+		return service.importGeofence(geofence)
+	case ExportKindTrigger:
+		trigger := &Trigger{}
+		if err := json.Unmarshal(record.Data, trigger); err != nil {
+			return false, err
+		}
+		return service.importTrigger(trigger)
+	case ExportKindCron:
+		event := &Event{}
+		if err := json.Unmarshal(record.Data, event); err != nil {
+			return false, err
+		}
+		return service.importCron(event)
+	case ExportKindEvent:
+		event := &Event{}
+		if err := json.Unmarshal(record.Data, event); err != nil {
+			return false, err
+		}
+		return service.importEvent(event)
+	case ExportKindAlert:
+		alert := &Alert{}
+		if err := json.Unmarshal(record.Data, alert); err != nil {
+			return false, err
+		}
+		return service.importAlert(alert)
+	case ExportKindError:
+		var message string
+		_ = json.Unmarshal(record.Data, &message)
+		return false, fmt.Errorf("the export is incomplete: %s", message)
+	}
+	return false, fmt.Errorf("unknown kind [%s]", record.Kind)
+}
+
+func (service *Service) importEventType(eventType *EventType) (bool, error) {
+	if eventType.EventTypeID == "" || eventType.Name == "" {
+		return false, errors.New("eventType has no eventTypeId or name")
+	}
+	exists, err := service.eventTypeDB.itemExists(eventType.EventTypeID, "pz-workflow")
+	if err != nil || exists {
+		return false, err
+	}
+	id, found, err := service.eventTypeDB.GetIDByName(nil, eventType.Namespace, eventType.Name, "pz-workflow")
+	if err != nil {
+		return false, err
+	}
+	if found {
+		return false, fmt.Errorf("eventType name %s already exists under eventTypeId %s", eventType.typeName(), *id)
+	}
+
+	eventType.Mapping = service.addUniqueParams(eventType.typeName(), eventType.Mapping)
+	if err = service.eventTypeDB.PostData(eventType); err != nil {
+		return false, err
+	}
+	if err = service.eventDB.AddMapping(eventType.typeName(), eventType.Mapping, eventType.CreatedBy); err != nil {
+		_, _ = service.eventTypeDB.DeleteByID(eventType.EventTypeID, eventType.CreatedBy)
+		return false, err
+	}
+	service.stats.IncrEventTypes()
+	return true, nil
+}
+
+func (service *Service) importGeofence(geofence *Geofence) (bool, error) {
+	if geofence.GeofenceID == "" {
+		return false, errors.New("geofence has no geofenceId")
+	}
+	exists, err := service.geofenceDB.Esi.ItemExists(service.geofenceDB.mapping, geofence.GeofenceID.String())
+	if err != nil || exists {
+		return false, err
+	}
+	polygons, err := parseGeofenceGeometry(geofence.Geometry)
+	if err != nil {
+		return false, err
+	}
+	geofence.Bbox = geoPolygonsBbox(polygons)
+	return true, service.geofenceDB.PostData(geofence)
+}
+
+func (service *Service) importTrigger(trigger *Trigger) (bool, error) {
+	if trigger.TriggerID == "" {
+		return false, errors.New("trigger has no triggerId")
+	}
+	exists, err := service.triggerDB.itemExists(trigger.TriggerID, "pz-workflow")
+	if err != nil || exists {
+		return false, err
+	}
+	eventType, found, err := service.eventTypeDB.GetOne(trigger.EventTypeID, "pz-workflow")
+	if !found || err != nil {
+		return false, fmt.Errorf("eventType %s could not be found", trigger.EventTypeID)
+	}
+	if trigger.Geofence != nil {
+		if err = service.validateGeofenceCondition(trigger.Geofence, eventType); err != nil {
+			return false, err
+		}
+	}
+	condition, ok := prefixCondition(trigger.Condition, eventType.typeName())
+	if !ok {
+		return false, errors.New("failed to parse query")
+	}
+	trigger.Condition = condition
+	if err = service.triggerDB.PostData(trigger); err != nil {
+		return false, err
+	}
+	service.stats.IncrTriggers()
+	return true, nil
+}
+
+func (service *Service) importCron(event *Event) (bool, error) {
+	if event.EventID == "" {
+		return false, errors.New("cron entry has no eventId")
+	}
+	exists, err := service.cronDB.itemExists(event.EventID, "pz-workflow")
+	if err != nil || exists {
+		return false, err
+	}
+	eventType, found, err := service.eventTypeDB.GetOne(event.EventTypeID, "pz-workflow")
+	if !found || err != nil {
+		return false, fmt.Errorf("eventType %s could not be found", event.EventTypeID)
+	}
+	event.Data = service.addUniqueParams(eventType.typeName(), event.Data)
+	if err = service.addCronJob(event, eventType.typeName()); err != nil {
+		return false, err
+	}
+	if err = service.cronDB.PostData(event); err != nil {
+		service.removeCronJob(event.EventID)
+		return false, err
+	}
+	return true, nil
+}
+
+func (service *Service) importEvent(event *Event) (bool, error) {
+	if event.EventID == "" {
+		return false, errors.New("event has no eventId")
+	}
+	eventType, found, err := service.eventTypeDB.GetOne(event.EventTypeID, "pz-workflow")
+	if !found || err != nil {
+		return false, fmt.Errorf("eventType %s could not be found", event.EventTypeID)
+	}
+	exists, err := service.eventDB.itemExists(eventType.typeName(), event.EventID, "pz-workflow")
+	if err != nil || exists {
+		return false, err
+	}
+	event.Data = service.addUniqueParams(eventType.typeName(), event.Data)
+	if err = service.eventDB.PostData(event, eventType.typeName()); err != nil {
+		return false, err
+	}
+	service.stats.IncrEvents()
+	return true, nil
+}
+
+func (service *Service) importAlert(alert *Alert) (bool, error) {
+	if alert.AlertID == "" {
+		return false, errors.New("alert has no alertId")
+	}
+	exists, err := service.alertDB.itemExists(alert.AlertID, "pz-workflow")
+	if err != nil || exists {
+		return false, err
+	}
+	if err = service.alertDB.PostData(alert); err != nil {
+		return false, err
+	}
+	service.stats.IncrAlerts()
+	return true, nil
+}
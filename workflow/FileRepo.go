@@ -0,0 +1,962 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// The repositories kept in a FileStore. Each resource has a collection named
+// as its index is; events have one per EventType, named "events.<EventType>",
+// beside which are kept the EventTypes' mappings and the triggers'
+// percolation queries.
+const (
+	fileEventsPrefix      = keyEvents + "."
+	fileEventMappings     = "eventmappings"
+	fileEventPercolations = "percolations"
+)
+
+func fileEventsCollection(name string) string {
+	return fileEventsPrefix + name
+}
+
+// parseFileSearch reads a search body, as SearchByJSON would
+func parseFileSearch(dslString string) (*dslSearch, error) {
+	search, err := parseDslSearch(dslString)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse query: %s", err)
+	}
+	return search, nil
+}
+
+func identStrings(ids []piazza.Ident) []string {
+	out := make([]string, len(ids))
+	for i, id := range ids {
+		out[i] = id.String()
+	}
+	return out
+}
+
+//---------------------------------------------------------------------------
+
+// FileEventTypeRepo keeps EventTypes in a FileStore
+type FileEventTypeRepo struct {
+	service *Service
+	store   *FileStore
+}
+
+func NewFileEventTypeRepo(service *Service, store *FileStore) *FileEventTypeRepo {
+	return &FileEventTypeRepo{service: service, store: store}
+}
+
+func (db *FileEventTypeRepo) PostData(eventType *EventType) error {
+	if err := checkEventTypeMapping(eventType.Mapping); err != nil {
+		return LoggedError("FileEventTypeRepo.PostData failed: %s", err)
+	}
+	// the store gives the version
+	eventType.Version = 0
+	if err := db.store.write(keyEventTypes, eventType.EventTypeID.String(), eventType, true); err != nil {
+		return LoggedError("FileEventTypeRepo.PostData failed: %s", err)
+	}
+	eventType.Version = 1
+	return nil
+}
+
+func (db *FileEventTypeRepo) PutData(eventType *EventType, version int64) error {
+	stored := *eventType
+	stored.Version = 0
+	newVersion, err := db.store.writeAt(keyEventTypes, eventType.EventTypeID.String(), &stored, version)
+	if err == errVersionConflict {
+		return err
+	}
+	if err != nil {
+		return LoggedError("FileEventTypeRepo.PutData failed: %s", err)
+	}
+	eventType.Version = newVersion
+	return nil
+}
+
+func (db *FileEventTypeRepo) GetAll(format *piazza.JsonPagination, actor string) ([]EventType, int64, error) {
+	return db.search(paginationSearch(nil, format))
+}
+
+func (db *FileEventTypeRepo) GetEventTypesByDslQuery(dslString string, actor string) ([]EventType, int64, error) {
+	search, err := parseFileSearch(dslString)
+	if err != nil {
+		return nil, 0, LoggedError("FileEventTypeRepo.GetEventTypesByDslQuery failed: %s", err)
+	}
+	return db.search(search)
+}
+
+func (db *FileEventTypeRepo) search(search *dslSearch) ([]EventType, int64, error) {
+	hits, totalHits, err := db.store.search([]string{keyEventTypes}, search)
+	if err != nil {
+		return nil, 0, LoggedError("FileEventTypeRepo.search failed: %s", err)
+	}
+	eventTypes := []EventType{}
+	for _, hit := range hits {
+		var eventType EventType
+		if err := json.Unmarshal(*hit, &eventType); err != nil {
+			return nil, 0, err
+		}
+		eventTypes = append(eventTypes, eventType)
+	}
+	return eventTypes, totalHits, nil
+}
+
+func (db *FileEventTypeRepo) GetOne(id piazza.Ident, actor string) (*EventType, bool, error) {
+	src, version, found := db.store.getVersioned(keyEventTypes, id.String())
+	if !found {
+		return nil, false, fmt.Errorf("FileEventTypeRepo.GetOne failed: eventType %s does not exist", id)
+	}
+	var eventType EventType
+	if err := json.Unmarshal(*src, &eventType); err != nil {
+		return nil, true, err
+	}
+	eventType.Version = version
+	return &eventType, true, nil
+}
+
+func (db *FileEventTypeRepo) GetIDByName(format *piazza.JsonPagination, namespace string, name string, actor string) (*piazza.Ident, bool, error) {
+	eventTypes, _, err := db.search(paginationSearch(nameQuery(namespace, name), nil))
+	if err != nil {
+		return nil, false, err
+	}
+	for _, eventType := range eventTypes {
+		// the term query also matches by word, which a name must not
+		if eventType.Name == name {
+			return &eventType.EventTypeID, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+func (db *FileEventTypeRepo) DeleteByID(id piazza.Ident, actor string) (bool, error) {
+	found, err := db.store.remove(keyEventTypes, id.String())
+	if err != nil {
+		return false, LoggedError("FileEventTypeRepo.DeleteById failed: %s", err)
+	}
+	return found, nil
+}
+
+func (db *FileEventTypeRepo) deleteAtVersion(id piazza.Ident, version int64) (bool, error) {
+	found, err := db.store.removeAt(keyEventTypes, id.String(), version)
+	if err == errVersionConflict {
+		return found, err
+	}
+	if err != nil {
+		return false, LoggedError("FileEventTypeRepo.DeleteById failed: %s", err)
+	}
+	return found, nil
+}
+
+func (db *FileEventTypeRepo) itemExists(id piazza.Ident, actor string) (bool, error) {
+	return db.store.has(keyEventTypes, id.String()), nil
+}
+
+//---------------------------------------------------------------------------
+
+// FileEventRepo keeps Events in a FileStore, with the mappings of their
+// EventTypes and the triggers' percolation queries, which it evaluates itself
+type FileEventRepo struct {
+	service *Service
+	store   *FileStore
+}
+
+func NewFileEventRepo(service *Service, store *FileStore) *FileEventRepo {
+	return &FileEventRepo{service: service, store: store}
+}
+
+func (db *FileEventRepo) PostData(event *Event, typ string) error {
+	if err := db.service.verifyEventReadyToPost(event); err != nil {
+		return err
+	}
+	if err := db.store.write(fileEventsCollection(typ), event.EventID.String(), event, true); err != nil {
+		return LoggedError("FileEventRepo.PostData failed: %s", err)
+	}
+	return nil
+}
+
+// collections are those holding the EventType's events, or every EventType's
+func (db *FileEventRepo) collections(mapping string, n int) ([]string, error) {
+	if mapping == "" {
+		return db.store.collectionsWithPrefix(fileEventsPrefix), nil
+	}
+	exists, err := db.NameExists(mapping, "pz-workflow")
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("Type %s does not exist (%d)", mapping, n)
+	}
+	return []string{fileEventsCollection(mapping)}, nil
+}
+
+func (db *FileEventRepo) GetAll(mapping string, format *piazza.JsonPagination, actor string) ([]Event, int64, error) {
+	collections, err := db.collections(mapping, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	return db.search(collections, paginationSearch(nil, format))
+}
+
+func (db *FileEventRepo) GetEventsByDslQuery(mapping string, jsnString string, actor string) ([]Event, int64, error) {
+	collections, err := db.collections(mapping, 2)
+	if err != nil {
+		return nil, 0, err
+	}
+	search, err := parseFileSearch(jsnString)
+	if err != nil {
+		return nil, 0, LoggedError("FileEventRepo.GetEventsByDslQuery failed: %s", err)
+	}
+	return db.search(collections, search)
+}
+
+func (db *FileEventRepo) GetEventsByEventTypeID(format *piazza.JsonPagination, mapping string, eventTypeID piazza.Ident, actor string) ([]Event, int64, error) {
+	collections, err := db.collections(mapping, 3)
+	if err != nil {
+		return nil, 0, err
+	}
+	return db.search(collections, paginationSearch(termQuery("eventTypeId", eventTypeID.String()), format))
+}
+
+func (db *FileEventRepo) search(collections []string, search *dslSearch) ([]Event, int64, error) {
+	hits, totalHits, err := db.store.search(collections, search)
+	if err != nil {
+		return nil, 0, LoggedError("FileEventRepo.search failed: %s", err)
+	}
+	events := []Event{}
+	for _, hit := range hits {
+		var event Event
+		if err := json.Unmarshal(*hit, &event); err != nil {
+			return nil, 0, err
+		}
+		events = append(events, event)
+	}
+	return events, totalHits, nil
+}
+
+func (db *FileEventRepo) GetOne(mapping string, id piazza.Ident, actor string) (*Event, bool, error) {
+	src, found := db.store.get(fileEventsCollection(mapping), id.String())
+	if !found {
+		return nil, false, fmt.Errorf("FileEventRepo.GetOne failed: event %s does not exist", id)
+	}
+	var event Event
+	if err := json.Unmarshal(*src, &event); err != nil {
+		return nil, true, err
+	}
+	return &event, true, nil
+}
+
+func (db *FileEventRepo) DeleteByID(mapping string, id piazza.Ident, actor string) (bool, error) {
+	found, err := db.store.remove(fileEventsCollection(mapping), id.String())
+	if err != nil {
+		return false, LoggedError("FileEventRepo.DeleteById failed: %s", err)
+	}
+	return found, nil
+}
+
+func (db *FileEventRepo) DeleteByIDs(mapping string, ids []piazza.Ident, actor string) (int, error) {
+	deleted, err := db.store.removeAll(fileEventsCollection(mapping), identStrings(ids))
+	if err != nil {
+		return 0, LoggedError("FileEventRepo.DeleteByIDs failed: %s", err)
+	}
+	return deleted, nil
+}
+
+// NameExists checks if an EventType name exists, by its mapping
+func (db *FileEventRepo) NameExists(name string, actor string) (bool, error) {
+	return db.store.has(fileEventMappings, name), nil
+}
+
+func (db *FileEventRepo) itemExists(mapping string, id piazza.Ident, actor string) (bool, error) {
+	return db.store.has(fileEventsCollection(mapping), id.String()), nil
+}
+
+func (db *FileEventRepo) lookupEventTypeNameByEventID(id piazza.Ident, actor string) (string, error) {
+	for _, collection := range db.store.collectionsWithPrefix(fileEventsPrefix) {
+		if db.store.has(collection, id.String()) {
+			return collection[len(fileEventsPrefix):], nil
+		}
+	}
+	return "", LoggedError("FileEventRepo.lookupEventTypeNameByEventID failed: [Item %s in events does not exist]", id.String())
+}
+
+func (db *FileEventRepo) lookupEventTypeNamesByEventIDs(ids []piazza.Ident, actor string) (map[piazza.Ident]string, error) {
+	mappings := map[piazza.Ident]string{}
+	for _, collection := range db.store.collectionsWithPrefix(fileEventsPrefix) {
+		for _, id := range ids {
+			if db.store.has(collection, id.String()) {
+				mappings[id] = collection[len(fileEventsPrefix):]
+			}
+		}
+	}
+	return mappings, nil
+}
+
+// AddMapping records the EventType's mapping, which is checked as Elasticsearch
+// would, and makes the collection for its events
+func (db *FileEventRepo) AddMapping(name string, mapping map[string]interface{}, actor string) error {
+	if _, err := ConstructEventMappingSchema(name, mapping); err != nil {
+		return LoggedError("FileEventRepo.AddMapping failed: %s", err)
+	}
+	if err := db.store.write(fileEventMappings, name, mapping, false); err != nil {
+		return LoggedError("FileEventRepo.AddMapping failed: %s", err)
+	}
+	if err := db.store.createCollection(fileEventsCollection(name)); err != nil {
+		return LoggedError("FileEventRepo.AddMapping failed: %s", err)
+	}
+	return nil
+}
+
+// RemoveMapping drops an EventType's mapping and any events left under it,
+// so that its name can be used again
+func (db *FileEventRepo) RemoveMapping(name string, actor string) error {
+	if _, err := db.store.remove(fileEventMappings, name); err != nil {
+		return LoggedError("FileEventRepo.RemoveMapping failed: %s", err)
+	}
+	if err := db.store.dropCollection(fileEventsCollection(name)); err != nil {
+		return LoggedError("FileEventRepo.RemoveMapping failed: %s", err)
+	}
+	return nil
+}
+
+// PercolateEventData returns the ids of the percolation queries that match
+// the event data, in order
+func (db *FileEventRepo) PercolateEventData(eventType string, data map[string]interface{}, id piazza.Ident, actor string) (*[]piazza.Ident, error) {
+	hits, _, err := db.store.search([]string{fileEventPercolations}, paginationSearch(nil, nil))
+	if err != nil {
+		return nil, LoggedError("FileEventRepo.PercolateEventData failed: %s", err)
+	}
+
+	// the document is read back from JSON, as Elasticsearch would see it
+	byts, err := json.Marshal(map[string]interface{}{"data": data})
+	if err != nil {
+		return nil, LoggedError("FileEventRepo.PercolateEventData failed: %s", err)
+	}
+	doc := dslDoc{id: id.String()}
+	if err = json.Unmarshal(byts, &doc.source); err != nil {
+		return nil, LoggedError("FileEventRepo.PercolateEventData failed: %s", err)
+	}
+
+	ids := []piazza.Ident{}
+	for _, hit := range hits {
+		var percolation fileEventPercolation
+		if err = json.Unmarshal(*hit, &percolation); err != nil {
+			return nil, LoggedError("FileEventRepo.PercolateEventData failed: %s", err)
+		}
+		matched, err := dslMatches(percolation.Query, doc)
+		if err != nil {
+			return nil, LoggedError("FileEventRepo.PercolateEventData failed: trigger %s: %s", percolation.ID, err)
+		}
+		if matched {
+			ids = append(ids, percolation.ID)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return &ids, nil
+}
+
+// fileEventPercolation is a percolation query as the FileEventRepo keeps it
+type fileEventPercolation struct {
+	ID    piazza.Ident `json:"id"`
+	Query interface{}  `json:"query"`
+}
+
+// AddPercolationQuery keeps the query under the given id, once it is sure it
+// can evaluate it
+func (db *FileEventRepo) AddPercolationQuery(id piazza.Ident, query piazza.JsonString) (piazza.Ident, error) {
+	var parsed interface{}
+	if err := json.Unmarshal([]byte(query), &parsed); err != nil {
+		return "", fmt.Errorf("failed to parse query: %s", err)
+	}
+	if _, err := dslMatches(parsed, dslDoc{source: map[string]interface{}{}}); err != nil {
+		return "", fmt.Errorf("failed to parse query: %s", err)
+	}
+	if err := db.store.write(fileEventPercolations, id.String(), &fileEventPercolation{ID: id, Query: parsed}, false); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (db *FileEventRepo) DeletePercolationQuery(id piazza.Ident) (bool, error) {
+	return db.store.remove(fileEventPercolations, id.String())
+}
+
+func (db *FileEventRepo) GetPercolationIDs(actor string) ([]piazza.Ident, error) {
+	hits, _, err := db.store.search([]string{fileEventPercolations}, paginationSearch(nil, nil))
+	if err != nil {
+		return nil, LoggedError("FileEventRepo.GetPercolationIDs failed: %s", err)
+	}
+	ids := make([]piazza.Ident, len(hits))
+	for i, hit := range hits {
+		var percolation fileEventPercolation
+		if err = json.Unmarshal(*hit, &percolation); err != nil {
+			return nil, LoggedError("FileEventRepo.GetPercolationIDs failed: %s", err)
+		}
+		ids[i] = percolation.ID
+	}
+	return ids, nil
+}
+
+//---------------------------------------------------------------------------
+
+// FileTriggerRepo keeps Triggers in a FileStore
+type FileTriggerRepo struct {
+	service *Service
+	store   *FileStore
+}
+
+func NewFileTriggerRepo(service *Service, store *FileStore) *FileTriggerRepo {
+	return &FileTriggerRepo{service: service, store: store}
+}
+
+func (db *FileTriggerRepo) PostData(trigger *Trigger) error {
+	if err := checkTriggerService(trigger); err != nil {
+		return err
+	}
+
+	body, err := db.service.percolationQuery(trigger.Condition, trigger.EventTypeID)
+	if err != nil {
+		return err
+	}
+	percolationID, err := db.service.eventDB.AddPercolationQuery(trigger.TriggerID, body)
+	if err != nil {
+		return percolationError(err)
+	}
+	trigger.PercolationID = percolationID
+
+	trigger.Condition = encodeCondition(trigger.Condition).(map[string]interface{})
+
+	// the store gives the version
+	trigger.Version = 0
+	if err = db.store.write(keyTriggers, trigger.TriggerID.String(), trigger, true); err != nil {
+		_, _ = db.service.eventDB.DeletePercolationQuery(trigger.TriggerID)
+		return LoggedError("FileTriggerRepo.PostData failed: %s", err)
+	}
+	trigger.Version = 1
+	return nil
+}
+
+func (db *FileTriggerRepo) PutTrigger(trigger *Trigger, update *TriggerUpdate, version int64, actor string) (*Trigger, error) {
+	trigger.Enabled = update.Enabled
+	stored := *trigger
+	stored.Condition = encodeCondition(trigger.Condition).(map[string]interface{})
+	stored.Version = 0
+	newVersion, err := db.store.writeAt(keyTriggers, trigger.TriggerID.String(), &stored, version)
+	if err == errVersionConflict {
+		return trigger, err
+	}
+	if err != nil {
+		return trigger, LoggedError("FileTriggerRepo.PutData failed: %s", err)
+	}
+	trigger.Version = newVersion
+	return trigger, nil
+}
+
+func (db *FileTriggerRepo) GetAll(format *piazza.JsonPagination, actor string) ([]Trigger, int64, error) {
+	return db.search(paginationSearch(nil, format))
+}
+
+func (db *FileTriggerRepo) GetTriggersByDslQuery(dslString string, actor string) ([]Trigger, int64, error) {
+	search, err := parseFileSearch(dslString)
+	if err != nil {
+		return nil, 0, LoggedError("FileTriggerRepo.GetTriggersByDslQuery failed: %s", err)
+	}
+	return db.search(search)
+}
+
+func (db *FileTriggerRepo) GetTriggersByEventTypeID(format *piazza.JsonPagination, id piazza.Ident, actor string) ([]Trigger, int64, error) {
+	return db.search(paginationSearch(termQuery("eventTypeId", id.String()), format))
+}
+
+func (db *FileTriggerRepo) search(search *dslSearch) ([]Trigger, int64, error) {
+	hits, totalHits, err := db.store.search([]string{keyTriggers}, search)
+	if err != nil {
+		return nil, 0, LoggedError("FileTriggerRepo.search failed: %s", err)
+	}
+	triggers := []Trigger{}
+	for _, hit := range hits {
+		var trigger Trigger
+		if err := json.Unmarshal(*hit, &trigger); err != nil {
+			return nil, 0, err
+		}
+		trigger.Condition = decodeCondition(trigger.Condition).(map[string]interface{})
+		triggers = append(triggers, trigger)
+	}
+	return triggers, totalHits, nil
+}
+
+func (db *FileTriggerRepo) GetOne(id piazza.Ident, actor string) (*Trigger, bool, error) {
+	src, version, found := db.store.getVersioned(keyTriggers, id.String())
+	if !found {
+		return nil, false, fmt.Errorf("FileTriggerRepo.GetOne failed: trigger %s does not exist", id)
+	}
+	var trigger Trigger
+	if err := json.Unmarshal(*src, &trigger); err != nil {
+		return nil, true, LoggedError("FileTriggerRepo.GetOne failed: %s", err)
+	}
+	trigger.Version = version
+	trigger.Condition = decodeCondition(trigger.Condition).(map[string]interface{})
+	return &trigger, true, nil
+}
+
+// GetTriggersByGeofenceID returns the triggers that refer to the geofence
+func (db *FileTriggerRepo) GetTriggersByGeofenceID(id piazza.Ident, actor string) ([]Trigger, error) {
+	return getTriggersByGeofenceID(db, id, actor)
+}
+
+func (db *FileTriggerRepo) DeleteTrigger(id piazza.Ident, version int64, actor string) (bool, error) {
+	trigger, found, err := db.GetOne(id, actor)
+	if !found {
+		return false, nil
+	}
+	if err != nil {
+		return found, err
+	}
+	if found, err = db.store.removeAt(keyTriggers, id.String(), version); err != nil || !found {
+		return found, err
+	}
+	found, err = db.service.eventDB.DeletePercolationQuery(trigger.PercolationID)
+	if err != nil {
+		return found, LoggedError("FileTriggerRepo.DeleteById percquery failed: %s", err)
+	}
+	return found, nil
+}
+
+func (db *FileTriggerRepo) itemExists(id piazza.Ident, actor string) (bool, error) {
+	return db.store.has(keyTriggers, id.String()), nil
+}
+
+//---------------------------------------------------------------------------
+
+// FileAlertRepo keeps Alerts in a FileStore
+type FileAlertRepo struct {
+	service *Service
+	store   *FileStore
+}
+
+func NewFileAlertRepo(service *Service, store *FileStore) *FileAlertRepo {
+	return &FileAlertRepo{service: service, store: store}
+}
+
+func (db *FileAlertRepo) PostData(alert *Alert) error {
+	// the store gives the version
+	alert.Version = 0
+	if err := db.store.write(keyAlerts, alert.AlertID.String(), alert, true); err != nil {
+		return LoggedError("FileAlertRepo.PostData failed: %s", err)
+	}
+	alert.Version = 1
+	return nil
+}
+
+func (db *FileAlertRepo) PutData(alert *Alert, version int64) error {
+	stored := *alert
+	stored.Version = 0
+	newVersion, err := db.store.writeAt(keyAlerts, alert.AlertID.String(), &stored, version)
+	if err == errVersionConflict {
+		return err
+	}
+	if err != nil {
+		return LoggedError("FileAlertRepo.PutData failed: %s", err)
+	}
+	alert.Version = newVersion
+	return nil
+}
+
+func (db *FileAlertRepo) GetAll(format *piazza.JsonPagination, actor string) ([]Alert, int64, error) {
+	return db.search(paginationSearch(nil, format))
+}
+
+func (db *FileAlertRepo) GetAlertsByDslQuery(dslString string, actor string) ([]Alert, int64, error) {
+	search, err := parseFileSearch(dslString)
+	if err != nil {
+		return nil, 0, LoggedError("FileAlertRepo.GetAlertsByDslQuery failed: %s", err)
+	}
+	return db.search(search)
+}
+
+func (db *FileAlertRepo) GetAllByTrigger(format *piazza.JsonPagination, triggerID piazza.Ident, actor string) ([]Alert, int64, error) {
+	return db.search(paginationSearch(termQuery("triggerId", triggerID.String()), format))
+}
+
+func (db *FileAlertRepo) search(search *dslSearch) ([]Alert, int64, error) {
+	hits, totalHits, err := db.store.search([]string{keyAlerts}, search)
+	if err != nil {
+		return nil, 0, LoggedError("FileAlertRepo.search failed: %s", err)
+	}
+	alerts := []Alert{}
+	for _, hit := range hits {
+		var alert Alert
+		if err := json.Unmarshal(*hit, &alert); err != nil {
+			return nil, 0, err
+		}
+		alerts = append(alerts, alert)
+	}
+	return alerts, totalHits, nil
+}
+
+func (db *FileAlertRepo) GetOne(id piazza.Ident, actor string) (*Alert, bool, error) {
+	src, version, found := db.store.getVersioned(keyAlerts, id.String())
+	if !found {
+		return nil, false, fmt.Errorf("FileAlertRepo.GetOne failed: alert %s does not exist", id)
+	}
+	var alert Alert
+	if err := json.Unmarshal(*src, &alert); err != nil {
+		return nil, true, err
+	}
+	alert.Version = version
+	return &alert, true, nil
+}
+
+func (db *FileAlertRepo) DeleteByID(id piazza.Ident, actor string) (bool, error) {
+	return db.deleteAtVersion(id, 0)
+}
+
+func (db *FileAlertRepo) deleteAtVersion(id piazza.Ident, version int64) (bool, error) {
+	found, err := db.store.removeAt(keyAlerts, id.String(), version)
+	if err == errVersionConflict {
+		return found, err
+	}
+	if err != nil {
+		return false, fmt.Errorf("FileAlertRepo.DeleteById failed: %s", err)
+	}
+	if !found {
+		return false, fmt.Errorf("FileAlertRepo.DeleteById failed: not found")
+	}
+	return true, nil
+}
+
+func (db *FileAlertRepo) DeleteByIDs(ids []piazza.Ident, actor string) (int, error) {
+	deleted, err := db.store.removeAll(keyAlerts, identStrings(ids))
+	if err != nil {
+		return 0, fmt.Errorf("FileAlertRepo.DeleteByIDs failed: %s", err)
+	}
+	return deleted, nil
+}
+
+func (db *FileAlertRepo) itemExists(id piazza.Ident, actor string) (bool, error) {
+	return db.store.has(keyAlerts, id.String()), nil
+}
+
+//---------------------------------------------------------------------------
+
+// FileCronRepo keeps the repeating Events in a FileStore
+type FileCronRepo struct {
+	service *Service
+	store   *FileStore
+}
+
+func NewFileCronRepo(service *Service, store *FileStore) *FileCronRepo {
+	return &FileCronRepo{service: service, store: store}
+}
+
+func (db *FileCronRepo) PostData(event *Event) error {
+	if err := db.store.write(keyCrons, event.EventID.String(), event, true); err != nil {
+		return LoggedError("FileCronRepo.PostData failed: %s", err)
+	}
+	return nil
+}
+
+func (db *FileCronRepo) GetAll(actor string) (*[]Event, error) {
+	events, _, err := db.GetPage(nil, actor)
+	if err != nil {
+		return nil, err
+	}
+	return &events, nil
+}
+
+func (db *FileCronRepo) GetPage(format *piazza.JsonPagination, actor string) ([]Event, int64, error) {
+	return db.search(paginationSearch(nil, format))
+}
+
+func (db *FileCronRepo) GetCronsByDslQuery(dslString string, actor string) ([]Event, int64, error) {
+	search, err := parseFileSearch(dslString)
+	if err != nil {
+		return nil, 0, LoggedError("FileCronRepo.GetCronsByDslQuery failed: %s", err)
+	}
+	return db.search(search)
+}
+
+func (db *FileCronRepo) search(search *dslSearch) ([]Event, int64, error) {
+	hits, totalHits, err := db.store.search([]string{keyCrons}, search)
+	if err != nil {
+		return nil, 0, LoggedError("FileCronRepo.search failed: %s", err)
+	}
+	events := []Event{}
+	for _, hit := range hits {
+		var event Event
+		if err := json.Unmarshal(*hit, &event); err != nil {
+			return nil, 0, LoggedError("FileCronRepo.search failed: %s", err)
+		}
+		events = append(events, event)
+	}
+	return events, totalHits, nil
+}
+
+// Exists is always true, as the store has nothing to set up
+func (db *FileCronRepo) Exists(actor string) (bool, error) {
+	return true, nil
+}
+
+func (db *FileCronRepo) DeleteByID(id piazza.Ident, actor string) (bool, error) {
+	found, err := db.store.remove(keyCrons, id.String())
+	if err != nil {
+		return false, LoggedError("FileCronRepo.DeleteById failed: %s", err)
+	}
+	return found, nil
+}
+
+func (db *FileCronRepo) itemExists(id piazza.Ident, actor string) (bool, error) {
+	return db.store.has(keyCrons, id.String()), nil
+}
+
+//---------------------------------------------------------------------------
+
+// FileOutboxRepo keeps the work a shutdown left unfinished in a FileStore
+type FileOutboxRepo struct {
+	service *Service
+	store   *FileStore
+}
+
+func NewFileOutboxRepo(service *Service, store *FileStore) *FileOutboxRepo {
+	return &FileOutboxRepo{service: service, store: store}
+}
+
+func (db *FileOutboxRepo) PostData(entry *OutboxEntry) error {
+	if err := db.store.write(keyOutbox, entry.EntryID.String(), entry, true); err != nil {
+		return LoggedError("FileOutboxRepo.PostData failed: %s", err)
+	}
+	return nil
+}
+
+func (db *FileOutboxRepo) GetAll(format *piazza.JsonPagination, actor string) ([]OutboxEntry, int64, error) {
+	hits, totalHits, err := db.store.search([]string{keyOutbox}, paginationSearch(nil, format))
+	if err != nil {
+		return nil, 0, LoggedError("FileOutboxRepo.GetAll failed: %s", err)
+	}
+	entries := []OutboxEntry{}
+	for _, hit := range hits {
+		var entry OutboxEntry
+		if err := json.Unmarshal(*hit, &entry); err != nil {
+			return nil, 0, LoggedError("FileOutboxRepo.GetAll failed: %s", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, totalHits, nil
+}
+
+func (db *FileOutboxRepo) DeleteByID(id piazza.Ident, actor string) (bool, error) {
+	found, err := db.store.remove(keyOutbox, id.String())
+	if err != nil {
+		return false, LoggedError("FileOutboxRepo.DeleteById failed: %s", err)
+	}
+	return found, nil
+}
+
+//---------------------------------------------------------------------------
+
+// FileACLRepo keeps the ACLs that have been set in a FileStore
+type FileACLRepo struct {
+	service *Service
+	store   *FileStore
+}
+
+func NewFileACLRepo(service *Service, store *FileStore) *FileACLRepo {
+	return &FileACLRepo{service: service, store: store}
+}
+
+func (db *FileACLRepo) PutData(acl *ACL) error {
+	if err := db.store.write(keyACLs, acl.ResourceID.String(), acl, false); err != nil {
+		return LoggedError("FileACLRepo.PutData failed: %s", err)
+	}
+	return nil
+}
+
+func (db *FileACLRepo) GetOne(id piazza.Ident) (*ACL, bool, error) {
+	src, found := db.store.get(keyACLs, id.String())
+	if !found {
+		return nil, false, nil
+	}
+	var acl ACL
+	if err := json.Unmarshal(*src, &acl); err != nil {
+		return nil, true, LoggedError("FileACLRepo.GetOne failed: %s", err)
+	}
+	return &acl, true, nil
+}
+
+func (db *FileACLRepo) DeleteByID(id piazza.Ident, actor string) (bool, error) {
+	found, err := db.store.remove(keyACLs, id.String())
+	if err != nil {
+		return false, LoggedError("FileACLRepo.DeleteById failed: %s", err)
+	}
+	return found, nil
+}
+
+//---------------------------------------------------------------------------
+
+// FileAuditRepo keeps the audit messages in a FileStore
+type FileAuditRepo struct {
+	service *Service
+	store   *FileStore
+}
+
+func NewFileAuditRepo(service *Service, store *FileStore) *FileAuditRepo {
+	return &FileAuditRepo{service: service, store: store}
+}
+
+func (db *FileAuditRepo) PostData(record *AuditRecord) error {
+	if err := db.store.write(keyAudit, record.AuditID.String(), record, true); err != nil {
+		return LoggedError("FileAuditRepo.PostData failed: %s", err)
+	}
+	return nil
+}
+
+func (db *FileAuditRepo) GetAuditByDslQuery(dslString string, actor string) ([]AuditRecord, int64, error) {
+	search, err := parseFileSearch(dslString)
+	if err != nil {
+		return nil, 0, LoggedError("FileAuditRepo.GetAuditByDslQuery failed: %s", err)
+	}
+	hits, totalHits, err := db.store.search([]string{keyAudit}, search)
+	if err != nil {
+		return nil, 0, LoggedError("FileAuditRepo.GetAuditByDslQuery failed: %s", err)
+	}
+	records := []AuditRecord{}
+	for _, hit := range hits {
+		var record AuditRecord
+		if err := json.Unmarshal(*hit, &record); err != nil {
+			return nil, 0, LoggedError("FileAuditRepo.GetAuditByDslQuery failed: %s", err)
+		}
+		records = append(records, record)
+	}
+	return records, totalHits, nil
+}
+
+//---------------------------------------------------------------------------
+
+// FileIndex is a MemIndex whose documents are kept in a FileStore too, one
+// collection per type named "<index>.<type>", for the resources workflow
+// keeps through an index rather than a repository: geofences, their states
+// and the stats. Its types are those it is made with.
+type FileIndex struct {
+	*MemIndex
+	store *FileStore
+	lock  sync.Mutex
+}
+
+// NewFileIndex makes the index, with the documents already in the store
+func NewFileIndex(store *FileStore, name string, types ...string) (*FileIndex, error) {
+	esi := &FileIndex{MemIndex: NewMemIndex(name), store: store}
+	if err := esi.MemIndex.Create(""); err != nil {
+		return nil, err
+	}
+	for _, typ := range types {
+		if err := esi.MemIndex.SetMapping(typ, "{}"); err != nil {
+			return nil, err
+		}
+		for id, doc := range store.documents(esi.collection(typ)) {
+			if _, err := esi.MemIndex.PostData(typ, id, doc); err != nil {
+				return nil, fmt.Errorf("FileIndex: %s %s: %s", esi.collection(typ), id, err)
+			}
+		}
+	}
+	return esi, nil
+}
+
+func (esi *FileIndex) collection(typ string) string {
+	return esi.IndexName() + "." + typ
+}
+
+func (esi *FileIndex) PostData(typ string, id string, obj interface{}) (*elasticsearch.IndexResponse, error) {
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+
+	old, _ := esi.MemIndex.GetByID(typ, id)
+	resp, err := esi.MemIndex.PostData(typ, id, obj)
+	if err != nil {
+		return nil, err
+	}
+	got, err := esi.MemIndex.GetByID(typ, resp.ID)
+	if err == nil {
+		err = esi.store.write(esi.collection(typ), resp.ID, got.Source, false)
+	}
+	if err != nil {
+		if old != nil && old.Found {
+			_, _ = esi.MemIndex.PostData(typ, id, old.Source)
+		} else {
+			_, _ = esi.MemIndex.DeleteByID(typ, resp.ID)
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (esi *FileIndex) PutData(typ string, id string, obj interface{}) (*elasticsearch.IndexResponse, error) {
+	return esi.PostData(typ, id, obj)
+}
+
+func (esi *FileIndex) DeleteByID(typ string, id string) (*elasticsearch.DeleteResponse, error) {
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+
+	resp, err := esi.MemIndex.DeleteByID(typ, id)
+	if err != nil {
+		return resp, err
+	}
+	if _, err = esi.store.remove(esi.collection(typ), id); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// DirectAccess writes out the type it changed
+func (esi *FileIndex) DirectAccess(verb string, endpoint string, input interface{}, output interface{}) error {
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+
+	if err := esi.MemIndex.DirectAccess(verb, endpoint, input, output); err != nil {
+		return err
+	}
+	// MemIndex takes /<index>/_search and GETs, which change nothing,
+	// /<index>/_mapping/<type> and /<index>/<type>/...
+	parts := strings.Split(strings.Trim(strings.SplitN(endpoint, "?", 2)[0], "/"), "/")
+	typ := parts[1]
+	if typ == "_search" || verb == "GET" {
+		return nil
+	}
+	if typ == "_mapping" {
+		typ = parts[2]
+	}
+	if exists, _ := esi.MemIndex.TypeExists(typ); !exists {
+		return esi.store.dropCollection(esi.collection(typ))
+	}
+	// all of it, which is not a search a window applies to
+	result, err := esi.MemIndex.search(typ, paginationSearch(nil, nil))
+	if err != nil {
+		return err
+	}
+	docs := map[string]json.RawMessage{}
+	for _, hit := range *result.GetHits() {
+		docs[hit.ID] = *hit.Source
+	}
+	return esi.store.replace(esi.collection(typ), docs)
+}
@@ -0,0 +1,413 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// FileStore keeps documents as JSON in a directory, one file per collection,
+// so that workflow can run without Elasticsearch. Collections are held in
+// memory, and every write rewrites its collection's file, which suits small
+// deployments and tests rather than large ones.
+type FileStore struct {
+	dir         string
+	lock        sync.Mutex
+	collections map[string]map[string]json.RawMessage
+}
+
+const fileStoreExt = ".json"
+
+// NewFileStore opens the store in dir, creating the directory if need be
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	store := &FileStore{dir: dir, collections: map[string]map[string]json.RawMessage{}}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), fileStoreExt) {
+			continue
+		}
+		name, err := url.PathUnescape(strings.TrimSuffix(file.Name(), fileStoreExt))
+		if err != nil {
+			return nil, fmt.Errorf("FileStore: %s is not a collection: %s", file.Name(), err)
+		}
+		byts, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		docs := map[string]json.RawMessage{}
+		if err = json.Unmarshal(byts, &docs); err != nil {
+			return nil, fmt.Errorf("FileStore: %s is corrupt: %s", file.Name(), err)
+		}
+		store.collections[name] = docs
+	}
+	return store, nil
+}
+
+// Dir is where the store keeps its files
+func (store *FileStore) Dir() string {
+	return store.dir
+}
+
+func (store *FileStore) path(collection string) string {
+	return filepath.Join(store.dir, url.PathEscape(collection)+fileStoreExt)
+}
+
+// save writes the collection to a temporary file and moves it into place,
+// so that a crash leaves either the old file or the new one
+func (store *FileStore) save(collection string) error {
+	byts, err := json.Marshal(store.collections[collection])
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(store.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(byts); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), store.path(collection))
+}
+
+// write stores the document, failing if it must be new and is not
+func (store *FileStore) write(collection string, id string, doc interface{}, create bool) error {
+	byts, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	docs, ok := store.collections[collection]
+	if !ok {
+		docs = map[string]json.RawMessage{}
+		store.collections[collection] = docs
+	}
+	old, exists := docs[id]
+	if create && exists {
+		return fmt.Errorf("document %s already exists in %s", id, collection)
+	}
+	docs[id] = json.RawMessage(byts)
+	if err = store.save(collection); err != nil {
+		if exists {
+			docs[id] = old
+		} else {
+			delete(docs, id)
+		}
+		return err
+	}
+	return nil
+}
+
+func (store *FileStore) get(collection string, id string) (*json.RawMessage, bool) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	doc, ok := store.collections[collection][id]
+	if !ok {
+		return nil, false
+	}
+	return &doc, true
+}
+
+func (store *FileStore) has(collection string, id string) bool {
+	_, ok := store.get(collection, id)
+	return ok
+}
+
+// fileVersionKey is where the store keeps the version of a document in the
+// document, as Elasticsearch keeps _version beside the source
+const fileVersionKey = "_version"
+
+// versionOf is the version of the stored document, which is 1 until it is
+// written with writeAt
+func versionOf(doc json.RawMessage) int64 {
+	var meta struct {
+		Version int64 `json:"_version"`
+	}
+	if err := json.Unmarshal(doc, &meta); err != nil || meta.Version == 0 {
+		return 1
+	}
+	return meta.Version
+}
+
+// getVersioned reads the document with its version
+func (store *FileStore) getVersioned(collection string, id string) (*json.RawMessage, int64, bool) {
+	doc, ok := store.get(collection, id)
+	if !ok {
+		return nil, 0, false
+	}
+	return doc, versionOf(*doc), true
+}
+
+// writeAt stores the document over the version of it, or over any if that
+// is 0, failing with errVersionConflict if it is at another, and says which
+// version it now is
+func (store *FileStore) writeAt(collection string, id string, doc interface{}, version int64) (int64, error) {
+	byts, err := json.Marshal(doc)
+	if err != nil {
+		return 0, err
+	}
+	fields := map[string]json.RawMessage{}
+	if err = json.Unmarshal(byts, &fields); err != nil {
+		return 0, err
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	docs, ok := store.collections[collection]
+	if !ok {
+		docs = map[string]json.RawMessage{}
+		store.collections[collection] = docs
+	}
+	old, exists := docs[id]
+	var current int64
+	if exists {
+		current = versionOf(old)
+	}
+	if version != 0 && version != current {
+		return 0, errVersionConflict
+	}
+	fields[fileVersionKey] = json.RawMessage(strconv.FormatInt(current+1, 10))
+	if byts, err = json.Marshal(fields); err != nil {
+		return 0, err
+	}
+	docs[id] = json.RawMessage(byts)
+	if err = store.save(collection); err != nil {
+		if exists {
+			docs[id] = old
+		} else {
+			delete(docs, id)
+		}
+		return 0, err
+	}
+	return current + 1, nil
+}
+
+func (store *FileStore) remove(collection string, id string) (bool, error) {
+	return store.removeAt(collection, id, 0)
+}
+
+// removeAt deletes the document at the version, or at any if that is 0,
+// failing with errVersionConflict if it is at another or gone
+func (store *FileStore) removeAt(collection string, id string, version int64) (bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	docs := store.collections[collection]
+	old, ok := docs[id]
+	if version != 0 && (!ok || versionOf(old) != version) {
+		return false, errVersionConflict
+	}
+	if !ok {
+		return false, nil
+	}
+	delete(docs, id)
+	if err := store.save(collection); err != nil {
+		docs[id] = old
+		return false, err
+	}
+	return true, nil
+}
+
+// removeAll deletes the documents there are of those named, writing the
+// collection once, and says how many there were
+func (store *FileStore) removeAll(collection string, ids []string) (int, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	docs := store.collections[collection]
+	old := map[string]json.RawMessage{}
+	for _, id := range ids {
+		if doc, ok := docs[id]; ok {
+			old[id] = doc
+			delete(docs, id)
+		}
+	}
+	if len(old) == 0 {
+		return 0, nil
+	}
+	if err := store.save(collection); err != nil {
+		for id, doc := range old {
+			docs[id] = doc
+		}
+		return 0, err
+	}
+	return len(old), nil
+}
+
+// documents copies out the documents of the collection, by id
+func (store *FileStore) documents(collection string) map[string]json.RawMessage {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	docs := map[string]json.RawMessage{}
+	for id, doc := range store.collections[collection] {
+		docs[id] = doc
+	}
+	return docs
+}
+
+// replace puts docs in place of all that the collection holds
+func (store *FileStore) replace(collection string, docs map[string]json.RawMessage) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	old, existed := store.collections[collection]
+	store.collections[collection] = docs
+	if err := store.save(collection); err != nil {
+		if existed {
+			store.collections[collection] = old
+		} else {
+			delete(store.collections, collection)
+		}
+		return err
+	}
+	return nil
+}
+
+func (store *FileStore) collectionExists(collection string) bool {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	_, ok := store.collections[collection]
+	return ok
+}
+
+// createCollection makes an empty collection, if there is none
+func (store *FileStore) createCollection(collection string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if _, ok := store.collections[collection]; ok {
+		return nil
+	}
+	store.collections[collection] = map[string]json.RawMessage{}
+	if err := store.save(collection); err != nil {
+		delete(store.collections, collection)
+		return err
+	}
+	return nil
+}
+
+// dropCollection deletes the collection with its documents
+func (store *FileStore) dropCollection(collection string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if _, ok := store.collections[collection]; !ok {
+		return nil
+	}
+	if err := os.Remove(store.path(collection)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(store.collections, collection)
+	return nil
+}
+
+// collectionsWithPrefix are the names of the collections starting with prefix,
+// in order
+func (store *FileStore) collectionsWithPrefix(prefix string) []string {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	names := []string{}
+	for name := range store.collections {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// search runs the search over the collections, returning the page of
+// documents it asks for and the number that matched
+func (store *FileStore) search(collections []string, search *dslSearch) ([]*json.RawMessage, int64, error) {
+	store.lock.Lock()
+	docs := []dslDoc{}
+	raw := []json.RawMessage{}
+	for _, collection := range collections {
+		for id, byts := range store.collections[collection] {
+			source := map[string]interface{}{}
+			if err := json.Unmarshal(byts, &source); err != nil {
+				store.lock.Unlock()
+				return nil, 0, err
+			}
+			docs = append(docs, dslDoc{id: id, source: source, ref: len(raw)})
+			raw = append(raw, byts)
+		}
+	}
+	store.lock.Unlock()
+
+	hits, totalHits, err := search.run(docs)
+	if err != nil {
+		return nil, 0, err
+	}
+	out := make([]*json.RawMessage, len(hits))
+	for i, hit := range hits {
+		out[i] = &raw[hit.ref]
+	}
+	return out, totalHits, nil
+}
+
+// paginationSearch is the search for one page of the documents the query
+// matches, or for all of them if there is no format
+func paginationSearch(query interface{}, format *piazza.JsonPagination) *dslSearch {
+	if query == nil {
+		query = map[string]interface{}{"match_all": map[string]interface{}{}}
+	}
+	search := &dslSearch{query: query, size: -1}
+	if format == nil {
+		return search
+	}
+	search.from = format.Page * format.PerPage
+	search.size = format.PerPage
+	if format.SortBy != "" {
+		search.sort = []dslSort{{field: format.SortBy, desc: format.Order == piazza.SortOrderDescending}}
+	}
+	return search
+}
+
+// termQuery is {"term": {field: value}}
+func termQuery(field string, value interface{}) map[string]interface{} {
+	return map[string]interface{}{"term": map[string]interface{}{field: value}}
+}
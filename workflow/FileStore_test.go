@@ -0,0 +1,314 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+type FileStoreTester struct {
+	suite.Suite
+	sys *piazza.SystemConfig
+}
+
+func (suite *FileStoreTester) SetupSuite() {
+}
+
+func (suite *FileStoreTester) TearDownSuite() {
+}
+
+//---------------------------------------------------------------------------
+
+func (suite *FileStoreTester) Test50Query() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	var source map[string]interface{}
+	assert.NoError(json.Unmarshal([]byte(`{
+		"name": "Quick Brown Fox",
+		"num": 17,
+		"createdOn": "2016-08-01T12:00:00Z",
+		"tags": ["a", "b"],
+		"data": {"where": {"lat": 10, "lon": 20}, "items": [{"n": 1}, {"n": 2}]}
+	}`), &source))
+	doc := dslDoc{id: "x", source: source}
+
+	matches := func(query string) bool {
+		var q interface{}
+		assert.NoError(json.Unmarshal([]byte(query), &q))
+		ok, err := dslMatches(q, doc)
+		assert.NoError(err, query)
+		return ok
+	}
+
+	assert.True(matches(`{"match_all": {}}`))
+	assert.True(matches(`{"term": {"num": 17}}`))
+	assert.True(matches(`{"term": {"tags": "b"}}`))
+	assert.True(matches(`{"match": {"name": "fox jumps"}}`))
+	assert.False(matches(`{"match": {"name": {"query": "fox jumps", "operator": "and"}}}`))
+	assert.True(matches(`{"match_phrase": {"name": "brown fox"}}`))
+	assert.True(matches(`{"range": {"num": {"gt": 16, "lte": 17}}}`))
+	assert.False(matches(`{"range": {"createdOn": {"gte": "2016-09-01T00:00:00Z"}}}`))
+	assert.True(matches(`{"term": {"data.items.n": 2}}`))
+	assert.True(matches(`{"bool": {"must": {"exists": {"field": "tags"}}, "must_not": {"ids": {"values": ["y"]}}}}`))
+	assert.False(matches(`{"bool": {"should": [{"term": {"num": 1}}, {"term": {"num": 2}}]}}`))
+	assert.True(matches(`{"geo_distance": {"distance": "200km", "data.where": {"lat": 11, "lon": 20}}}`))
+	assert.False(matches(`{"geo_distance": {"distance": "100km", "data.where": {"lat": 11, "lon": 20}}}`))
+	assert.True(matches(`{"geo_bounding_box": {"data.where": {"top_left": [19, 11], "bottom_right": [21, 9]}}}`))
+	assert.True(matches(`{"query": {"wildcard": {"name": "Quick*"}}}`))
+
+	var q interface{}
+	assert.NoError(json.Unmarshal([]byte(`{"fuzzy": {"name": "fx"}}`), &q))
+	_, err := dslMatches(q, doc)
+	assert.Error(err)
+}
+
+func (suite *FileStoreTester) Test51FileStore() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "pzworkflow")
+	assert.NoError(err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	store, err := NewFileStore(dir)
+	assert.NoError(err)
+	service := &Service{}
+	err = service.InitEmbedded(suite.sys, &pzsyslog.NilWriter{}, &pzsyslog.NilWriter{}, store, "123456")
+	assert.NoError(err)
+
+	// the system's eventTypes, and ours
+	eventTypes, total, err := service.eventTypeDB.GetAll(&piazza.JsonPagination{PerPage: 10}, "test")
+	assert.NoError(err)
+	assert.EqualValues(2, total)
+	assert.Len(eventTypes, 2)
+
+	name := makeTestEventTypeName()
+	resp := service.PostEventType(&EventType{Name: name, Mapping: map[string]interface{}{"num": "integer", "str": "string"}, CreatedBy: "test"})
+	assert.Equal(201, resp.StatusCode, resp.Message)
+	eventType := resp.Data.(*EventType)
+	resp = service.PostEventType(&EventType{Name: name, Mapping: map[string]interface{}{"num": "integer"}, CreatedBy: "test"})
+	assert.Equal(400, resp.StatusCode)
+
+	trigger := makeTestTrigger([]piazza.Ident{eventType.EventTypeID})
+	trigger.Condition = map[string]interface{}{"match": map[string]interface{}{"data.num": 17}}
+	resp = service.PostTrigger(trigger)
+	assert.Equal(201, resp.StatusCode, resp.Message)
+	triggerID := resp.Data.(*Trigger).TriggerID
+
+	// percolation is evaluated by the store
+	resp = service.TestTrigger(triggerID, &Event{EventTypeID: eventType.EventTypeID, Data: map[string]interface{}{"num": 17, "str": "a"}}, "test")
+	assert.Equal(200, resp.StatusCode, resp.Message)
+	assert.True(resp.Data.(*TriggerTestResult).Matched)
+	resp = service.TestTrigger(triggerID, &Event{EventTypeID: eventType.EventTypeID, Data: map[string]interface{}{"num": 18, "str": "a"}}, "test")
+	assert.False(resp.Data.(*TriggerTestResult).Matched)
+
+	eventIDs := []piazza.Ident{}
+	for _, num := range []int{18, 19, 20} {
+		resp = service.PostEvent(&Event{EventTypeID: eventType.EventTypeID, Data: map[string]interface{}{"num": num, "str": "b"}, CreatedBy: "test"}, nil)
+		assert.Equal(201, resp.StatusCode, resp.Message)
+		eventIDs = append(eventIDs, resp.Data.(*Event).EventID)
+	}
+	resp = service.PostEvent(&Event{EventTypeID: eventType.EventTypeID, Data: map[string]interface{}{"num": 21}, CreatedBy: "test"}, nil)
+	assert.Equal(400, resp.StatusCode)
+
+	events, total, err := service.eventDB.GetEventsByDslQuery(name, `{"query": {"range": {"data.`+name+`.num": {"gte": 19}}}, "sort": [{"data.`+name+`.num": "desc"}]}`, "test")
+	assert.NoError(err)
+	assert.EqualValues(2, total)
+	assert.Len(events, 2)
+	assert.Equal(eventIDs[2], events[0].EventID)
+	events, total, err = service.eventDB.GetAll(name, &piazza.JsonPagination{PerPage: 2, Page: 1, SortBy: "eventId", Order: piazza.SortOrderAscending}, "test")
+	assert.NoError(err)
+	assert.EqualValues(3, total)
+	assert.Len(events, 1)
+	_, _, err = service.eventDB.GetAll("nosuchtype", nil, "test")
+	assert.Error(err)
+
+	// everything is there after a restart
+	reopened, err := NewFileStore(dir)
+	assert.NoError(err)
+	eventDB := NewFileEventRepo(service, reopened)
+	events, total, err = eventDB.GetEventsByEventTypeID(&piazza.JsonPagination{PerPage: 10}, name, eventType.EventTypeID, "test")
+	assert.NoError(err)
+	assert.EqualValues(3, total)
+	mapping, err := eventDB.lookupEventTypeNameByEventID(eventIDs[0], "test")
+	assert.NoError(err)
+	assert.Equal(name, mapping)
+	got, found, err := NewFileTriggerRepo(service, reopened).GetOne(triggerID, "test")
+	assert.NoError(err)
+	assert.True(found)
+	assert.EqualValues(map[string]interface{}{"match": map[string]interface{}{"data.num": 17.0}}, got.Condition)
+	statsIndex, err := NewFileIndex(reopened, keyStats, EventTypeHourDBMapping, TriggerStatsDBMapping)
+	assert.NoError(err)
+	statsDB, err := NewStatsDB(service, statsIndex)
+	assert.NoError(err)
+	hours, err := statsDB.GetEventTypeHours(eventType.EventTypeID, time.Now().Add(-time.Hour), time.Now())
+	assert.NoError(err)
+	counted := int64(0)
+	for _, hour := range hours {
+		counted += hour.Events
+	}
+	assert.EqualValues(3, counted)
+
+	// the store keeps the versions, and writes only over the one asked for
+	assert.EqualValues(1, got.Version)
+	resp = service.PutTrigger(triggerID, &TriggerUpdate{Enabled: true}, VersionETag(1), "test")
+	assert.Equal(200, resp.StatusCode, resp.Message)
+	resp = service.PutTrigger(triggerID, &TriggerUpdate{Enabled: false}, VersionETag(1), "test")
+	assert.Equal(412, resp.StatusCode)
+	_, err = service.triggerDB.PutTrigger(got, &TriggerUpdate{Enabled: false}, 1, "test")
+	assert.Equal(errVersionConflict, err)
+	_, err = service.triggerDB.DeleteTrigger(triggerID, 1, "test")
+	assert.Equal(errVersionConflict, err)
+
+	// deleting the trigger takes its percolation query with it
+	resp = service.DeleteTrigger(triggerID, "", "pz-workflow")
+	assert.Equal(200, resp.StatusCode, resp.Message)
+	ids, err := service.eventDB.PercolateEventData(name, map[string]interface{}{name: map[string]interface{}{"num": 17}}, "", "test")
+	assert.NoError(err)
+	assert.Len(*ids, 0)
+
+	// in bulk, with one write of the collection
+	deleted, err := service.eventDB.DeleteByIDs(name, []piazza.Ident{eventIDs[0], eventIDs[1], "nonsense"}, "test")
+	assert.NoError(err)
+	assert.Equal(2, deleted)
+	_, total, err = service.eventDB.GetAll(name, nil, "test")
+	assert.NoError(err)
+	assert.EqualValues(1, total)
+
+	assert.NoError(service.eventDB.RemoveMapping(name, "test"))
+	exists, err := service.eventDB.NameExists(name, "test")
+	assert.NoError(err)
+	assert.False(exists)
+}
+
+func (suite *FileStoreTester) Test52ExportPages() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	esi := NewMemIndex("pages")
+	assert.NoError(esi.Create(""))
+	esi.window = 2 * exportPerPage
+	const count = 3*exportPerPage + 7
+	for i := 0; i < count; i++ {
+		id := fmt.Sprintf("doc-%04d", i)
+		_, err := esi.PostData("things", id, map[string]interface{}{"thingId": id})
+		assert.NoError(err)
+	}
+
+	// from and size stop at the window
+	_, err := esi.FilterByMatchAll("things", &piazza.JsonPagination{Page: 2, PerPage: exportPerPage})
+	assert.Error(err)
+
+	// paging after the last one seen does not, by a field or by _uid
+	for _, sortBy := range []string{"thingId", "_uid"} {
+		ids := []string{}
+		err = exportPages(sortBy, nil, func(dsl string) (int, string, error) {
+			resp, err := esi.SearchByJSON("things", dsl)
+			if err != nil {
+				return 0, "", err
+			}
+			last := ""
+			for _, hit := range *resp.GetHits() {
+				ids = append(ids, hit.ID)
+				last = hit.ID
+				if sortBy == "_uid" {
+					last = "things#" + hit.ID
+				}
+			}
+			return resp.NumHits(), last, nil
+		})
+		assert.NoError(err, sortBy)
+		assert.Len(ids, count, sortBy)
+		for i, id := range ids {
+			assert.Equal(fmt.Sprintf("doc-%04d", i), id, sortBy)
+		}
+	}
+
+	// and a query narrows every page
+	ids := []string{}
+	err = exportPages("thingId", map[string]interface{}{"prefix": map[string]interface{}{"thingId": "doc-01"}}, func(dsl string) (int, string, error) {
+		resp, err := esi.SearchByJSON("things", dsl)
+		if err != nil {
+			return 0, "", err
+		}
+		last := ""
+		for _, hit := range *resp.GetHits() {
+			ids = append(ids, hit.ID)
+			last = hit.ID
+		}
+		return resp.NumHits(), last, nil
+	})
+	assert.NoError(err)
+	assert.Len(ids, exportPerPage)
+}
+
+func (suite *FileStoreTester) Test53ExpiredPages() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	esi := NewMemIndex("expired")
+	assert.NoError(esi.Create(""))
+	esi.window = 2 * exportPerPage
+	const count = 3*exportPerPage + 7
+	now := time.Now().UTC().Truncate(time.Second)
+	for i := 0; i < count; i++ {
+		// in threes to the second, so that a page can end within one
+		createdOn := piazza.TimeStamp(now.Add(-time.Duration(i/3) * time.Second))
+		id := fmt.Sprintf("doc-%04d", i)
+		_, err := esi.PostData("things", id, map[string]interface{}{"thingId": id, "createdOn": createdOn})
+		assert.NoError(err)
+	}
+
+	expired, err := expiredPages("thingId", map[string]interface{}{"match_all": map[string]interface{}{}}, "", 50, now, func(dsl string) ([]piazza.Ident, []piazza.TimeStamp, error) {
+		resp, err := esi.SearchByJSON("things", dsl)
+		if err != nil {
+			return nil, nil, err
+		}
+		ids, createdOn := []piazza.Ident{}, []piazza.TimeStamp{}
+		for _, hit := range *resp.GetHits() {
+			var thing struct {
+				ThingID   piazza.Ident     `json:"thingId"`
+				CreatedOn piazza.TimeStamp `json:"createdOn"`
+			}
+			if err = json.Unmarshal(*hit.Source, &thing); err != nil {
+				return nil, nil, err
+			}
+			ids = append(ids, thing.ThingID)
+			createdOn = append(createdOn, thing.CreatedOn)
+		}
+		return ids, createdOn, nil
+	})
+	assert.NoError(err)
+	assert.Len(expired, count-50)
+	seen := map[piazza.Ident]bool{}
+	for _, id := range expired {
+		assert.False(seen[id], id)
+		seen[id] = true
+	}
+	// the newest fifty are kept, by createdOn and then by id, both descending
+	for i := 0; i < 51; i++ {
+		assert.Equal(i == 48, seen[piazza.Ident(fmt.Sprintf("doc-%04d", i))], i)
+	}
+}
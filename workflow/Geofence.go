@@ -0,0 +1,808 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// geofenceFieldBbox is the pseudo-field used when the location of an event
+// is given by the minX/minY/maxX/maxY variables, as in piazza:ingest
+const geofenceFieldBbox = "minX,minY,maxX,maxY"
+
+// geoPoint is a position, x being longitude and y latitude
+type geoPoint struct {
+	x, y float64
+}
+
+type geoRing []geoPoint
+
+// geoPolygon is an outer ring followed by zero or more holes
+type geoPolygon []geoRing
+
+// geoShape is the location of an event, flattened into what the
+// relation tests need: its vertices, its edges and any areas it encloses
+type geoShape struct {
+	points   []geoPoint
+	edges    [][2]geoPoint
+	polygons []geoPolygon
+}
+
+//------------------------------------------------------------------------------
+
+func isValidGeofenceRelation(relation string) bool {
+	switch relation {
+	case GeofenceRelationEnter, GeofenceRelationExit, GeofenceRelationInside, GeofenceRelationIntersects:
+		return true
+	}
+	return false
+}
+
+// parseGeofenceGeometry reads a GeoJSON Polygon or MultiPolygon
+func parseGeofenceGeometry(geometry map[string]interface{}) ([]geoPolygon, error) {
+	typ, _ := geometry["type"].(string)
+	coords, ok := geometry["coordinates"].([]interface{})
+	if !ok {
+		return nil, errors.New("geometry has no coordinates")
+	}
+
+	switch strings.ToLower(typ) {
+	case "polygon":
+		polygon, err := parseGeoPolygon(coords)
+		if err != nil {
+			return nil, err
+		}
+		return []geoPolygon{polygon}, nil
+	case "multipolygon":
+		polygons := []geoPolygon{}
+		for _, c := range coords {
+			arr, ok := c.([]interface{})
+			if !ok {
+				return nil, errors.New("MultiPolygon member is not an array")
+			}
+			polygon, err := parseGeoPolygon(arr)
+			if err != nil {
+				return nil, err
+			}
+			polygons = append(polygons, polygon)
+		}
+		if len(polygons) == 0 {
+			return nil, errors.New("MultiPolygon has no members")
+		}
+		return polygons, nil
+	}
+	return nil, fmt.Errorf("geometry type [%s] is not Polygon or MultiPolygon", typ)
+}
+
+func parseGeoPolygon(coords []interface{}) (geoPolygon, error) {
+	if len(coords) == 0 {
+		return nil, errors.New("Polygon has no rings")
+	}
+	polygon := geoPolygon{}
+	for _, c := range coords {
+		arr, ok := c.([]interface{})
+		if !ok {
+			return nil, errors.New("Polygon ring is not an array")
+		}
+		ring, err := parseGeoPositions(arr)
+		if err != nil {
+			return nil, err
+		}
+		if len(ring) < 4 || ring[0] != ring[len(ring)-1] {
+			return nil, errors.New("Polygon ring must be closed and have at least four positions")
+		}
+		distinct := map[geoPoint]bool{}
+		for _, p := range ring {
+			if p.x < -180 || p.x > 180 || p.y < -90 || p.y > 90 {
+				return nil, fmt.Errorf("position [%v, %v] is out of range", p.x, p.y)
+			}
+			distinct[p] = true
+		}
+		if len(distinct) < 3 {
+			return nil, errors.New("Polygon ring must have at least three distinct positions")
+		}
+		polygon = append(polygon, ring)
+	}
+	return polygon, nil
+}
+
+func parseGeoPositions(coords []interface{}) ([]geoPoint, error) {
+	points := []geoPoint{}
+	for _, c := range coords {
+		point, err := parseGeoPosition(c)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, point)
+	}
+	return points, nil
+}
+
+// parseGeoPosition reads a GeoJSON [lon, lat] position
+func parseGeoPosition(v interface{}) (geoPoint, error) {
+	arr, ok := v.([]interface{})
+	if !ok || len(arr) < 2 {
+		return geoPoint{}, fmt.Errorf("position %v is not a [lon, lat] array", v)
+	}
+	x, err := toFloat(arr[0])
+	if err != nil {
+		return geoPoint{}, err
+	}
+	y, err := toFloat(arr[1])
+	if err != nil {
+		return geoPoint{}, err
+	}
+	return geoPoint{x: x, y: y}, nil
+}
+
+func toFloat(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case float64:
+		return n, nil
+	case float32:
+		return float64(n), nil
+	case int:
+		return float64(n), nil
+	case int64:
+		return float64(n), nil
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(n), 64)
+	}
+	return 0, fmt.Errorf("value %v is not a number", v)
+}
+
+//------------------------------------------------------------------------------
+
+// parseGeoPointValue reads any of the forms Elasticsearch accepts for a
+// geo_point, other than geohashes: {"lat":..,"lon":..}, "lat,lon" and [lon, lat]
+func parseGeoPointValue(v interface{}) (*geoShape, error) {
+	var point geoPoint
+	switch p := v.(type) {
+	case map[string]interface{}:
+		lat, err := toFloat(p["lat"])
+		if err != nil {
+			return nil, err
+		}
+		lon, err := toFloat(p["lon"])
+		if err != nil {
+			return nil, err
+		}
+		point = geoPoint{x: lon, y: lat}
+	case string:
+		parts := strings.Split(p, ",")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("geo_point [%s] is not of the form \"lat,lon\"", p)
+		}
+		lat, err := toFloat(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		lon, err := toFloat(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		point = geoPoint{x: lon, y: lat}
+	case []interface{}:
+		var err error
+		if point, err = parseGeoPosition(p); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("geo_point %v is not in a supported form", v)
+	}
+	return &geoShape{points: []geoPoint{point}}, nil
+}
+
+// parseGeoShapeValue reads a GeoJSON geometry, or an Elasticsearch envelope
+func parseGeoShapeValue(v interface{}) (*geoShape, error) {
+	geometry, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("geo_shape %v is not an object", v)
+	}
+	typ, _ := geometry["type"].(string)
+	coords, ok := geometry["coordinates"].([]interface{})
+	if !ok {
+		return nil, errors.New("geo_shape has no coordinates")
+	}
+
+	shape := &geoShape{}
+	switch strings.ToLower(typ) {
+	case "point":
+		point, err := parseGeoPosition(coords)
+		if err != nil {
+			return nil, err
+		}
+		shape.points = append(shape.points, point)
+	case "multipoint":
+		points, err := parseGeoPositions(coords)
+		if err != nil {
+			return nil, err
+		}
+		shape.points = append(shape.points, points...)
+	case "linestring":
+		points, err := parseGeoPositions(coords)
+		if err != nil {
+			return nil, err
+		}
+		shape.addLine(points)
+	case "multilinestring":
+		for _, c := range coords {
+			arr, ok := c.([]interface{})
+			if !ok {
+				return nil, errors.New("MultiLineString member is not an array")
+			}
+			points, err := parseGeoPositions(arr)
+			if err != nil {
+				return nil, err
+			}
+			shape.addLine(points)
+		}
+	case "polygon", "multipolygon":
+		polygons, err := parseGeofenceGeometry(geometry)
+		if err != nil {
+			return nil, err
+		}
+		for _, polygon := range polygons {
+			shape.addPolygon(polygon)
+		}
+	case "envelope":
+		corners, err := parseGeoPositions(coords)
+		if err != nil {
+			return nil, err
+		}
+		if len(corners) != 2 {
+			return nil, errors.New("envelope must have exactly two corners")
+		}
+		shape.addPolygon(geoRectangle(corners[0].x, corners[1].y, corners[1].x, corners[0].y))
+	default:
+		return nil, fmt.Errorf("geo_shape type [%s] is not supported", typ)
+	}
+	return shape, nil
+}
+
+// geoBbox is the [minX, minY, maxX, maxY] of a set of points, or nil if there are none
+func geoBbox(points []geoPoint) []float64 {
+	if len(points) == 0 {
+		return nil
+	}
+	bbox := []float64{points[0].x, points[0].y, points[0].x, points[0].y}
+	for _, p := range points[1:] {
+		bbox[0] = math.Min(bbox[0], p.x)
+		bbox[1] = math.Min(bbox[1], p.y)
+		bbox[2] = math.Max(bbox[2], p.x)
+		bbox[3] = math.Max(bbox[3], p.y)
+	}
+	return bbox
+}
+
+func geoPolygonsBbox(polygons []geoPolygon) []float64 {
+	points := []geoPoint{}
+	for _, polygon := range polygons {
+		points = append(points, polygon[0]...)
+	}
+	return geoBbox(points)
+}
+
+func geoBboxesOverlap(a, b []float64) bool {
+	return a[0] <= b[2] && b[0] <= a[2] && a[1] <= b[3] && b[1] <= a[3]
+}
+
+func geoRectangle(minX, minY, maxX, maxY float64) geoPolygon {
+	return geoPolygon{geoRing{
+		{minX, minY}, {maxX, minY}, {maxX, maxY}, {minX, maxY}, {minX, minY},
+	}}
+}
+
+func (shape *geoShape) addLine(points []geoPoint) {
+	shape.points = append(shape.points, points...)
+	for i := 1; i < len(points); i++ {
+		shape.edges = append(shape.edges, [2]geoPoint{points[i-1], points[i]})
+	}
+}
+
+func (shape *geoShape) addPolygon(polygon geoPolygon) {
+	for _, ring := range polygon {
+		shape.addLine(ring)
+	}
+	shape.polygons = append(shape.polygons, polygon)
+}
+
+//------------------------------------------------------------------------------
+
+func (ring geoRing) contains(p geoPoint) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a.y > p.y) != (b.y > p.y) && p.x < (b.x-a.x)*(p.y-a.y)/(b.y-a.y)+a.x {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+func (polygon geoPolygon) contains(p geoPoint) bool {
+	if !polygon[0].contains(p) {
+		return false
+	}
+	for _, hole := range polygon[1:] {
+		if hole.contains(p) {
+			return false
+		}
+	}
+	return true
+}
+
+func geoPolygonsContain(polygons []geoPolygon, p geoPoint) bool {
+	for _, polygon := range polygons {
+		if polygon.contains(p) {
+			return true
+		}
+	}
+	return false
+}
+
+func geoOrientation(a, b, c geoPoint) float64 {
+	return (b.x-a.x)*(c.y-a.y) - (b.y-a.y)*(c.x-a.x)
+}
+
+func geoSegmentsCross(p1, p2, q1, q2 geoPoint) bool {
+	d1 := geoOrientation(q1, q2, p1)
+	d2 := geoOrientation(q1, q2, p2)
+	d3 := geoOrientation(p1, p2, q1)
+	d4 := geoOrientation(p1, p2, q2)
+	return ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) &&
+		((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0))
+}
+
+func geoEdgesCross(shape *geoShape, fence []geoPolygon) bool {
+	for _, edge := range shape.edges {
+		for _, polygon := range fence {
+			for _, ring := range polygon {
+				for i := 1; i < len(ring); i++ {
+					if geoSegmentsCross(edge[0], edge[1], ring[i-1], ring[i]) {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// geofenceContains is true if the shape lies entirely within the fence
+func geofenceContains(fence []geoPolygon, shape *geoShape) bool {
+	if len(shape.points) == 0 {
+		return false
+	}
+	for _, p := range shape.points {
+		if !geoPolygonsContain(fence, p) {
+			return false
+		}
+	}
+	return !geoEdgesCross(shape, fence)
+}
+
+// geofenceIntersects is true if the shape and the fence share any area
+func geofenceIntersects(fence []geoPolygon, shape *geoShape) bool {
+	for _, p := range shape.points {
+		if geoPolygonsContain(fence, p) {
+			return true
+		}
+	}
+	for _, polygon := range fence {
+		if geoPolygonsContain(shape.polygons, polygon[0][0]) {
+			return true
+		}
+	}
+	return geoEdgesCross(shape, fence)
+}
+
+//------------------------------------------------------------------------------
+
+// resolveGeofenceField picks the variable of the (un-nested) EventType mapping
+// that holds an event's location, and tells whether it is a geo_point, a
+// geo_shape or an ingest bounding box
+func resolveGeofenceField(field string, mapping map[string]interface{}) (string, string, error) {
+	vars, err := piazza.GetVarsFromStruct(mapping)
+	if err != nil {
+		return "", "", err
+	}
+	isGeo := func(typ interface{}) bool {
+		s := fmt.Sprint(typ)
+		return s == string(elasticsearch.MappingElementTypeGeoPoint) || s == string(elasticsearch.MappingElementTypeGeoShape)
+	}
+
+	if field != "" {
+		if field == geofenceFieldBbox {
+			if !hasBboxVars(vars) {
+				return "", "", errors.New("eventType has no minX/minY/maxX/maxY variables")
+			}
+			return field, geofenceFieldBbox, nil
+		}
+		typ, ok := vars[field]
+		if !ok || !isGeo(typ) {
+			return "", "", fmt.Errorf("field [%s] is not a geo_point or geo_shape variable of the eventType", field)
+		}
+		return field, fmt.Sprint(typ), nil
+	}
+
+	keys := []string{}
+	for k, typ := range vars {
+		if isGeo(typ) {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) > 0 {
+		sort.Strings(keys)
+		return keys[0], fmt.Sprint(vars[keys[0]]), nil
+	}
+	if hasBboxVars(vars) {
+		return geofenceFieldBbox, geofenceFieldBbox, nil
+	}
+	return "", "", errors.New("eventType has no geo_point, geo_shape or bounding box variables")
+}
+
+func hasBboxVars(vars map[string]interface{}) bool {
+	for _, k := range []string{"minX", "minY", "maxX", "maxY"} {
+		if _, ok := vars[k]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// getDataValue follows a dotted path into (un-nested) event data
+func getDataValue(data map[string]interface{}, path string) (interface{}, bool) {
+	var cur interface{} = data
+	for _, part := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// eventLocation extracts the location of an event from its (un-nested) data
+func eventLocation(data map[string]interface{}, field string, kind string) (*geoShape, error) {
+	if kind == geofenceFieldBbox {
+		bounds := make([]float64, 4)
+		for i, k := range []string{"minX", "minY", "maxX", "maxY"} {
+			v, ok := data[k]
+			if !ok {
+				return nil, fmt.Errorf("event has no [%s] value", k)
+			}
+			f, err := toFloat(v)
+			if err != nil {
+				return nil, err
+			}
+			bounds[i] = f
+		}
+		shape := &geoShape{}
+		shape.addPolygon(geoRectangle(bounds[0], bounds[1], bounds[2], bounds[3]))
+		return shape, nil
+	}
+
+	v, ok := getDataValue(data, field)
+	if !ok {
+		return nil, fmt.Errorf("event has no [%s] value", field)
+	}
+	if kind == string(elasticsearch.MappingElementTypeGeoShape) {
+		return parseGeoShapeValue(v)
+	}
+	return parseGeoPointValue(v)
+}
+
+//------------------------------------------------------------------------------
+
+func (service *Service) validateGeofenceCondition(cond *GeofenceCondition, eventType *EventType) error {
+	if !isValidGeofenceRelation(cond.Relation) {
+		return fmt.Errorf("geofence relation [%s] must be one of enter, exit, inside or intersects", cond.Relation)
+	}
+	if cond.GeofenceID == "" {
+		return errors.New("geofence condition has no geofenceId")
+	}
+	if _, found, err := service.geofenceDB.GetOne(cond.GeofenceID, "pz-workflow"); !found || err != nil {
+		return fmt.Errorf("geofence %s could not be found", cond.GeofenceID)
+	}
+
+	mapping := service.removeUniqueParams(eventType.typeName(), eventType.Mapping)
+	if _, _, err := resolveGeofenceField(cond.Field, mapping); err != nil {
+		return err
+	}
+
+	if cond.Relation == GeofenceRelationEnter || cond.Relation == GeofenceRelationExit {
+		if cond.EntityKey == "" {
+			return fmt.Errorf("geofence relation [%s] requires an entityKey", cond.Relation)
+		}
+		vars, err := piazza.GetVarsFromStruct(mapping)
+		if err != nil {
+			return err
+		}
+		if _, ok := vars[cond.EntityKey]; !ok {
+			return fmt.Errorf("entityKey [%s] is not a variable of the eventType", cond.EntityKey)
+		}
+	}
+	return nil
+}
+
+// evaluateGeofence decides whether the geofence condition of the trigger
+// holds for the (un-nested) event data. For enter and exit the entity's
+// position is recorded, and its first sighting never fires; without record,
+// the answer is given against the last recorded position and nothing changes.
+func (service *Service) evaluateGeofence(trigger *Trigger, eventType *EventType, data map[string]interface{}, record bool) (bool, error) {
+	cond := trigger.Geofence
+
+	geofence, found, err := service.geofenceDB.GetOne(cond.GeofenceID, "pz-workflow")
+	if !found || err != nil {
+		return false, fmt.Errorf("geofence %s could not be found", cond.GeofenceID)
+	}
+	fence, err := parseGeofenceGeometry(geofence.Geometry)
+	if err != nil {
+		return false, err
+	}
+
+	mapping := service.removeUniqueParams(eventType.typeName(), eventType.Mapping)
+	field, kind, err := resolveGeofenceField(cond.Field, mapping)
+	if err != nil {
+		return false, err
+	}
+	shape, err := eventLocation(data, field, kind)
+	if err != nil {
+		return false, err
+	}
+
+	// the precomputed bounding box rules out most distant events cheaply
+	near := len(geofence.Bbox) != 4 || geoBboxesOverlap(geofence.Bbox, geoBbox(shape.points))
+
+	switch cond.Relation {
+	case GeofenceRelationInside:
+		return near && geofenceContains(fence, shape), nil
+	case GeofenceRelationIntersects:
+		return near && geofenceIntersects(fence, shape), nil
+	}
+
+	entity, ok := getDataValue(data, cond.EntityKey)
+	if !ok {
+		return false, fmt.Errorf("event has no [%s] value", cond.EntityKey)
+	}
+	inside := near && geofenceIntersects(fence, shape)
+
+	service.geofenceLock.Lock()
+	defer service.geofenceLock.Unlock()
+
+	last, seen, err := service.geofenceStateDB.GetState(trigger.TriggerID, fmt.Sprint(entity))
+	if err != nil {
+		return false, err
+	}
+	state := &GeofenceState{
+		TriggerID: trigger.TriggerID,
+		Entity:    fmt.Sprint(entity),
+		Inside:    inside,
+		UpdatedOn: piazza.NewTimeStamp(),
+	}
+	if record {
+		if err = service.geofenceStateDB.PutState(state); err != nil {
+			return false, err
+		}
+	}
+	if !seen {
+		return false, nil
+	}
+
+	if cond.Relation == GeofenceRelationEnter {
+		return !last.Inside && inside, nil
+	}
+	return last.Inside && !inside, nil
+}
+
+//------------------------------------------------------------------------------
+
+// conditionGeofenceIDs lists the geofences referred to by a trigger condition
+func conditionGeofenceIDs(condition interface{}) []piazza.Ident {
+	ids := []piazza.Ident{}
+	switch c := condition.(type) {
+	case map[string]interface{}:
+		for k, v := range c {
+			if refs, ok := v.(map[string]interface{}); ok && k == "geofence" {
+				for _, ref := range refs {
+					if id, _, err := parseGeofenceRef(ref); err == nil {
+						ids = append(ids, id)
+					}
+				}
+				continue
+			}
+			ids = append(ids, conditionGeofenceIDs(v)...)
+		}
+	case []interface{}:
+		for _, v := range c {
+			ids = append(ids, conditionGeofenceIDs(v)...)
+		}
+	}
+	return ids
+}
+
+func triggerUsesGeofence(trigger *Trigger, id piazza.Ident) bool {
+	if trigger.Geofence != nil && trigger.Geofence.GeofenceID == id {
+		return true
+	}
+	for _, ref := range conditionGeofenceIDs(trigger.Condition) {
+		if ref == id {
+			return true
+		}
+	}
+	return false
+}
+
+// parseGeofenceRef reads either "<geofenceId>" or {"geofenceId": .., "relation": ..}
+func parseGeofenceRef(ref interface{}) (piazza.Ident, string, error) {
+	switch r := ref.(type) {
+	case string:
+		return piazza.Ident(r), "intersects", nil
+	case map[string]interface{}:
+		id, _ := r["geofenceId"].(string)
+		if id == "" {
+			return "", "", errors.New("geofence reference has no geofenceId")
+		}
+		relation, _ := r["relation"].(string)
+		if relation == "" {
+			relation = "intersects"
+		}
+		if relation != "intersects" && relation != "within" && relation != "disjoint" {
+			return "", "", fmt.Errorf("geofence reference relation [%s] must be one of intersects, within or disjoint", relation)
+		}
+		return piazza.Ident(id), relation, nil
+	}
+	return "", "", fmt.Errorf("geofence reference %v is not an id or an object", ref)
+}
+
+// expandGeofenceRefs replaces the geofence references in a trigger condition,
+// whose variables already carry the eventType prefix, with the equivalent
+// Elasticsearch geo queries: geo_shape for geo_shape variables and
+// geo_polygon for geo_point variables
+func (service *Service) expandGeofenceRefs(condition map[string]interface{}, eventTypeID piazza.Ident) (map[string]interface{}, error) {
+	if len(conditionGeofenceIDs(condition)) == 0 {
+		return condition, nil
+	}
+	eventType, found, err := service.eventTypeDB.GetOne(eventTypeID, "pz-workflow")
+	if !found || err != nil {
+		return nil, fmt.Errorf("eventType %s could not be found", eventTypeID)
+	}
+	vars, err := piazza.GetVarsFromStruct(service.removeUniqueParams(eventType.typeName(), eventType.Mapping))
+	if err != nil {
+		return nil, err
+	}
+
+	var expand func(interface{}) (interface{}, error)
+	expand = func(in interface{}) (interface{}, error) {
+		switch c := in.(type) {
+		case map[string]interface{}:
+			out := map[string]interface{}{}
+			for k, v := range c {
+				refs, ok := v.(map[string]interface{})
+				if k != "geofence" || !ok {
+					var err error
+					if out[k], err = expand(v); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				if len(refs) != 1 || len(c) != 1 {
+					return nil, errors.New("a geofence clause must stand alone and name exactly one field")
+				}
+				for field, ref := range refs {
+					return service.expandGeofenceRef(field, ref, eventType.typeName(), vars)
+				}
+			}
+			return out, nil
+		case []interface{}:
+			out := []interface{}{}
+			for _, v := range c {
+				e, err := expand(v)
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, e)
+			}
+			return out, nil
+		}
+		return in, nil
+	}
+
+	out, err := expand(condition)
+	if err != nil {
+		return nil, err
+	}
+	return out.(map[string]interface{}), nil
+}
+
+func (service *Service) expandGeofenceRef(field string, ref interface{}, eventTypeName string, vars map[string]interface{}) (interface{}, error) {
+	id, relation, err := parseGeofenceRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	geofence, found, err := service.geofenceDB.GetOne(id, "pz-workflow")
+	if !found || err != nil {
+		return nil, fmt.Errorf("geofence %s could not be found", id)
+	}
+	polygons, err := parseGeofenceGeometry(geofence.Geometry)
+	if err != nil {
+		return nil, err
+	}
+
+	typ := fmt.Sprint(vars[strings.TrimPrefix(field, "data."+eventTypeName+".")])
+	switch typ {
+	case string(elasticsearch.MappingElementTypeGeoShape):
+		return map[string]interface{}{
+			"geo_shape": map[string]interface{}{
+				field: map[string]interface{}{
+					"shape":    geofence.Geometry,
+					"relation": relation,
+				},
+			},
+		}, nil
+	case string(elasticsearch.MappingElementTypeGeoPoint):
+		// geo_polygon knows nothing of holes or multiple polygons, so build them from bool
+		should := []interface{}{}
+		for _, polygon := range polygons {
+			mustNot := []interface{}{}
+			for _, hole := range polygon[1:] {
+				mustNot = append(mustNot, geoPolygonQuery(field, hole))
+			}
+			should = append(should, map[string]interface{}{
+				"bool": map[string]interface{}{
+					"must":     []interface{}{geoPolygonQuery(field, polygon[0])},
+					"must_not": mustNot,
+				},
+			})
+		}
+		query := map[string]interface{}{
+			"bool": map[string]interface{}{
+				"should":               should,
+				"minimum_should_match": 1,
+			},
+		}
+		if relation == "disjoint" {
+			query = map[string]interface{}{
+				"bool": map[string]interface{}{"must_not": []interface{}{query}},
+			}
+		}
+		return query, nil
+	}
+	return nil, fmt.Errorf("field [%s] of a geofence reference is not a geo_point or geo_shape variable", field)
+}
+
+func geoPolygonQuery(field string, ring geoRing) map[string]interface{} {
+	points := []interface{}{}
+	for _, p := range ring {
+		points = append(points, map[string]interface{}{"lat": p.y, "lon": p.x})
+	}
+	return map[string]interface{}{
+		"geo_polygon": map[string]interface{}{
+			field: map[string]interface{}{"points": points},
+		},
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+type GeofenceDB struct {
+	*ResourceDB
+	mapping string
+}
+
+func NewGeofenceDB(service *Service, esi elasticsearch.IIndex) (*GeofenceDB, error) {
+	rdb, err := NewResourceDB(service, esi)
+	if err != nil {
+		return nil, err
+	}
+	gfdb := GeofenceDB{ResourceDB: rdb, mapping: GeofenceDBMapping}
+	return &gfdb, nil
+}
+
+func (db *GeofenceDB) PostData(geofence *Geofence) error {
+	indexResult, err := db.Esi.PostData(db.mapping, geofence.GeofenceID.String(), geofence)
+	if err != nil {
+		return LoggedError("GeofenceDB.PostData failed: %s", err)
+	}
+	if !indexResult.Created {
+		return LoggedError("GeofenceDB.PostData failed: not created")
+	}
+
+	return nil
+}
+
+func (db *GeofenceDB) PutData(geofence *Geofence) error {
+	if _, err := db.Esi.PutData(db.mapping, geofence.GeofenceID.String(), geofence); err != nil {
+		return LoggedError("GeofenceDB.PutData failed: %s", err)
+	}
+	return nil
+}
+
+func (db *GeofenceDB) GetAll(format *piazza.JsonPagination, actor string) ([]Geofence, int64, error) {
+	geofences := []Geofence{}
+
+	exists, err := db.Esi.TypeExists(db.mapping)
+	if err != nil {
+		return geofences, 0, err
+	}
+	if !exists {
+		return geofences, 0, nil
+	}
+
+	searchResult, err := db.Esi.FilterByMatchAll(db.mapping, format)
+	if err != nil {
+		return nil, 0, LoggedError("GeofenceDB.GetAll failed: %s", err)
+	}
+	if searchResult == nil {
+		return nil, 0, LoggedError("GeofenceDB.GetAll failed: no searchResult")
+	}
+
+	if searchResult != nil && searchResult.GetHits() != nil {
+		for _, hit := range *searchResult.GetHits() {
+			var geofence Geofence
+			if err := json.Unmarshal(*hit.Source, &geofence); err != nil {
+				return nil, 0, err
+			}
+			geofences = append(geofences, geofence)
+		}
+	}
+
+	return geofences, searchResult.TotalHits(), nil
+}
+
+func (db *GeofenceDB) GetGeofencesByDslQuery(dslString string, actor string) ([]Geofence, int64, error) {
+	geofences := []Geofence{}
+
+	exists, err := db.Esi.TypeExists(db.mapping)
+	if err != nil {
+		return geofences, 0, err
+	}
+	if !exists {
+		return geofences, 0, nil
+	}
+
+	searchResult, err := db.Esi.SearchByJSON(db.mapping, dslString)
+	if err != nil {
+		return nil, 0, LoggedError("GeofenceDB.GetGeofencesByDslQuery failed: %s", err)
+	}
+	if searchResult == nil {
+		return nil, 0, LoggedError("GeofenceDB.GetGeofencesByDslQuery failed: no searchResult")
+	}
+
+	if searchResult != nil && searchResult.GetHits() != nil {
+		for _, hit := range *searchResult.GetHits() {
+			var geofence Geofence
+			if err := json.Unmarshal(*hit.Source, &geofence); err != nil {
+				return nil, 0, err
+			}
+			geofences = append(geofences, geofence)
+		}
+	}
+
+	return geofences, searchResult.TotalHits(), nil
+}
+
+func (db *GeofenceDB) GetOne(id piazza.Ident, actor string) (*Geofence, bool, error) {
+	getResult, err := db.Esi.GetByID(db.mapping, id.String())
+	if err != nil {
+		return nil, false, LoggedError("GeofenceDB.GetOne failed: %s", err)
+	}
+	if getResult == nil {
+		return nil, false, LoggedError("GeofenceDB.GetOne failed: no getResult")
+	}
+
+	src := getResult.Source
+	var geofence Geofence
+	if err = json.Unmarshal(*src, &geofence); err != nil {
+		return nil, getResult.Found, err
+	}
+
+	return &geofence, getResult.Found, nil
+}
+
+func (db *GeofenceDB) DeleteByID(id piazza.Ident, actor string) (bool, error) {
+	deleteResult, err := db.Esi.DeleteByID(db.mapping, string(id))
+	if err != nil {
+		return false, LoggedError("GeofenceDB.DeleteById failed: %s", err)
+	}
+	if deleteResult == nil {
+		return false, LoggedError("GeofenceDB.DeleteById failed: no deleteResult")
+	}
+
+	return deleteResult.Found, nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// GeofenceStateDB remembers, per trigger and entity, whether the entity was
+// last seen inside the trigger's geofence. Enter and exit conditions need this
+// to tell a crossing from a repeated sighting.
+type GeofenceStateDB struct {
+	*ResourceDB
+	mapping string
+}
+
+func NewGeofenceStateDB(service *Service, esi elasticsearch.IIndex) (*GeofenceStateDB, error) {
+	rdb, err := NewResourceDB(service, esi)
+	if err != nil {
+		return nil, err
+	}
+	gsdb := GeofenceStateDB{ResourceDB: rdb, mapping: GeofenceStateDBMapping}
+	return &gsdb, nil
+}
+
+func geofenceStateID(triggerID piazza.Ident, entity string) string {
+	return triggerID.String() + ":" + entity
+}
+
+// GetState returns the last recorded state of the entity, and false if the
+// entity has not been seen by the trigger before
+func (db *GeofenceStateDB) GetState(triggerID piazza.Ident, entity string) (*GeofenceState, bool, error) {
+	id := geofenceStateID(triggerID, entity)
+
+	ok, err := db.Esi.ItemExists(db.mapping, id)
+	if err != nil {
+		return nil, false, LoggedError("GeofenceStateDB.GetState failed: %s", err)
+	}
+	if !ok {
+		return nil, false, nil
+	}
+
+	getResult, err := db.Esi.GetByID(db.mapping, id)
+	if err != nil {
+		return nil, false, LoggedError("GeofenceStateDB.GetState failed: %s", err)
+	}
+	if getResult == nil {
+		return nil, false, LoggedError("GeofenceStateDB.GetState failed: no getResult")
+	}
+
+	var state GeofenceState
+	if err = json.Unmarshal(*getResult.Source, &state); err != nil {
+		return nil, getResult.Found, LoggedError("GeofenceStateDB.GetState failed: %s", err)
+	}
+
+	return &state, getResult.Found, nil
+}
+
+func (db *GeofenceStateDB) PutState(state *GeofenceState) error {
+	_, err := db.Esi.PutData(db.mapping, geofenceStateID(state.TriggerID, state.Entity), state)
+	if err != nil {
+		return LoggedError("GeofenceStateDB.PutState failed: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+type GeofenceTester struct {
+	suite.Suite
+	service *Service
+}
+
+func (suite *GeofenceTester) SetupSuite() {
+}
+
+func (suite *GeofenceTester) TearDownSuite() {
+}
+
+// a 10x10 square at the origin, with a 2x2 hole in the middle
+func makeTestGeofence() *Geofence {
+	return &Geofence{
+		Name: "MY GEOFENCE",
+		Geometry: map[string]interface{}{
+			"type": "Polygon",
+			"coordinates": []interface{}{
+				[]interface{}{
+					[]interface{}{0.0, 0.0}, []interface{}{10.0, 0.0}, []interface{}{10.0, 10.0},
+					[]interface{}{0.0, 10.0}, []interface{}{0.0, 0.0},
+				},
+				[]interface{}{
+					[]interface{}{4.0, 4.0}, []interface{}{6.0, 4.0}, []interface{}{6.0, 6.0},
+					[]interface{}{4.0, 6.0}, []interface{}{4.0, 4.0},
+				},
+			},
+		},
+	}
+}
+
+func geoPointAt(lon, lat float64) map[string]interface{} {
+	return map[string]interface{}{"lat": lat, "lon": lon}
+}
+
+//---------------------------------------------------------------------------
+
+func (suite *GeofenceTester) Test30Geometry() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	fence, err := parseGeofenceGeometry(makeTestGeofence().Geometry)
+	assert.NoError(err)
+
+	_, err = parseGeofenceGeometry(map[string]interface{}{
+		"type":        "Polygon",
+		"coordinates": []interface{}{[]interface{}{[]interface{}{0.0, 0.0}, []interface{}{1.0, 1.0}}},
+	})
+	assert.Error(err)
+
+	_, err = parseGeofenceGeometry(map[string]interface{}{
+		"type": "Polygon",
+		"coordinates": []interface{}{[]interface{}{
+			[]interface{}{0.0, 0.0}, []interface{}{200.0, 0.0}, []interface{}{200.0, 10.0}, []interface{}{0.0, 0.0},
+		}},
+	})
+	assert.Error(err)
+
+	assert.Equal([]float64{0, 0, 10, 10}, geoPolygonsBbox(fence))
+
+	check := func(v interface{}, inside bool, intersects bool) {
+		shape, err := parseGeoPointValue(v)
+		assert.NoError(err)
+		assert.Equal(inside, geofenceContains(fence, shape), "%v", v)
+		assert.Equal(intersects, geofenceIntersects(fence, shape), "%v", v)
+	}
+	check(geoPointAt(1, 1), true, true)
+	check("2,3", true, true)
+	check([]interface{}{3.0, 2.0}, true, true)
+	check(geoPointAt(5, 5), false, false) // in the hole
+	check(geoPointAt(11, 5), false, false)
+
+	_, err = parseGeoPointValue("drm3btev3e86")
+	assert.Error(err)
+
+	// a line crossing the boundary intersects but is not inside
+	shape, err := parseGeoShapeValue(map[string]interface{}{
+		"type":        "LineString",
+		"coordinates": []interface{}{[]interface{}{1.0, 1.0}, []interface{}{20.0, 1.0}},
+	})
+	assert.NoError(err)
+	assert.False(geofenceContains(fence, shape))
+	assert.True(geofenceIntersects(fence, shape))
+
+	// an envelope around the whole fence intersects it, with no vertex inside
+	shape, err = parseGeoShapeValue(map[string]interface{}{
+		"type":        "envelope",
+		"coordinates": []interface{}{[]interface{}{-1.0, 11.0}, []interface{}{11.0, -1.0}},
+	})
+	assert.NoError(err)
+	assert.False(geofenceContains(fence, shape))
+	assert.True(geofenceIntersects(fence, shape))
+
+	// ingest bounding boxes
+	shape, err = eventLocation(map[string]interface{}{"minX": 1, "minY": 1, "maxX": 2.0, "maxY": "2"}, geofenceFieldBbox, geofenceFieldBbox)
+	assert.NoError(err)
+	assert.True(geofenceContains(fence, shape))
+}
+
+func (suite *GeofenceTester) Test31GeofenceField() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	mapping := map[string]interface{}{
+		"name": elasticsearch.MappingElementTypeString,
+		"track": map[string]interface{}{
+			"where": elasticsearch.MappingElementTypeGeoPoint,
+		},
+		"area": elasticsearch.MappingElementTypeGeoShape,
+	}
+
+	field, kind, err := resolveGeofenceField("", mapping)
+	assert.NoError(err)
+	assert.Equal("area", field)
+	assert.Equal("geo_shape", kind)
+
+	field, kind, err = resolveGeofenceField("track.where", mapping)
+	assert.NoError(err)
+	assert.Equal("track.where", field)
+	assert.Equal("geo_point", kind)
+
+	_, _, err = resolveGeofenceField("name", mapping)
+	assert.Error(err)
+
+	ingest := map[string]interface{}{"minX": "double", "minY": "double", "maxX": "double", "maxY": "double"}
+	field, _, err = resolveGeofenceField("", ingest)
+	assert.NoError(err)
+	assert.Equal(geofenceFieldBbox, field)
+
+	_, _, err = resolveGeofenceField("", map[string]interface{}{"num": "integer"})
+	assert.Error(err)
+
+	v, ok := getDataValue(map[string]interface{}{"track": map[string]interface{}{"where": "1,2"}}, "track.where")
+	assert.True(ok)
+	assert.Equal("1,2", v)
+}
+
+func (suite *GeofenceTester) Test32EnterExit() {
+	t := suite.T()
+	assert := assert.New(t)
+	service := suite.service
+
+	resp := service.PostGeofence(makeTestGeofence())
+	assert.False(resp.IsError())
+	geofence := resp.Data.(*Geofence)
+	defer func() {
+		assert.False(service.DeleteGeofence(geofence.GeofenceID, "pz-workflow").IsError())
+	}()
+
+	eventType := &EventType{
+		EventTypeID: service.newIdent(),
+		Name:        makeTestEventTypeName(),
+	}
+	eventType.Mapping = service.addUniqueParams(eventType.Name, map[string]interface{}{
+		"vehicle":  elasticsearch.MappingElementTypeString,
+		"location": elasticsearch.MappingElementTypeGeoPoint,
+	})
+	assert.NoError(service.validateGeofenceCondition(&GeofenceCondition{
+		GeofenceID: geofence.GeofenceID, Relation: GeofenceRelationExit, EntityKey: "vehicle",
+	}, eventType))
+
+	makeTrigger := func(relation string) *Trigger {
+		return &Trigger{
+			TriggerID:   service.newIdent(),
+			EventTypeID: eventType.EventTypeID,
+			Geofence:    &GeofenceCondition{GeofenceID: geofence.GeofenceID, Relation: relation, EntityKey: "vehicle"},
+		}
+	}
+	move := func(trigger *Trigger, vehicle string, lon, lat float64) bool {
+		data := map[string]interface{}{"vehicle": vehicle, "location": geoPointAt(lon, lat)}
+		fired, err := service.evaluateGeofence(trigger, eventType, data, true)
+		assert.NoError(err)
+		return fired
+	}
+
+	enter := makeTrigger(GeofenceRelationEnter)
+	assert.False(move(enter, "A", 20, 20)) // first sighting
+	assert.False(move(enter, "A", 21, 20))
+	assert.True(move(enter, "A", 1, 1))
+	assert.False(move(enter, "A", 2, 2))
+	assert.False(move(enter, "B", 2, 2)) // first sighting, already inside
+	assert.False(move(enter, "A", 5, 5)) // into the hole is leaving
+	assert.True(move(enter, "A", 3, 3))
+
+	exit := makeTrigger(GeofenceRelationExit)
+	assert.False(move(exit, "A", 1, 1))
+	assert.True(move(exit, "A", 20, 20))
+	assert.False(move(exit, "A", 30, 20))
+
+	inside := makeTrigger(GeofenceRelationInside)
+	assert.True(move(inside, "A", 1, 1))
+	assert.False(move(inside, "A", 20, 20))
+
+	_, err := service.evaluateGeofence(enter, eventType, map[string]interface{}{"location": geoPointAt(1, 1)}, true)
+	assert.Error(err)
+}
+
+func (suite *GeofenceTester) Test33GeofenceReferences() {
+	t := suite.T()
+	assert := assert.New(t)
+	service := suite.service
+
+	resp := service.PostGeofence(makeTestGeofence())
+	assert.False(resp.IsError())
+	geofence := resp.Data.(*Geofence)
+	geofenceID := geofence.GeofenceID
+	assert.Equal([]float64{0, 0, 10, 10}, geofence.Bbox)
+
+	eventType := &EventType{
+		Name: makeTestEventTypeName(),
+		Mapping: map[string]interface{}{
+			"vehicle":  "string",
+			"location": "geo_point",
+			"area":     "geo_shape",
+		},
+	}
+	resp = service.PostEventType(eventType)
+	assert.False(resp.IsError())
+	eventTypeID := resp.Data.(*EventType).EventTypeID
+
+	makeTrigger := func(condition map[string]interface{}) *Trigger {
+		trigger := makeTestTrigger([]piazza.Ident{eventTypeID})
+		trigger.Condition = condition
+		return trigger
+	}
+	percolation := func(id piazza.Ident) string {
+		getResult, err := service.eventDB.(*EventDB).Esi.GetByID(".percolator", id.String())
+		assert.NoError(err)
+		return string(*getResult.Source)
+	}
+
+	resp = service.PostTrigger(makeTrigger(map[string]interface{}{
+		"geofence": map[string]interface{}{"data.location": "not-a-geofence"},
+	}))
+	assert.True(resp.IsError())
+
+	resp = service.PostTrigger(makeTrigger(map[string]interface{}{
+		"geofence": map[string]interface{}{"data.vehicle": geofenceID.String()},
+	}))
+	assert.True(resp.IsError())
+
+	resp = service.PostTrigger(makeTrigger(map[string]interface{}{
+		"bool": map[string]interface{}{
+			"must": []interface{}{
+				map[string]interface{}{
+					"geofence": map[string]interface{}{"data.location": geofenceID.String()},
+				},
+				map[string]interface{}{
+					"geofence": map[string]interface{}{
+						"data.area": map[string]interface{}{"geofenceId": geofenceID.String(), "relation": "within"},
+					},
+				},
+			},
+		},
+	}))
+	assert.False(resp.IsError(), resp.Message)
+	triggerID := resp.Data.(*Trigger).TriggerID
+
+	body := percolation(triggerID)
+	assert.Contains(body, `"geo_polygon":{"data.`+eventType.Name+`.location"`)
+	assert.Contains(body, `"geo_shape":{"data.`+eventType.Name+`.area"`)
+	assert.Contains(body, `"relation":"within"`)
+	assert.NotContains(body, `"geofence"`)
+
+	resp = service.GetTrigger(triggerID, "test")
+	assert.False(resp.IsError())
+	trigger := resp.Data.(*Trigger)
+	assert.Equal([]piazza.Ident{geofenceID, geofenceID}, conditionGeofenceIDs(trigger.Condition))
+
+	// move the fence, and the trigger follows
+	moved := makeTestGeofence()
+	moved.Geometry["coordinates"].([]interface{})[0].([]interface{})[1] = []interface{}{20.0, 0.0}
+	moved.Geometry["coordinates"].([]interface{})[0].([]interface{})[2] = []interface{}{20.0, 10.0}
+	resp = service.PutGeofence(geofenceID, moved, "pz-workflow")
+	assert.False(resp.IsError(), resp.Message)
+	assert.Equal([]float64{0, 0, 20, 10}, resp.Data.(*Geofence).Bbox)
+	body = percolation(triggerID)
+	assert.Contains(body, `{"lat":0,"lon":20}`)
+	assert.NotContains(body, `{"lat":10,"lon":10}`)
+
+	resp = service.PutGeofence(geofenceID, &Geofence{Name: "BAD", Geometry: map[string]interface{}{"type": "Polygon"}}, "pz-workflow")
+	assert.True(resp.IsError())
+
+	// in use by the condition
+	resp = service.DeleteGeofence(geofenceID, "pz-workflow")
+	assert.True(resp.IsError())
+
+	assert.False(service.DeleteTrigger(triggerID, "", "pz-workflow").IsError())
+	assert.False(service.DeleteEventType(eventTypeID, "", "pz-workflow").IsError())
+	assert.False(service.DeleteGeofence(geofenceID, "pz-workflow").IsError())
+}
@@ -0,0 +1,205 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// each dependency has this long to answer before it counts as down
+const healthCheckTimeout = 2 * time.Second
+
+// the indices that events cannot be posted, nor triggers fired, without
+var healthIndices = []string{keyEventTypes, keyEvents, keyTriggers, keyAlerts, keyCrons}
+
+// GetHealthLive says the service is up. It checks no dependencies, so that
+// an outage of one does not get the service restarted.
+func (service *Service) GetHealthLive() *piazza.JsonResponse {
+	defer service.handlePanic()
+	return service.statusOK(&HealthReport{Status: HealthUp, CheckedOn: piazza.NewTimeStamp()})
+}
+
+// GetHealthReady checks, all at once, what the service needs to fire
+// triggers. Any dependency down, or shutting down, makes it unready: 503,
+// with the report.
+func (service *Service) GetHealthReady() *piazza.JsonResponse {
+	defer service.handlePanic()
+
+	checks := map[string]func() (string, error){
+		"elasticsearch": service.checkElasticsearch,
+		"rabbitmq":      service.checkRabbitMQ,
+		"cron":          service.checkCron,
+		"idam":          service.checkIdam,
+	}
+
+	report := &HealthReport{Status: HealthUp, Checks: map[string]HealthCheck{}}
+	if service.inFlight.isDraining() {
+		report.Status = HealthDown
+		report.Checks["shutdown"] = HealthCheck{Status: HealthDown, Message: "shutting down"}
+	}
+	var lock sync.Mutex
+	var waitGroup sync.WaitGroup
+	for name, check := range checks {
+		waitGroup.Add(1)
+		go func(name string, check func() (string, error)) {
+			defer waitGroup.Done()
+			result := runHealthCheck(check)
+			lock.Lock()
+			defer lock.Unlock()
+			report.Checks[name] = result
+			if result.Status == HealthDown {
+				report.Status = HealthDown
+			}
+		}(name, check)
+	}
+	waitGroup.Wait()
+	report.CheckedOn = piazza.NewTimeStamp()
+
+	if report.Status == HealthDown {
+		down := []string{}
+		for name, check := range report.Checks {
+			if check.Status == HealthDown {
+				down = append(down, name)
+			}
+		}
+		sort.Strings(down)
+		service.syslogger.Warning("Health error: not ready: %s is down", strings.Join(down, ", "))
+		resp := &piazza.JsonResponse{
+			StatusCode: http.StatusServiceUnavailable,
+			Message:    "not ready: " + strings.Join(down, ", ") + " down",
+			Data:       report,
+			Origin:     service.origin,
+		}
+		if err := resp.SetType(); err != nil {
+			return service.statusInternalError(err)
+		}
+		return resp
+	}
+	return service.statusOK(report)
+}
+
+// runHealthCheck runs a check, which is down if it fails or takes too long.
+// A check returns the status it is in when it does not fail.
+func runHealthCheck(check func() (string, error)) HealthCheck {
+	type result struct {
+		status string
+		err    error
+	}
+	start := time.Now()
+	done := make(chan result, 1)
+	go func() {
+		status, err := check()
+		done <- result{status, err}
+	}()
+
+	healthCheck := HealthCheck{}
+	select {
+	case r := <-done:
+		healthCheck.Status = r.status
+		if r.err != nil {
+			if r.status != HealthSkipped {
+				healthCheck.Status = HealthDown
+			}
+			healthCheck.Message = r.err.Error()
+		}
+	case <-time.After(healthCheckTimeout):
+		healthCheck.Status = HealthDown
+		healthCheck.Message = fmt.Sprintf("no answer within %s", healthCheckTimeout)
+	}
+	healthCheck.Duration = float64(time.Since(start)) / float64(time.Millisecond)
+	return healthCheck
+}
+
+func (service *Service) checkElasticsearch() (string, error) {
+	if service.aliasDB(keyEventTypes) == nil {
+		return HealthSkipped, fmt.Errorf("resources are not kept in Elasticsearch")
+	}
+	missing := []string{}
+	for _, alias := range healthIndices {
+		db := service.aliasDB(alias)
+		if db == nil {
+			continue
+		}
+		exists, err := db.Esi.IndexExists()
+		if err != nil {
+			return HealthDown, fmt.Errorf("index %s: %s", alias, err)
+		}
+		if !exists {
+			missing = append(missing, alias)
+		}
+	}
+	if len(missing) > 0 {
+		return HealthDown, fmt.Errorf("indices missing: %s", strings.Join(missing, ", "))
+	}
+	return HealthUp, nil
+}
+
+// checkRabbitMQ connects, as sending a job does
+func (service *Service) checkRabbitMQ() (string, error) {
+	rabbitAddress, err := service.sys.GetAddress(piazza.PzRabbitMQ)
+	if err != nil {
+		return HealthSkipped, fmt.Errorf("not configured")
+	}
+	conn, err := amqp.DialConfig(rabbitAddress, amqp.Config{
+		Dial: func(network string, addr string) (net.Conn, error) {
+			return net.DialTimeout(network, addr, healthCheckTimeout)
+		},
+	})
+	if err != nil {
+		return HealthDown, err
+	}
+	return HealthUp, conn.Close()
+}
+
+// checkCron says whether the repeating events are being posted; the cron is
+// started once they have been scheduled
+func (service *Service) checkCron() (string, error) {
+	service.cronLock.Lock()
+	defer service.cronLock.Unlock()
+	if !service.cronStarted {
+		return HealthDown, fmt.Errorf("not started")
+	}
+	return HealthUp, nil
+}
+
+// checkIdam asks pz-idam for anything; any answer other than a server error
+// means it can authorize jobs
+func (service *Service) checkIdam() (string, error) {
+	idamURL, err := service.sys.GetURL(piazza.PzIdam)
+	if err != nil {
+		return HealthSkipped, fmt.Errorf("not configured")
+	}
+	client := &http.Client{Timeout: healthCheckTimeout}
+	resp, err := client.Get(idamURL)
+	if err != nil {
+		return HealthDown, err
+	}
+	if err = resp.Body.Close(); err != nil {
+		return HealthDown, err
+	}
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return HealthDown, fmt.Errorf("answered %s", resp.Status)
+	}
+	return HealthUp, nil
+}
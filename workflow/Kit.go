@@ -15,17 +15,7 @@
 package workflow
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
 	"log"
-	"os"
-	"os/exec"
-	"reflect"
-	"regexp"
-	"sort"
-	"strings"
 
 	"github.com/venicegeo/pz-gocommon/elasticsearch"
 	piazza "github.com/venicegeo/pz-gocommon/gocommon"
@@ -66,6 +56,8 @@ func NewKit(
 
 	if kit.mocking {
 		kit.indices = kit.makeMockIndices()
+		// there is no rabbitmq to take the jobs of fired triggers
+		kit.Service.sendJob = func(string, piazza.Ident, string, *Span) error { return nil }
 	} else {
 		kit.indices = kit.makeIndices(sys)
 	}
@@ -75,11 +67,51 @@ func NewKit(
 		return nil, err
 	}
 
+	return kit.serve()
+}
+
+// NewEmbeddedKit is a Kit whose service keeps its resources in a FileStore
+// in dir, rather than in Elasticsearch
+func NewEmbeddedKit(
+	sys *piazza.SystemConfig,
+	logWriter pzsyslog.Writer,
+	auditWriter pzsyslog.Writer,
+	dir string,
+	pen string,
+) (*Kit, error) {
+
+	kit := &Kit{}
+	kit.Service = &Service{}
+	kit.LogWriter = logWriter
+	kit.AuditWriter = auditWriter
+	kit.Sys = sys
+
+	store, err := NewFileStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = kit.Service.InitEmbedded(sys, logWriter, auditWriter, store, pen)
+	if err != nil {
+		return nil, err
+	}
+
+	return kit.serve()
+}
+
+// serve starts the cron jobs and the sweeper, unless mocking, and sets up
+// the server
+func (kit *Kit) serve() (*Kit, error) {
+	var err error
+
 	if !kit.mocking {
 		err = kit.Service.InitCron()
 		if err != nil {
 			log.Fatal(err)
 		}
+		err = kit.Service.InitSweeper()
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	kit.Server = &Server{}
@@ -109,10 +141,38 @@ func (kit *Kit) Wait() error {
 	return <-kit.done
 }
 
+// Stop stops taking requests, then waits, up to ShutdownTimeout, for the
+// triggers being fired; what is left goes into the outbox. The logs are
+// flushed last. A step that fails does not keep the later ones from being
+// taken; the first error is returned once they all have been.
 func (kit *Kit) Stop() error {
+	var firstErr error
+	record := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
 	err := kit.GenericServer.Stop()
 	if err != nil {
-		return err
+		log.Printf("pz-workflow could not stop taking requests: %s", err)
+		record(err)
+	}
+
+	left, err := kit.Service.Shutdown(ShutdownTimeout)
+	if len(left) > 0 {
+		log.Printf("pz-workflow stopped with %d unfinished, in the outbox", len(left))
+	}
+	if err != nil {
+		log.Printf("pz-workflow could not put all that was unfinished in the outbox: %s", err)
+		record(err)
+	}
+	kit.Service.tracer.flush()
+	for _, writer := range []pzsyslog.Writer{kit.LogWriter, kit.AuditWriter} {
+		if err = writer.Close(); err != nil {
+			log.Printf("pz-workflow could not flush its logs: %s", err)
+			record(err)
+		}
 	}
 
 	if kit.mocking {
@@ -137,20 +197,56 @@ func (kit *Kit) Stop() error {
 		if err != nil {
 			return err
 		}
+
+		err = indices[keyGeofences].Delete()
+		if err != nil {
+			return err
+		}
+
+		err = indices[keyGeofenceStates].Delete()
+		if err != nil {
+			return err
+		}
+
+		err = indices[keyStats].Delete()
+		if err != nil {
+			return err
+		}
+
+		err = indices[keyOutbox].Delete()
+		if err != nil {
+			return err
+		}
+
+		err = indices[keyACLs].Delete()
+		if err != nil {
+			return err
+		}
+
+		err = indices[keyAudit].Delete()
+		if err != nil {
+			return err
+		}
 	}
 
-	return nil
+	return firstErr
 }
 
 func (kit *Kit) makeMockIndices() *map[string]elasticsearch.IIndex {
 
 	indices := &map[string]elasticsearch.IIndex{
-		keyEventTypes:        elasticsearch.NewMockIndex(keyEventTypes),
-		keyEvents:            elasticsearch.NewMockIndex(keyEvents),
-		keyTriggers:          elasticsearch.NewMockIndex(keyTriggers),
-		keyAlerts:            elasticsearch.NewMockIndex(keyAlerts),
-		keyCrons:             elasticsearch.NewMockIndex(keyCrons),
-		keyTestElasticsearch: elasticsearch.NewMockIndex(keyTestElasticsearch),
+		keyEventTypes:        NewMemIndex(keyEventTypes),
+		keyEvents:            NewMemIndex(keyEvents),
+		keyTriggers:          NewMemIndex(keyTriggers),
+		keyAlerts:            NewMemIndex(keyAlerts),
+		keyCrons:             NewMemIndex(keyCrons),
+		keyTestElasticsearch: NewMemIndex(keyTestElasticsearch),
+		keyGeofences:         NewMemIndex(keyGeofences),
+		keyGeofenceStates:    NewMemIndex(keyGeofenceStates),
+		keyStats:             NewMemIndex(keyStats),
+		keyOutbox:            NewMemIndex(keyOutbox),
+		keyACLs:              NewMemIndex(keyACLs),
+		keyAudit:             NewMemIndex(keyAudit),
 	}
 	(*indices)[keyEventTypes].SetMapping(EventTypeDBMapping, "{}")
 	(*indices)[keyEvents].SetMapping(EventDBMapping, "{}")
@@ -158,126 +254,50 @@ func (kit *Kit) makeMockIndices() *map[string]elasticsearch.IIndex {
 	(*indices)[keyAlerts].SetMapping(AlertDBMapping, "{}")
 	(*indices)[keyCrons].SetMapping(CronDBMapping, "{}")
 	(*indices)[keyTestElasticsearch].SetMapping(TestElasticsearchMapping, "{}")
+	(*indices)[keyGeofences].SetMapping(GeofenceDBMapping, "{}")
+	(*indices)[keyGeofenceStates].SetMapping(GeofenceStateDBMapping, "{}")
+	(*indices)[keyStats].SetMapping(EventTypeHourDBMapping, "{}")
+	(*indices)[keyStats].SetMapping(TriggerStatsDBMapping, "{}")
+	(*indices)[keyOutbox].SetMapping(OutboxDBMapping, "{}")
+	(*indices)[keyACLs].SetMapping(ACLDBMapping, "{}")
+	(*indices)[keyAudit].SetMapping(AuditDBMapping, "{}")
+
+	admin := NewMockIndexAdmin()
+	for _, esi := range *indices {
+		admin.addIndex(esi.(*MemIndex))
+	}
+	kit.Service.indexAdmin = admin
+
 	return indices
 }
 
+// makeIndices brings the indices up to the latest migration and opens each
+// through its alias
 func (kit *Kit) makeIndices(sys *piazza.SystemConfig) *map[string]elasticsearch.IIndex {
-	var err error
-	var pwd, esURL string
-	{
-		pwd, err = os.Getwd()
-		if err != nil {
-			log.Fatalln(err)
-		}
-		esURL, err = sys.GetURL(piazza.PzElasticSearch)
-		if err != nil {
-			log.Fatalln(err)
-		}
-	}
-
-	keyToPattern := map[string]string{
-		keyEventTypes:        "EventType",
-		keyEvents:            "Event",
-		keyTriggers:          "Trigger",
-		keyAlerts:            "Alert",
-		keyCrons:             "Cron",
-		keyTestElasticsearch: "TestES",
-	}
-	keyToScripts := map[string][]string{
-		keyEventTypes:        []string{},
-		keyEvents:            []string{},
-		keyTriggers:          []string{},
-		keyAlerts:            []string{},
-		keyCrons:             []string{},
-		keyTestElasticsearch: []string{},
-	}
-	keyToType := map[string]string{
-		keyEventTypes:        EventTypeDBMapping,
-		keyEvents:            EventDBMapping,
-		keyTriggers:          TriggerDBMapping,
-		keyAlerts:            AlertDBMapping,
-		keyCrons:             CronDBMapping,
-		keyTestElasticsearch: TestElasticsearchMapping,
+	admin, err := NewEsIndexAdmin(sys)
+	if err != nil {
+		log.Fatalln(err)
 	}
-	indices := make(map[string]elasticsearch.IIndex)
-
-	{
-		files, err := ioutil.ReadDir(pwd + "/db/")
-		if err != nil {
-			log.Fatalln(err)
-		}
-		for _, f := range files {
-			for alias, pattern := range keyToPattern {
-				re, err := regexp.Compile(fmt.Sprintf(`^[0-9]{3}-%s.sh$`, pattern))
-				if err != nil {
-					log.Fatalln(err)
-				}
-				if re.MatchString(f.Name()) {
-					keyToScripts[alias] = append(keyToScripts[alias], f.Name())
-				}
-			}
-		}
-		for _, scripts := range keyToScripts {
-			sort.Strings(scripts)
-		}
+	kit.Service.indexAdmin = admin
+	migrator, err := NewMigrator(admin, Migrations)
+	if err != nil {
+		log.Fatalln(err)
 	}
 
-	type ScriptRes struct {
-		Status  string `json:"status"`
-		Message string `json:"message"`
-		Mapping string `json:"mapping"`
+	applied, err := migrator.Up()
+	for _, record := range applied {
+		log.Printf("Applied migration %d: %s is on %s\n", record.Version, record.Alias, record.Index)
 	}
-
-	format := func(dat []byte) []byte {
-		re := regexp.MustCompile(`\r?\n?\t`)
-		splitStr := `{"status":`
-		split := strings.SplitN(string(bytes.TrimPrefix([]byte(re.ReplaceAllString(string(dat), "")), []byte("\xef\xbb\xbf"))), splitStr, 2)
-		return []byte(splitStr + split[len(split)-1])
+	if err != nil {
+		log.Fatalln(err)
 	}
 
-	log.Println("==========")
-	for alias, scripts := range keyToScripts {
-		log.Println(alias)
-		for i, script := range scripts {
-			log.Println(" ", script)
-			outDat, err := exec.Command("bash", pwd+"/db/"+script, alias, esURL).Output()
-			if err != nil {
-				log.Fatalln(err)
-			}
-			resDat := format(outDat)
-			scriptRes := ScriptRes{}
-			if err = json.Unmarshal(resDat, &scriptRes); err != nil {
-				log.Fatalln(err, "\nOutput:", string(outDat))
-			}
-			if scriptRes.Status != "success" {
-				log.Fatalf("Script failed: [%s]\n", scriptRes.Message)
-			}
-			if indices[alias], err = elasticsearch.NewIndex(sys, alias, ""); err != nil {
-				log.Fatalln(err)
-			}
-			if scriptRes.Mapping != "" && i == len(scripts)-1 {
-				inter, err := piazza.StructStringToInterface(scriptRes.Mapping)
-				if err != nil {
-					log.Fatalln(err)
-				}
-				var scriptMap, esMap map[string]interface{}
-				var ok bool
-				if scriptMap, ok = inter.(map[string]interface{}); !ok {
-					log.Fatalf("Schema [%s] on alias [%s] in script is not type map[string]interface{}\n", keyToType[alias], alias)
-				}
-				if inter, err = indices[alias].GetMapping(keyToType[alias]); err != nil {
-					log.Fatalln(err)
-				}
-				if esMap, ok = inter.(map[string]interface{}); !ok {
-					log.Fatalf("Schema [%s] on alias [%s] on elasticsearch is not type map[string]interface{}\n", keyToType[alias], alias)
-				}
-				if !reflect.DeepEqual(scriptMap, esMap) {
-					log.Fatalf("Schema [%s] on alias [%s] on elasticsearch does not match the mapping provided\n", keyToType[alias], alias)
-				}
-			}
+	indices := make(map[string]elasticsearch.IIndex)
+	for _, alias := range migrator.Aliases() {
+		if indices[alias], err = elasticsearch.NewIndex(sys, alias, ""); err != nil {
+			log.Fatalln(err)
 		}
 	}
-	log.Println("==========")
 
 	return &indices
 }
@@ -0,0 +1,391 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// a trigger can have raised any number of alerts, and a cron entry produced
+// any number of events, so a graph stops growing at this many nodes
+const lineageMaxNodes = 500
+
+// GetLineage returns the graph around an event, trigger, alert or job: the
+// alerts an event raised, with their triggers and jobs, the cron entries
+// upstream of it and the events downstream of it. What the caller may not
+// read is left out.
+func (service *Service) GetLineage(id piazza.Ident, caller string) *piazza.JsonResponse {
+	defer service.handlePanic()
+	actor := actorOf(caller)
+	service.syslogger.Audit(actor, "gettingLineage", id, "Service.GetLineage: User is getting the lineage of [%s]", id)
+
+	l := &lineageBuilder{
+		service:  service,
+		graph:    &Lineage{RootID: id, Nodes: []LineageNode{}, Edges: []LineageEdge{}},
+		nodes:    map[piazza.Ident]bool{},
+		edges:    map[LineageEdge]bool{},
+		triggers: map[piazza.Ident]*Trigger{},
+	}
+	found, err := l.root(id)
+	if err != nil {
+		service.syslogger.Audit(actor, "gettingLineageFailure", id, "Service.GetLineage: User failed to get the lineage of [%s]", id)
+		return service.statusInternalError(err)
+	}
+	if !found {
+		service.syslogger.Audit(actor, "gettingLineageFailure", id, "Service.GetLineage: User failed to get the lineage of [%s]", id)
+		return service.statusNotFound(fmt.Errorf("%s is not an event, trigger, alert or job", id))
+	}
+	if err = l.readable(caller); err != nil {
+		service.syslogger.Audit(actor, "gettingLineageFailure", id, "Service.GetLineage: User failed to get the lineage of [%s]", id)
+		return service.statusInternalError(err)
+	}
+
+	service.syslogger.Audit(actor, "gotLineage", id, "Service.GetLineage: User got the lineage of [%s] (%d nodes)", id, len(l.graph.Nodes))
+	return service.statusOK(l.graph)
+}
+
+type lineageBuilder struct {
+	service  *Service
+	graph    *Lineage
+	nodes    map[piazza.Ident]bool
+	edges    map[LineageEdge]bool
+	triggers map[piazza.Ident]*Trigger
+}
+
+// root works out what the id is of, and builds the graph from there. Jobs
+// are known only by the alerts that started them.
+func (l *lineageBuilder) root(id piazza.Ident) (bool, error) {
+	exists, err := l.service.triggerDB.itemExists(id, "pz-workflow")
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		return true, l.fromTrigger(id)
+	}
+
+	if exists, err = l.service.alertDB.itemExists(id, "pz-workflow"); err != nil {
+		return false, err
+	}
+	if exists {
+		alert, _, err := l.service.alertDB.GetOne(id, "pz-workflow")
+		if err != nil {
+			return false, err
+		}
+		return true, l.fromAlert(alert)
+	}
+
+	if mapping, _ := l.service.eventDB.lookupEventTypeNameByEventID(id, "pz-workflow"); mapping != "" {
+		return l.fromEventID(id, mapping, true)
+	}
+
+	alerts, err := l.alertsWhere("jobId", id)
+	if err != nil || len(alerts) == 0 {
+		return false, err
+	}
+	for i := range alerts {
+		if err = l.fromAlert(&alerts[i]); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+func (l *lineageBuilder) fromTrigger(id piazza.Ident) error {
+	trigger, err := l.trigger(id)
+	if err != nil {
+		return err
+	}
+	if trigger != nil {
+		l.addNode(id, LineageKindTrigger, trigger.Name)
+	}
+	alerts, err := l.alertsWhere("triggerId", id)
+	if err != nil {
+		return err
+	}
+	for i := range alerts {
+		if err = l.fromAlert(&alerts[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fromAlert builds the graph from the alert's event, which leads back to the
+// alert, or from the alert alone if the event is gone
+func (l *lineageBuilder) fromAlert(alert *Alert) error {
+	if l.nodes[alert.AlertID] {
+		return nil
+	}
+	if mapping, _ := l.service.eventDB.lookupEventTypeNameByEventID(alert.EventID, "pz-workflow"); mapping != "" {
+		found, err := l.fromEventID(alert.EventID, mapping, true)
+		if found || err != nil {
+			return err
+		}
+	}
+	return l.alert(alert)
+}
+
+func (l *lineageBuilder) fromEventID(id piazza.Ident, mapping string, downstream bool) (bool, error) {
+	event, found, err := l.service.eventDB.GetOne(mapping, id, "pz-workflow")
+	if !found {
+		return false, nil
+	}
+	if err != nil {
+		return true, err
+	}
+	return true, l.event(event, mapping, downstream)
+}
+
+// event adds the event, the cron entry that produced it, the alerts it
+// raised and, if asked, the events it produced in turn. Upstream of an event
+// is only its cron entry, not the other events that entry produced.
+func (l *lineageBuilder) event(event *Event, mapping string, downstream bool) error {
+	if l.nodes[event.EventID] {
+		return nil
+	}
+	kind := LineageKindEvent
+	isCron, err := l.service.cronDB.itemExists(event.EventID, "pz-workflow")
+	if err != nil {
+		return err
+	}
+	if isCron {
+		kind = LineageKindCron
+	}
+	if !l.addNode(event.EventID, kind, mapping) {
+		return nil
+	}
+
+	// events a cron entry produced are created by that entry
+	producerID := piazza.Ident(event.CreatedBy)
+	if producerID != "" {
+		if isCron, err = l.service.cronDB.itemExists(producerID, "pz-workflow"); err != nil {
+			return err
+		}
+		if isCron {
+			if producerMapping, _ := l.service.eventDB.lookupEventTypeNameByEventID(producerID, "pz-workflow"); producerMapping != "" {
+				if _, err = l.fromEventID(producerID, producerMapping, false); err != nil {
+					return err
+				}
+			}
+			l.addEdge(producerID, event.EventID, LineageProduced)
+		}
+	}
+
+	alerts, err := l.alertsWhere("eventId", event.EventID)
+	if err != nil {
+		return err
+	}
+	for i := range alerts {
+		if err = l.alert(&alerts[i]); err != nil {
+			return err
+		}
+	}
+
+	if !downstream {
+		return nil
+	}
+	query, err := lineageQuery("createdBy", event.EventID)
+	if err != nil {
+		return err
+	}
+	produced, _, err := l.service.eventDB.GetEventsByDslQuery("", query, "pz-workflow")
+	if err != nil {
+		return err
+	}
+	for i := range produced {
+		child := &produced[i]
+		childMapping, err := l.service.eventDB.lookupEventTypeNameByEventID(child.EventID, "pz-workflow")
+		if err != nil {
+			return err
+		}
+		if err = l.event(child, childMapping, true); err != nil {
+			return err
+		}
+		l.addEdge(event.EventID, child.EventID, LineageProduced)
+	}
+	return nil
+}
+
+// alert adds the alert with its trigger and job. Its event, if in the graph,
+// is connected through the trigger.
+func (l *lineageBuilder) alert(alert *Alert) error {
+	if !l.addNode(alert.AlertID, LineageKindAlert, "") {
+		return nil
+	}
+	trigger, err := l.trigger(alert.TriggerID)
+	if err != nil {
+		return err
+	}
+	if trigger != nil {
+		l.addNode(alert.TriggerID, LineageKindTrigger, trigger.Name)
+		l.addEdge(alert.EventID, alert.TriggerID, LineageMatched)
+		l.addEdge(alert.TriggerID, alert.AlertID, LineageRaised)
+	}
+	if alert.JobID != "" {
+		l.addNode(alert.JobID, LineageKindJob, "")
+		l.addEdge(alert.AlertID, alert.JobID, LineageStarted)
+	}
+	return nil
+}
+
+// trigger fetches a trigger once; it is nil if gone
+func (l *lineageBuilder) trigger(id piazza.Ident) (*Trigger, error) {
+	if trigger, ok := l.triggers[id]; ok {
+		return trigger, nil
+	}
+	trigger, found, err := l.service.triggerDB.GetOne(id, "pz-workflow")
+	if !found {
+		trigger, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	l.triggers[id] = trigger
+	return trigger, nil
+}
+
+func (l *lineageBuilder) alertsWhere(field string, id piazza.Ident) ([]Alert, error) {
+	query, err := lineageQuery(field, id)
+	if err != nil {
+		return nil, err
+	}
+	alerts, _, err := l.service.alertDB.GetAlertsByDslQuery(query, "pz-workflow")
+	return alerts, err
+}
+
+func lineageQuery(field string, id piazza.Ident) (string, error) {
+	byts, err := json.Marshal(map[string]interface{}{
+		"query": map[string]interface{}{"term": map[string]interface{}{field: id}},
+		"size":  lineageMaxNodes,
+	})
+	return string(byts), err
+}
+
+// readable drops the nodes the caller may not read, and their edges. Events
+// and cron entries go by the ACL of their EventType, alerts by that of their
+// trigger, and jobs by their alerts.
+func (l *lineageBuilder) readable(caller string) error {
+	may := l.service.readableBy(caller)
+	kept := map[piazza.Ident]bool{}
+	for _, node := range l.graph.Nodes {
+		var ok bool
+		var err error
+		switch node.Kind {
+		case LineageKindEvent, LineageKindCron:
+			ok, err = may(aclEvent, node.ID)
+		case LineageKindTrigger:
+			ok, err = may(aclTrigger, node.ID)
+		case LineageKindAlert:
+			ok, err = may(aclAlert, node.ID)
+		}
+		if err != nil {
+			return err
+		}
+		kept[node.ID] = ok
+	}
+	for _, edge := range l.graph.Edges {
+		if edge.Relation == LineageStarted && kept[edge.From] {
+			kept[edge.To] = true
+		}
+	}
+
+	nodes := []LineageNode{}
+	for _, node := range l.graph.Nodes {
+		if kept[node.ID] {
+			nodes = append(nodes, node)
+		}
+	}
+	edges := []LineageEdge{}
+	for _, edge := range l.graph.Edges {
+		if kept[edge.From] && kept[edge.To] {
+			edges = append(edges, edge)
+		}
+	}
+	l.graph.Nodes, l.graph.Edges = nodes, edges
+	return nil
+}
+
+// addNode says whether the node is new and, once the graph is full, marks
+// it truncated instead
+func (l *lineageBuilder) addNode(id piazza.Ident, kind string, label string) bool {
+	if l.nodes[id] {
+		return false
+	}
+	if len(l.graph.Nodes) >= lineageMaxNodes {
+		l.graph.Truncated = true
+		return false
+	}
+	l.nodes[id] = true
+	l.graph.Nodes = append(l.graph.Nodes, LineageNode{ID: id, Kind: kind, Label: label})
+	return true
+}
+
+// addEdge connects two nodes, if both made it into the graph
+func (l *lineageBuilder) addEdge(from piazza.Ident, to piazza.Ident, relation string) {
+	edge := LineageEdge{From: from, To: to, Relation: relation}
+	if !l.nodes[from] || !l.nodes[to] || l.edges[edge] {
+		return
+	}
+	l.edges[edge] = true
+	l.graph.Edges = append(l.graph.Edges, edge)
+}
+
+//---------------------------------------------------------------------------
+
+// acceptsGraphviz says whether an Accept header lists DOT before JSON
+func acceptsGraphviz(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		switch strings.ToLower(strings.TrimSpace(strings.Split(part, ";")[0])) {
+		case ContentTypeGraphviz:
+			return true
+		case piazza.ContentTypeJSON, "application/*", "*/*":
+			return false
+		}
+	}
+	return false
+}
+
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func dotQuote(s string) string {
+	return `"` + dotEscaper.Replace(s) + `"`
+}
+
+// Dot renders the graph in the Graphviz DOT language, the root in bold
+func (lineage *Lineage) Dot() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("digraph lineage {\n\trankdir=LR;\n\tnode [shape=box];\n")
+	for _, node := range lineage.Nodes {
+		label := node.Kind + "\n" + node.ID.String()
+		if node.Label != "" {
+			label += "\n" + node.Label
+		}
+		style := ""
+		if node.ID == lineage.RootID {
+			style = ", style=bold"
+		}
+		fmt.Fprintf(&buf, "\t%s [label=%s%s];\n", dotQuote(node.ID.String()), dotQuote(label), style)
+	}
+	for _, edge := range lineage.Edges {
+		fmt.Fprintf(&buf, "\t%s -> %s [label=%s];\n", dotQuote(edge.From.String()), dotQuote(edge.To.String()), dotQuote(edge.Relation))
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
@@ -0,0 +1,975 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+	"gopkg.in/olivere/elastic.v3"
+)
+
+// MemIndex is an index held in memory that behaves as an Elasticsearch 2.x
+// index does, for the tests and for running without Elasticsearch. Unlike
+// elasticsearch.MockIndex it searches with the query DSL of Query.go,
+// enforces "dynamic": "strict" mappings and the types of mapped fields, and
+// percolates documents against the queries registered with it.
+//
+// Unmapped fields of dynamic objects are accepted without being added to
+// the mapping, and documents are found in searches as soon as they are
+// written, as though every write were refreshed.
+type MemIndex struct {
+	name     string
+	lock     sync.RWMutex
+	exists   bool
+	coerce   bool
+	types    map[string]*memIndexType
+	idSource int
+
+	// window is the index's max_result_window, past which from and size
+	// cannot page
+	window int
+}
+
+type memIndexType struct {
+	items   map[string]*json.RawMessage
+	mapping map[string]interface{}
+
+	// versions counts the writes of each document, as _version does
+	versions map[string]int64
+}
+
+func newMemIndexType() *memIndexType {
+	return &memIndexType{
+		items:    map[string]*json.RawMessage{},
+		mapping:  map[string]interface{}{},
+		versions: map[string]int64{},
+	}
+}
+
+const (
+	memDefaultType = "_default_"
+
+	// memDefaultSize is how many hits a search returns when it does not say
+	memDefaultSize = 10
+
+	// memResultWindow is Elasticsearch's default max_result_window
+	memResultWindow = 10000
+)
+
+var _ elasticsearch.IIndex = (*MemIndex)(nil)
+
+func NewMemIndex(name string) *MemIndex {
+	return &MemIndex{
+		name:   name,
+		coerce: true,
+		types:  map[string]*memIndexType{},
+		window: memResultWindow,
+	}
+}
+
+func (esi *MemIndex) GetVersion() string {
+	return "2.2.0"
+}
+
+func (esi *MemIndex) IndexName() string {
+	return esi.name
+}
+
+func (esi *MemIndex) IndexExists() (bool, error) {
+	esi.lock.RLock()
+	defer esi.lock.RUnlock()
+	return esi.exists, nil
+}
+
+func (esi *MemIndex) TypeExists(typ string) (bool, error) {
+	esi.lock.RLock()
+	defer esi.lock.RUnlock()
+	return esi.typeExists(typ), nil
+}
+
+func (esi *MemIndex) typeExists(typ string) bool {
+	_, ok := esi.types[typ]
+	return esi.exists && ok
+}
+
+func (esi *MemIndex) ItemExists(typ string, id string) (bool, error) {
+	esi.lock.RLock()
+	defer esi.lock.RUnlock()
+	return esi.itemExists(typ, id), nil
+}
+
+func (esi *MemIndex) itemExists(typ string, id string) bool {
+	if !esi.typeExists(typ) {
+		return false
+	}
+	_, ok := esi.types[typ].items[id]
+	return ok
+}
+
+// Create makes the index with the given settings and mappings; as with
+// Elasticsearch, it does nothing if the index is already there
+func (esi *MemIndex) Create(settings string) error {
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+
+	if esi.exists {
+		return nil
+	}
+	if settings != "" {
+		obj := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(settings), &obj); err != nil {
+			return err
+		}
+		if coerce, ok := memSetting(obj["settings"], "index.mapping.coerce"); ok {
+			esi.coerce = fmt.Sprint(coerce) != "false"
+		}
+		mappings, _ := obj["mappings"].(map[string]interface{})
+		// the default mapping goes first, since the others start from it
+		if mapping, ok := mappings[memDefaultType].(map[string]interface{}); ok {
+			if err := esi.setMapping(memDefaultType, mapping); err != nil {
+				return err
+			}
+		}
+		for typ, v := range mappings {
+			mapping, ok := v.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("mapping for %s is not an object", typ)
+			}
+			if typ == memDefaultType {
+				continue
+			}
+			if err := esi.setMapping(typ, mapping); err != nil {
+				return err
+			}
+		}
+	}
+	esi.exists = true
+	return nil
+}
+
+// memSetting finds an index setting given either flat, as
+// {"index.mapping.coerce": false}, or nested
+func memSetting(settings interface{}, name string) (interface{}, bool) {
+	obj, ok := settings.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	if v, ok := obj[name]; ok {
+		return v, true
+	}
+	parts := strings.SplitN(name, ".", 2)
+	if len(parts) < 2 {
+		return nil, false
+	}
+	return memSetting(obj[parts[0]], parts[1])
+}
+
+func (esi *MemIndex) Close() error {
+	return nil
+}
+
+func (esi *MemIndex) Delete() error {
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+
+	esi.exists = false
+	esi.coerce = true
+	esi.types = map[string]*memIndexType{}
+	return nil
+}
+
+// SetMapping puts the mapping of a type, merging it into any it already has.
+// The mapping may be given bare or under the type's name.
+func (esi *MemIndex) SetMapping(typ string, jsn piazza.JsonString) error {
+	mapping := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(jsn), &mapping); err != nil {
+		return err
+	}
+
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+	return esi.setMapping(typ, mapping)
+}
+
+func (esi *MemIndex) setMapping(typ string, mapping map[string]interface{}) error {
+	if inner, ok := mapping[typ].(map[string]interface{}); ok && len(mapping) == 1 {
+		mapping = inner
+	}
+
+	t, ok := esi.types[typ]
+	if !ok {
+		t = newMemIndexType()
+		if def, ok := esi.types[memDefaultType]; ok && typ != memDefaultType {
+			t.mapping = memCopy(def.mapping).(map[string]interface{})
+		}
+	}
+	merged := memCopy(t.mapping).(map[string]interface{})
+	if err := memMergeMapping("", merged, mapping); err != nil {
+		return err
+	}
+	t.mapping = merged
+	esi.types[typ] = t
+	return nil
+}
+
+// memMergeMapping adds the fields of src to dst, refusing to change the type
+// of a field that is already mapped
+func memMergeMapping(path string, dst map[string]interface{}, src map[string]interface{}) error {
+	for k, v := range src {
+		if k != "properties" {
+			dst[k] = memCopy(v)
+			continue
+		}
+		srcProps, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("properties of [%s] are not an object", path)
+		}
+		dstProps, ok := dst["properties"].(map[string]interface{})
+		if !ok {
+			dstProps = map[string]interface{}{}
+			dst["properties"] = dstProps
+		}
+		for name, field := range srcProps {
+			srcField, ok := field.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("mapping of [%s] is not an object", memPath(path, name))
+			}
+			dstField, ok := dstProps[name].(map[string]interface{})
+			if !ok {
+				dstProps[name] = memCopy(srcField)
+				continue
+			}
+			if memFieldType(dstField) != memFieldType(srcField) {
+				return fmt.Errorf("mapper [%s] of different type, current_type [%s], merged_type [%s]",
+					memPath(path, name), memFieldType(dstField), memFieldType(srcField))
+			}
+			if err := memMergeMapping(memPath(path, name), dstField, srcField); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// memFieldType is the type of a mapped field, objects included
+func memFieldType(field map[string]interface{}) string {
+	if typ, ok := field["type"].(string); ok && typ != "nested" {
+		return typ
+	}
+	return "object"
+}
+
+func memPath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// memCopy is a deep copy of a value read from JSON
+func memCopy(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			out[k] = memCopy(e)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(t))
+		for i, e := range t {
+			out[i] = memCopy(e)
+		}
+		return out
+	}
+	return v
+}
+
+//---------------------------------------------------------------------------
+
+// checkMapping refuses a document as Elasticsearch would: for a value that
+// does not suit the type of its field, or for a field that a strict object
+// does not map
+func (esi *MemIndex) checkMapping(path string, field map[string]interface{}, value interface{}, strict bool) error {
+	if value == nil {
+		return nil
+	}
+	typ := memFieldType(field)
+
+	if arr, ok := value.([]interface{}); ok {
+		// [lon, lat] is a single geo_point
+		if typ == "geo_point" {
+			if _, err := parseGeoPointValue(arr); err == nil {
+				return nil
+			}
+		}
+		for _, v := range arr {
+			if err := esi.checkMapping(path, field, v, strict); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if _, ok := value.(map[string]interface{}); ok && typ != "object" && typ != "geo_point" && typ != "geo_shape" {
+		return fmt.Errorf("failed to parse [%s]: found an object for a field of type [%s]", path, typ)
+	}
+
+	var err error
+	switch typ {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("object mapping for [%s] tried to parse field [%s] as object, but found a concrete value", path, path)
+		}
+		return esi.checkObject(path, field, obj, strict)
+	case "string":
+	case "long", "integer", "short", "byte", "double", "float":
+		err = esi.checkNumber(typ, value)
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			if s, isString := value.(string); !isString || (s != "true" && s != "false") {
+				err = fmt.Errorf("%v is not a boolean", value)
+			}
+		}
+	case "date":
+		if _, isNumber := value.(float64); !isNumber {
+			if _, ok := dslTime(value); !ok {
+				err = fmt.Errorf("%v is not a date", value)
+			}
+		}
+	case "geo_point":
+		_, err = parseGeoPointValue(value)
+	case "geo_shape":
+		_, err = parseGeoShapeValue(value)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse [%s]: %s", path, err)
+	}
+	return nil
+}
+
+func (esi *MemIndex) checkObject(path string, mapping map[string]interface{}, obj map[string]interface{}, strict bool) error {
+	if dynamic, ok := mapping["dynamic"]; ok {
+		strict = fmt.Sprint(dynamic) == "strict"
+	}
+	props, _ := mapping["properties"].(map[string]interface{})
+	for k, v := range obj {
+		field, ok := props[k].(map[string]interface{})
+		if !ok {
+			if strict {
+				within := path
+				if within == "" {
+					within = "_doc"
+				}
+				return fmt.Errorf("mapping set to strict, dynamic introduction of [%s] within [%s] is not allowed", k, within)
+			}
+			continue
+		}
+		if err := esi.checkMapping(memPath(path, k), field, v, strict); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkNumber takes numbers, and strings of them unless the index does not
+// coerce; whole number types take fractions only by coercion
+func (esi *MemIndex) checkNumber(typ string, value interface{}) error {
+	var n float64
+	switch v := value.(type) {
+	case float64:
+		n = v
+	case string:
+		if !esi.coerce {
+			return fmt.Errorf("%q is a string, and the index does not coerce", v)
+		}
+		var err error
+		if n, err = strconv.ParseFloat(v, 64); err != nil {
+			return fmt.Errorf("%q is not a number", v)
+		}
+	default:
+		return fmt.Errorf("%v is not a number", value)
+	}
+	if typ != "double" && typ != "float" && !esi.coerce && n != math.Trunc(n) {
+		return fmt.Errorf("%v is not a whole number", n)
+	}
+	return nil
+}
+
+// parse reads a document back from its JSON, checking it against the mapping
+// of its type
+func (esi *MemIndex) parse(typ string, obj interface{}) (*json.RawMessage, map[string]interface{}, error) {
+	byts, err := json.Marshal(obj)
+	if err != nil {
+		return nil, nil, err
+	}
+	source := map[string]interface{}{}
+	if err = json.Unmarshal(byts, &source); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse, document is empty or not an object")
+	}
+	if t, ok := esi.types[typ]; ok && typ != percolatorType {
+		if err = esi.checkObject("", t.mapping, source, false); err != nil {
+			return nil, nil, err
+		}
+	}
+	raw := json.RawMessage(byts)
+	return &raw, source, nil
+}
+
+//---------------------------------------------------------------------------
+
+// PostData indexes the document, making its type from the default mapping if
+// it is new, as Elasticsearch does
+func (esi *MemIndex) PostData(typ string, id string, obj interface{}) (*elasticsearch.IndexResponse, error) {
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+
+	if !esi.exists {
+		return nil, fmt.Errorf("Index %s does not exist", esi.name)
+	}
+	if _, ok := esi.types[typ]; !ok {
+		if err := esi.setMapping(typ, map[string]interface{}{}); err != nil {
+			return nil, err
+		}
+	}
+	raw, _, err := esi.parse(typ, obj)
+	if err != nil {
+		return nil, err
+	}
+	return esi.put(typ, id, raw), nil
+}
+
+func (esi *MemIndex) put(typ string, id string, raw *json.RawMessage) *elasticsearch.IndexResponse {
+	if id == "" {
+		esi.idSource++
+		id = strconv.Itoa(esi.idSource)
+	}
+	t := esi.types[typ]
+	_, existed := t.items[id]
+	t.items[id] = raw
+	t.versions[id]++
+	return &elasticsearch.IndexResponse{Created: !existed, ID: id, Index: esi.name, Type: typ, Version: int(t.versions[id])}
+}
+
+func (esi *MemIndex) PutData(typ string, id string, obj interface{}) (*elasticsearch.IndexResponse, error) {
+	return esi.PostData(typ, id, obj)
+}
+
+func (esi *MemIndex) GetByID(typ string, id string) (*elasticsearch.GetResult, error) {
+	esi.lock.RLock()
+	defer esi.lock.RUnlock()
+
+	if !esi.itemExists(typ, id) {
+		return &elasticsearch.GetResult{Found: false}, fmt.Errorf("Item %s in index %s and type %s does not exist", id, esi.name, typ)
+	}
+	return &elasticsearch.GetResult{ID: id, Source: esi.types[typ].items[id], Found: true}, nil
+}
+
+func (esi *MemIndex) DeleteByID(typ string, id string) (*elasticsearch.DeleteResponse, error) {
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+
+	if !esi.itemExists(typ, id) {
+		return &elasticsearch.DeleteResponse{Found: false}, fmt.Errorf("Item %s in index %s and type %s does not exist", id, esi.name, typ)
+	}
+	delete(esi.types[typ].items, id)
+	delete(esi.types[typ].versions, id)
+	return &elasticsearch.DeleteResponse{Found: true, ID: id}, nil
+}
+
+//---------------------------------------------------------------------------
+
+// search runs the search over one type, or over all of them but the
+// percolator's if typ is ""
+func (esi *MemIndex) search(typ string, search *dslSearch) (*elasticsearch.SearchResult, error) {
+	esi.lock.RLock()
+	if search.size >= 0 && search.from+search.size > esi.window {
+		esi.lock.RUnlock()
+		return nil, fmt.Errorf("Result window is too large, from + size must be less than or equal to: [%d] but was [%d]", esi.window, search.from+search.size)
+	}
+	docs := []dslDoc{}
+	raws := []*json.RawMessage{}
+	for name, t := range esi.types {
+		if (typ != "" && name != typ) || (typ == "" && name == percolatorType) {
+			continue
+		}
+		for id, raw := range t.items {
+			source := map[string]interface{}{}
+			if err := json.Unmarshal(*raw, &source); err != nil {
+				esi.lock.RUnlock()
+				return nil, err
+			}
+			docs = append(docs, dslDoc{id: id, typ: name, source: source, ref: len(raws)})
+			raws = append(raws, raw)
+		}
+	}
+	esi.lock.RUnlock()
+
+	hits, totalHits, err := search.run(docs)
+	if err != nil {
+		return nil, err
+	}
+	result := &elastic.SearchResult{Hits: &elastic.SearchHits{TotalHits: totalHits, Hits: make([]*elastic.SearchHit, len(hits))}}
+	for i, hit := range hits {
+		result.Hits.Hits[i] = &elastic.SearchHit{Index: esi.name, Id: hit.id, Source: raws[hit.ref]}
+	}
+	return elasticsearch.NewSearchResult(result), nil
+}
+
+// memSearch is paginationSearch, with Elasticsearch's page size when there is
+// no format
+func memSearch(query interface{}, format *piazza.JsonPagination) *dslSearch {
+	search := paginationSearch(query, format)
+	if format == nil {
+		search.size = memDefaultSize
+	}
+	return search
+}
+
+func (esi *MemIndex) FilterByMatchAll(typ string, format *piazza.JsonPagination) (*elasticsearch.SearchResult, error) {
+	return esi.search(typ, memSearch(nil, format))
+}
+
+func (esi *MemIndex) GetAllElements(typ string) (*elasticsearch.SearchResult, error) {
+	if typ == "" {
+		return nil, fmt.Errorf("MemIndex.GetAllElements: empty type")
+	}
+	if ok, _ := esi.TypeExists(typ); !ok {
+		return nil, fmt.Errorf("MemIndex.GetAllElements: type %s in index %s does not exist", typ, esi.name)
+	}
+	return esi.search(typ, memSearch(nil, nil))
+}
+
+func (esi *MemIndex) FilterByTermQuery(typ string, name string, value interface{}, format *piazza.JsonPagination) (*elasticsearch.SearchResult, error) {
+	if typ == "" {
+		return nil, fmt.Errorf("Can't filter on type \"\"")
+	}
+	if ok, _ := esi.TypeExists(typ); !ok {
+		return &elasticsearch.SearchResult{Found: false}, fmt.Errorf("Type %s in index %s does not exist", typ, esi.name)
+	}
+	return esi.search(typ, memSearch(termQuery(name, memValue(value)), format))
+}
+
+func (esi *MemIndex) FilterByMatchQuery(typ string, name string, value interface{}, format *piazza.JsonPagination) (*elasticsearch.SearchResult, error) {
+	if typ == "" {
+		return nil, fmt.Errorf("Can't filter on type \"\"")
+	}
+	if ok, _ := esi.TypeExists(typ); !ok {
+		return nil, fmt.Errorf("Type %s in index %s does not exist", typ, esi.name)
+	}
+	query := map[string]interface{}{"match": map[string]interface{}{name: memValue(value)}}
+	return esi.search(typ, memSearch(query, format))
+}
+
+// memValue is a query value as it would be after a trip through JSON, so that
+// an Ident is a string
+func memValue(value interface{}) interface{} {
+	byts, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	var out interface{}
+	if err = json.Unmarshal(byts, &out); err != nil {
+		return value
+	}
+	return out
+}
+
+func (esi *MemIndex) SearchByJSON(typ string, jsn string) (*elasticsearch.SearchResult, error) {
+	search, err := parseDslSearch(jsn)
+	if err != nil {
+		return nil, err
+	}
+	return esi.search(typ, search)
+}
+
+func (esi *MemIndex) GetTypes() ([]string, error) {
+	esi.lock.RLock()
+	defer esi.lock.RUnlock()
+
+	if !esi.exists {
+		return nil, fmt.Errorf("Index %s does not exist", esi.name)
+	}
+	types := []string{}
+	for typ := range esi.types {
+		if typ != memDefaultType && typ != percolatorType {
+			types = append(types, typ)
+		}
+	}
+	sort.Strings(types)
+	return types, nil
+}
+
+// GetMapping is the mapping of the type, under the type's name
+func (esi *MemIndex) GetMapping(typ string) (interface{}, error) {
+	esi.lock.RLock()
+	defer esi.lock.RUnlock()
+
+	if !esi.typeExists(typ) {
+		return nil, fmt.Errorf("Type %s in index %s does not exist", typ, esi.name)
+	}
+	return map[string]interface{}{typ: memCopy(esi.types[typ].mapping)}, nil
+}
+
+//---------------------------------------------------------------------------
+
+// AddPercolationQuery registers the query, refusing one that the query DSL
+// cannot evaluate. The query is usually under "query", but may stand alone.
+func (esi *MemIndex) AddPercolationQuery(id string, query piazza.JsonString) (*elasticsearch.IndexResponse, error) {
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+
+	if !esi.exists {
+		return nil, fmt.Errorf("Index %s does not exist", esi.name)
+	}
+	raw, source, err := esi.parse(percolatorType, json.RawMessage(query))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = dslMatches(source, dslDoc{id: id, source: map[string]interface{}{}}); err != nil {
+		return nil, fmt.Errorf("failed to parse query [%s]: %s", id, err)
+	}
+	if _, ok := esi.types[percolatorType]; !ok {
+		esi.types[percolatorType] = newMemIndexType()
+	}
+	return esi.put(percolatorType, id, raw), nil
+}
+
+func (esi *MemIndex) DeletePercolationQuery(id string) (*elasticsearch.DeleteResponse, error) {
+	return esi.DeleteByID(percolatorType, id)
+}
+
+// AddPercolationDocument reads the document as one of the given type, and
+// answers with the registered queries that match it, in order of id
+func (esi *MemIndex) AddPercolationDocument(typ string, doc interface{}) (*elasticsearch.PercolateResponse, error) {
+	esi.lock.RLock()
+	defer esi.lock.RUnlock()
+
+	if !esi.typeExists(typ) {
+		return nil, fmt.Errorf("Type %s in index %s does not exist", typ, esi.name)
+	}
+	_, source, err := esi.parse(typ, doc)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	if percolators, ok := esi.types[percolatorType]; ok {
+		for id := range percolators.items {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	result := &elastic.PercolateResponse{Matches: []*elastic.PercolateMatch{}}
+	for _, id := range ids {
+		var query interface{}
+		if err = json.Unmarshal(*esi.types[percolatorType].items[id], &query); err != nil {
+			return nil, err
+		}
+		matched, err := dslMatches(query, dslDoc{source: source})
+		if err != nil {
+			return nil, fmt.Errorf("percolator %s: %s", id, err)
+		}
+		if matched {
+			result.Matches = append(result.Matches, &elastic.PercolateMatch{Index: esi.name, Id: id})
+		}
+	}
+	result.Total = int64(len(result.Matches))
+	return elasticsearch.NewPercolateResponse(result), nil
+}
+
+// DirectAccess supports only what workflow asks of it: dropping a type,
+// with DELETE /<index>/_mapping/<type>, deleting what a query matches,
+// with DELETE /<index>/<type>/_query as the delete-by-query plugin does,
+// finding the ids and types of what a query matches across the types, with
+// POST /<index>/_search, scripted upserts, with
+// POST /<index>/<type>/<id>/_update, and reading, writing and deleting a
+// document with its version, with GET, PUT and DELETE /<index>/<type>/<id>.
+// Parameters of the endpoint other than version are ignored.
+func (esi *MemIndex) DirectAccess(verb string, endpoint string, input interface{}, output interface{}) error {
+	path := strings.SplitN(endpoint, "?", 2)
+	parts := strings.Split(strings.Trim(path[0], "/"), "/")
+	if verb == "POST" && len(parts) == 2 && parts[0] == esi.name && parts[1] == "_search" {
+		return esi.searchTypes(input, output)
+	}
+	if verb == "POST" && len(parts) == 4 && parts[0] == esi.name && parts[3] == "_update" {
+		return esi.update(parts[1], parts[2], input, output)
+	}
+	if len(parts) != 3 || parts[0] != esi.name {
+		return fmt.Errorf("MemIndex.DirectAccess: %s %s is not supported", verb, endpoint)
+	}
+	switch {
+	case verb == "DELETE" && parts[1] == "_mapping":
+		return esi.deleteType(parts[2])
+	case verb == "DELETE" && parts[2] == "_query":
+		return esi.deleteByQuery(parts[1], input, output)
+	case verb == "GET" || verb == "PUT" || verb == "DELETE":
+		var params url.Values
+		if len(path) == 2 {
+			var err error
+			if params, err = url.ParseQuery(path[1]); err != nil {
+				return err
+			}
+		}
+		return esi.document(verb, parts[1], parts[2], params, input, output)
+	}
+	return fmt.Errorf("MemIndex.DirectAccess: %s %s is not supported", verb, endpoint)
+}
+
+// document reads, writes or deletes the document, answering as
+// Elasticsearch does, and refusing with a conflict to write or delete a
+// version of it other than the one asked for, if one is
+func (esi *MemIndex) document(verb string, typ string, id string, params url.Values, input interface{}, output interface{}) error {
+	var version int64
+	if param := params.Get("version"); param != "" {
+		var err error
+		if version, err = strconv.ParseInt(param, 10, 64); err != nil {
+			return fmt.Errorf("MemIndex.DirectAccess: version %q is not a number", param)
+		}
+	}
+
+	if verb == "GET" {
+		esi.lock.RLock()
+		defer esi.lock.RUnlock()
+	} else {
+		esi.lock.Lock()
+		defer esi.lock.Unlock()
+	}
+
+	var raw *json.RawMessage
+	var current int64
+	t, ok := esi.types[typ]
+	if ok {
+		raw, current = t.items[id], t.versions[id]
+	}
+
+	resp := map[string]interface{}{"_index": esi.name, "_type": typ, "_id": id}
+	switch {
+	case verb != "GET" && version != 0 && (raw == nil || version != current):
+		reason := fmt.Sprintf("[%s][%s]: version conflict, current [%d], provided [%d]", typ, id, current, version)
+		resp = map[string]interface{}{
+			"error":  map[string]interface{}{"type": "version_conflict_engine_exception", "reason": reason},
+			"status": 409,
+		}
+	case verb == "GET":
+		resp["found"] = raw != nil
+		if raw != nil {
+			resp["_version"] = current
+			resp["_source"] = raw
+		}
+	case verb == "PUT":
+		if !esi.exists {
+			return fmt.Errorf("Index %s does not exist", esi.name)
+		}
+		if !ok {
+			if err := esi.setMapping(typ, map[string]interface{}{}); err != nil {
+				return err
+			}
+		}
+		parsed, _, err := esi.parse(typ, input)
+		if err != nil {
+			return err
+		}
+		written := esi.put(typ, id, parsed)
+		resp["_version"] = written.Version
+		resp["created"] = written.Created
+	case verb == "DELETE":
+		resp["found"] = raw != nil
+		if raw != nil {
+			delete(t.items, id)
+			delete(t.versions, id)
+			resp["_version"] = current + 1
+		}
+	}
+
+	byts, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(byts, output)
+}
+
+func (esi *MemIndex) deleteType(typ string) error {
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+
+	if !esi.typeExists(typ) {
+		return fmt.Errorf("type[[%s]] missing", typ)
+	}
+	delete(esi.types, typ)
+	return nil
+}
+
+func (esi *MemIndex) deleteByQuery(typ string, input interface{}, output interface{}) error {
+	// the body as Elasticsearch would read it
+	byts, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	var body map[string]interface{}
+	if err = json.Unmarshal(byts, &body); err != nil {
+		return err
+	}
+
+	esi.lock.Lock()
+	deleted := 0
+	if esi.typeExists(typ) {
+		t := esi.types[typ]
+		for id, raw := range t.items {
+			source := map[string]interface{}{}
+			if err = json.Unmarshal(*raw, &source); err != nil {
+				esi.lock.Unlock()
+				return err
+			}
+			matched, err := dslMatches(body["query"], dslDoc{id: id, source: source})
+			if err != nil {
+				esi.lock.Unlock()
+				return err
+			}
+			if matched {
+				delete(t.items, id)
+				delete(t.versions, id)
+				deleted++
+			}
+		}
+	}
+	esi.lock.Unlock()
+
+	all := map[string]interface{}{"found": deleted, "deleted": deleted, "missing": 0, "failed": 0}
+	if byts, err = json.Marshal(map[string]interface{}{"_indices": map[string]interface{}{"_all": all, esi.name: all}}); err != nil {
+		return err
+	}
+	return json.Unmarshal(byts, output)
+}
+
+func (esi *MemIndex) searchTypes(input interface{}, output interface{}) error {
+	byts, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	var body map[string]interface{}
+	if err = json.Unmarshal(byts, &body); err != nil {
+		return err
+	}
+
+	hits := []interface{}{}
+	esi.lock.RLock()
+	for typ, t := range esi.types {
+		if typ == percolatorType || typ == memDefaultType {
+			continue
+		}
+		for id, raw := range t.items {
+			source := map[string]interface{}{}
+			if err = json.Unmarshal(*raw, &source); err != nil {
+				esi.lock.RUnlock()
+				return err
+			}
+			matched, err := dslMatches(body["query"], dslDoc{id: id, source: source})
+			if err != nil {
+				esi.lock.RUnlock()
+				return err
+			}
+			if matched {
+				hits = append(hits, map[string]interface{}{"_index": esi.name, "_type": typ, "_id": id})
+			}
+		}
+	}
+	esi.lock.RUnlock()
+
+	if byts, err = json.Marshal(map[string]interface{}{"hits": map[string]interface{}{"total": len(hits), "hits": hits}}); err != nil {
+		return err
+	}
+	return json.Unmarshal(byts, output)
+}
+
+// memScriptStatement is the one form of statement a MemIndex runs in an
+// update script: ctx._source.<field> = <param>, or += <param>
+var memScriptStatement = regexp.MustCompile(`^ctx\._source\.(\w+)\s*(\+=|=)\s*(\w+)$`)
+
+// update runs the script of a scripted upsert on the document, or indexes
+// the upsert if there is no document
+func (esi *MemIndex) update(typ string, id string, input interface{}, output interface{}) error {
+	byts, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	var body struct {
+		Script struct {
+			Inline string                 `json:"inline"`
+			Params map[string]interface{} `json:"params"`
+		} `json:"script"`
+		Upsert map[string]interface{} `json:"upsert"`
+	}
+	if err = json.Unmarshal(byts, &body); err != nil {
+		return err
+	}
+
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+
+	if !esi.exists {
+		return fmt.Errorf("Index %s does not exist", esi.name)
+	}
+	if _, ok := esi.types[typ]; !ok {
+		if err = esi.setMapping(typ, map[string]interface{}{}); err != nil {
+			return err
+		}
+	}
+	doc := body.Upsert
+	if raw, ok := esi.types[typ].items[id]; ok {
+		doc = map[string]interface{}{}
+		if err = json.Unmarshal(*raw, &doc); err != nil {
+			return err
+		}
+		for _, statement := range strings.Split(body.Script.Inline, ";") {
+			match := memScriptStatement.FindStringSubmatch(strings.TrimSpace(statement))
+			if match == nil {
+				return fmt.Errorf("MemIndex.DirectAccess: cannot run script statement %q", statement)
+			}
+			field, op, param := match[1], match[2], body.Script.Params[match[3]]
+			if op == "=" {
+				doc[field] = param
+				continue
+			}
+			n, ok1 := doc[field].(float64)
+			add, ok2 := param.(float64)
+			if !ok1 || !ok2 {
+				return fmt.Errorf("MemIndex.DirectAccess: cannot add %v to %s", param, field)
+			}
+			doc[field] = n + add
+		}
+	}
+	raw, _, err := esi.parse(typ, doc)
+	if err != nil {
+		return err
+	}
+	resp := esi.put(typ, id, raw)
+	if byts, err = json.Marshal(map[string]interface{}{"_index": esi.name, "_type": typ, "_id": resp.ID}); err != nil {
+		return err
+	}
+	return json.Unmarshal(byts, output)
+}
@@ -0,0 +1,428 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// ContentTypePrometheus is the media type of GET /metrics, version 0.0.4 of
+// the Prometheus text format
+const ContentTypePrometheus = "text/plain; version=0.0.4; charset=utf-8"
+
+// The metrics of GET /metrics. Counters and histograms last as long as the
+// process, which Prometheus expects and allows for.
+const (
+	metricEvents             = "pzworkflow_events_total"
+	metricTriggerFirings     = "pzworkflow_trigger_firings_total"
+	metricHTTPRequests       = "pzworkflow_http_requests_total"
+	metricPercolation        = "pzworkflow_percolation_duration_seconds"
+	metricIdam               = "pzworkflow_idam_duration_seconds"
+	metricRabbitMQPublish    = "pzworkflow_rabbitmq_publish_duration_seconds"
+	metricElasticsearch      = "pzworkflow_elasticsearch_duration_seconds"
+	metricHTTPDuration       = "pzworkflow_http_request_duration_seconds"
+	metricCronEntries        = "pzworkflow_cron_entries"
+	metricDispatchesInFlight = "pzworkflow_dispatches_in_flight"
+)
+
+var metricHelp = map[string]string{
+	metricEvents:             "Events posted, by EventType.",
+	metricTriggerFirings:     "Jobs sent for a trigger an event fired, by trigger.",
+	metricHTTPRequests:       "HTTP requests answered, by route and status code.",
+	metricPercolation:        "Time taken to find the triggers an event fires.",
+	metricIdam:               "Time taken by pz-idam to authorize the job of a fired trigger.",
+	metricRabbitMQPublish:    "Time taken to send the job of a fired trigger to RabbitMQ.",
+	metricElasticsearch:      "Time taken by Elasticsearch, by index and operation.",
+	metricHTTPDuration:       "Time taken to answer HTTP requests, by route.",
+	metricCronEntries:        "Repeating events scheduled.",
+	metricDispatchesInFlight: "Fired triggers whose jobs are being sent.",
+}
+
+// the upper bounds, in seconds, of the histogram buckets; those the
+// Prometheus client libraries default to
+var metricBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metricHistogram struct {
+	// per bucket, and past the last; the text format wants them cumulative
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *metricHistogram) observe(seconds float64) {
+	i := sort.SearchFloat64s(metricBuckets, seconds)
+	h.counts[i]++
+	h.count++
+	h.sum += seconds
+}
+
+// metrics holds the counters and histograms, each series under its rendered
+// labels. Gauges are read when asked for.
+type metrics struct {
+	lock       sync.Mutex
+	counters   map[string]map[string]float64
+	histograms map[string]map[string]*metricHistogram
+	inFlight   int64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		counters:   map[string]map[string]float64{},
+		histograms: map[string]map[string]*metricHistogram{},
+	}
+}
+
+// inc adds one to a counter; labels are name, value pairs
+func (m *metrics) inc(name string, labels ...string) {
+	key := metricLabels(labels)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.counters[name] == nil {
+		m.counters[name] = map[string]float64{}
+	}
+	m.counters[name][key]++
+}
+
+// since observes the time from start until now
+func (m *metrics) since(name string, start time.Time, labels ...string) {
+	seconds := time.Since(start).Seconds()
+	key := metricLabels(labels)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.histograms[name] == nil {
+		m.histograms[name] = map[string]*metricHistogram{}
+	}
+	h := m.histograms[name][key]
+	if h == nil {
+		h = &metricHistogram{counts: make([]uint64, len(metricBuckets)+1)}
+		m.histograms[name][key] = h
+	}
+	h.observe(seconds)
+}
+
+func (m *metrics) dispatchStarted() {
+	atomic.AddInt64(&m.inFlight, 1)
+}
+
+func (m *metrics) dispatchDone() {
+	atomic.AddInt64(&m.inFlight, -1)
+}
+
+var metricEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func metricLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		parts = append(parts, labels[i]+`="`+metricEscaper.Replace(labels[i+1])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// withLabel adds a label to rendered labels
+func withLabel(key string, label string) string {
+	if key == "" {
+		return "{" + label + "}"
+	}
+	return key[:len(key)-1] + "," + label + "}"
+}
+
+// write renders the metrics in the text format, with the given gauges
+func (m *metrics) write(buf *bytes.Buffer, gauges map[string]float64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	names := []string{}
+	for name := range m.counters {
+		names = append(names, name)
+	}
+	for name := range m.histograms {
+		names = append(names, name)
+	}
+	for name := range gauges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(buf, "# HELP %s %s\n", name, metricHelp[name])
+		if series, ok := m.counters[name]; ok {
+			fmt.Fprintf(buf, "# TYPE %s counter\n", name)
+			for _, key := range sortedKeys(series) {
+				fmt.Fprintf(buf, "%s%s %s\n", name, key, formatMetric(series[key]))
+			}
+		} else if series, ok := m.histograms[name]; ok {
+			fmt.Fprintf(buf, "# TYPE %s histogram\n", name)
+			keys := []string{}
+			for key := range series {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				h := series[key]
+				var cumulative uint64
+				for i, count := range h.counts {
+					cumulative += count
+					le := "+Inf"
+					if i < len(metricBuckets) {
+						le = formatMetric(metricBuckets[i])
+					}
+					fmt.Fprintf(buf, "%s_bucket%s %d\n", name, withLabel(key, `le="`+le+`"`), cumulative)
+				}
+				fmt.Fprintf(buf, "%s_sum%s %s\n", name, key, formatMetric(h.sum))
+				fmt.Fprintf(buf, "%s_count%s %d\n", name, key, h.count)
+			}
+		} else {
+			fmt.Fprintf(buf, "# TYPE %s gauge\n", name)
+			fmt.Fprintf(buf, "%s %s\n", name, formatMetric(gauges[name]))
+		}
+	}
+}
+
+func sortedKeys(series map[string]float64) []string {
+	keys := []string{}
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatMetric(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Metrics is GET /metrics
+func (service *Service) Metrics() []byte {
+	service.cronLock.Lock()
+	cronEntries := len(service.cronJobs)
+	service.cronLock.Unlock()
+
+	var buf bytes.Buffer
+	service.metrics.write(&buf, map[string]float64{
+		metricCronEntries:        float64(cronEntries),
+		metricDispatchesInFlight: float64(atomic.LoadInt64(&service.metrics.inFlight)),
+	})
+	return buf.Bytes()
+}
+
+// instrument counts and times the requests of a route, under its path rather
+// than the URL asked for
+func (server *Server) instrument(route piazza.RouteData) gin.HandlerFunc {
+	handler := route.Handler
+	return func(c *gin.Context) {
+		start := time.Now()
+		handler(c)
+		metrics := server.service.metrics
+		metrics.inc(metricHTTPRequests, "method", route.Verb, "route", route.Path, "code", strconv.Itoa(c.Writer.Status()))
+		metrics.since(metricHTTPDuration, start, "method", route.Verb, "route", route.Path)
+	}
+}
+
+//---------------------------------------------------------------------------
+
+// timedIndex times, and traces, the calls an index makes to Elasticsearch
+type timedIndex struct {
+	elasticsearch.IIndex
+	metrics *metrics
+	tracer  *tracer
+}
+
+func (service *Service) timeIndex(esi elasticsearch.IIndex) elasticsearch.IIndex {
+	if _, ok := esi.(*timedIndex); ok {
+		return esi
+	}
+	return &timedIndex{IIndex: esi, metrics: service.metrics, tracer: service.tracer}
+}
+
+type timedCall struct {
+	esi       *timedIndex
+	operation string
+	start     time.Time
+	span      *Span
+}
+
+func (esi *timedIndex) call(operation string) *timedCall {
+	span := esi.tracer.start("elasticsearch "+operation, SpanKindClient, nil)
+	span.set("db.system", "elasticsearch")
+	span.set("db.operation", operation)
+	span.set("db.name", esi.IIndex.IndexName())
+	return &timedCall{esi: esi, operation: operation, start: time.Now(), span: span}
+}
+
+func (call *timedCall) done(err error) {
+	call.esi.metrics.since(metricElasticsearch, call.start, "index", call.esi.IIndex.IndexName(), "operation", call.operation)
+	call.span.end(err)
+}
+
+func (esi *timedIndex) IndexExists() (bool, error) {
+	call := esi.call("IndexExists")
+	out, err := esi.IIndex.IndexExists()
+	call.done(err)
+	return out, err
+}
+
+func (esi *timedIndex) TypeExists(typ string) (bool, error) {
+	call := esi.call("TypeExists")
+	out, err := esi.IIndex.TypeExists(typ)
+	call.done(err)
+	return out, err
+}
+
+func (esi *timedIndex) ItemExists(typ string, id string) (bool, error) {
+	call := esi.call("ItemExists")
+	out, err := esi.IIndex.ItemExists(typ, id)
+	call.done(err)
+	return out, err
+}
+
+func (esi *timedIndex) Create(settings string) error {
+	call := esi.call("Create")
+	err := esi.IIndex.Create(settings)
+	call.done(err)
+	return err
+}
+
+func (esi *timedIndex) Delete() error {
+	call := esi.call("Delete")
+	err := esi.IIndex.Delete()
+	call.done(err)
+	return err
+}
+
+func (esi *timedIndex) PostData(typ string, id string, obj interface{}) (*elasticsearch.IndexResponse, error) {
+	call := esi.call("PostData")
+	out, err := esi.IIndex.PostData(typ, id, obj)
+	call.done(err)
+	return out, err
+}
+
+func (esi *timedIndex) PutData(typ string, id string, obj interface{}) (*elasticsearch.IndexResponse, error) {
+	call := esi.call("PutData")
+	out, err := esi.IIndex.PutData(typ, id, obj)
+	call.done(err)
+	return out, err
+}
+
+func (esi *timedIndex) GetByID(typ string, id string) (*elasticsearch.GetResult, error) {
+	call := esi.call("GetByID")
+	out, err := esi.IIndex.GetByID(typ, id)
+	call.done(err)
+	return out, err
+}
+
+func (esi *timedIndex) DeleteByID(typ string, id string) (*elasticsearch.DeleteResponse, error) {
+	call := esi.call("DeleteByID")
+	out, err := esi.IIndex.DeleteByID(typ, id)
+	call.done(err)
+	return out, err
+}
+
+func (esi *timedIndex) FilterByMatchAll(typ string, format *piazza.JsonPagination) (*elasticsearch.SearchResult, error) {
+	call := esi.call("FilterByMatchAll")
+	out, err := esi.IIndex.FilterByMatchAll(typ, format)
+	call.done(err)
+	return out, err
+}
+
+func (esi *timedIndex) GetAllElements(typ string) (*elasticsearch.SearchResult, error) {
+	call := esi.call("GetAllElements")
+	out, err := esi.IIndex.GetAllElements(typ)
+	call.done(err)
+	return out, err
+}
+
+func (esi *timedIndex) FilterByTermQuery(typ string, name string, value interface{}, format *piazza.JsonPagination) (*elasticsearch.SearchResult, error) {
+	call := esi.call("FilterByTermQuery")
+	out, err := esi.IIndex.FilterByTermQuery(typ, name, value, format)
+	call.done(err)
+	return out, err
+}
+
+func (esi *timedIndex) FilterByMatchQuery(typ string, name string, value interface{}, format *piazza.JsonPagination) (*elasticsearch.SearchResult, error) {
+	call := esi.call("FilterByMatchQuery")
+	out, err := esi.IIndex.FilterByMatchQuery(typ, name, value, format)
+	call.done(err)
+	return out, err
+}
+
+func (esi *timedIndex) SearchByJSON(typ string, jsn string) (*elasticsearch.SearchResult, error) {
+	call := esi.call("SearchByJSON")
+	out, err := esi.IIndex.SearchByJSON(typ, jsn)
+	call.done(err)
+	return out, err
+}
+
+func (esi *timedIndex) SetMapping(typename string, jsn piazza.JsonString) error {
+	call := esi.call("SetMapping")
+	err := esi.IIndex.SetMapping(typename, jsn)
+	call.done(err)
+	return err
+}
+
+func (esi *timedIndex) GetTypes() ([]string, error) {
+	call := esi.call("GetTypes")
+	out, err := esi.IIndex.GetTypes()
+	call.done(err)
+	return out, err
+}
+
+func (esi *timedIndex) GetMapping(typ string) (interface{}, error) {
+	call := esi.call("GetMapping")
+	out, err := esi.IIndex.GetMapping(typ)
+	call.done(err)
+	return out, err
+}
+
+func (esi *timedIndex) AddPercolationQuery(id string, query piazza.JsonString) (*elasticsearch.IndexResponse, error) {
+	call := esi.call("AddPercolationQuery")
+	out, err := esi.IIndex.AddPercolationQuery(id, query)
+	call.done(err)
+	return out, err
+}
+
+func (esi *timedIndex) DeletePercolationQuery(id string) (*elasticsearch.DeleteResponse, error) {
+	call := esi.call("DeletePercolationQuery")
+	out, err := esi.IIndex.DeletePercolationQuery(id)
+	call.done(err)
+	return out, err
+}
+
+func (esi *timedIndex) AddPercolationDocument(typ string, doc interface{}) (*elasticsearch.PercolateResponse, error) {
+	call := esi.call("AddPercolationDocument")
+	out, err := esi.IIndex.AddPercolationDocument(typ, doc)
+	call.done(err)
+	return out, err
+}
+
+func (esi *timedIndex) DirectAccess(verb string, endpoint string, input interface{}, output interface{}) error {
+	call := esi.call("DirectAccess")
+	err := esi.IIndex.DirectAccess(verb, endpoint, input, output)
+	call.done(err)
+	return err
+}
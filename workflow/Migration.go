@@ -0,0 +1,483 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// the index in which applied migrations are recorded
+const migrationIndex = "workflowmigrations"
+const migrationType = "Migration"
+
+const migrationSettings = `
+	{
+		"mappings": {
+			"Migration": {
+				"dynamic": "strict",
+				"properties": {
+					"version": {
+						"type": "integer"
+					},
+					"alias": {
+						"type": "string",
+						"index": "not_analyzed"
+					},
+					"index": {
+						"type": "string",
+						"index": "not_analyzed"
+					},
+					"appliedOn": {
+						"type": "date",
+						"format": "` + esDateFormat + `"
+					}
+				}
+			}
+		}
+	}`
+
+//---------------------------------------------------------------------------
+
+// Migration moves an alias onto a new index, created with the given
+// settings. With Reindex, the documents of the indices the alias was on are
+// copied into the new one first.
+type Migration struct {
+	Version  int
+	Alias    string
+	Index    string
+	Settings string
+	Reindex  bool
+}
+
+// MigrationRecord is kept in the metadata index for each applied Migration
+type MigrationRecord struct {
+	Version   int              `json:"version"`
+	Alias     string           `json:"alias"`
+	Index     string           `json:"index"`
+	AppliedOn piazza.TimeStamp `json:"appliedOn"`
+}
+
+// MigrationStatus tells whether a Migration has been applied, and when
+type MigrationStatus struct {
+	Version   int               `json:"version"`
+	Alias     string            `json:"alias"`
+	Index     string            `json:"index"`
+	Applied   bool              `json:"applied"`
+	AppliedOn *piazza.TimeStamp `json:"appliedOn,omitempty"`
+}
+
+//---------------------------------------------------------------------------
+
+// IndexAdmin is what migrations need of Elasticsearch beyond a single index
+type IndexAdmin interface {
+	IndexExists(name string) (bool, error)
+	// OpenIndex creates the index, with the settings, if it does not exist
+	OpenIndex(name string, settings string) (elasticsearch.IIndex, error)
+	DeleteIndex(name string) error
+	// AliasIndices lists the indices the alias is on
+	AliasIndices(alias string) ([]string, error)
+	// SwapAlias moves the alias from whatever indices it is on to this one,
+	// in one step
+	SwapAlias(alias string, index string) error
+}
+
+// EsIndexAdmin is the IndexAdmin of a real cluster
+type EsIndexAdmin struct {
+	url string
+}
+
+func NewEsIndexAdmin(sys *piazza.SystemConfig) (*EsIndexAdmin, error) {
+	url, err := sys.GetURL(piazza.PzElasticSearch)
+	if err != nil {
+		return nil, err
+	}
+	return &EsIndexAdmin{url: url}, nil
+}
+
+func (admin *EsIndexAdmin) IndexExists(name string) (bool, error) {
+	h := &piazza.Http{BaseUrl: admin.url}
+	code, err := h.Verb("GET", "/"+name, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	return code == http.StatusOK, nil
+}
+
+func (admin *EsIndexAdmin) OpenIndex(name string, settings string) (elasticsearch.IIndex, error) {
+	return elasticsearch.NewIndex2(admin.url, name, settings)
+}
+
+func (admin *EsIndexAdmin) DeleteIndex(name string) error {
+	h := &piazza.Http{BaseUrl: admin.url}
+	code, err := h.Verb("DELETE", "/"+name, nil, nil)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK {
+		return fmt.Errorf("could not delete index %s: status %d", name, code)
+	}
+	return nil
+}
+
+func (admin *EsIndexAdmin) AliasIndices(alias string) ([]string, error) {
+	h := &piazza.Http{BaseUrl: admin.url}
+
+	out := map[string]json.RawMessage{}
+	code, err := h.Verb("GET", "/_alias/"+alias, nil, &out)
+	if code == http.StatusNotFound {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if code != http.StatusOK {
+		return nil, fmt.Errorf("could not get the indices of alias %s: status %d", alias, code)
+	}
+
+	indices := []string{}
+	for index := range out {
+		indices = append(indices, index)
+	}
+	return indices, nil
+}
+
+func (admin *EsIndexAdmin) SwapAlias(alias string, index string) error {
+	current, err := admin.AliasIndices(alias)
+	if err != nil {
+		return err
+	}
+
+	actions := []map[string]map[string]string{}
+	for _, old := range current {
+		actions = append(actions, map[string]map[string]string{"remove": {"index": old, "alias": alias}})
+	}
+	actions = append(actions, map[string]map[string]string{"add": {"index": index, "alias": alias}})
+
+	h := &piazza.Http{BaseUrl: admin.url}
+	out := struct {
+		Acknowledged bool `json:"acknowledged"`
+	}{}
+	code, err := h.Verb("POST", "/_aliases", map[string]interface{}{"actions": actions}, &out)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK || !out.Acknowledged {
+		return fmt.Errorf("could not move alias %s to index %s: status %d", alias, index, code)
+	}
+	return nil
+}
+
+// MockIndexAdmin keeps MemIndexes, for testing migrations
+type MockIndexAdmin struct {
+	indices map[string]*MemIndex
+	aliases map[string]string
+}
+
+func NewMockIndexAdmin() *MockIndexAdmin {
+	return &MockIndexAdmin{
+		indices: map[string]*MemIndex{},
+		aliases: map[string]string{},
+	}
+}
+
+// addIndex puts an index made elsewhere behind an alias of its own name
+func (admin *MockIndexAdmin) addIndex(esi *MemIndex) {
+	admin.indices[esi.IndexName()] = esi
+	admin.aliases[esi.IndexName()] = esi.IndexName()
+}
+
+func (admin *MockIndexAdmin) IndexExists(name string) (bool, error) {
+	if index, ok := admin.aliases[name]; ok {
+		name = index
+	}
+	_, ok := admin.indices[name]
+	return ok, nil
+}
+
+func (admin *MockIndexAdmin) OpenIndex(name string, settings string) (elasticsearch.IIndex, error) {
+	if index, ok := admin.aliases[name]; ok {
+		name = index
+	}
+	if esi, ok := admin.indices[name]; ok {
+		return esi, nil
+	}
+	esi := NewMemIndex(name)
+	if err := esi.Create(settings); err != nil {
+		return nil, err
+	}
+	admin.indices[name] = esi
+	return esi, nil
+}
+
+func (admin *MockIndexAdmin) DeleteIndex(name string) error {
+	esi, ok := admin.indices[name]
+	if !ok {
+		return fmt.Errorf("index %s does not exist", name)
+	}
+	delete(admin.indices, name)
+	return esi.Delete()
+}
+
+func (admin *MockIndexAdmin) AliasIndices(alias string) ([]string, error) {
+	if index, ok := admin.aliases[alias]; ok {
+		return []string{index}, nil
+	}
+	return []string{}, nil
+}
+
+func (admin *MockIndexAdmin) SwapAlias(alias string, index string) error {
+	if _, ok := admin.indices[index]; !ok {
+		return fmt.Errorf("index %s does not exist", index)
+	}
+	admin.aliases[alias] = index
+	return nil
+}
+
+//---------------------------------------------------------------------------
+
+// Migrator applies Migrations in order of version, recording each as it
+// goes, so that it can be run again and again
+type Migrator struct {
+	admin      IndexAdmin
+	migrations []Migration
+}
+
+func NewMigrator(admin IndexAdmin, migrations []Migration) (*Migrator, error) {
+	for i, migration := range migrations {
+		if i > 0 && migration.Version <= migrations[i-1].Version {
+			return nil, fmt.Errorf("migration %d must come before migration %d", migration.Version, migrations[i-1].Version)
+		}
+		if migration.Alias == "" || migration.Index == "" {
+			return nil, fmt.Errorf("migration %d needs both an alias and an index", migration.Version)
+		}
+	}
+	return &Migrator{admin: admin, migrations: migrations}, nil
+}
+
+// Aliases are those the migrations move, in the order they first appear
+func (migrator *Migrator) Aliases() []string {
+	seen := map[string]bool{}
+	aliases := []string{}
+	for _, migration := range migrator.migrations {
+		if !seen[migration.Alias] {
+			seen[migration.Alias] = true
+			aliases = append(aliases, migration.Alias)
+		}
+	}
+	return aliases
+}
+
+func (migrator *Migrator) records() (elasticsearch.IIndex, map[int]MigrationRecord, error) {
+	esi, err := migrator.admin.OpenIndex(migrationIndex, migrationSettings)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	records := map[int]MigrationRecord{}
+	err = exportPages("_uid", nil, func(dsl string) (int, string, error) {
+		resp, err := esi.SearchByJSON(migrationType, dsl)
+		if err != nil {
+			return 0, "", err
+		}
+		last := ""
+		for _, hit := range *resp.GetHits() {
+			var record MigrationRecord
+			if err = json.Unmarshal(*hit.Source, &record); err != nil {
+				return 0, "", err
+			}
+			records[record.Version] = record
+			last = migrationType + "#" + hit.ID
+		}
+		return resp.NumHits(), last, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return esi, records, nil
+}
+
+// Status is every migration, applied or not
+func (migrator *Migrator) Status() ([]MigrationStatus, error) {
+	_, records, err := migrator.records()
+	if err != nil {
+		return nil, err
+	}
+
+	status := []MigrationStatus{}
+	for _, migration := range migrator.migrations {
+		s := MigrationStatus{Version: migration.Version, Alias: migration.Alias, Index: migration.Index}
+		if record, ok := records[migration.Version]; ok {
+			appliedOn := record.AppliedOn
+			s.Applied = true
+			s.AppliedOn = &appliedOn
+		}
+		status = append(status, s)
+	}
+	return status, nil
+}
+
+// Up applies the migrations not yet recorded, stopping at the first to fail,
+// and returns those it applied
+func (migrator *Migrator) Up() ([]MigrationRecord, error) {
+	esi, records, err := migrator.records()
+	if err != nil {
+		return nil, err
+	}
+
+	applied := []MigrationRecord{}
+	for _, migration := range migrator.migrations {
+		if _, ok := records[migration.Version]; ok {
+			continue
+		}
+		if err = migrator.apply(&migration); err != nil {
+			return applied, fmt.Errorf("migration %d (%s to %s) failed: %s", migration.Version, migration.Alias, migration.Index, err)
+		}
+
+		record := MigrationRecord{
+			Version:   migration.Version,
+			Alias:     migration.Alias,
+			Index:     migration.Index,
+			AppliedOn: piazza.NewTimeStamp(),
+		}
+		if _, err = esi.PostData(migrationType, strconv.Itoa(record.Version), &record); err != nil {
+			return applied, err
+		}
+		applied = append(applied, record)
+	}
+	return applied, nil
+}
+
+func (migrator *Migrator) apply(migration *Migration) error {
+	current, err := migrator.admin.AliasIndices(migration.Alias)
+	if err != nil {
+		return err
+	}
+
+	to, err := migrator.admin.OpenIndex(migration.Index, migration.Settings)
+	if err != nil {
+		return err
+	}
+
+	if migration.Reindex {
+		for _, name := range current {
+			if name == migration.Index {
+				continue
+			}
+			from, err := migrator.admin.OpenIndex(name, "")
+			if err != nil {
+				return err
+			}
+			if err = (&indexCopy{from: from, to: to}).run(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(current) == 1 && current[0] == migration.Index {
+		return nil
+	}
+	return migrator.admin.SwapAlias(migration.Alias, migration.Index)
+}
+
+// indexCopy writes every document of every type of from into to, under the
+// same id, adding the mapping of any type to does not already have.
+// Percolation queries are not documents, and are left to the caller.
+type indexCopy struct {
+	from elasticsearch.IIndex
+	to   elasticsearch.IIndex
+
+	// transform, if set, rewrites each document on its way
+	transform func(typ string, source *json.RawMessage) (interface{}, error)
+	// copied, if set, is called after each document is written
+	copied func()
+}
+
+func (c *indexCopy) run() error {
+	types, err := c.from.GetTypes()
+	if err != nil {
+		return err
+	}
+
+	for _, typ := range types {
+		if strings.HasPrefix(typ, ".") {
+			continue
+		}
+		last := ""
+		err = exportPages("_uid", nil, func(dsl string) (int, string, error) {
+			resp, err := c.from.SearchByJSON(typ, dsl)
+			if err != nil {
+				return 0, "", err
+			}
+			// a type with nothing in it, such as that of a deleted
+			// EventType, is not carried over
+			if last == "" && resp.NumHits() > 0 {
+				if err = c.mapType(typ); err != nil {
+					return 0, "", err
+				}
+			}
+			for _, hit := range *resp.GetHits() {
+				if err = c.copy(typ, hit); err != nil {
+					return 0, "", err
+				}
+				last = typ + "#" + hit.ID
+			}
+			return resp.NumHits(), last, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *indexCopy) mapType(typ string) error {
+	exists, err := c.to.TypeExists(typ)
+	if err != nil || exists {
+		return err
+	}
+	mapping, err := c.from.GetMapping(typ)
+	if err != nil {
+		return err
+	}
+	byts, err := json.Marshal(mapping)
+	if err != nil {
+		return err
+	}
+	return c.to.SetMapping(typ, piazza.JsonString(byts))
+}
+
+func (c *indexCopy) copy(typ string, hit *elasticsearch.SearchResultHit) error {
+	var doc interface{} = hit.Source
+	if c.transform != nil {
+		var err error
+		if doc, err = c.transform(typ, hit.Source); err != nil {
+			return fmt.Errorf("%s %s: %s", typ, hit.ID, err)
+		}
+	}
+	if _, err := c.to.PostData(typ, hit.ID, doc); err != nil {
+		return err
+	}
+	if c.copied != nil {
+		c.copied()
+	}
+	return nil
+}
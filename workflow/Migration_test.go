@@ -0,0 +1,161 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type MigrationTester struct {
+	suite.Suite
+}
+
+func (suite *MigrationTester) SetupSuite() {
+}
+
+func (suite *MigrationTester) TearDownSuite() {
+}
+
+//---------------------------------------------------------------------------
+
+const migrationTestSettings = `{"mappings":{"Thing":{"properties":{"name":{"type":"string"}}}}}`
+
+func (suite *MigrationTester) Test40Migrations() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	admin := NewMockIndexAdmin()
+
+	_, err := NewMigrator(admin, []Migration{
+		{Version: 2, Alias: "things", Index: "things002", Settings: migrationTestSettings},
+		{Version: 1, Alias: "things", Index: "things001", Settings: migrationTestSettings},
+	})
+	assert.Error(err)
+
+	// the real migrations all apply, once
+	migrator, err := NewMigrator(admin, Migrations)
+	assert.NoError(err)
+	applied, err := migrator.Up()
+	assert.NoError(err)
+	assert.Len(applied, len(Migrations))
+	applied, err = migrator.Up()
+	assert.NoError(err)
+	assert.Len(applied, 0)
+
+	// each alias is on the index of its latest migration
+	latest := map[string]string{}
+	for _, migration := range Migrations {
+		latest[migration.Alias] = migration.Index
+	}
+	for alias, index := range latest {
+		indices, err := admin.AliasIndices(alias)
+		assert.NoError(err)
+		assert.Equal([]string{index}, indices)
+	}
+	esi, err := admin.OpenIndex(keyAlerts, "")
+	assert.NoError(err)
+	ok, err := esi.TypeExists(AlertDBMapping)
+	assert.NoError(err)
+	assert.True(ok)
+
+	// an upgrade keeps what the index scripts' indices hold
+	admin = NewMockIndexAdmin()
+	baseline := map[string]string{
+		keyEventTypes: `{"mappings":{"EventType":{"dynamic":"strict","properties":{
+			"eventTypeId":{"type":"string","index":"not_analyzed"},"name":{"type":"string","index":"not_analyzed"},
+			"createdOn":{"type":"date","format":"` + esDateFormat + `"},"createdBy":{"type":"string","index":"not_analyzed"},
+			"mapping":{"dynamic":"false","type":"object"}}}}}`,
+		keyTriggers: `{"mappings":{"Trigger":{"dynamic":"strict","properties":{
+			"triggerId":{"type":"string","index":"not_analyzed"},"name":{"type":"string","index":"not_analyzed"},
+			"eventTypeId":{"type":"string","index":"not_analyzed"},"enabled":{"type":"boolean"},
+			"condition":{"dynamic":"false","type":"object"}}}}}`,
+		keyAlerts: `{"mappings":{"Alert":{"dynamic":"strict","properties":{
+			"alertId":{"type":"string","index":"not_analyzed"},"triggerId":{"type":"string","index":"not_analyzed"},
+			"eventId":{"type":"string","index":"not_analyzed"}}}}}`,
+	}
+	docs := map[string][]interface{}{
+		keyEventTypes: {EventTypeDBMapping, "et1", map[string]interface{}{"eventTypeId": "et1", "name": "old", "mapping": map[string]interface{}{"n": "integer"}}},
+		keyTriggers:   {TriggerDBMapping, "t1", map[string]interface{}{"triggerId": "t1", "name": "old", "eventTypeId": "et1", "enabled": true}},
+		keyAlerts:     {AlertDBMapping, "a1", map[string]interface{}{"alertId": "a1", "triggerId": "t1", "eventId": "e1"}},
+	}
+	for alias, settings := range baseline {
+		esi, err := admin.OpenIndex(alias+"004", settings)
+		assert.NoError(err)
+		doc := docs[alias]
+		_, err = esi.PostData(doc[0].(string), doc[1].(string), doc[2])
+		assert.NoError(err)
+		assert.NoError(admin.SwapAlias(alias, alias+"004"))
+	}
+	migrator, err = NewMigrator(admin, Migrations)
+	assert.NoError(err)
+	_, err = migrator.Up()
+	assert.NoError(err)
+	for alias, doc := range docs {
+		esi, err = admin.OpenIndex(alias, "")
+		assert.NoError(err)
+		assert.Equal(latest[alias], esi.IndexName())
+		ok, err = esi.ItemExists(doc[0].(string), doc[1].(string))
+		assert.NoError(err)
+		assert.True(ok, alias)
+	}
+
+	// a later migration copies the documents over and moves the alias
+	admin = NewMockIndexAdmin()
+	migrations := []Migration{
+		{Version: 1, Alias: "things", Index: "things001", Settings: migrationTestSettings},
+	}
+	migrator, err = NewMigrator(admin, migrations)
+	assert.NoError(err)
+	_, err = migrator.Up()
+	assert.NoError(err)
+
+	esi, err = admin.OpenIndex("things", "")
+	assert.NoError(err)
+	assert.Equal("things001", esi.IndexName())
+	for _, id := range []string{"a", "b", "c"} {
+		_, err = esi.PostData("Thing", id, map[string]string{"name": id})
+		assert.NoError(err)
+	}
+
+	migrations = append(migrations, Migration{Version: 2, Alias: "things", Index: "things002", Settings: migrationTestSettings, Reindex: true})
+	migrator, err = NewMigrator(admin, migrations)
+	assert.NoError(err)
+
+	status, err := migrator.Status()
+	assert.NoError(err)
+	assert.Len(status, 2)
+	assert.True(status[0].Applied)
+	assert.NotNil(status[0].AppliedOn)
+	assert.False(status[1].Applied)
+
+	applied, err = migrator.Up()
+	assert.NoError(err)
+	assert.Len(applied, 1)
+	assert.Equal(2, applied[0].Version)
+
+	esi, err = admin.OpenIndex("things", "")
+	assert.NoError(err)
+	assert.Equal("things002", esi.IndexName())
+	for _, id := range []string{"a", "b", "c"} {
+		ok, err = esi.ItemExists("Thing", id)
+		assert.NoError(err)
+		assert.True(ok)
+	}
+
+	status, err = migrator.Status()
+	assert.NoError(err)
+	assert.True(status[1].Applied)
+}
@@ -0,0 +1,700 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+// esDateFormat accepts the TimeStamps of every precision Go writes
+const esDateFormat = `yyyy-MM-dd'T'HH:mm:ssZZ||yyyy-MM-dd'T'HH:mm:ss.SZZ||yyyy-MM-dd'T'HH:mm:ss.SSZZ||yyyy-MM-dd'T'HH:mm:ss.SSSZZ||yyyy-MM-dd'T'HH:mm:ss.SSSSZZ||yyyy-MM-dd'T'HH:mm:ss.SSSSSZZ||yyyy-MM-dd'T'HH:mm:ss.SSSSSSZZ||yyyy-MM-dd'T'HH:mm:ss.SSSSSSSZZ`
+
+// Migrations are the versions of the indices, oldest first. A change to a
+// mapping is a new migration onto a new index, never an edit of an old one,
+// and copies the documents over with Reindex.
+var Migrations = []Migration{
+	{
+		Version: 1,
+		Alias:   keyEventTypes,
+		Index:   "eventtypes005",
+		// copying eventtypes004, which the index scripts made before there were migrations
+		Reindex: true,
+		Settings: `
+			{
+				"mappings": {
+					"EventType": {
+						"dynamic": "strict",
+						"properties": {
+							"eventTypeId": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"name": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"createdOn": {
+								"type": "date",
+								"format": "` + esDateFormat + `"
+							},
+							"createdBy": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"mapping": {
+								"dynamic": "false",
+								"type": "object"
+							},
+							"retention": {
+								"properties": {
+									"maxAge": {
+										"type": "string",
+										"index": "not_analyzed"
+									},
+									"maxCount": {
+										"type": "integer"
+									},
+									"alertMaxAge": {
+										"type": "string",
+										"index": "not_analyzed"
+									},
+									"alertMaxCount": {
+										"type": "integer"
+									}
+								}
+							}
+						}
+					}
+				}
+			}`,
+	},
+	{
+		Version: 2,
+		Alias:   keyEvents,
+		Index:   "events005",
+		Settings: `
+			{
+				"settings": {
+					"index.mapping.coerce": false,
+					"index.version.created": 2010299
+				},
+				"mappings": {
+					"_default_": {
+						"dynamic": "strict",
+						"properties": {
+							"eventTypeId": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"eventId": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"data": {
+								"dynamic": "true",
+								"type": "object"
+							},
+							"createdBy": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"createdOn": {
+								"type": "date",
+								"format": "` + esDateFormat + `"
+							},
+							"cronSchedule": {
+								"type": "string",
+								"index": "not_analyzed"
+							}
+						}
+					}
+				}
+			}`,
+	},
+	{
+		Version: 3,
+		Alias:   keyTriggers,
+		Index:   "triggers005",
+		// copying triggers004, as migration 1 does eventtypes004
+		Reindex: true,
+		Settings: `
+			{
+				"mappings": {
+					"Trigger": {
+						"dynamic": "strict",
+						"properties": {
+							"triggerId": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"name": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"createdOn": {
+								"type": "date",
+								"format": "` + esDateFormat + `"
+							},
+							"createdBy": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"eventTypeId": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"enabled": {
+								"type": "boolean"
+							},
+							"condition": {
+								"dynamic": "false",
+								"type": "object"
+							},
+							"job": {
+								"properties": {
+									"createdBy": {
+										"type": "string",
+										"index": "not_analyzed"
+									},
+									"jobType": {
+										"dynamic": "false",
+										"type": "object"
+									}
+								}
+							},
+							"percolationId": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"geofence": {
+								"properties": {
+									"geofenceId": {
+										"type": "string",
+										"index": "not_analyzed"
+									},
+									"field": {
+										"type": "string",
+										"index": "not_analyzed"
+									},
+									"relation": {
+										"type": "string",
+										"index": "not_analyzed"
+									},
+									"entityKey": {
+										"type": "string",
+										"index": "not_analyzed"
+									}
+								}
+							}
+						}
+					}
+				}
+			}`,
+	},
+	{
+		Version: 4,
+		Alias:   keyAlerts,
+		Index:   "alerts005",
+		// copying alerts004, likewise
+		Reindex: true,
+		Settings: `
+			{
+				"mappings": {
+					"Alert": {
+						"dynamic": "strict",
+						"properties": {
+							"alertId": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"triggerId": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"jobId": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"eventId": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"createdBy": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"createdOn": {
+								"type": "date",
+								"format": "` + esDateFormat + `"
+							},
+							"resolved": {
+								"type": "boolean"
+							},
+							"resolvedOn": {
+								"type": "date",
+								"format": "` + esDateFormat + `"
+							}
+						}
+					}
+				}
+			}`,
+	},
+	{
+		Version: 5,
+		Alias:   keyCrons,
+		Index:   "crons004",
+		Settings: `
+			{
+				"settings": {
+					"index.mapping.coerce": false
+				},
+				"mappings": {
+					"Cron": {
+						"dynamic": "strict",
+						"properties": {
+							"eventTypeId": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"eventId": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"data": {
+								"dynamic": "false",
+								"type": "object"
+							},
+							"createdBy": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"createdOn": {
+								"type": "date",
+								"format": "` + esDateFormat + `"
+							},
+							"cronSchedule": {
+								"type": "string",
+								"index": "not_analyzed"
+							}
+						}
+					}
+				}
+			}`,
+	},
+	{
+		Version: 6,
+		Alias:   keyTestElasticsearch,
+		Index:   "testelasticsearch004",
+		Settings: `
+			{
+				"mappings": {
+					"TestElasticsearch": {
+						"dynamic": "strict",
+						"properties": {
+							"id": {
+								"type": "string"
+							},
+							"data": {
+								"type": "string"
+							},
+							"tags": {
+								"type": "string"
+							},
+							"value": {
+								"type": "long"
+							}
+						}
+					}
+				}
+			}`,
+	},
+	{
+		Version: 7,
+		Alias:   keyGeofences,
+		Index:   "geofences002",
+		Settings: `
+			{
+				"mappings": {
+					"Geofence": {
+						"dynamic": "strict",
+						"properties": {
+							"geofenceId": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"name": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"geometry": {
+								"type": "geo_shape"
+							},
+							"bbox": {
+								"type": "double"
+							},
+							"createdBy": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"createdOn": {
+								"type": "date",
+								"format": "` + esDateFormat + `"
+							}
+						}
+					}
+				}
+			}`,
+	},
+	{
+		Version: 8,
+		Alias:   keyGeofenceStates,
+		Index:   "geofencestates001",
+		Settings: `
+			{
+				"mappings": {
+					"GeofenceState": {
+						"dynamic": "strict",
+						"properties": {
+							"triggerId": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"entity": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"inside": {
+								"type": "boolean"
+							},
+							"updatedOn": {
+								"type": "date",
+								"format": "` + esDateFormat + `"
+							}
+						}
+					}
+				}
+			}`,
+	},
+	{
+		Version: 9,
+		Alias:   keyStats,
+		Index:   "stats001",
+		Settings: `
+			{
+				"mappings": {
+					"EventTypeHour": {
+						"dynamic": "strict",
+						"properties": {
+							"eventTypeId": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"hour": {
+								"type": "date",
+								"format": "` + esDateFormat + `"
+							},
+							"events": {
+								"type": "long"
+							}
+						}
+					},
+					"TriggerStats": {
+						"dynamic": "strict",
+						"properties": {
+							"triggerId": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"firings": {
+								"type": "long"
+							},
+							"lastFiredOn": {
+								"type": "date",
+								"format": "` + esDateFormat + `"
+							},
+							"dispatchFailures": {
+								"type": "long"
+							},
+							"lastFailedOn": {
+								"type": "date",
+								"format": "` + esDateFormat + `"
+							}
+						}
+					}
+				}
+			}`,
+	},
+	{
+		Version: 10,
+		Alias:   keyOutbox,
+		Index:   "outbox001",
+		Settings: `
+			{
+				"mappings": {
+					"OutboxEntry": {
+						"dynamic": "strict",
+						"properties": {
+							"entryId": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"stage": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"eventId": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"eventTypeId": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"triggerId": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"jobId": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"createdBy": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"startedOn": {
+								"type": "date",
+								"format": "` + esDateFormat + `"
+							},
+							"createdOn": {
+								"type": "date",
+								"format": "` + esDateFormat + `"
+							}
+						}
+					}
+				}
+			}`,
+	},
+	{
+		Version: 11,
+		Alias:   keyACLs,
+		Index:   "acls001",
+		Settings: `
+			{
+				"mappings": {
+					"ACL": {
+						"dynamic": "strict",
+						"properties": {
+							"resourceId": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"owner": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"readers": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"writers": {
+								"type": "string",
+								"index": "not_analyzed"
+							}
+						}
+					}
+				}
+			}`,
+	},
+	{
+		Version: 12,
+		Alias:   keyEventTypes,
+		Index:   "eventtypes006",
+		Reindex: true,
+		Settings: `
+			{
+				"mappings": {
+					"EventType": {
+						"dynamic": "strict",
+						"properties": {
+							"eventTypeId": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"name": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"namespace": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"createdOn": {
+								"type": "date",
+								"format": "` + esDateFormat + `"
+							},
+							"createdBy": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"mapping": {
+								"dynamic": "false",
+								"type": "object"
+							},
+							"retention": {
+								"properties": {
+									"maxAge": {
+										"type": "string",
+										"index": "not_analyzed"
+									},
+									"maxCount": {
+										"type": "integer"
+									},
+									"alertMaxAge": {
+										"type": "string",
+										"index": "not_analyzed"
+									},
+									"alertMaxCount": {
+										"type": "integer"
+									}
+								}
+							}
+						}
+					}
+				}
+			}`,
+	},
+	{
+		Version: 13,
+		Alias:   keyTriggers,
+		Index:   "triggers006",
+		Reindex: true,
+		Settings: `
+			{
+				"mappings": {
+					"Trigger": {
+						"dynamic": "strict",
+						"properties": {
+							"triggerId": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"name": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"namespace": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"createdOn": {
+								"type": "date",
+								"format": "` + esDateFormat + `"
+							},
+							"createdBy": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"eventTypeId": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"enabled": {
+								"type": "boolean"
+							},
+							"condition": {
+								"dynamic": "false",
+								"type": "object"
+							},
+							"job": {
+								"properties": {
+									"createdBy": {
+										"type": "string",
+										"index": "not_analyzed"
+									},
+									"jobType": {
+										"dynamic": "false",
+										"type": "object"
+									}
+								}
+							},
+							"percolationId": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"geofence": {
+								"properties": {
+									"geofenceId": {
+										"type": "string",
+										"index": "not_analyzed"
+									},
+									"field": {
+										"type": "string",
+										"index": "not_analyzed"
+									},
+									"relation": {
+										"type": "string",
+										"index": "not_analyzed"
+									},
+									"entityKey": {
+										"type": "string",
+										"index": "not_analyzed"
+									}
+								}
+							}
+						}
+					}
+				}
+			}`,
+	},
+	{
+		Version: 14,
+		Alias:   keyAudit,
+		Index:   "audit001",
+		Settings: `
+			{
+				"mappings": {
+					"AuditRecord": {
+						"dynamic": "strict",
+						"properties": {
+							"auditId": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"actor": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"action": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"resourceId": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"message": {
+								"type": "string"
+							},
+							"hostName": {
+								"type": "string",
+								"index": "not_analyzed"
+							},
+							"createdOn": {
+								"type": "date",
+								"format": "` + esDateFormat + `"
+							}
+						}
+					}
+				}
+			}`,
+	},
+}
@@ -0,0 +1,222 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// DefaultNamespace is that of what is created without one, and of all that
+// was created before there were namespaces
+const DefaultNamespace = "default"
+
+// namespaceSeparator joins the namespace of an EventType to its name, in the
+// name of its type in the events index. EventType names may not contain it.
+const namespaceSeparator = "::"
+
+var namespacePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+func namespaceOf(namespace string) string {
+	if namespace == "" {
+		return DefaultNamespace
+	}
+	return namespace
+}
+
+func validateNamespace(namespace string) error {
+	if namespace != "" && !namespacePattern.MatchString(namespace) {
+		return fmt.Errorf("namespace [%s] must be letters, digits, '-' and '_'", namespace)
+	}
+	return nil
+}
+
+// qualifiedTypeName is the type, in the events index, of an EventType. Those
+// of the default namespace are named as they were before there were others.
+func qualifiedTypeName(namespace string, name string) string {
+	if namespaceOf(namespace) == DefaultNamespace {
+		return name
+	}
+	return namespace + namespaceSeparator + name
+}
+
+// splitTypeName is the namespace and name of the EventType of a type
+func splitTypeName(typeName string) (string, string) {
+	if i := strings.Index(typeName, namespaceSeparator); i >= 0 {
+		return typeName[:i], typeName[i+len(namespaceSeparator):]
+	}
+	return DefaultNamespace, typeName
+}
+
+// typeName is the EventType's type in the events index, which also keys the
+// data of its events
+func (eventType *EventType) typeName() string {
+	return qualifiedTypeName(eventType.Namespace, eventType.Name)
+}
+
+// namespaceQuery matches the EventTypes or triggers of a namespace; those
+// stored without one are of the default namespace
+func namespaceQuery(namespace string) map[string]interface{} {
+	query := map[string]interface{}{"term": map[string]interface{}{"namespace": namespace}}
+	if namespace != DefaultNamespace {
+		return query
+	}
+	return map[string]interface{}{
+		"bool": map[string]interface{}{
+			"should": []interface{}{
+				query,
+				map[string]interface{}{"missing": map[string]interface{}{"field": "namespace"}},
+			},
+		},
+	}
+}
+
+// namespaceDsl is the search for a page of the EventTypes or triggers of a
+// namespace
+func namespaceDsl(namespace string, format *piazza.JsonPagination) (string, error) {
+	byts, err := json.Marshal(map[string]interface{}{"query": namespaceQuery(namespace)})
+	if err != nil {
+		return "", err
+	}
+	return format.SyncPagination(string(byts))
+}
+
+// nameQuery matches the EventTypes of a namespace the name is a term of
+func nameQuery(namespace string, name string) map[string]interface{} {
+	return map[string]interface{}{
+		"bool": map[string]interface{}{
+			"filter": []interface{}{termQuery("name", name), namespaceQuery(namespaceOf(namespace))},
+		},
+	}
+}
+
+// scopeDsl narrows the query of a search body by the filter
+func scopeDsl(dslString string, filter interface{}) (string, error) {
+	dsl := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(dslString), &dsl); err != nil {
+		return "", err
+	}
+	query, ok := dsl["query"]
+	if !ok {
+		query = map[string]interface{}{"match_all": map[string]interface{}{}}
+	}
+	dsl["query"] = map[string]interface{}{
+		"bool": map[string]interface{}{"must": query, "filter": filter},
+	}
+	byts, err := json.Marshal(dsl)
+	return string(byts), err
+}
+
+// namespaceParam is the namespace a list is scoped to, or "" for all of them
+func namespaceParam(params *piazza.HttpQueryParams) (string, error) {
+	namespace, err := params.GetAsString("namespace", "")
+	if err != nil {
+		return "", err
+	}
+	return namespace, validateNamespace(namespace)
+}
+
+// namespaceEventTypes returns every EventType of the namespace
+func (service *Service) namespaceEventTypes(namespace string) ([]EventType, error) {
+	eventTypes := []EventType{}
+	err := exportPages("eventTypeId", namespaceQuery(namespace), func(dsl string) (int, string, error) {
+		page, _, err := service.eventTypeDB.GetEventTypesByDslQuery(dsl, "pz-workflow")
+		last := ""
+		for _, eventType := range page {
+			eventTypes = append(eventTypes, eventType)
+			last = eventType.EventTypeID.String()
+		}
+		return len(page), last, err
+	})
+	return eventTypes, err
+}
+
+// namespaceEventTypeIDs returns the IDs of every EventType of the namespace
+func (service *Service) namespaceEventTypeIDs(namespace string) ([]piazza.Ident, error) {
+	eventTypes, err := service.namespaceEventTypes(namespace)
+	if err != nil {
+		return nil, err
+	}
+	ids := []piazza.Ident{}
+	for _, eventType := range eventTypes {
+		ids = append(ids, eventType.EventTypeID)
+	}
+	return ids, nil
+}
+
+// GetNamespaceStats counts the EventTypes and triggers of the namespace, and
+// the events posted to it in each of the last hours
+func (service *Service) GetNamespaceStats(namespace string, params *piazza.HttpQueryParams, actor string) *piazza.JsonResponse {
+	defer service.handlePanic()
+	if err := validateNamespace(namespace); err != nil {
+		return service.statusBadRequest(err)
+	}
+	hours, err := params.GetAsInt("hours", 24)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	if hours < 1 || hours > statsMaxHours {
+		return service.statusBadRequest(fmt.Errorf("hours must be from 1 to %d", statsMaxHours))
+	}
+
+	service.syslogger.Audit(actor, "gettingNamespaceStats", piazza.Ident(namespace), "Service.GetNamespaceStats: User is getting stats of namespace [%s]", namespace)
+
+	eventTypes, err := service.namespaceEventTypes(namespace)
+	if err != nil {
+		service.syslogger.Audit(actor, "gettingNamespaceStatsFailure", piazza.Ident(namespace), "Service.GetNamespaceStats: User failed to get stats of namespace [%s]", namespace)
+		return service.statusInternalError(err)
+	}
+	dsl, err := namespaceDsl(namespace, &piazza.JsonPagination{PerPage: 1, SortBy: "triggerId", Order: piazza.SortOrderAscending})
+	if err != nil {
+		return service.statusInternalError(err)
+	}
+	_, triggers, err := service.triggerDB.GetTriggersByDslQuery(dsl, "pz-workflow")
+	if err != nil {
+		service.syslogger.Audit(actor, "gettingNamespaceStatsFailure", piazza.Ident(namespace), "Service.GetNamespaceStats: User failed to get stats of namespace [%s]", namespace)
+		return service.statusInternalError(err)
+	}
+
+	to := time.Now().UTC().Truncate(time.Hour)
+	from := to.Add(-time.Duration(hours-1) * time.Hour)
+	byHour := map[time.Time]int64{}
+	for _, eventType := range eventTypes {
+		counted, err := service.statsDB.GetEventTypeHours(eventType.EventTypeID, from, to)
+		if err != nil {
+			service.syslogger.Audit(actor, "gettingNamespaceStatsFailure", piazza.Ident(namespace), "Service.GetNamespaceStats: User failed to get stats of namespace [%s]", namespace)
+			return service.statusInternalError(err)
+		}
+		for _, count := range counted {
+			byHour[time.Time(count.Hour).UTC()] += count.Events
+		}
+	}
+
+	stats := &NamespaceStats{
+		Namespace:  namespace,
+		EventTypes: int64(len(eventTypes)),
+		Triggers:   triggers,
+		Hours:      []NamespaceHour{},
+	}
+	for hour := from; !hour.After(to); hour = hour.Add(time.Hour) {
+		events := byHour[hour]
+		stats.Hours = append(stats.Hours, NamespaceHour{Hour: piazza.TimeStamp(hour), Events: events})
+		stats.Events += events
+	}
+	return service.statusOK(stats)
+}
@@ -0,0 +1,93 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// OutboxDB keeps the work a shutdown left unfinished in Elasticsearch
+type OutboxDB struct {
+	*ResourceDB
+	mapping string
+}
+
+func NewOutboxDB(service *Service, esi elasticsearch.IIndex) (*OutboxDB, error) {
+	rdb, err := NewResourceDB(service, esi)
+	if err != nil {
+		return nil, err
+	}
+	return &OutboxDB{ResourceDB: rdb, mapping: OutboxDBMapping}, nil
+}
+
+func (db *OutboxDB) PostData(entry *OutboxEntry) error {
+	indexResult, err := db.Esi.PostData(db.mapping, entry.EntryID.String(), entry)
+	if err != nil {
+		return LoggedError("OutboxDB.PostData failed: %s", err)
+	} else if !indexResult.Created {
+		return LoggedError("OutboxDB.PostData failed: not created")
+	}
+	return nil
+}
+
+func (db *OutboxDB) GetAll(format *piazza.JsonPagination, actor string) ([]OutboxEntry, int64, error) {
+	entries := []OutboxEntry{}
+
+	exists, err := db.Esi.TypeExists(db.mapping)
+	if err != nil {
+		return entries, 0, err
+	}
+	if !exists {
+		return entries, 0, nil
+	}
+
+	searchResult, err := db.Esi.FilterByMatchAll(db.mapping, format)
+	if err != nil {
+		return nil, 0, LoggedError("OutboxDB.GetAll failed: %s", err)
+	}
+	if searchResult == nil {
+		return nil, 0, LoggedError("OutboxDB.GetAll failed: no searchResult")
+	}
+
+	if searchResult.GetHits() != nil {
+		for _, hit := range *searchResult.GetHits() {
+			var entry OutboxEntry
+			if err := json.Unmarshal(*hit.Source, &entry); err != nil {
+				return nil, 0, err
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, searchResult.TotalHits(), nil
+}
+
+func (db *OutboxDB) DeleteByID(id piazza.Ident, actor string) (bool, error) {
+	exists, err := db.Esi.ItemExists(db.mapping, id.String())
+	if err != nil || !exists {
+		return false, err
+	}
+	deleteResult, err := db.Esi.DeleteByID(db.mapping, id.String())
+	if err != nil {
+		return false, LoggedError("OutboxDB.DeleteById failed: %s", err)
+	}
+	if deleteResult == nil {
+		return false, LoggedError("OutboxDB.DeleteById failed: no deleteResult")
+	}
+	return deleteResult.Found, nil
+}
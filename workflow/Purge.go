@@ -0,0 +1,370 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// the kinds a purge deletes, dependents first, so that nothing is still in
+// use by the time it is deleted
+var purgeOrder = []string{ExportKindAlert, ExportKindTrigger, ExportKindCron, ExportKindEvent, ExportKindEventType}
+
+// a job keeps only the first errors, which are usually all the same
+const purgeMaxErrors = 100
+
+// how long a finished purge or reindex can still be asked after; jobs are
+// kept in memory, by the instance running them, and dropped once this old
+const finishedJobTTL = 24 * time.Hour
+
+// finishedBefore says whether a job completed before the cutoff
+func finishedBefore(completedOn *piazza.TimeStamp, cutoff time.Time) bool {
+	return completedOn != nil && time.Time(*completedOn).Before(cutoff)
+}
+
+// PostPurge starts deleting what the request selects and returns the job at
+// once; GetPurge reports its progress
+func (service *Service) PostPurge(request *PurgeRequest, actor string) *piazza.JsonResponse {
+	defer service.handlePanic()
+
+	known := map[string]bool{}
+	for _, kind := range purgeOrder {
+		known[kind] = true
+	}
+	kinds := map[string]bool{}
+	for _, kind := range request.Kinds {
+		if !known[kind] {
+			return service.statusBadRequest(fmt.Errorf("cannot purge [%s]: kinds must be among %v", kind, purgeOrder))
+		}
+		kinds[kind] = true
+	}
+	if len(kinds) == 0 {
+		kinds = known
+	}
+
+	if request.EventTypeID != "" {
+		if _, found, err := service.eventTypeDB.GetOne(request.EventTypeID, "pz-workflow"); !found {
+			if err == nil {
+				err = fmt.Errorf("eventType %s could not be found", request.EventTypeID)
+			}
+			return service.statusBadRequest(err)
+		}
+	}
+
+	job := &PurgeJob{
+		PurgeID:   service.newIdent(),
+		Request:   *request,
+		Status:    PurgeStatusRunning,
+		Deleted:   map[string]int{},
+		Failed:    map[string]int{},
+		CreatedBy: actor,
+		CreatedOn: piazza.NewTimeStamp(),
+	}
+
+	service.purgeLock.Lock()
+	cutoff := time.Now().Add(-finishedJobTTL)
+	for id, old := range service.purgeJobs {
+		if finishedBefore(old.CompletedOn, cutoff) {
+			delete(service.purgeJobs, id)
+		}
+	}
+	service.purgeJobs[job.PurgeID] = job
+	out := job.copy()
+	service.purgeLock.Unlock()
+
+	service.syslogger.Audit(actor, "purging", job.PurgeID, "Service.PostPurge: User is purging [%v] (dry run: %t)", request.Kinds, request.DryRun)
+
+	go service.purge(job, kinds)
+
+	return service.statusCreated(out)
+}
+
+// GetPurge returns the progress of a purge
+func (service *Service) GetPurge(id piazza.Ident) *piazza.JsonResponse {
+	defer service.handlePanic()
+
+	service.purgeLock.Lock()
+	job, ok := service.purgeJobs[id]
+	var out *PurgeJob
+	if ok {
+		out = job.copy()
+	}
+	service.purgeLock.Unlock()
+
+	if !ok {
+		return service.statusNotFound(fmt.Errorf("purge %s could not be found", id))
+	}
+	return service.statusOK(out)
+}
+
+// copy is a snapshot of the job, for reading while the purge runs on
+func (job *PurgeJob) copy() *PurgeJob {
+	out := *job
+	out.Deleted = map[string]int{}
+	for k, v := range job.Deleted {
+		out.Deleted[k] = v
+	}
+	out.Failed = map[string]int{}
+	for k, v := range job.Failed {
+		out.Failed[k] = v
+	}
+	out.Errors = append([]string(nil), job.Errors...)
+	return &out
+}
+
+// updatePurge changes the job where GetPurge can see it
+func (service *Service) updatePurge(job *PurgeJob, update func()) {
+	service.purgeLock.Lock()
+	defer service.purgeLock.Unlock()
+	update()
+}
+
+func (service *Service) purge(job *PurgeJob, kinds map[string]bool) {
+	finish := func(status string, err error) {
+		var deleted, failed map[string]int
+		service.updatePurge(job, func() {
+			now := piazza.NewTimeStamp()
+			job.Status = status
+			job.Stage = ""
+			job.CompletedOn = &now
+			if err != nil {
+				job.Errors = append(job.Errors, err.Error())
+			}
+			snapshot := job.copy()
+			deleted, failed = snapshot.Deleted, snapshot.Failed
+		})
+		if status == PurgeStatusFailed {
+			service.syslogger.Audit(job.CreatedBy, "purgingFailure", job.PurgeID, "Service.purge: User failed to purge: %v", err)
+		} else {
+			service.syslogger.Audit(job.CreatedBy, "purged", job.PurgeID, "Service.purge: User successfully purged %v, failing on %v", deleted, failed)
+		}
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			finish(PurgeStatusFailed, fmt.Errorf("purge panicked: %v", r))
+		}
+	}()
+
+	// cron events are events too, and are gone once their cron entry is
+	done := map[piazza.Ident]bool{}
+
+	for _, kind := range purgeOrder {
+		if !kinds[kind] {
+			continue
+		}
+		service.updatePurge(job, func() { job.Stage = kind })
+
+		ids, err := service.purgeCandidates(kind, &job.Request)
+		if err != nil {
+			finish(PurgeStatusFailed, err)
+			return
+		}
+
+		for _, id := range ids {
+			if done[id] {
+				continue
+			}
+			done[id] = true
+
+			var resp *piazza.JsonResponse
+			if !job.Request.DryRun {
+				resp = service.purgeOne(kind, id, job.CreatedBy)
+			}
+			service.updatePurge(job, func() {
+				if resp != nil && resp.IsError() {
+					job.Failed[kind]++
+					if len(job.Errors) < purgeMaxErrors {
+						job.Errors = append(job.Errors, fmt.Sprintf("%s %s: %s", kind, id, resp.Message))
+					}
+					return
+				}
+				job.Deleted[kind]++
+			})
+		}
+	}
+
+	finish(PurgeStatusDone, nil)
+}
+
+// purgeOne deletes through the same calls as the API, as the actor, so that
+// percolation queries and cron jobs go with their triggers and events
+func (service *Service) purgeOne(kind string, id piazza.Ident, actor string) *piazza.JsonResponse {
+	switch kind {
+	case ExportKindAlert:
+		return service.DeleteAlert(id, "", actor)
+	case ExportKindTrigger:
+		return service.DeleteTrigger(id, "", actor)
+	case ExportKindCron, ExportKindEvent:
+		return service.DeleteEvent(id, actor)
+	case ExportKindEventType:
+		return service.DeleteEventType(id, "", actor)
+	}
+	return service.statusBadRequest(fmt.Errorf("cannot purge [%s]", kind))
+}
+
+// purgeMatches tells whether an object passes the request's filters
+func purgeMatches(request *PurgeRequest, createdBy string, createdOn piazza.TimeStamp, eventTypeID piazza.Ident) bool {
+	if request.CreatedBy != "" && createdBy != request.CreatedBy {
+		return false
+	}
+	if request.CreatedBefore != nil && !time.Time(createdOn).Before(time.Time(*request.CreatedBefore)) {
+		return false
+	}
+	if request.EventTypeID != "" && eventTypeID != request.EventTypeID {
+		return false
+	}
+	return true
+}
+
+// purgeCandidates reads every page of the kind before anything is deleted,
+// so that deleting does not shift the pages still to be read
+func (service *Service) purgeCandidates(kind string, request *PurgeRequest) ([]piazza.Ident, error) {
+	ids := []piazza.Ident{}
+	var err error
+
+	switch kind {
+	case ExportKindAlert:
+		triggerEventTypes := map[piazza.Ident]piazza.Ident{}
+		err = exportPages("alertId", nil, func(dsl string) (int, string, error) {
+			page, _, err := service.alertDB.GetAlertsByDslQuery(dsl, "pz-workflow")
+			last := ""
+			for i := 0; err == nil && i < len(page); i++ {
+				alert := page[i]
+				last = alert.AlertID.String()
+				var eventTypeID piazza.Ident
+				if request.EventTypeID != "" {
+					var ok bool
+					if eventTypeID, ok = triggerEventTypes[alert.TriggerID]; !ok {
+						var trigger *Trigger
+						if trigger, ok, err = service.triggerDB.GetOne(alert.TriggerID, "pz-workflow"); ok && trigger != nil {
+							eventTypeID = trigger.EventTypeID
+						}
+						// an alert whose trigger is gone is not of any eventType
+						err = nil
+						triggerEventTypes[alert.TriggerID] = eventTypeID
+					}
+				}
+				if purgeMatches(request, alert.CreatedBy, alert.CreatedOn, eventTypeID) {
+					ids = append(ids, alert.AlertID)
+				}
+			}
+			return len(page), last, err
+		})
+
+	case ExportKindTrigger:
+		err = exportPages("triggerId", nil, func(dsl string) (int, string, error) {
+			page, _, err := service.triggerDB.GetTriggersByDslQuery(dsl, "pz-workflow")
+			last := ""
+			for _, trigger := range page {
+				if purgeMatches(request, trigger.CreatedBy, trigger.CreatedOn, trigger.EventTypeID) {
+					ids = append(ids, trigger.TriggerID)
+				}
+				last = trigger.TriggerID.String()
+			}
+			return len(page), last, err
+		})
+
+	case ExportKindCron:
+		err = exportPages("eventId", nil, func(dsl string) (int, string, error) {
+			page, _, err := service.cronDB.GetCronsByDslQuery(dsl, "pz-workflow")
+			last := ""
+			for _, event := range page {
+				if purgeMatches(request, event.CreatedBy, event.CreatedOn, event.EventTypeID) {
+					ids = append(ids, event.EventID)
+				}
+				last = event.EventID.String()
+			}
+			return len(page), last, err
+		})
+
+	case ExportKindEvent:
+		var eventTypes []EventType
+		if eventTypes, err = service.purgeEventTypes(request); err != nil {
+			return nil, err
+		}
+		// by eventType, as the events index has no type for unknown ones
+		for _, eventType := range eventTypes {
+			if IsSystemEvent(eventType.typeName()) {
+				continue
+			}
+			var exists bool
+			if exists, err = service.eventDB.NameExists(eventType.typeName(), "pz-workflow"); err != nil {
+				return nil, err
+			}
+			if !exists {
+				continue
+			}
+			err = exportPages("eventId", nil, func(dsl string) (int, string, error) {
+				page, _, err := service.eventDB.GetEventsByDslQuery(eventType.typeName(), dsl, "pz-workflow")
+				last := ""
+				for _, event := range page {
+					if purgeMatches(request, event.CreatedBy, event.CreatedOn, event.EventTypeID) {
+						ids = append(ids, event.EventID)
+					}
+					last = event.EventID.String()
+				}
+				return len(page), last, err
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+	case ExportKindEventType:
+		var eventTypes []EventType
+		if eventTypes, err = service.purgeEventTypes(request); err != nil {
+			return nil, err
+		}
+		for _, eventType := range eventTypes {
+			if !IsSystemEvent(eventType.typeName()) && purgeMatches(request, eventType.CreatedBy, eventType.CreatedOn, eventType.EventTypeID) {
+				ids = append(ids, eventType.EventTypeID)
+			}
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// purgeEventTypes is the EventType the request names, or else all of them
+func (service *Service) purgeEventTypes(request *PurgeRequest) ([]EventType, error) {
+	if request.EventTypeID != "" {
+		eventType, found, err := service.eventTypeDB.GetOne(request.EventTypeID, "pz-workflow")
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return []EventType{}, nil
+		}
+		return []EventType{*eventType}, nil
+	}
+
+	eventTypes := []EventType{}
+	err := exportPages("eventTypeId", nil, func(dsl string) (int, string, error) {
+		page, _, err := service.eventTypeDB.GetEventTypesByDslQuery(dsl, "pz-workflow")
+		last := ""
+		for _, eventType := range page {
+			eventTypes = append(eventTypes, eventType)
+			last = eventType.EventTypeID.String()
+		}
+		return len(page), last, err
+	})
+	return eventTypes, err
+}
@@ -0,0 +1,893 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// This file evaluates the query DSL against documents held in memory, for
+// the stores that have no Elasticsearch to do it. It covers the queries
+// workflow and its clients use:
+//
+//	match_all, match_none, term, terms, match, match_phrase, multi_match,
+//	range, exists, missing, ids, prefix, wildcard, regexp,
+//	bool, filtered, constant_score, and, or, not,
+//	geo_bounding_box, geo_distance, geo_polygon, geo_shape
+//
+// Text is compared as Elasticsearch's standard analyzer would, lowercased
+// and split into words, whether or not the field is analyzed.
+
+// dslDoc is a document as a search sees it; ref is the caller's, for
+// finding the document again among its own
+type dslDoc struct {
+	id     string
+	typ    string
+	source map[string]interface{}
+	ref    int
+}
+
+// uid is the document's _uid, its type and id
+func (doc dslDoc) uid() string {
+	return doc.typ + "#" + doc.id
+}
+
+// dslSort is one key of a search's "sort"
+type dslSort struct {
+	field string
+	desc  bool
+}
+
+// dslSearch is a parsed search body
+type dslSearch struct {
+	query interface{}
+	from  int
+	size  int
+	sort  []dslSort
+}
+
+// parseDslSearch reads {"query", "from", "size", "sort"}; a missing query
+// matches everything, and a missing size is Elasticsearch's 10
+func parseDslSearch(jsn string) (*dslSearch, error) {
+	body := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(jsn), &body); err != nil {
+		return nil, err
+	}
+
+	search := &dslSearch{query: map[string]interface{}{"match_all": map[string]interface{}{}}, size: 10}
+	for k, v := range body {
+		var err error
+		switch k {
+		case "query":
+			search.query = v
+		case "filter", "post_filter":
+			// the filter of an ES 1.x search narrows the query
+			search.query = map[string]interface{}{"bool": map[string]interface{}{"must": search.query, "filter": v}}
+		case "from":
+			search.from, err = dslInt(v)
+		case "size":
+			search.size, err = dslInt(v)
+		case "sort":
+			search.sort, err = parseDslSort(v)
+		case "_source", "fields", "aggs", "aggregations", "track_scores", "timeout", "version", "min_score":
+			// nothing to do for a search that returns whole documents
+		default:
+			err = fmt.Errorf("search key [%s] is not supported", k)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return search, nil
+}
+
+func parseDslSort(v interface{}) ([]dslSort, error) {
+	items, ok := v.([]interface{})
+	if !ok {
+		items = []interface{}{v}
+	}
+
+	sorts := []dslSort{}
+	for _, item := range items {
+		switch s := item.(type) {
+		case string:
+			sorts = append(sorts, dslSort{field: s, desc: s == "_score"})
+		case map[string]interface{}:
+			for field, order := range s {
+				desc := false
+				switch o := order.(type) {
+				case string:
+					desc = strings.ToLower(o) == "desc"
+				case map[string]interface{}:
+					if str, ok := o["order"].(string); ok {
+						desc = strings.ToLower(str) == "desc"
+					}
+				}
+				sorts = append(sorts, dslSort{field: field, desc: desc})
+			}
+		default:
+			return nil, fmt.Errorf("sort %v is not supported", item)
+		}
+	}
+	return sorts, nil
+}
+
+// run is the documents the search matches, sorted and cut to its page, and
+// the number matched before the cut
+func (search *dslSearch) run(docs []dslDoc) ([]dslDoc, int64, error) {
+	matched := []dslDoc{}
+	for _, doc := range docs {
+		ok, err := dslMatches(search.query, doc)
+		if err != nil {
+			return nil, 0, err
+		}
+		if ok {
+			matched = append(matched, doc)
+		}
+	}
+	dslSortDocs(matched, search.sort)
+	return dslPage(matched, search.from, search.size), int64(len(matched)), nil
+}
+
+// dslSortDocs sorts by the keys in turn, then by id, so that paging is stable.
+// Documents without a value for a key go last, as in Elasticsearch.
+func dslSortDocs(docs []dslDoc, sorts []dslSort) {
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, s := range sorts {
+			if s.field == "_score" {
+				continue
+			}
+			a, b := dslSortValue(docs[i], s.field), dslSortValue(docs[j], s.field)
+			if a == nil || b == nil {
+				if (a == nil) != (b == nil) {
+					return b == nil
+				}
+				continue
+			}
+			c := dslCompare(a, b)
+			if c != 0 {
+				return (c < 0) != s.desc
+			}
+		}
+		return docs[i].id < docs[j].id
+	})
+}
+
+func dslSortValue(doc dslDoc, field string) interface{} {
+	if field == "_id" {
+		return doc.id
+	}
+	if field == "_uid" {
+		return doc.uid()
+	}
+	values := dslValues(doc.source, field)
+	if len(values) == 0 {
+		return nil
+	}
+	return values[0]
+}
+
+func dslPage(docs []dslDoc, from int, size int) []dslDoc {
+	if from < 0 {
+		from = 0
+	}
+	if from >= len(docs) {
+		return []dslDoc{}
+	}
+	if size < 0 || from+size > len(docs) {
+		return docs[from:]
+	}
+	return docs[from : from+size]
+}
+
+//------------------------------------------------------------------------------
+
+// dslMatches tells whether the document satisfies the query
+func dslMatches(query interface{}, doc dslDoc) (bool, error) {
+	clause, ok := query.(map[string]interface{})
+	if !ok {
+		return false, fmt.Errorf("query %v is not an object", query)
+	}
+	if len(clause) == 0 {
+		return true, nil
+	}
+	if len(clause) != 1 {
+		// a search body, as percolation queries are written
+		if q, ok := clause["query"]; ok {
+			return dslMatches(q, doc)
+		}
+		return false, fmt.Errorf("query %v must have exactly one clause", query)
+	}
+
+	for name, body := range clause {
+		switch name {
+		case "query":
+			return dslMatches(body, doc)
+		case "match_all":
+			return true, nil
+		case "match_none":
+			return false, nil
+		case "bool":
+			return dslBool(body, doc)
+		case "filtered":
+			b, _ := body.(map[string]interface{})
+			return dslBool(map[string]interface{}{"must": b["query"], "filter": b["filter"]}, doc)
+		case "constant_score":
+			b, _ := body.(map[string]interface{})
+			return dslBool(map[string]interface{}{"filter": b["filter"], "must": b["query"]}, doc)
+		case "and":
+			return dslBool(map[string]interface{}{"must": dslFilters(body)}, doc)
+		case "or":
+			return dslBool(map[string]interface{}{"should": dslFilters(body)}, doc)
+		case "not":
+			b, ok := body.(map[string]interface{})
+			if inner, has := b["filter"]; ok && has {
+				body = inner
+			} else if inner, has := b["query"]; ok && has {
+				body = inner
+			}
+			m, err := dslMatches(body, doc)
+			return !m, err
+		case "ids":
+			return dslIDs(body, doc)
+		case "exists", "missing":
+			b, _ := body.(map[string]interface{})
+			field, ok := b["field"].(string)
+			if !ok {
+				return false, fmt.Errorf("%s needs a field", name)
+			}
+			exists := len(dslValues(doc.source, field)) > 0
+			return exists == (name == "exists"), nil
+		case "geo_bounding_box", "geo_distance", "geo_polygon", "geo_shape":
+			return dslGeo(name, body, doc)
+		case "multi_match":
+			return dslMultiMatch(body, doc)
+		}
+
+		field, arg, err := dslFieldClause(name, body)
+		if err != nil {
+			return false, err
+		}
+		values := dslValues(doc.source, field)
+		if field == "_id" {
+			values = []interface{}{doc.id}
+		}
+		if field == "_uid" {
+			values = []interface{}{doc.uid()}
+		}
+		switch name {
+		case "term":
+			return dslAny(values, func(v interface{}) bool { return dslTermEquals(v, dslValueOf(arg)) }), nil
+		case "terms":
+			terms, ok := arg.([]interface{})
+			if !ok {
+				return false, fmt.Errorf("terms of [%s] is not an array", field)
+			}
+			return dslAny(values, func(v interface{}) bool {
+				for _, t := range terms {
+					if dslTermEquals(v, t) {
+						return true
+					}
+				}
+				return false
+			}), nil
+		case "match":
+			return dslMatch(values, arg, false)
+		case "match_phrase":
+			return dslMatch(values, arg, true)
+		case "range":
+			return dslRange(values, arg)
+		case "prefix":
+			prefix := strings.ToLower(fmt.Sprint(dslValueOf(arg)))
+			return dslAny(values, func(v interface{}) bool {
+				return strings.HasPrefix(strings.ToLower(fmt.Sprint(v)), prefix)
+			}), nil
+		case "wildcard", "regexp":
+			pattern := fmt.Sprint(dslValueOf(arg))
+			if name == "wildcard" {
+				pattern = dslWildcard(pattern)
+			}
+			re, err := regexp.Compile("^(?:" + pattern + ")$")
+			if err != nil {
+				return false, err
+			}
+			return dslAny(values, func(v interface{}) bool { return re.MatchString(fmt.Sprint(v)) }), nil
+		}
+		return false, fmt.Errorf("query [%s] is not supported", name)
+	}
+	return false, nil
+}
+
+// dslFieldClause reads {field: arg} or {field: {"value": arg, ...}}
+func dslFieldClause(name string, body interface{}) (string, interface{}, error) {
+	b, ok := body.(map[string]interface{})
+	if !ok {
+		return "", nil, fmt.Errorf("%s %v is not an object", name, body)
+	}
+	for field, arg := range b {
+		switch field {
+		case "boost", "_name", "execution", "_cache":
+			continue
+		}
+		return field, arg, nil
+	}
+	return "", nil, fmt.Errorf("%s names no field", name)
+}
+
+// dslValueOf unwraps {"value": v}, {"query": v} and {"term": v}
+func dslValueOf(arg interface{}) interface{} {
+	if m, ok := arg.(map[string]interface{}); ok {
+		for _, k := range []string{"value", "query", "term"} {
+			if v, ok := m[k]; ok {
+				return v
+			}
+		}
+	}
+	return arg
+}
+
+func dslFilters(body interface{}) interface{} {
+	if b, ok := body.(map[string]interface{}); ok {
+		if filters, ok := b["filters"]; ok {
+			return filters
+		}
+	}
+	return body
+}
+
+func dslBool(body interface{}, doc dslDoc) (bool, error) {
+	b, ok := body.(map[string]interface{})
+	if !ok {
+		return false, fmt.Errorf("bool %v is not an object", body)
+	}
+	list := func(v interface{}) []interface{} {
+		switch l := v.(type) {
+		case nil:
+			return nil
+		case []interface{}:
+			return l
+		}
+		return []interface{}{v}
+	}
+
+	for _, key := range []string{"must", "filter"} {
+		for _, q := range list(b[key]) {
+			m, err := dslMatches(q, doc)
+			if err != nil || !m {
+				return false, err
+			}
+		}
+	}
+	for _, q := range list(b["must_not"]) {
+		m, err := dslMatches(q, doc)
+		if err != nil || m {
+			return false, err
+		}
+	}
+
+	should := list(b["should"])
+	minimum := 0
+	if len(should) > 0 && len(list(b["must"])) == 0 && len(list(b["filter"])) == 0 {
+		minimum = 1
+	}
+	if v, ok := b["minimum_should_match"]; ok {
+		n, err := dslInt(v)
+		if err != nil {
+			return false, fmt.Errorf("minimum_should_match: %s", err)
+		}
+		minimum = n
+	}
+	matched := 0
+	for _, q := range should {
+		m, err := dslMatches(q, doc)
+		if err != nil {
+			return false, err
+		}
+		if m {
+			matched++
+		}
+	}
+	return matched >= minimum, nil
+}
+
+func dslIDs(body interface{}, doc dslDoc) (bool, error) {
+	b, _ := body.(map[string]interface{})
+	values, ok := b["values"].([]interface{})
+	if !ok {
+		return false, fmt.Errorf("ids needs values")
+	}
+	for _, v := range values {
+		if fmt.Sprint(v) == doc.id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func dslMultiMatch(body interface{}, doc dslDoc) (bool, error) {
+	b, _ := body.(map[string]interface{})
+	fields, ok := b["fields"].([]interface{})
+	if !ok {
+		return false, fmt.Errorf("multi_match needs fields")
+	}
+	for _, f := range fields {
+		m, err := dslMatch(dslValues(doc.source, fmt.Sprint(f)), b, false)
+		if err != nil || m {
+			return m, err
+		}
+	}
+	return false, nil
+}
+
+// dslMatch is true if any word of the query is in the value, or with
+// operator "and", or for a phrase, all of them in order
+func dslMatch(values []interface{}, arg interface{}, phrase bool) (bool, error) {
+	query := dslValueOf(arg)
+	and := phrase
+	if m, ok := arg.(map[string]interface{}); ok {
+		if op, ok := m["operator"].(string); ok && strings.ToLower(op) == "and" {
+			and = true
+		}
+		if t, ok := m["type"].(string); ok && t == "phrase" {
+			phrase = true
+		}
+	}
+
+	if _, isString := query.(string); !isString {
+		return dslAny(values, func(v interface{}) bool { return dslTermEquals(v, query) }), nil
+	}
+	words := dslWords(query.(string))
+	if len(words) == 0 {
+		return false, nil
+	}
+	return dslAny(values, func(v interface{}) bool {
+		have := dslWords(fmt.Sprint(v))
+		if phrase {
+			return strings.Contains(" "+strings.Join(have, " ")+" ", " "+strings.Join(words, " ")+" ")
+		}
+		set := map[string]bool{}
+		for _, w := range have {
+			set[w] = true
+		}
+		n := 0
+		for _, w := range words {
+			if set[w] {
+				n++
+			}
+		}
+		if and {
+			return n == len(words)
+		}
+		return n > 0
+	}), nil
+}
+
+func dslRange(values []interface{}, arg interface{}) (bool, error) {
+	bounds, ok := arg.(map[string]interface{})
+	if !ok {
+		return false, fmt.Errorf("range %v is not an object", arg)
+	}
+	// ES 1.x spells the bounds from, to, include_lower and include_upper
+	if v, ok := bounds["from"]; ok && v != nil {
+		if incl, ok := bounds["include_lower"].(bool); ok && !incl {
+			bounds["gt"] = v
+		} else {
+			bounds["gte"] = v
+		}
+	}
+	if v, ok := bounds["to"]; ok && v != nil {
+		if incl, ok := bounds["include_upper"].(bool); ok && !incl {
+			bounds["lt"] = v
+		} else {
+			bounds["lte"] = v
+		}
+	}
+
+	return dslAny(values, func(v interface{}) bool {
+		for op, bound := range bounds {
+			var ok bool
+			switch op {
+			case "gt":
+				ok = dslCompare(v, bound) > 0
+			case "gte":
+				ok = dslCompare(v, bound) >= 0
+			case "lt":
+				ok = dslCompare(v, bound) < 0
+			case "lte":
+				ok = dslCompare(v, bound) <= 0
+			default:
+				continue
+			}
+			if !ok {
+				return false
+			}
+		}
+		return true
+	}), nil
+}
+
+//------------------------------------------------------------------------------
+
+func dslGeo(name string, body interface{}, doc dslDoc) (bool, error) {
+	b, ok := body.(map[string]interface{})
+	if !ok {
+		return false, fmt.Errorf("%s %v is not an object", name, body)
+	}
+
+	var field string
+	var arg interface{}
+	for k, v := range b {
+		switch k {
+		case "distance", "distance_type", "optimize_bbox", "validation_method", "type", "_name", "boost", "ignore_unmapped", "coerce", "ignore_malformed":
+			continue
+		}
+		field, arg = k, v
+	}
+	if field == "" {
+		return false, fmt.Errorf("%s names no field", name)
+	}
+
+	var test func(*geoShape) bool
+	switch name {
+	case "geo_bounding_box":
+		box, _ := arg.(map[string]interface{})
+		tl, err := parseGeoPointValue(box["top_left"])
+		if err != nil {
+			return false, fmt.Errorf("geo_bounding_box top_left: %s", err)
+		}
+		br, err := parseGeoPointValue(box["bottom_right"])
+		if err != nil {
+			return false, fmt.Errorf("geo_bounding_box bottom_right: %s", err)
+		}
+		fence := []geoPolygon{geoRectangle(tl.points[0].x, br.points[0].y, br.points[0].x, tl.points[0].y)}
+		test = func(shape *geoShape) bool { return geofenceIntersects(fence, shape) }
+
+	case "geo_distance":
+		center, err := parseGeoPointValue(arg)
+		if err != nil {
+			return false, err
+		}
+		meters, err := dslDistance(b["distance"])
+		if err != nil {
+			return false, err
+		}
+		test = func(shape *geoShape) bool { return geoWithinDistance(shape, center.points[0], meters) }
+
+	case "geo_polygon":
+		a, _ := arg.(map[string]interface{})
+		points, ok := a["points"].([]interface{})
+		if !ok {
+			return false, fmt.Errorf("geo_polygon needs points")
+		}
+		ring := geoRing{}
+		for _, p := range points {
+			point, err := parseGeoPointValue(p)
+			if err != nil {
+				return false, err
+			}
+			ring = append(ring, point.points[0])
+		}
+		if len(ring) > 0 && ring[0] != ring[len(ring)-1] {
+			ring = append(ring, ring[0])
+		}
+		fence := []geoPolygon{{ring}}
+		test = func(shape *geoShape) bool { return geofenceIntersects(fence, shape) }
+
+	case "geo_shape":
+		a, _ := arg.(map[string]interface{})
+		shape, _ := a["shape"].(map[string]interface{})
+		relation, _ := a["relation"].(string)
+		if relation == "" {
+			relation = "intersects"
+		}
+		if typ, _ := shape["type"].(string); strings.ToLower(typ) == "circle" {
+			center, err := parseGeoPointValue(shape["coordinates"])
+			if err != nil {
+				return false, err
+			}
+			meters, err := dslDistance(shape["radius"])
+			if err != nil {
+				return false, err
+			}
+			within := func(s *geoShape) bool { return geoWithinDistance(s, center.points[0], meters) }
+			switch relation {
+			case "intersects", "within":
+				test = within
+			case "disjoint":
+				test = func(s *geoShape) bool { return !within(s) }
+			default:
+				return false, fmt.Errorf("geo_shape relation [%s] is not supported for circles", relation)
+			}
+			break
+		}
+		queryShape, err := parseGeoShapeValue(shape)
+		if err != nil {
+			return false, err
+		}
+		intersects := func(s *geoShape) bool {
+			if len(queryShape.polygons) > 0 && geofenceIntersects(queryShape.polygons, s) {
+				return true
+			}
+			if len(s.polygons) > 0 && geofenceIntersects(s.polygons, queryShape) {
+				return true
+			}
+			for _, p := range s.points {
+				for _, q := range queryShape.points {
+					if p == q {
+						return true
+					}
+				}
+			}
+			return false
+		}
+		switch relation {
+		case "intersects":
+			test = intersects
+		case "disjoint":
+			test = func(s *geoShape) bool { return !intersects(s) }
+		case "within":
+			test = func(s *geoShape) bool { return geofenceContains(queryShape.polygons, s) }
+		case "contains":
+			test = func(s *geoShape) bool { return geofenceContains(s.polygons, queryShape) }
+		default:
+			return false, fmt.Errorf("geo_shape relation [%s] is not supported", relation)
+		}
+	}
+
+	for _, v := range dslValues(doc.source, field) {
+		shape, err := dslGeoValue(v)
+		if err != nil {
+			continue
+		}
+		if test(shape) {
+			return true, nil
+		}
+	}
+	// a geo_point array of [lon, lat] is read as one point, not two numbers
+	if shape, err := dslGeoValue(dslRaw(doc.source, field)); err == nil && test(shape) {
+		return true, nil
+	}
+	return false, nil
+}
+
+// dslGeoValue reads a geo_shape if it looks like one, and else a geo_point
+func dslGeoValue(v interface{}) (*geoShape, error) {
+	if m, ok := v.(map[string]interface{}); ok {
+		if _, ok := m["type"]; ok {
+			return parseGeoShapeValue(m)
+		}
+	}
+	return parseGeoPointValue(v)
+}
+
+var dslDistanceUnits = map[string]float64{
+	"": 1, "m": 1, "meters": 1, "km": 1000, "kilometers": 1000,
+	"cm": 0.01, "mm": 0.001, "mi": 1609.344, "miles": 1609.344,
+	"yd": 0.9144, "yards": 0.9144, "ft": 0.3048, "feet": 0.3048,
+	"in": 0.0254, "inch": 0.0254, "nmi": 1852, "NM": 1852,
+}
+
+func dslDistance(v interface{}) (float64, error) {
+	if n, err := toFloat(v); err == nil {
+		return n, nil
+	}
+	s := fmt.Sprint(v)
+	match := eventSearchDistance.FindStringSubmatch(s)
+	if match == nil {
+		return 0, fmt.Errorf("distance [%s] is not a number with an optional unit", s)
+	}
+	unit, ok := dslDistanceUnits[match[2]]
+	if !ok {
+		return 0, fmt.Errorf("distance unit [%s] is not supported", match[2])
+	}
+	n, err := strconv.ParseFloat(strings.TrimSuffix(s, match[2]), 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * unit, nil
+}
+
+// geoWithinDistance is true if any point of the shape is within the given
+// number of meters of the center, along the earth's surface
+func geoWithinDistance(shape *geoShape, center geoPoint, meters float64) bool {
+	const earthRadius = 6371008.8
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	for _, p := range shape.points {
+		dLat := rad(p.y - center.y)
+		dLon := rad(p.x - center.x)
+		a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(rad(center.y))*math.Cos(rad(p.y))*math.Sin(dLon/2)*math.Sin(dLon/2)
+		if 2*earthRadius*math.Asin(math.Min(1, math.Sqrt(a))) <= meters {
+			return true
+		}
+	}
+	return false
+}
+
+//------------------------------------------------------------------------------
+
+// dslRaw is the value at the dotted path, as stored
+func dslRaw(source map[string]interface{}, path string) interface{} {
+	var cur interface{} = source
+	for _, part := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		cur = m[part]
+	}
+	return cur
+}
+
+// dslValues is every value at the dotted path, looking into arrays of
+// objects along the way and flattening arrays at the end
+func dslValues(source map[string]interface{}, path string) []interface{} {
+	var walk func(cur interface{}, parts []string) []interface{}
+	walk = func(cur interface{}, parts []string) []interface{} {
+		if arr, ok := cur.([]interface{}); ok {
+			out := []interface{}{}
+			for _, item := range arr {
+				out = append(out, walk(item, parts)...)
+			}
+			return out
+		}
+		if len(parts) == 0 {
+			if cur == nil {
+				return nil
+			}
+			return []interface{}{cur}
+		}
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		// a key may itself hold dots, as the mock and some documents do
+		for i := len(parts); i > 0; i-- {
+			if v, ok := m[strings.Join(parts[:i], ".")]; ok {
+				return walk(v, parts[i:])
+			}
+		}
+		return nil
+	}
+	return walk(source, strings.Split(path, "."))
+}
+
+func dslAny(values []interface{}, test func(interface{}) bool) bool {
+	for _, v := range values {
+		if test(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// dslTermEquals compares as a term query does: numbers by value, and
+// strings exactly or, as an analyzed field would hold them, by word
+func dslTermEquals(v interface{}, term interface{}) bool {
+	if a, err := dslNumber(v); err == nil {
+		if b, err := dslNumber(term); err == nil {
+			return a == b
+		}
+	}
+	if a, ok := v.(bool); ok {
+		b, err := strconv.ParseBool(fmt.Sprint(term))
+		return err == nil && a == b
+	}
+	s, t := fmt.Sprint(v), fmt.Sprint(term)
+	if s == t {
+		return true
+	}
+	for _, w := range dslWords(s) {
+		if w == t {
+			return true
+		}
+	}
+	return false
+}
+
+// dslCompare orders numbers by value, times by time, and anything else as
+// strings
+func dslCompare(a interface{}, b interface{}) int {
+	if x, err := dslNumber(a); err == nil {
+		if y, err := dslNumber(b); err == nil {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+	if x, ok := dslTime(a); ok {
+		if y, ok := dslTime(b); ok {
+			switch {
+			case x.Before(y):
+				return -1
+			case x.After(y):
+				return 1
+			}
+			return 0
+		}
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+func dslNumber(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case float64, float32, int, int64:
+		return toFloat(n)
+	case json.Number:
+		return n.Float64()
+	}
+	return 0, fmt.Errorf("%v is not a number", v)
+}
+
+var dslTimeFormats = []string{time.RFC3339Nano, eventSearchTimeFormat, "2006-01-02T15:04:05Z0700", "2006-01-02T15:04:05", "2006-01-02"}
+
+func dslTime(v interface{}) (time.Time, bool) {
+	s, ok := v.(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	for _, format := range dslTimeFormats {
+		if t, err := time.Parse(format, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func dslInt(v interface{}) (int, error) {
+	switch n := v.(type) {
+	case float64:
+		return int(n), nil
+	case int:
+		return n, nil
+	case string:
+		return strconv.Atoi(n)
+	}
+	return 0, fmt.Errorf("%v is not an integer", v)
+}
+
+// dslWords splits text as the standard analyzer does, near enough
+func dslWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// dslWildcard turns * and ? into a regular expression
+func dslWildcard(pattern string) string {
+	var b strings.Builder
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,362 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// The resources quotas count
+const (
+	quotaEventTypes = "EventTypes"
+	quotaTriggers   = "triggers"
+	quotaCrons      = "repeating events"
+)
+
+// quotaAnonymous is the owner whose quotas what has no owner counts against
+const quotaAnonymous = "anonymous"
+
+// quotaOwner is the owner the quotas of a resource's creator are those of
+func quotaOwner(owner string) string {
+	if owner == "" {
+		return quotaAnonymous
+	}
+	return owner
+}
+
+// Quotas is the file $PZ_WORKFLOW_QUOTAS names: the limits of every owner
+// and of every namespace, and those of the ones named, which replace them
+type Quotas struct {
+	Owner      QuotaLimits            `json:"owner"`
+	Namespace  QuotaLimits            `json:"namespace"`
+	Owners     map[string]QuotaLimits `json:"owners"`
+	Namespaces map[string]QuotaLimits `json:"namespaces"`
+
+	// err is why the quotas file could not be read, if it could not
+	err error
+}
+
+func NewQuotas(path string) (*Quotas, error) {
+	byts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	quotas := &Quotas{}
+	if err = json.Unmarshal(byts, quotas); err != nil {
+		return nil, fmt.Errorf("quotas file %s: %s", path, err)
+	}
+	return quotas, nil
+}
+
+// newQuotasFromEnv reads the quotas file, if any. Without one nothing is
+// limited; a quotas file that cannot be read, like a policy, lets nobody
+// create anything or post events.
+func (service *Service) newQuotasFromEnv() *Quotas {
+	path := os.Getenv("PZ_WORKFLOW_QUOTAS")
+	if path == "" {
+		return &Quotas{}
+	}
+	quotas, err := NewQuotas(path)
+	if err != nil {
+		service.syslogger.Error("Quota error: %s; everything that quotas limit will be refused", err)
+		return &Quotas{err: err}
+	}
+	return quotas
+}
+
+func (quotas *Quotas) ownerLimits(owner string) QuotaLimits {
+	if limits, ok := quotas.Owners[owner]; ok {
+		return limits
+	}
+	return quotas.Owner
+}
+
+func (quotas *Quotas) namespaceLimits(namespace string) QuotaLimits {
+	if limits, ok := quotas.Namespaces[namespace]; ok {
+		return limits
+	}
+	return quotas.Namespace
+}
+
+func (limits QuotaLimits) of(resource string) int64 {
+	switch resource {
+	case quotaEventTypes:
+		return limits.EventTypes
+	case quotaTriggers:
+		return limits.Triggers
+	case quotaCrons:
+		return limits.Crons
+	}
+	return 0
+}
+
+// burst is how many events may be posted at once; at least one, so that a
+// rate below one a second lets any through
+func (limits QuotaLimits) burst() float64 {
+	if limits.EventBurst > 0 {
+		return float64(limits.EventBurst)
+	}
+	return math.Max(1, math.Ceil(limits.EventsPerSecond))
+}
+
+//---------------------------------------------------------------------------
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket for each owner and namespace that posts
+// events, in this instance only. A bucket fills at the rate of its limits,
+// up to their burst, and each event takes a token.
+type rateLimiter struct {
+	lock    sync.Mutex
+	buckets map[string]*tokenBucket
+	now     func() time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: map[string]*tokenBucket{}, now: time.Now}
+}
+
+// fill tops up the bucket for the time since it was last filled; a new
+// bucket starts full
+func (r *rateLimiter) fill(key string, limits QuotaLimits) *tokenBucket {
+	now := r.now()
+	bucket, ok := r.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: limits.burst(), last: now}
+		r.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(limits.burst(), bucket.tokens+now.Sub(bucket.last).Seconds()*limits.EventsPerSecond)
+	bucket.last = now
+	return bucket
+}
+
+// take takes a token for each key from its bucket, or none if any is empty,
+// and says which was
+func (r *rateLimiter) take(keys []string, limits []QuotaLimits) (string, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	buckets := []*tokenBucket{}
+	for i, key := range keys {
+		if limits[i].EventsPerSecond <= 0 {
+			continue
+		}
+		bucket := r.fill(key, limits[i])
+		if bucket.tokens < 1 {
+			return key, false
+		}
+		buckets = append(buckets, bucket)
+	}
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+	return "", true
+}
+
+// tokens is how many events the key may post now
+func (r *rateLimiter) tokens(key string, limits QuotaLimits) float64 {
+	if limits.EventsPerSecond <= 0 {
+		return 0
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.fill(key, limits).tokens
+}
+
+func ownerKey(owner string) string {
+	return "owner:" + owner
+}
+
+func namespaceKey(namespace string) string {
+	return "namespace:" + namespace
+}
+
+//---------------------------------------------------------------------------
+
+// countDsl is the search for the count of what the query matches
+func countDsl(query interface{}, sortBy string) (string, error) {
+	byts, err := json.Marshal(map[string]interface{}{"query": query})
+	if err != nil {
+		return "", err
+	}
+	format := &piazza.JsonPagination{PerPage: 1, SortBy: sortBy, Order: piazza.SortOrderAscending}
+	return format.SyncPagination(string(byts))
+}
+
+// ownerQuery matches what the owner created; the anonymous owner's is also
+// what has no owner
+func ownerQuery(owner string) map[string]interface{} {
+	query := map[string]interface{}{"term": map[string]interface{}{"createdBy": owner}}
+	if owner != quotaAnonymous {
+		return query
+	}
+	return map[string]interface{}{
+		"bool": map[string]interface{}{
+			"should": []interface{}{
+				query,
+				map[string]interface{}{"term": map[string]interface{}{"createdBy": ""}},
+				map[string]interface{}{"missing": map[string]interface{}{"field": "createdBy"}},
+			},
+		},
+	}
+}
+
+// countUsage counts the resources of the owner or, if none is given, of the
+// namespace. The owner and namespace of a repeating event are those of the
+// event and its EventType; they are few enough to count one by one.
+func (service *Service) countUsage(resource string, owner string, namespace string) (int64, error) {
+	var query map[string]interface{}
+	if owner != "" {
+		query = ownerQuery(owner)
+	} else {
+		query = namespaceQuery(namespace)
+	}
+
+	switch resource {
+	case quotaEventTypes:
+		dsl, err := countDsl(query, "eventTypeId")
+		if err != nil {
+			return 0, err
+		}
+		_, count, err := service.eventTypeDB.GetEventTypesByDslQuery(dsl, "pz-workflow")
+		return count, err
+	case quotaTriggers:
+		dsl, err := countDsl(query, "triggerId")
+		if err != nil {
+			return 0, err
+		}
+		_, count, err := service.triggerDB.GetTriggersByDslQuery(dsl, "pz-workflow")
+		return count, err
+	}
+
+	inNamespace := map[piazza.Ident]bool{}
+	if owner == "" {
+		ids, err := service.namespaceEventTypeIDs(namespace)
+		if err != nil {
+			return 0, err
+		}
+		for _, id := range ids {
+			inNamespace[id] = true
+		}
+	}
+	var count int64
+	err := exportPages("eventId", nil, func(dsl string) (int, string, error) {
+		page, _, err := service.cronDB.GetCronsByDslQuery(dsl, "pz-workflow")
+		last := ""
+		for _, event := range page {
+			if (owner != "" && quotaOwner(event.CreatedBy) == owner) || inNamespace[event.EventTypeID] {
+				count++
+			}
+			last = event.EventID.String()
+		}
+		return len(page), last, err
+	})
+	return count, err
+}
+
+// checkQuota refuses, with a 403, one more of the resource to an owner or a
+// namespace that has as many as its limit. The limit is approximate: what
+// is being created as it counts, here or in another instance, and what was
+// created too recently for the index to have made searchable, is not
+// counted, so callers creating at once can each get the last one.
+func (service *Service) checkQuota(resource string, owner string, namespace string) *piazza.JsonResponse {
+	if err := service.quotas.err; err != nil {
+		return service.statusForbidden(fmt.Errorf("quotas file: %s", err))
+	}
+	check := func(limit int64, owner string, namespace string, whose string) *piazza.JsonResponse {
+		if limit <= 0 {
+			return nil
+		}
+		count, err := service.countUsage(resource, owner, namespace)
+		if err != nil {
+			return service.statusInternalError(err)
+		}
+		if count >= limit {
+			service.syslogger.Audit(owner, "quotaExceeded", piazza.Ident(namespace), "Service.checkQuota: %s has %d of %d %s", whose, count, limit, resource)
+			return service.statusForbidden(fmt.Errorf("quota exceeded: %s has %d of %d %s", whose, count, limit, resource))
+		}
+		return nil
+	}
+
+	owner = quotaOwner(owner)
+	if resp := check(service.quotas.ownerLimits(owner).of(resource), owner, "", "owner ["+owner+"]"); resp != nil {
+		return resp
+	}
+	return check(service.quotas.namespaceLimits(namespace).of(resource), "", namespace, "namespace ["+namespace+"]")
+}
+
+// checkEventRate takes a token from the buckets of the event's owner and
+// namespace, or refuses the event with a 429 if either is empty
+func (service *Service) checkEventRate(owner string, namespace string) *piazza.JsonResponse {
+	if err := service.quotas.err; err != nil {
+		return service.statusForbidden(fmt.Errorf("quotas file: %s", err))
+	}
+	owner = quotaOwner(owner)
+	keys := []string{namespaceKey(namespace), ownerKey(owner)}
+	limits := []QuotaLimits{service.quotas.namespaceLimits(namespace), service.quotas.ownerLimits(owner)}
+	if key, ok := service.limiter.take(keys, limits); !ok {
+		service.syslogger.Audit(owner, "rateLimited", piazza.Ident(namespace), "Service.checkEventRate: %s is posting events too fast", key)
+		return service.statusTooManyRequests(fmt.Errorf("rate limit exceeded: %s is posting events too fast", key))
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------------
+
+// GetOwnerUsage says what the owner has, against its limits
+func (service *Service) GetOwnerUsage(owner string, actor string) *piazza.JsonResponse {
+	defer service.handlePanic()
+	limits := service.quotas.ownerLimits(owner)
+	usage := &Usage{Owner: owner, Limits: limits, EventTokens: service.limiter.tokens(ownerKey(owner), limits)}
+	return service.getUsage(usage, owner, "", actor)
+}
+
+// GetNamespaceUsage says what the namespace has, against its limits
+func (service *Service) GetNamespaceUsage(namespace string, actor string) *piazza.JsonResponse {
+	defer service.handlePanic()
+	if err := validateNamespace(namespace); err != nil {
+		return service.statusBadRequest(err)
+	}
+	limits := service.quotas.namespaceLimits(namespace)
+	usage := &Usage{Namespace: namespace, Limits: limits, EventTokens: service.limiter.tokens(namespaceKey(namespace), limits)}
+	return service.getUsage(usage, "", namespace, actor)
+}
+
+func (service *Service) getUsage(usage *Usage, owner string, namespace string, actor string) *piazza.JsonResponse {
+	whose := owner + namespace
+	service.syslogger.Audit(actor, "gettingUsage", piazza.Ident(whose), "Service.getUsage: User is getting the usage of [%s]", whose)
+
+	var err error
+	if usage.EventTypes, err = service.countUsage(quotaEventTypes, owner, namespace); err == nil {
+		if usage.Triggers, err = service.countUsage(quotaTriggers, owner, namespace); err == nil {
+			usage.Crons, err = service.countUsage(quotaCrons, owner, namespace)
+		}
+	}
+	if err != nil {
+		service.syslogger.Audit(actor, "gettingUsageFailure", piazza.Ident(whose), "Service.getUsage: User failed to get the usage of [%s]", whose)
+		return service.statusInternalError(err)
+	}
+	return service.statusOK(usage)
+}
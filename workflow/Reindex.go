@@ -0,0 +1,399 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// a job keeps only the first errors, as purges do
+const reindexMaxErrors = purgeMaxErrors
+
+// PostReindex starts moving an alias onto a new index and returns the job at
+// once; GetReindex reports its progress
+func (service *Service) PostReindex(request *ReindexRequest, actor string) *piazza.JsonResponse {
+	defer service.handlePanic()
+
+	if service.indexAdmin == nil {
+		return service.statusBadRequest(fmt.Errorf("cannot reindex: the service is not using Elasticsearch"))
+	}
+	db := service.aliasDB(request.Alias)
+	if db == nil {
+		return service.statusBadRequest(fmt.Errorf("cannot reindex [%s]: not an alias of the service", request.Alias))
+	}
+	if request.Index == "" {
+		return service.statusBadRequest(fmt.Errorf("the index to reindex into is required"))
+	}
+	exists, err := service.indexAdmin.IndexExists(request.Index)
+	if err != nil {
+		return service.statusInternalError(err)
+	}
+	if exists {
+		return service.statusBadRequest(fmt.Errorf("index %s already exists", request.Index))
+	}
+	from, err := service.indexAdmin.AliasIndices(request.Alias)
+	if err != nil {
+		return service.statusInternalError(err)
+	}
+	if request.Settings == "" {
+		request.Settings = latestSettings(request.Alias)
+	}
+
+	job := &ReindexJob{
+		ReindexID: service.newIdent(),
+		Request:   *request,
+		Status:    ReindexStatusRunning,
+		From:      from,
+		CreatedBy: actor,
+		CreatedOn: piazza.NewTimeStamp(),
+	}
+
+	service.reindexLock.Lock()
+	if service.reindexing {
+		service.reindexLock.Unlock()
+		return service.statusConflict(fmt.Errorf("a reindex is already running"))
+	}
+	service.reindexing = true
+	cutoff := time.Now().Add(-finishedJobTTL)
+	for id, old := range service.reindexJobs {
+		if finishedBefore(old.CompletedOn, cutoff) {
+			delete(service.reindexJobs, id)
+		}
+	}
+	service.reindexJobs[job.ReindexID] = job
+	out := job.copy()
+	service.reindexLock.Unlock()
+
+	service.syslogger.Audit(actor, "reindexing", job.ReindexID, "Service.PostReindex: User is moving alias [%s] from %v to [%s]", request.Alias, from, request.Index)
+
+	go service.reindex(job, db)
+
+	return service.statusCreated(out)
+}
+
+// GetReindex returns the progress of a reindex
+func (service *Service) GetReindex(id piazza.Ident) *piazza.JsonResponse {
+	defer service.handlePanic()
+
+	service.reindexLock.Lock()
+	job, ok := service.reindexJobs[id]
+	var out *ReindexJob
+	if ok {
+		out = job.copy()
+	}
+	service.reindexLock.Unlock()
+
+	if !ok {
+		return service.statusNotFound(fmt.Errorf("reindex %s could not be found", id))
+	}
+	return service.statusOK(out)
+}
+
+func (job *ReindexJob) copy() *ReindexJob {
+	out := *job
+	out.From = append([]string(nil), job.From...)
+	out.Errors = append([]string(nil), job.Errors...)
+	return &out
+}
+
+// updateReindex changes the job where GetReindex can see it
+func (service *Service) updateReindex(job *ReindexJob, update func()) {
+	service.reindexLock.Lock()
+	defer service.reindexLock.Unlock()
+	update()
+}
+
+// aliasDB is the DB reading and writing through the alias, or nil if the
+// resource is not kept in Elasticsearch
+func (service *Service) aliasDB(alias string) *ResourceDB {
+	var repo interface{}
+	switch alias {
+	case keyEventTypes:
+		repo = service.eventTypeDB
+	case keyEvents:
+		repo = service.eventDB
+	case keyTriggers:
+		repo = service.triggerDB
+	case keyAlerts:
+		repo = service.alertDB
+	case keyCrons:
+		repo = service.cronDB
+	case keyTestElasticsearch:
+		repo = service.testElasticsearchDB
+	case keyGeofences:
+		repo = service.geofenceDB
+	case keyGeofenceStates:
+		repo = service.geofenceStateDB
+	case keyStats:
+		repo = service.statsDB
+	case keyOutbox:
+		repo = service.outboxDB
+	case keyACLs:
+		repo = service.aclDB
+	case keyAudit:
+		repo = service.auditDB
+	}
+	if db, ok := repo.(esRepo); ok {
+		return db.resourceDB()
+	}
+	return nil
+}
+
+// latestSettings are those the alias's newest migration created its index with
+func latestSettings(alias string) string {
+	settings := ""
+	for _, migration := range Migrations {
+		if migration.Alias == alias {
+			settings = migration.Settings
+		}
+	}
+	return settings
+}
+
+// reindex creates the new index, copies the documents into it, and moves
+// the alias onto it. Writes through this instance wait from the copy until
+// the alias has moved, so none is left behind on the old index; those
+// through other instances do not. On failure the alias goes back and the
+// new index is deleted.
+func (service *Service) reindex(job *ReindexJob, db *ResourceDB) {
+	request := job.Request
+	swapped := false
+	paused := false
+	resume := func() {
+		if paused {
+			paused = false
+			db.writes.Unlock()
+		}
+	}
+
+	stage := func(name string) {
+		service.updateReindex(job, func() { job.Stage = name })
+	}
+	finish := func(status string, err error) {
+		service.updateReindex(job, func() {
+			now := piazza.NewTimeStamp()
+			job.Status = status
+			job.Stage = ""
+			job.CompletedOn = &now
+			if err != nil && len(job.Errors) < reindexMaxErrors {
+				job.Errors = append(job.Errors, err.Error())
+			}
+		})
+		switch status {
+		case ReindexStatusDone:
+			service.syslogger.Audit(job.CreatedBy, "reindexed", job.ReindexID, "Service.reindex: User successfully moved alias [%s] to [%s]", request.Alias, request.Index)
+		default:
+			service.syslogger.Audit(job.CreatedBy, "reindexingFailure", job.ReindexID, "Service.reindex: User failed to move alias [%s] to [%s]: %v", request.Alias, request.Index, err)
+		}
+		service.reindexLock.Lock()
+		service.reindexing = false
+		service.reindexLock.Unlock()
+	}
+	fail := func(err error) {
+		resume()
+		stage("rollingBack")
+		if rollbackErr := service.rollbackReindex(job, db, swapped); rollbackErr != nil {
+			service.updateReindex(job, func() { job.Errors = append(job.Errors, err.Error()) })
+			finish(ReindexStatusFailed, fmt.Errorf("rollback failed: %s", rollbackErr))
+			return
+		}
+		finish(ReindexStatusRolledBack, err)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			fail(fmt.Errorf("reindex panicked: %v", r))
+		}
+	}()
+
+	stage("creating")
+	to, err := service.indexAdmin.OpenIndex(request.Index, request.Settings)
+	if err != nil {
+		finish(ReindexStatusRolledBack, err)
+		return
+	}
+
+	// the old indices by name, as the alias will not lead to them for long
+	froms := []elasticsearch.IIndex{}
+	for _, name := range job.From {
+		from, err := service.indexAdmin.OpenIndex(name, "")
+		if err != nil {
+			fail(err)
+			return
+		}
+		froms = append(froms, from)
+	}
+
+	copied := func() { service.updateReindex(job, func() { job.Copied++ }) }
+	transform := service.reindexTransform(request.Alias)
+
+	stage("pausing")
+	db.writes.Lock()
+	paused = true
+
+	if request.Alias == keyEvents {
+		stage("mapping")
+		if err = service.reindexEventMappings(to); err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	stage("copying")
+	for _, from := range froms {
+		if err = (&indexCopy{from: from, to: to, transform: transform, copied: copied}).run(); err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	if request.Alias == keyEvents {
+		stage("percolating")
+		if err = service.reindexPercolation(to); err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	stage("swapping")
+	if err = service.indexAdmin.SwapAlias(request.Alias, request.Index); err != nil {
+		fail(err)
+		return
+	}
+	swapped = true
+	if err = service.reopenAlias(db, request.Alias); err != nil {
+		fail(err)
+		return
+	}
+	resume()
+
+	finish(ReindexStatusDone, nil)
+}
+
+// reindexTransform rewrites documents that were written in an older form.
+// Trigger conditions have their dotted keys encoded again, which leaves
+// those already encoded as they are.
+func (service *Service) reindexTransform(alias string) func(string, *json.RawMessage) (interface{}, error) {
+	if alias != keyTriggers {
+		return nil
+	}
+	return func(typ string, source *json.RawMessage) (interface{}, error) {
+		doc := map[string]interface{}{}
+		if err := json.Unmarshal(*source, &doc); err != nil {
+			return nil, err
+		}
+		if condition, ok := doc["condition"].(map[string]interface{}); ok {
+			doc["condition"] = encodeCondition(condition)
+		}
+		return doc, nil
+	}
+}
+
+// reindexEventMappings gives the new events index the mapping of every
+// EventType, from the EventTypes themselves rather than the old index
+func (service *Service) reindexEventMappings(to elasticsearch.IIndex) error {
+	eventTypes, err := service.purgeEventTypes(&PurgeRequest{})
+	if err != nil {
+		return err
+	}
+	for _, eventType := range eventTypes {
+		exists, err := to.TypeExists(eventType.typeName())
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		jsn, err := ConstructEventMappingSchema(eventType.typeName(), eventType.Mapping)
+		if err != nil {
+			return err
+		}
+		if err = to.SetMapping(eventType.typeName(), jsn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reindexPercolation registers every trigger's percolation query with the
+// new events index, as PostTrigger does with the current one
+func (service *Service) reindexPercolation(to elasticsearch.IIndex) error {
+	triggerDB, ok := service.triggerDB.(*TriggerDB)
+	if !ok {
+		return fmt.Errorf("triggers are not kept in Elasticsearch")
+	}
+	eventTypeNames := map[piazza.Ident]string{}
+	return exportPages("triggerId", nil, func(dsl string) (int, string, error) {
+		page, _, err := service.triggerDB.GetTriggersByDslQuery(dsl, "pz-workflow")
+		if err != nil {
+			return 0, "", err
+		}
+		last := ""
+		for i := range page {
+			trigger := &page[i]
+			last = trigger.TriggerID.String()
+			name, ok := eventTypeNames[trigger.EventTypeID]
+			if !ok {
+				eventType, found, err := service.eventTypeDB.GetOne(trigger.EventTypeID, "pz-workflow")
+				if !found || err != nil {
+					return 0, "", fmt.Errorf("eventType %s of trigger %s could not be found", trigger.EventTypeID, trigger.TriggerID)
+				}
+				name = eventType.typeName()
+				eventTypeNames[trigger.EventTypeID] = name
+			}
+			condition, ok := prefixCondition(trigger.Condition, name)
+			if !ok {
+				return 0, "", fmt.Errorf("failed to parse query of trigger %s", trigger.TriggerID)
+			}
+			if err = triggerDB.addPercolation(to, trigger, condition); err != nil {
+				return 0, "", err
+			}
+		}
+		return len(page), last, nil
+	})
+}
+
+// reopenAlias points the DB at whatever the alias is now on. A real index
+// is opened by its alias and follows it by itself.
+func (service *Service) reopenAlias(db *ResourceDB, alias string) error {
+	esi, err := service.indexAdmin.OpenIndex(alias, "")
+	if err != nil {
+		return err
+	}
+	if esi.IndexName() != db.Esi.IndexName() {
+		db.Esi = db.gate(service.timeIndex(esi))
+	}
+	return nil
+}
+
+func (service *Service) rollbackReindex(job *ReindexJob, db *ResourceDB, swapped bool) error {
+	request := job.Request
+	if swapped {
+		if len(job.From) != 1 {
+			return fmt.Errorf("alias %s was on %d indices and cannot be moved back", request.Alias, len(job.From))
+		}
+		if err := service.indexAdmin.SwapAlias(request.Alias, job.From[0]); err != nil {
+			return err
+		}
+		if err := service.reopenAlias(db, request.Alias); err != nil {
+			return err
+		}
+	}
+	return service.indexAdmin.DeleteIndex(request.Index)
+}
@@ -0,0 +1,160 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import "github.com/venicegeo/pz-gocommon/gocommon"
+
+// The Service keeps its resources in these repositories. The *DB types keep
+// them in Elasticsearch, and the File*Repo types in a FileStore.
+//
+// The dslString of a query is an Elasticsearch search body; the FileStore
+// evaluates the subset of the query DSL that Query.go describes. A write or
+// delete at a version fails with errVersionConflict unless the document is
+// at that version; at version 0 it goes ahead whatever the version.
+
+// EventTypeRepo holds EventTypes
+type EventTypeRepo interface {
+	PostData(eventType *EventType) error
+	PutData(eventType *EventType, version int64) error
+	GetAll(format *piazza.JsonPagination, actor string) ([]EventType, int64, error)
+	GetEventTypesByDslQuery(dslString string, actor string) ([]EventType, int64, error)
+	GetOne(id piazza.Ident, actor string) (*EventType, bool, error)
+	GetIDByName(format *piazza.JsonPagination, namespace string, name string, actor string) (*piazza.Ident, bool, error)
+	DeleteByID(id piazza.Ident, actor string) (bool, error)
+	deleteAtVersion(id piazza.Ident, version int64) (bool, error)
+	itemExists(id piazza.Ident, actor string) (bool, error)
+}
+
+// EventRepo holds Events, under the name of their EventType, and the
+// percolation queries of the triggers that watch them
+type EventRepo interface {
+	PostData(event *Event, typ string) error
+	GetAll(mapping string, format *piazza.JsonPagination, actor string) ([]Event, int64, error)
+	GetEventsByDslQuery(mapping string, jsnString string, actor string) ([]Event, int64, error)
+	GetEventsByEventTypeID(format *piazza.JsonPagination, mapping string, eventTypeID piazza.Ident, actor string) ([]Event, int64, error)
+	GetOne(mapping string, id piazza.Ident, actor string) (*Event, bool, error)
+	DeleteByID(mapping string, id piazza.Ident, actor string) (bool, error)
+	DeleteByIDs(mapping string, ids []piazza.Ident, actor string) (int, error)
+	NameExists(name string, actor string) (bool, error)
+	AddMapping(name string, mapping map[string]interface{}, actor string) error
+	RemoveMapping(name string, actor string) error
+	PercolateEventData(eventType string, data map[string]interface{}, id piazza.Ident, actor string) (*[]piazza.Ident, error)
+	AddPercolationQuery(id piazza.Ident, query piazza.JsonString) (piazza.Ident, error)
+	DeletePercolationQuery(id piazza.Ident) (bool, error)
+	GetPercolationIDs(actor string) ([]piazza.Ident, error)
+	itemExists(mapping string, id piazza.Ident, actor string) (bool, error)
+	lookupEventTypeNameByEventID(id piazza.Ident, actor string) (string, error)
+	lookupEventTypeNamesByEventIDs(ids []piazza.Ident, actor string) (map[piazza.Ident]string, error)
+}
+
+// TriggerRepo holds Triggers, registering their percolation queries with the
+// EventRepo as they come and go
+type TriggerRepo interface {
+	PostData(trigger *Trigger) error
+	PutTrigger(trigger *Trigger, update *TriggerUpdate, version int64, actor string) (*Trigger, error)
+	GetAll(format *piazza.JsonPagination, actor string) ([]Trigger, int64, error)
+	GetTriggersByDslQuery(dslString string, actor string) ([]Trigger, int64, error)
+	GetOne(id piazza.Ident, actor string) (*Trigger, bool, error)
+	GetTriggersByEventTypeID(format *piazza.JsonPagination, id piazza.Ident, actor string) ([]Trigger, int64, error)
+	GetTriggersByGeofenceID(id piazza.Ident, actor string) ([]Trigger, error)
+	DeleteTrigger(id piazza.Ident, version int64, actor string) (bool, error)
+	itemExists(id piazza.Ident, actor string) (bool, error)
+}
+
+// AlertRepo holds Alerts
+type AlertRepo interface {
+	PostData(alert *Alert) error
+	PutData(alert *Alert, version int64) error
+	GetAll(format *piazza.JsonPagination, actor string) ([]Alert, int64, error)
+	GetAlertsByDslQuery(dslString string, actor string) ([]Alert, int64, error)
+	GetAllByTrigger(format *piazza.JsonPagination, triggerID piazza.Ident, actor string) ([]Alert, int64, error)
+	GetOne(id piazza.Ident, actor string) (*Alert, bool, error)
+	DeleteByID(id piazza.Ident, actor string) (bool, error)
+	DeleteByIDs(ids []piazza.Ident, actor string) (int, error)
+	deleteAtVersion(id piazza.Ident, version int64) (bool, error)
+	itemExists(id piazza.Ident, actor string) (bool, error)
+}
+
+// CronRepo holds the Events that repeat on a schedule
+type CronRepo interface {
+	PostData(event *Event) error
+	GetAll(actor string) (*[]Event, error)
+	GetPage(format *piazza.JsonPagination, actor string) ([]Event, int64, error)
+	GetCronsByDslQuery(dslString string, actor string) ([]Event, int64, error)
+	Exists(actor string) (bool, error)
+	DeleteByID(id piazza.Ident, actor string) (bool, error)
+	itemExists(id piazza.Ident, actor string) (bool, error)
+}
+
+// OutboxRepo holds the work a shutdown left unfinished
+type OutboxRepo interface {
+	PostData(entry *OutboxEntry) error
+	GetAll(format *piazza.JsonPagination, actor string) ([]OutboxEntry, int64, error)
+	DeleteByID(id piazza.Ident, actor string) (bool, error)
+}
+
+// ACLRepo holds the ACLs that have been set
+type ACLRepo interface {
+	PutData(acl *ACL) error
+	GetOne(id piazza.Ident) (*ACL, bool, error)
+	DeleteByID(id piazza.Ident, actor string) (bool, error)
+}
+
+// AuditRepo holds the audit messages
+type AuditRepo interface {
+	PostData(record *AuditRecord) error
+	GetAuditByDslQuery(dslString string, actor string) ([]AuditRecord, int64, error)
+}
+
+var (
+	_ EventTypeRepo = (*EventTypeDB)(nil)
+	_ EventRepo     = (*EventDB)(nil)
+	_ TriggerRepo   = (*TriggerDB)(nil)
+	_ AlertRepo     = (*AlertDB)(nil)
+	_ CronRepo      = (*CronDB)(nil)
+	_ OutboxRepo    = (*OutboxDB)(nil)
+	_ ACLRepo       = (*ACLDB)(nil)
+	_ AuditRepo     = (*AuditDB)(nil)
+
+	_ EventTypeRepo = (*FileEventTypeRepo)(nil)
+	_ EventRepo     = (*FileEventRepo)(nil)
+	_ TriggerRepo   = (*FileTriggerRepo)(nil)
+	_ AlertRepo     = (*FileAlertRepo)(nil)
+	_ CronRepo      = (*FileCronRepo)(nil)
+	_ OutboxRepo    = (*FileOutboxRepo)(nil)
+	_ ACLRepo       = (*FileACLRepo)(nil)
+	_ AuditRepo     = (*FileAuditRepo)(nil)
+)
+
+// getTriggersByGeofenceID pages through every trigger, returning those whose
+// geofence condition or condition query refers to the given geofence
+func getTriggersByGeofenceID(db TriggerRepo, id piazza.Ident, actor string) ([]Trigger, error) {
+	triggers := []Trigger{}
+	err := exportPages("triggerId", nil, func(dsl string) (int, string, error) {
+		page, _, err := db.GetTriggersByDslQuery(dsl, actor)
+		last := ""
+		for _, trigger := range page {
+			if triggerUsesGeofence(&trigger, id) {
+				triggers = append(triggers, trigger)
+			}
+			last = trigger.TriggerID.String()
+		}
+		return len(page), last, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return triggers, nil
+}
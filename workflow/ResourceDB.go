@@ -14,22 +14,216 @@
 
 package workflow
 
-import "github.com/venicegeo/pz-gocommon/elasticsearch"
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
 
 type ResourceDB struct {
 	service *Service
 	Esi     elasticsearch.IIndex
+
+	// writes is held by a reindex while it copies the index and moves the
+	// alias, and by every write to Esi otherwise
+	writes *sync.RWMutex
 }
 
 func NewResourceDB(service *Service, esi elasticsearch.IIndex) (*ResourceDB, error) {
 	db := &ResourceDB{
 		service: service,
-		Esi:     esi,
+		writes:  &sync.RWMutex{},
 	}
+	db.Esi = db.gate(service.timeIndex(esi))
 
-	if err := esi.Create(""); err != nil {
+	if err := db.Esi.Create(""); err != nil {
 		return nil, err
 	}
 
 	return db, nil
 }
+
+// gate makes the writes to esi wait while a reindex holds the DB's writes
+func (db *ResourceDB) gate(esi elasticsearch.IIndex) elasticsearch.IIndex {
+	return &gatedIndex{IIndex: esi, writes: db.writes}
+}
+
+type gatedIndex struct {
+	elasticsearch.IIndex
+	writes *sync.RWMutex
+}
+
+func (esi *gatedIndex) PostData(typ string, id string, obj interface{}) (*elasticsearch.IndexResponse, error) {
+	esi.writes.RLock()
+	defer esi.writes.RUnlock()
+	return esi.IIndex.PostData(typ, id, obj)
+}
+
+func (esi *gatedIndex) PutData(typ string, id string, obj interface{}) (*elasticsearch.IndexResponse, error) {
+	esi.writes.RLock()
+	defer esi.writes.RUnlock()
+	return esi.IIndex.PutData(typ, id, obj)
+}
+
+func (esi *gatedIndex) DeleteByID(typ string, id string) (*elasticsearch.DeleteResponse, error) {
+	esi.writes.RLock()
+	defer esi.writes.RUnlock()
+	return esi.IIndex.DeleteByID(typ, id)
+}
+
+func (esi *gatedIndex) SetMapping(typename string, jsn piazza.JsonString) error {
+	esi.writes.RLock()
+	defer esi.writes.RUnlock()
+	return esi.IIndex.SetMapping(typename, jsn)
+}
+
+func (esi *gatedIndex) AddPercolationQuery(id string, query piazza.JsonString) (*elasticsearch.IndexResponse, error) {
+	esi.writes.RLock()
+	defer esi.writes.RUnlock()
+	return esi.IIndex.AddPercolationQuery(id, query)
+}
+
+func (esi *gatedIndex) DeletePercolationQuery(id string) (*elasticsearch.DeleteResponse, error) {
+	esi.writes.RLock()
+	defer esi.writes.RUnlock()
+	return esi.IIndex.DeletePercolationQuery(id)
+}
+
+// DirectAccess waits for anything but a read or a search
+func (esi *gatedIndex) DirectAccess(verb string, endpoint string, input interface{}, output interface{}) error {
+	if verb != "GET" && !strings.HasSuffix(endpoint, "/_search") {
+		esi.writes.RLock()
+		defer esi.writes.RUnlock()
+	}
+	return esi.IIndex.DirectAccess(verb, endpoint, input, output)
+}
+
+// esRepo is a repository kept in Elasticsearch, which reindexing can move
+type esRepo interface {
+	resourceDB() *ResourceDB
+}
+
+func (db *ResourceDB) resourceDB() *ResourceDB {
+	return db
+}
+
+// deleteByQueryResponse is what the delete-by-query plugin answers
+type deleteByQueryResponse struct {
+	Indices map[string]struct {
+		Deleted int `json:"deleted"`
+		Failed  int `json:"failed"`
+	} `json:"_indices"`
+	Error interface{} `json:"error"`
+}
+
+// deleteByIDs deletes the documents of the type in one request to the
+// delete-by-query plugin, or one at a time where Elasticsearch lacks it,
+// and says how many it deleted
+func (db *ResourceDB) deleteByIDs(typ string, ids []piazza.Ident) (int, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	endpoint := fmt.Sprintf("/%s/%s/_query", db.Esi.IndexName(), typ)
+	query := map[string]interface{}{"query": map[string]interface{}{"ids": map[string]interface{}{"values": ids}}}
+	out := &deleteByQueryResponse{}
+	err := db.Esi.DirectAccess("DELETE", endpoint, query, out)
+	if all, ok := out.Indices["_all"]; err == nil && out.Error == nil && ok {
+		if all.Failed > 0 {
+			return all.Deleted, fmt.Errorf("failed to delete %d of %d", all.Failed, len(ids))
+		}
+		return all.Deleted, nil
+	}
+
+	deleted := 0
+	for _, id := range ids {
+		resp, err := db.Esi.DeleteByID(typ, id.String())
+		if resp != nil && !resp.Found {
+			// already gone
+			continue
+		}
+		if err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// versionedResponse is what Elasticsearch answers a read, write or delete
+// of one document by its id
+type versionedResponse struct {
+	Found   bool             `json:"found"`
+	Created bool             `json:"created"`
+	Version int64            `json:"_version"`
+	Source  *json.RawMessage `json:"_source"`
+	Error   interface{}      `json:"error"`
+	Status  int              `json:"status"`
+}
+
+// err is the failure the response reports, if it does, with a version
+// conflict as errVersionConflict
+func (resp *versionedResponse) err() error {
+	if resp.Status == http.StatusConflict {
+		return errVersionConflict
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("%v", resp.Error)
+	}
+	return nil
+}
+
+// documentEndpoint is where the document is, written over the version
+// unless that is 0
+func (db *ResourceDB) documentEndpoint(typ string, id piazza.Ident, version int64) string {
+	endpoint := fmt.Sprintf("/%s/%s/%s", db.Esi.IndexName(), typ, id)
+	if version != 0 {
+		endpoint += fmt.Sprintf("?version=%d", version)
+	}
+	return endpoint
+}
+
+// getVersioned reads the document with the version Elasticsearch has of it
+func (db *ResourceDB) getVersioned(typ string, id piazza.Ident) (*json.RawMessage, int64, bool, error) {
+	out := &versionedResponse{}
+	if err := db.Esi.DirectAccess("GET", db.documentEndpoint(typ, id, 0), nil, out); err != nil {
+		return nil, 0, false, err
+	}
+	if err := out.err(); err != nil {
+		return nil, 0, false, err
+	}
+	if !out.Found || out.Source == nil {
+		return nil, 0, false, fmt.Errorf("Item %s in index %s and type %s does not exist", id, db.Esi.IndexName(), typ)
+	}
+	return out.Source, out.Version, true, nil
+}
+
+// putVersioned writes the document over the version of it, or over any
+// if that is 0, and says which version it now is
+func (db *ResourceDB) putVersioned(typ string, id piazza.Ident, obj interface{}, version int64) (int64, error) {
+	out := &versionedResponse{}
+	if err := db.Esi.DirectAccess("PUT", db.documentEndpoint(typ, id, version), obj, out); err != nil {
+		return 0, err
+	}
+	if err := out.err(); err != nil {
+		return 0, err
+	}
+	return out.Version, nil
+}
+
+// deleteVersioned deletes the document at the version, or at any if that
+// is 0, and says whether there was one
+func (db *ResourceDB) deleteVersioned(typ string, id piazza.Ident, version int64) (bool, error) {
+	out := &versionedResponse{}
+	if err := db.Esi.DirectAccess("DELETE", db.documentEndpoint(typ, id, version), nil, out); err != nil {
+		return false, err
+	}
+	if err := out.err(); err != nil {
+		return false, err
+	}
+	return out.Found, nil
+}
@@ -0,0 +1,346 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// how often the retention sweeper runs
+const sweepSchedule = "@every 1h"
+
+// validate checks the limits can be used; a nil Retention has none
+func (r *Retention) validate() error {
+	if r == nil {
+		return nil
+	}
+	if r.MaxCount < 0 || r.AlertMaxCount < 0 {
+		return fmt.Errorf("retention counts cannot be negative")
+	}
+	for _, age := range []string{r.MaxAge, r.AlertMaxAge} {
+		if _, err := parseRetentionAge(age); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseRetentionAge(age string) (time.Duration, error) {
+	if age == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(age)
+	if err != nil {
+		return 0, fmt.Errorf("retention age [%s] is not a duration: %s", age, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("retention age [%s] cannot be negative", age)
+	}
+	return d, nil
+}
+
+// expiredPages pages through what the query matches, newest first, returning
+// the ids of those older than maxAge or beyond the newest maxCount. Zero
+// limits are no limits. get returns the ids and createdOn of what the search
+// body of a page finds. A page starts after the last of the one before, by
+// createdOn and then by the id field, as search_after does, rather than at an
+// offset, which an index refuses past its max_result_window.
+func expiredPages(idField string, query interface{}, age string, maxCount int, now time.Time, get func(dsl string) ([]piazza.Ident, []piazza.TimeStamp, error)) ([]piazza.Ident, error) {
+	maxAge, _ := parseRetentionAge(age)
+
+	expired := []piazza.Ident{}
+	seen := 0
+	var after map[string]interface{}
+	for {
+		dsl, err := expiredDsl(idField, query, after)
+		if err != nil {
+			return nil, err
+		}
+		ids, createdOn, err := get(dsl)
+		if err != nil {
+			return nil, err
+		}
+		for i, id := range ids {
+			if (maxCount > 0 && seen >= maxCount) || (maxAge > 0 && now.Sub(time.Time(createdOn[i])) > maxAge) {
+				expired = append(expired, id)
+			}
+			seen++
+		}
+		if len(ids) < exportPerPage {
+			return expired, nil
+		}
+		last := len(ids) - 1
+		after = map[string]interface{}{"createdOn": createdOn[last], idField: ids[last]}
+	}
+}
+
+// expiredDsl is the search body of the page of expiredPages that starts after
+// the createdOn and id of after, or at the newest if it is nil
+func expiredDsl(idField string, query interface{}, after map[string]interface{}) (string, error) {
+	if after != nil {
+		createdOn := after["createdOn"]
+		query = map[string]interface{}{"bool": map[string]interface{}{
+			"must": query,
+			"filter": map[string]interface{}{"bool": map[string]interface{}{
+				"should": []interface{}{
+					map[string]interface{}{"range": map[string]interface{}{"createdOn": map[string]interface{}{"lt": createdOn}}},
+					map[string]interface{}{"bool": map[string]interface{}{"filter": []interface{}{
+						map[string]interface{}{"range": map[string]interface{}{"createdOn": map[string]interface{}{"gte": createdOn, "lte": createdOn}}},
+						map[string]interface{}{"range": map[string]interface{}{idField: map[string]interface{}{"lt": after[idField]}}},
+					}}},
+				},
+			}},
+		}}
+	}
+	byts, err := json.Marshal(map[string]interface{}{
+		"query": query,
+		"sort":  []interface{}{map[string]interface{}{"createdOn": "desc"}, map[string]interface{}{idField: "desc"}},
+		"size":  exportPerPage,
+	})
+	return string(byts), err
+}
+
+// inBatches calls fn for successive slices of at most exportPerPage ids
+func inBatches(ids []piazza.Ident, fn func(batch []piazza.Ident) error) error {
+	for len(ids) > 0 {
+		n := exportPerPage
+		if n > len(ids) {
+			n = len(ids)
+		}
+		if err := fn(ids[:n]); err != nil {
+			return err
+		}
+		ids = ids[n:]
+	}
+	return nil
+}
+
+// InitSweeper schedules the retention sweeper
+func (service *Service) InitSweeper() error {
+	return service.cron.AddFunc(sweepSchedule, func() { service.Sweep() })
+}
+
+// PostSweep runs the retention sweeper now, rather than waiting for it
+func (service *Service) PostSweep(actor string) *piazza.JsonResponse {
+	defer service.handlePanic()
+	service.syslogger.Audit(actor, "sweeping", keyEvents, "Service.PostSweep: User is running the retention sweeper")
+	return service.statusOK(service.Sweep())
+}
+
+// Sweep deletes the events and resolved alerts that have outlived the
+// retention of their EventType, and records what it did in the stats.
+// Alerts go first, so that their events are no longer held back by them.
+func (service *Service) Sweep() *SweepResult {
+	service.sweepLock.Lock()
+	defer service.sweepLock.Unlock()
+
+	result := &SweepResult{StartedOn: piazza.NewTimeStamp()}
+	if err := service.sweep(result); err != nil {
+		result.Errors = append(result.Errors, err.Error())
+	}
+
+	result.CompletedOn = piazza.NewTimeStamp()
+	service.syslogger.Audit("pz-workflow", "swept", keyEvents, "Service.Sweep: Retention sweeper deleted %d events and %d alerts, keeping %d events for unresolved alerts", result.EventsDeleted, result.AlertsDeleted, result.EventsProtected)
+
+	service.Lock()
+	service.stats.LastSweep = result
+	service.Unlock()
+
+	return result
+}
+
+func (service *Service) sweep(result *SweepResult) error {
+	now := time.Now()
+
+	allEventTypes, err := service.purgeEventTypes(&PurgeRequest{})
+	if err != nil {
+		return err
+	}
+	eventTypes := []*EventType{}
+	for i := range allEventTypes {
+		if allEventTypes[i].Retention != nil {
+			eventTypes = append(eventTypes, &allEventTypes[i])
+		}
+	}
+	if len(eventTypes) == 0 {
+		return nil
+	}
+
+	for _, eventType := range eventTypes {
+		if err = service.sweepAlerts(eventType, now, result); err != nil {
+			return err
+		}
+	}
+
+	// cron events are schedules, not occurrences, and do not expire
+	crons := []piazza.Ident{}
+	err = exportPages("eventId", nil, func(dsl string) (int, string, error) {
+		page, _, err := service.cronDB.GetCronsByDslQuery(dsl, "pz-workflow")
+		last := ""
+		for _, event := range page {
+			crons = append(crons, event.EventID)
+			last = event.EventID.String()
+		}
+		return len(page), last, err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, eventType := range eventTypes {
+		if err = service.sweepEvents(eventType, crons, now, result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sweepAlerts deletes the resolved alerts of the EventType's triggers that
+// have expired
+func (service *Service) sweepAlerts(eventType *EventType, now time.Time, result *SweepResult) error {
+	retention := eventType.Retention
+	if retention.AlertMaxAge == "" && retention.AlertMaxCount == 0 {
+		return nil
+	}
+
+	triggerIDs := []piazza.Ident{}
+	err := exportPages("triggerId", termQuery("eventTypeId", eventType.EventTypeID.String()), func(dsl string) (int, string, error) {
+		page, _, err := service.triggerDB.GetTriggersByDslQuery(dsl, "pz-workflow")
+		last := ""
+		for _, trigger := range page {
+			triggerIDs = append(triggerIDs, trigger.TriggerID)
+			last = trigger.TriggerID.String()
+		}
+		return len(page), last, err
+	})
+	if err != nil || len(triggerIDs) == 0 {
+		return err
+	}
+
+	query := map[string]interface{}{
+		"bool": map[string]interface{}{
+			"filter": []interface{}{
+				termQuery("resolved", true),
+				map[string]interface{}{"terms": map[string]interface{}{"triggerId": triggerIDs}},
+			},
+		},
+	}
+	expired, err := expiredPages("alertId", query, retention.AlertMaxAge, retention.AlertMaxCount, now, func(dsl string) ([]piazza.Ident, []piazza.TimeStamp, error) {
+		page, _, err := service.alertDB.GetAlertsByDslQuery(dsl, "pz-workflow")
+		ids, createdOn := []piazza.Ident{}, []piazza.TimeStamp{}
+		for _, alert := range page {
+			ids = append(ids, alert.AlertID)
+			createdOn = append(createdOn, alert.CreatedOn)
+		}
+		return ids, createdOn, err
+	})
+	if err != nil {
+		return err
+	}
+
+	return inBatches(expired, func(batch []piazza.Ident) error {
+		deleted, err := service.alertDB.DeleteByIDs(batch, "pz-workflow")
+		result.AlertsDeleted += deleted
+		if err != nil {
+			result.Errors = append(result.Errors, err.Error())
+		}
+		return nil
+	})
+}
+
+// sweepEvents deletes the events of the EventType that have expired, but
+// for those an unresolved alert refers to
+func (service *Service) sweepEvents(eventType *EventType, crons []piazza.Ident, now time.Time, result *SweepResult) error {
+	retention := eventType.Retention
+	if retention.MaxAge == "" && retention.MaxCount == 0 {
+		return nil
+	}
+	exists, err := service.eventDB.NameExists(eventType.typeName(), "pz-workflow")
+	if err != nil || !exists {
+		return err
+	}
+
+	query := map[string]interface{}{
+		"bool": map[string]interface{}{
+			"must_not": []interface{}{
+				map[string]interface{}{"ids": map[string]interface{}{"values": crons}},
+			},
+		},
+	}
+	expired, err := expiredPages("eventId", query, retention.MaxAge, retention.MaxCount, now, func(dsl string) ([]piazza.Ident, []piazza.TimeStamp, error) {
+		page, _, err := service.eventDB.GetEventsByDslQuery(eventType.typeName(), dsl, "pz-workflow")
+		ids, createdOn := []piazza.Ident{}, []piazza.TimeStamp{}
+		for _, event := range page {
+			ids = append(ids, event.EventID)
+			createdOn = append(createdOn, event.CreatedOn)
+		}
+		return ids, createdOn, err
+	})
+	if err != nil {
+		return err
+	}
+
+	deleted := 0
+	err = inBatches(expired, func(batch []piazza.Ident) error {
+		protected, err := service.protectedEvents(batch)
+		if err != nil {
+			return err
+		}
+		ids := []piazza.Ident{}
+		for _, id := range batch {
+			if protected[id] {
+				result.EventsProtected++
+			} else {
+				ids = append(ids, id)
+			}
+		}
+		n, err := service.eventDB.DeleteByIDs(eventType.typeName(), ids, "pz-workflow")
+		deleted += n
+		if err != nil {
+			result.Errors = append(result.Errors, err.Error())
+		}
+		return nil
+	})
+	result.EventsDeleted += deleted
+	if deleted > 0 {
+		service.syslogger.Audit("pz-workflow", "sweptEvents", eventType.EventTypeID, "Service.Sweep: Retention sweeper deleted %d events of eventType [%s]", deleted, eventType.EventTypeID)
+	}
+	return err
+}
+
+// protectedEvents are, of the events, those an unresolved alert refers to
+func (service *Service) protectedEvents(eventIDs []piazza.Ident) (map[piazza.Ident]bool, error) {
+	query := map[string]interface{}{
+		"bool": map[string]interface{}{
+			"filter":   []interface{}{map[string]interface{}{"terms": map[string]interface{}{"eventId": eventIDs}}},
+			"must_not": []interface{}{termQuery("resolved", true)},
+		},
+	}
+	protected := map[piazza.Ident]bool{}
+	err := exportPages("alertId", query, func(dsl string) (int, string, error) {
+		page, _, err := service.alertDB.GetAlertsByDslQuery(dsl, "pz-workflow")
+		last := ""
+		for _, alert := range page {
+			protected[alert.EventID] = true
+			last = alert.AlertID.String()
+		}
+		return len(page), last, err
+	})
+	return protected, err
+}
@@ -15,6 +15,8 @@
 package workflow
 
 import (
+	"encoding/json"
+	"errors"
 	"net/http"
 
 	"bytes"
@@ -44,11 +46,17 @@ func (server *Server) Init(service *Service) error {
 	server.Routes = []piazza.RouteData{
 		{Verb: "GET", Path: "/", Handler: server.handleGetRoot},
 		{Verb: "GET", Path: "/version", Handler: server.handleGetVersion},
+		{Verb: "GET", Path: "/health/live", Handler: server.handleGetHealthLive},
+		{Verb: "GET", Path: "/health/ready", Handler: server.handleGetHealthReady},
 
 		{Verb: "GET", Path: "/eventType", Handler: server.handleGetAllEventTypes},
 		{Verb: "GET", Path: "/eventType/:id", Handler: server.handleGetEventType},
+		{Verb: "GET", Path: "/eventType/:id/stats", Handler: server.handleGetEventTypeStats},
 		{Verb: "POST", Path: "/eventType", Handler: server.handlePostEventType},
 		{Verb: "POST", Path: "/eventType/query", Handler: server.handleEventTypeQuery},
+		{Verb: "PUT", Path: "/eventType/:id", Handler: server.handlePutEventType},
+		{Verb: "GET", Path: "/eventType/:id/acl", Handler: server.handleGetEventTypeACL},
+		{Verb: "PUT", Path: "/eventType/:id/acl", Handler: server.handlePutEventTypeACL},
 		{Verb: "DELETE", Path: "/eventType/:id", Handler: server.handleDeleteEventType},
 
 		{Verb: "GET", Path: "/event/:id", Handler: server.handleGetEvent},
@@ -58,25 +66,64 @@ func (server *Server) Init(service *Service) error {
 		{Verb: "DELETE", Path: "/event/:id", Handler: server.handleDeleteEvent},
 
 		{Verb: "GET", Path: "/trigger/:id", Handler: server.handleGetTrigger},
+		{Verb: "GET", Path: "/trigger/:id/stats", Handler: server.handleGetTriggerStats},
 		{Verb: "GET", Path: "/trigger", Handler: server.handleGetAllTriggers},
 		{Verb: "POST", Path: "/trigger", Handler: server.handlePostTrigger},
 		{Verb: "POST", Path: "/trigger/query", Handler: server.handleTriggerQuery},
+		{Verb: "POST", Path: "/trigger/test/:id", Handler: server.handleTestTrigger},
 		{Verb: "PUT", Path: "/trigger/:id", Handler: server.handlePutTrigger},
+		{Verb: "GET", Path: "/trigger/:id/acl", Handler: server.handleGetTriggerACL},
+		{Verb: "PUT", Path: "/trigger/:id/acl", Handler: server.handlePutTriggerACL},
 		{Verb: "DELETE", Path: "/trigger/:id", Handler: server.handleDeleteTrigger},
 
 		{Verb: "GET", Path: "/alert/:id", Handler: server.handleGetAlert},
 		{Verb: "GET", Path: "/alert", Handler: server.handleGetAllAlerts},
 		{Verb: "POST", Path: "/alert", Handler: server.handlePostAlert},
 		{Verb: "POST", Path: "/alert/query", Handler: server.handleAlertQuery},
+		{Verb: "PUT", Path: "/alert/:id", Handler: server.handlePutAlert},
 		{Verb: "DELETE", Path: "/alert/:id", Handler: server.handleDeleteAlert},
 
+		{Verb: "GET", Path: "/lineage/:id", Handler: server.handleGetLineage},
+
+		{Verb: "GET", Path: "/namespace/:id/stats", Handler: server.handleGetNamespaceStats},
+		{Verb: "GET", Path: "/usage/owner/:id", Handler: server.handleGetOwnerUsage},
+		{Verb: "GET", Path: "/usage/namespace/:id", Handler: server.handleGetNamespaceUsage},
+
+		{Verb: "GET", Path: "/geofence/:id", Handler: server.handleGetGeofence},
+		{Verb: "GET", Path: "/geofence", Handler: server.handleGetAllGeofences},
+		{Verb: "POST", Path: "/geofence", Handler: server.handlePostGeofence},
+		{Verb: "PUT", Path: "/geofence/:id", Handler: server.handlePutGeofence},
+		{Verb: "GET", Path: "/geofence/:id/acl", Handler: server.handleGetGeofenceACL},
+		{Verb: "PUT", Path: "/geofence/:id/acl", Handler: server.handlePutGeofenceACL},
+		{Verb: "DELETE", Path: "/geofence/:id", Handler: server.handleDeleteGeofence},
+
+		{Verb: "GET", Path: "/audit", Handler: server.handleGetAudit},
+
 		{Verb: "GET", Path: "/admin/stats", Handler: server.handleGetStats},
+		{Verb: "GET", Path: "/metrics", Handler: server.handleGetMetrics},
+		{Verb: "GET", Path: "/admin/export", Handler: server.handleExport},
+		{Verb: "POST", Path: "/admin/import", Handler: server.handleImport},
+		{Verb: "POST", Path: "/admin/purge", Handler: server.handlePostPurge},
+		{Verb: "GET", Path: "/admin/purge/:id", Handler: server.handleGetPurge},
+		{Verb: "POST", Path: "/admin/sweep", Handler: server.handlePostSweep},
+		{Verb: "POST", Path: "/admin/reindex", Handler: server.handlePostReindex},
+		{Verb: "GET", Path: "/admin/reindex/:id", Handler: server.handleGetReindex},
+		{Verb: "GET", Path: "/admin/outbox", Handler: server.handleGetOutbox},
+		{Verb: "DELETE", Path: "/admin/outbox/:id", Handler: server.handleDeleteOutboxEntry},
+		{Verb: "GET", Path: "/admin/consistency", Handler: server.handleGetConsistency},
+		{Verb: "POST", Path: "/admin/consistency/repair", Handler: server.handlePostConsistencyRepair},
 
 		{Verb: "GET", Path: "/_test/elasticsearch/version", Handler: server.handleTestElasticsearchVersion},
 		{Verb: "GET", Path: "/_test/elasticsearch/data/:id", Handler: server.handleTestElasticsearchGetOne},
 		{Verb: "POST", Path: "/_test/elasticsearch/data", Handler: server.handleTestElasticsearchPost},
 	}
 
+	for i := range server.Routes {
+		server.Routes[i].Handler = server.authorizeRoute(server.Routes[i])
+		server.Routes[i].Handler = server.trace(server.Routes[i])
+		server.Routes[i].Handler = server.instrument(server.Routes[i])
+	}
+
 	server.origin = service.origin
 
 	return nil
@@ -96,22 +143,168 @@ func (server *Server) handleGetVersion(c *gin.Context) {
 	piazza.GinReturnJson(c, resp)
 }
 
+func (server *Server) handleGetHealthLive(c *gin.Context) {
+	resp := server.service.GetHealthLive()
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetHealthReady(c *gin.Context) {
+	resp := server.service.GetHealthReady()
+	piazza.GinReturnJson(c, resp)
+}
+
+// handleGetLineage answers in the DOT language if the Accept header asks for it
+func (server *Server) handleGetLineage(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.GetLineage(id, server.caller(c))
+	lineage, ok := resp.Data.(*Lineage)
+	if resp.IsError() || !ok || !acceptsGraphviz(c.Request.Header.Get("Accept")) {
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	c.Data(http.StatusOK, ContentTypeGraphviz, lineage.Dot())
+}
+
+func (server *Server) handleGetAudit(c *gin.Context) {
+	params := piazza.NewQueryParams(c.Request)
+	resp := server.service.GetAudit(params)
+	piazza.GinReturnJson(c, resp)
+}
+
 func (server *Server) handleGetStats(c *gin.Context) {
 	resp := server.service.GetStats()
 	piazza.GinReturnJson(c, resp)
 }
 
+func (server *Server) handleGetMetrics(c *gin.Context) {
+	c.Data(http.StatusOK, ContentTypePrometheus, server.service.Metrics())
+}
+
+func (server *Server) handleExport(c *gin.Context) {
+	c.Header("Content-Type", ContentTypeNDJSON)
+	c.Status(http.StatusOK)
+	// the status is already sent; Export reports its errors in the stream
+	_ = server.service.Export(c.Writer, server.actor(c))
+}
+
+func (server *Server) handleImport(c *gin.Context) {
+	resp := server.service.Import(c.Request.Body, server.actor(c))
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePostPurge(c *gin.Context) {
+	request := &PurgeRequest{}
+	err := c.BindJSON(request)
+	if err != nil {
+		resp := &piazza.JsonResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+			Origin:     server.origin,
+		}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PostPurge(request, server.actor(c))
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePostSweep(c *gin.Context) {
+	resp := server.service.PostSweep(server.actor(c))
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetPurge(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.GetPurge(id)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePostReindex(c *gin.Context) {
+	request := &ReindexRequest{}
+	err := c.BindJSON(request)
+	if err != nil {
+		resp := &piazza.JsonResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+			Origin:     server.origin,
+		}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PostReindex(request, server.actor(c))
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetReindex(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.GetReindex(id)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetOutbox(c *gin.Context) {
+	params := piazza.NewQueryParams(c.Request)
+	resp := server.service.GetOutbox(params, server.actor(c))
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleDeleteOutboxEntry(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.DeleteOutboxEntry(id, server.actor(c))
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetConsistency(c *gin.Context) {
+	resp := server.service.GetConsistency(server.actor(c))
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePostConsistencyRepair(c *gin.Context) {
+	resp := server.service.PostConsistencyRepair(server.actor(c))
+	piazza.GinReturnJson(c, resp)
+}
+
 //---------------------------------------------------------------------------
 
 func (server *Server) handleGetEventType(c *gin.Context) {
 	id := piazza.Ident(c.Param("id"))
-	resp := server.service.GetEventType(id, "pz-workflow")
+	resp := server.service.GetEventType(id, server.actor(c))
+	server.setETag(c, resp)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetEventTypeStats(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	params := piazza.NewQueryParams(c.Request)
+	resp := server.service.GetEventTypeStats(id, params, server.actor(c))
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetNamespaceStats(c *gin.Context) {
+	params := piazza.NewQueryParams(c.Request)
+	resp := server.service.GetNamespaceStats(c.Param("id"), params, server.actor(c))
+	piazza.GinReturnJson(c, resp)
+}
+
+// handleGetOwnerUsage lets only the owner, or an admin, see its usage
+func (server *Server) handleGetOwnerUsage(c *gin.Context) {
+	owner := c.Param("id")
+	caller := server.caller(c)
+	if caller != owner && !server.service.authorizer.IsAdmin(caller) {
+		piazza.GinReturnJson(c, server.service.statusForbidden(errors.New("only the owner, or an admin, may see its usage")))
+		return
+	}
+	resp := server.service.GetOwnerUsage(owner, server.actor(c))
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetNamespaceUsage(c *gin.Context) {
+	resp := server.service.GetNamespaceUsage(c.Param("id"), server.actor(c))
 	piazza.GinReturnJson(c, resp)
 }
 
 func (server *Server) handleGetAllEventTypes(c *gin.Context) {
 	params := piazza.NewQueryParams(c.Request)
-	resp := server.service.GetAllEventTypes(params)
+	resp := server.readable(c, server.service.GetAllEventTypes(params, server.actor(c)))
 	piazza.GinReturnJson(c, resp)
 }
 
@@ -127,6 +320,7 @@ func (server *Server) handlePostEventType(c *gin.Context) {
 		piazza.GinReturnJson(c, resp)
 		return
 	}
+	eventType.CreatedBy = server.caller(c)
 	resp := server.service.PostEventType(eventType)
 	piazza.GinReturnJson(c, resp)
 }
@@ -146,13 +340,40 @@ func (server *Server) handleEventTypeQuery(c *gin.Context) {
 	jsonString := buf.String()
 	params := piazza.NewQueryParams(c.Request)
 
-	resp := server.service.QueryEventTypes(jsonString, params)
+	resp := server.readable(c, server.service.QueryEventTypes(jsonString, params, server.actor(c)))
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePutEventType(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	update := &EventTypeUpdate{}
+	err := c.BindJSON(update)
+	if err != nil {
+		resp := &piazza.JsonResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+			Origin:     server.origin,
+		}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PutEventType(id, update, c.Request.Header.Get("If-Match"), server.actor(c))
+	server.setETag(c, resp)
 	piazza.GinReturnJson(c, resp)
 }
 
 func (server *Server) handleDeleteEventType(c *gin.Context) {
 	id := piazza.Ident(c.Param("id"))
-	resp := server.service.DeleteEventType(id)
+	var resp *piazza.JsonResponse
+	if c.Query("cascade") == "true" {
+		if resp = server.service.authorizeCascade(server.caller(c), id); resp != nil {
+			piazza.GinReturnJson(c, resp)
+			return
+		}
+		resp = server.service.DeleteEventTypeCascade(id, c.Query("alerts") == "true", c.Request.Header.Get("If-Match"), server.actor(c))
+	} else {
+		resp = server.service.DeleteEventType(id, c.Request.Header.Get("If-Match"), server.actor(c))
+	}
 	piazza.GinReturnJson(c, resp)
 }
 
@@ -160,14 +381,14 @@ func (server *Server) handleDeleteEventType(c *gin.Context) {
 
 func (server *Server) handleGetEvent(c *gin.Context) {
 	id := piazza.Ident(c.Param("id"))
-	resp := server.service.GetEvent(id)
+	resp := server.service.GetEvent(id, server.actor(c))
 	piazza.GinReturnJson(c, resp)
 }
 
 func (server *Server) handleGetAllEvents(c *gin.Context) {
 	params := piazza.NewQueryParams(c.Request)
-	resp := server.service.GetAllEvents(params)
-	piazza.GinReturnJson(c, resp)
+	resp := server.readable(c, server.service.GetAllEvents(params, server.actor(c)))
+	server.returnEvents(c, resp)
 }
 
 func (server *Server) handlePostEvent(c *gin.Context) {
@@ -182,12 +403,19 @@ func (server *Server) handlePostEvent(c *gin.Context) {
 		piazza.GinReturnJson(c, resp)
 		return
 	}
+	caller := server.caller(c)
+	if resp := server.service.authorize(caller, ActionWrite, aclEventType, event.EventTypeID); resp != nil {
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	// the owner is the caller, whatever the body claims; "" is anonymous
+	event.CreatedBy = caller
 
 	var resp *piazza.JsonResponse
 	if event.CronSchedule != "" {
 		resp = server.service.PostRepeatingEvent(event)
 	} else {
-		resp = server.service.PostEvent(event)
+		resp = server.service.PostEvent(event, requestSpan(c))
 	}
 	piazza.GinReturnJson(c, resp)
 }
@@ -207,13 +435,46 @@ func (server *Server) handleEventQuery(c *gin.Context) {
 	jsonString := buf.String()
 	params := piazza.NewQueryParams(c.Request)
 
-	resp := server.service.QueryEvents(jsonString, params)
-	piazza.GinReturnJson(c, resp)
+	resp := server.readable(c, server.service.QueryEvents(jsonString, params, server.actor(c)))
+	server.returnEvents(c, resp)
+}
+
+// returnEvents answers with the events as GeoJSON or CSV if the Accept header
+// asks for either, and as the usual JsonResponse otherwise. Errors are always JSON.
+func (server *Server) returnEvents(c *gin.Context, resp *piazza.JsonResponse) {
+	events, ok := resp.Data.([]Event)
+	format := eventExportFormat(c.Request.Header.Get("Accept"))
+	if resp.IsError() || !ok || format == "" {
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+
+	var byts []byte
+	var err error
+	switch format {
+	case ContentTypeGeoJSON:
+		var collection *GeoJSONFeatureCollection
+		if collection, err = server.service.EventsAsGeoJSON(events); err == nil {
+			byts, err = json.Marshal(collection)
+		}
+	case ContentTypeCSV:
+		byts, err = server.service.EventsAsCSV(events)
+	}
+	if err != nil {
+		resp = &piazza.JsonResponse{
+			StatusCode: http.StatusInternalServerError,
+			Message:    err.Error(),
+			Origin:     server.origin,
+		}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	c.Data(http.StatusOK, format, byts)
 }
 
 func (server *Server) handleDeleteEvent(c *gin.Context) {
 	id := piazza.Ident(c.Param("id"))
-	resp := server.service.DeleteEvent(id)
+	resp := server.service.DeleteEvent(id, server.actor(c))
 	piazza.GinReturnJson(c, resp)
 }
 
@@ -221,13 +482,20 @@ func (server *Server) handleDeleteEvent(c *gin.Context) {
 
 func (server *Server) handleGetTrigger(c *gin.Context) {
 	id := piazza.Ident(c.Param("id"))
-	resp := server.service.GetTrigger(id)
+	resp := server.service.GetTrigger(id, server.actor(c))
+	server.setETag(c, resp)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetTriggerStats(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.GetTriggerStats(id, server.actor(c))
 	piazza.GinReturnJson(c, resp)
 }
 
 func (server *Server) handleGetAllTriggers(c *gin.Context) {
 	params := piazza.NewQueryParams(c.Request)
-	resp := server.service.GetAllTriggers(params)
+	resp := server.readable(c, server.service.GetAllTriggers(params, server.actor(c)))
 	piazza.GinReturnJson(c, resp)
 }
 
@@ -243,6 +511,18 @@ func (server *Server) handlePostTrigger(c *gin.Context) {
 		piazza.GinReturnJson(c, resp)
 		return
 	}
+	caller := server.caller(c)
+	if resp := server.service.authorize(caller, ActionRead, aclEventType, trigger.EventTypeID); resp != nil {
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	if trigger.Geofence != nil {
+		if resp := server.service.authorize(caller, ActionRead, aclGeofence, trigger.Geofence.GeofenceID); resp != nil {
+			piazza.GinReturnJson(c, resp)
+			return
+		}
+	}
+	trigger.CreatedBy = caller
 	resp := server.service.PostTrigger(trigger)
 	piazza.GinReturnJson(c, resp)
 }
@@ -262,7 +542,7 @@ func (server *Server) handleTriggerQuery(c *gin.Context) {
 	jsonString := buf.String()
 	params := piazza.NewQueryParams(c.Request)
 
-	resp := server.service.QueryTriggers(jsonString, params)
+	resp := server.readable(c, server.service.QueryTriggers(jsonString, params, server.actor(c)))
 	piazza.GinReturnJson(c, resp)
 }
 
@@ -279,13 +559,31 @@ func (server *Server) handlePutTrigger(c *gin.Context) {
 		piazza.GinReturnJson(c, resp)
 		return
 	}
-	resp := server.service.PutTrigger(id, update)
+	resp := server.service.PutTrigger(id, update, c.Request.Header.Get("If-Match"), server.actor(c))
+	server.setETag(c, resp)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleTestTrigger(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	event := &Event{}
+	err := c.BindJSON(event)
+	if err != nil {
+		resp := &piazza.JsonResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+			Origin:     server.origin,
+		}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.TestTrigger(id, event, server.actor(c))
 	piazza.GinReturnJson(c, resp)
 }
 
 func (server *Server) handleDeleteTrigger(c *gin.Context) {
 	id := piazza.Ident(c.Param("id"))
-	resp := server.service.DeleteTrigger(id)
+	resp := server.service.DeleteTrigger(id, c.Request.Header.Get("If-Match"), server.actor(c))
 	piazza.GinReturnJson(c, resp)
 }
 
@@ -293,13 +591,14 @@ func (server *Server) handleDeleteTrigger(c *gin.Context) {
 
 func (server *Server) handleGetAlert(c *gin.Context) {
 	id := piazza.Ident(c.Param("id"))
-	resp := server.service.GetAlert(id)
+	resp := server.service.GetAlert(id, server.actor(c))
+	server.setETag(c, resp)
 	piazza.GinReturnJson(c, resp)
 }
 
 func (server *Server) handleGetAllAlerts(c *gin.Context) {
 	params := piazza.NewQueryParams(c.Request)
-	resp := server.service.GetAllAlerts(params)
+	resp := server.readable(c, server.service.GetAllAlerts(params, server.actor(c)))
 	piazza.GinReturnJson(c, resp)
 }
 
@@ -318,7 +617,7 @@ func (server *Server) handleAlertQuery(c *gin.Context) {
 	jsonString := buf.String()
 	params := piazza.NewQueryParams(c.Request)
 
-	resp := server.service.QueryAlerts(jsonString, params)
+	resp := server.readable(c, server.service.QueryAlerts(jsonString, params, server.actor(c)))
 	piazza.GinReturnJson(c, resp)
 }
 
@@ -334,13 +633,138 @@ func (server *Server) handlePostAlert(c *gin.Context) {
 		piazza.GinReturnJson(c, resp)
 		return
 	}
+	if resp := server.service.authorize(server.caller(c), ActionWrite, aclTrigger, alert.TriggerID); resp != nil {
+		piazza.GinReturnJson(c, resp)
+		return
+	}
 	resp := server.service.PostAlert(alert)
 	piazza.GinReturnJson(c, resp)
 }
 
+func (server *Server) handlePutAlert(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	update := &AlertUpdate{}
+	err := c.BindJSON(update)
+	if err != nil {
+		resp := &piazza.JsonResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+			Origin:     server.origin,
+		}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PutAlert(id, update, c.Request.Header.Get("If-Match"), server.actor(c))
+	server.setETag(c, resp)
+	piazza.GinReturnJson(c, resp)
+}
+
 func (server *Server) handleDeleteAlert(c *gin.Context) {
 	id := piazza.Ident(c.Param("id"))
-	resp := server.service.DeleteAlert(id)
+	resp := server.service.DeleteAlert(id, c.Request.Header.Get("If-Match"), server.actor(c))
+	piazza.GinReturnJson(c, resp)
+}
+
+//---------------------------------------------------------------------
+
+func (server *Server) handleGetGeofence(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.GetGeofence(id, server.actor(c))
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetAllGeofences(c *gin.Context) {
+	params := piazza.NewQueryParams(c.Request)
+	resp := server.readable(c, server.service.GetAllGeofences(params, server.actor(c)))
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePostGeofence(c *gin.Context) {
+	geofence := &Geofence{}
+	err := c.BindJSON(geofence)
+	if err != nil {
+		resp := &piazza.JsonResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+			Origin:     server.origin,
+		}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	geofence.CreatedBy = server.caller(c)
+	resp := server.service.PostGeofence(geofence)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePutGeofence(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	geofence := &Geofence{}
+	err := c.BindJSON(geofence)
+	if err != nil {
+		resp := &piazza.JsonResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+			Origin:     server.origin,
+		}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PutGeofence(id, geofence, server.actor(c))
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleDeleteGeofence(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.DeleteGeofence(id, server.actor(c))
+	piazza.GinReturnJson(c, resp)
+}
+
+//---------------------------------------------------------------------
+
+func (server *Server) handleGetEventTypeACL(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.GetACL(aclEventType, id)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePutEventTypeACL(c *gin.Context) {
+	server.putACL(c, aclEventType)
+}
+
+func (server *Server) handleGetTriggerACL(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.GetACL(aclTrigger, id)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePutTriggerACL(c *gin.Context) {
+	server.putACL(c, aclTrigger)
+}
+
+func (server *Server) handleGetGeofenceACL(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.GetACL(aclGeofence, id)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePutGeofenceACL(c *gin.Context) {
+	server.putACL(c, aclGeofence)
+}
+
+func (server *Server) putACL(c *gin.Context, kind string) {
+	id := piazza.Ident(c.Param("id"))
+	acl := &ACL{}
+	err := c.BindJSON(acl)
+	if err != nil {
+		resp := &piazza.JsonResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+			Origin:     server.origin,
+		}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PutACL(kind, id, acl, server.actor(c))
 	piazza.GinReturnJson(c, resp)
 }
 
@@ -15,11 +15,23 @@
 package workflow
 
 import (
+	"bytes"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"io/ioutil"
 	"log"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	assert "github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
@@ -30,8 +42,9 @@ import (
 
 type ServerTester struct {
 	suite.Suite
-	sys    *piazza.SystemConfig
-	client *Client
+	sys     *piazza.SystemConfig
+	client  *Client
+	service *Service
 }
 
 func assertNoData(t *testing.T, client *Client) {
@@ -80,8 +93,11 @@ func TestRunSuite(t *testing.T) {
 		log.Fatal(err)
 	}
 
+	// the suite's client is an admin
+	kit.Service.authorizer = &PolicyFileAuthorizer{policy: Policy{APIKeys: map[string]string{"test-key": "test"}, Admins: []string{"test"}}}
+
 	clientLogger := pzsyslog.NewLogger(&pzsyslog.NilWriter{}, &pzsyslog.NilWriter{}, "pz-workflow-unittest", "123456")
-	client, err := NewClient(kit.Url, "", clientLogger)
+	client, err := NewClient(kit.Url, "test-key", clientLogger)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -89,12 +105,21 @@ func TestRunSuite(t *testing.T) {
 	mappingTester := &MappingTester{}
 	suite.Run(t, mappingTester)
 
-	serverTester := &ServerTester{client: client, sys: sys}
+	serverTester := &ServerTester{client: client, sys: sys, service: kit.Service}
 	suite.Run(t, serverTester)
 
 	clientTester := &ClientTester{client: client, sys: sys}
 	suite.Run(t, clientTester)
 
+	geofenceTester := &GeofenceTester{service: kit.Service}
+	suite.Run(t, geofenceTester)
+
+	migrationTester := &MigrationTester{}
+	suite.Run(t, migrationTester)
+
+	fileStoreTester := &FileStoreTester{sys: sys}
+	suite.Run(t, fileStoreTester)
+
 	err = kit.Stop()
 	if err != nil {
 		log.Fatal(err)
@@ -354,9 +379,24 @@ func (suite *ServerTester) Test03Trigger() {
 	assert.EqualValues(string(id), string(trigger.TriggerID))
 	//printJSON("Trigger", trigger)
 
+	// the mock index matches no percolation queries
+	result, err := client.TestTrigger(id, makeTestEvent(eventTypeID))
+	assert.NoError(err)
+	assert.EqualValues(id, result.TriggerID)
+	assert.False(result.Matched)
+	assert.EqualValues("the condition does not match", result.Reason)
+	_, err = client.TestTrigger(id, &Event{EventTypeID: eventTypeID, Data: map[string]interface{}{}})
+	assert.Error(err)
+	_, err = client.TestTrigger("nonsense", makeTestEvent(eventTypeID))
+	assert.Error(err)
+
 	err = client.PutTrigger(id, &TriggerUpdate{})
 	assert.NoError(err)
 
+	result, err = client.TestTrigger(id, makeTestEvent(eventTypeID))
+	assert.NoError(err)
+	assert.EqualValues("the trigger is disabled", result.Reason)
+
 	//log.Printf("Delete trigger by id: %s", id)
 	err = client.DeleteTrigger(id)
 	assert.NoError(err)
@@ -873,6 +913,93 @@ func (suite *ServerTester) Test07MultiTrigger() {
 	}
 }*/
 
+func (suite *ServerTester) Test08Geofence() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	num, err := client.GetNumGeofences()
+	assert.NoError(err)
+	assert.Equal(0, num)
+
+	_, err = client.PostGeofence(&Geofence{
+		Name:     "NOT A POLYGON",
+		Geometry: map[string]interface{}{"type": "Point", "coordinates": []interface{}{1.0, 2.0}},
+	})
+	assert.Error(err)
+
+	geofence, err := client.PostGeofence(makeTestGeofence())
+	assert.NoError(err)
+	geofenceID := geofence.GeofenceID
+
+	geofence, err = client.GetGeofence(geofenceID)
+	assert.NoError(err)
+	assert.EqualValues("MY GEOFENCE", geofence.Name)
+
+	geofences, err := client.GetAllGeofences(100, 0)
+	assert.NoError(err)
+	assert.Len(*geofences, 1)
+
+	geofence.Name = "MY RENAMED GEOFENCE"
+	geofence, err = client.PutGeofence(geofenceID, geofence)
+	assert.NoError(err)
+	assert.EqualValues("MY RENAMED GEOFENCE", geofence.Name)
+	assert.Len(geofence.Bbox, 4)
+
+	eventType := &EventType{
+		Name: makeTestEventTypeName(),
+		Mapping: map[string]interface{}{
+			"vehicle":  elasticsearch.MappingElementTypeString,
+			"location": elasticsearch.MappingElementTypeGeoPoint,
+		},
+	}
+	respEventType, err := client.PostEventType(eventType)
+	assert.NoError(err)
+	eventTypeID := respEventType.EventTypeID
+
+	trigger := makeTestTrigger([]piazza.Ident{eventTypeID})
+	trigger.Condition = map[string]interface{}{"match_all": map[string]interface{}{}}
+
+	// enter and exit need to know which entity moved
+	trigger.Geofence = &GeofenceCondition{GeofenceID: geofenceID, Relation: GeofenceRelationEnter}
+	_, err = client.PostTrigger(trigger)
+	assert.Error(err)
+
+	trigger.Geofence = &GeofenceCondition{GeofenceID: geofenceID, Relation: "nearby"}
+	_, err = client.PostTrigger(trigger)
+	assert.Error(err)
+
+	trigger.Geofence = &GeofenceCondition{GeofenceID: geofenceID, Relation: GeofenceRelationEnter, EntityKey: "vehicle"}
+	respTrigger, err := client.PostTrigger(trigger)
+	assert.NoError(err)
+	triggerID := respTrigger.TriggerID
+
+	respTrigger, err = client.GetTrigger(triggerID)
+	assert.NoError(err)
+	assert.NotNil(respTrigger.Geofence)
+	assert.EqualValues(geofenceID, respTrigger.Geofence.GeofenceID)
+
+	// in use
+	err = client.DeleteGeofence(geofenceID)
+	assert.Error(err)
+
+	err = client.DeleteTrigger(triggerID)
+	assert.NoError(err)
+
+	err = client.DeleteEventType(eventTypeID)
+	assert.NoError(err)
+
+	err = client.DeleteGeofence(geofenceID)
+	assert.NoError(err)
+
+	geofences, err = client.GetAllGeofences(100, 0)
+	assert.NoError(err)
+	assert.Len(*geofences, 0)
+}
+
 func (suite *ServerTester) Test09Elasticsearch() {
 	t := suite.T()
 	assert := assert.New(t)
@@ -897,6 +1024,1807 @@ func (suite *ServerTester) Test09Elasticsearch() {
 	assert.Equal(17, data.Value)
 }
 
+func (suite *ServerTester) Test10EventSearch() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+
+	params := &piazza.HttpQueryParams{}
+	params.AddString("after", "2016-01-01T00:00:00Z")
+	params.AddString("createdBy", "bob")
+	params.AddString("bbox", "-10,-5,10,5")
+	params.AddString("lat", "1.5")
+	params.AddString("lon", "2.5")
+	params.AddString("radius", "500")
+	search, err := parseEventSearch(params)
+	assert.NoError(err)
+	assert.False(search.isEmpty())
+	assert.EqualValues("500m", search.radius)
+
+	// spatial filters need to know the eventType
+	_, err = search.query("", nil)
+	assert.Error(err)
+
+	mapping := map[string]interface{}{"location": "geo_point"}
+	query, err := search.query("ET", mapping)
+	assert.NoError(err)
+	byts, err := json.Marshal(query)
+	assert.NoError(err)
+	dsl := string(byts)
+	assert.Contains(dsl, `"range":{"createdOn":{"gte":"2016-01-01T00:00:00+00:00"}}`)
+	assert.Contains(dsl, `"term":{"createdBy":"bob"}`)
+	assert.Contains(dsl, `"geo_bounding_box":{"data.ET.location":{"bottom_right":{"lat":-5,"lon":10},"top_left":{"lat":5,"lon":-10}}}`)
+	assert.Contains(dsl, `"geo_distance":{"data.ET.location":{"lat":1.5,"lon":2.5},"distance":"500m"}`)
+
+	mapping = map[string]interface{}{"footprint": "geo_shape"}
+	query, err = search.query("ET", mapping)
+	assert.NoError(err)
+	byts, err = json.Marshal(query)
+	assert.NoError(err)
+	assert.Contains(string(byts), `"data.ET.footprint":{"relation":"intersects","shape":{"coordinates":[[-10,5],[10,-5]],"type":"envelope"}}`)
+
+	// no geo variable to search by
+	_, err = search.query("ET", map[string]interface{}{"name": "string"})
+	assert.Error(err)
+
+	for _, bad := range []url.Values{
+		{"after": {"yesterday"}},
+		{"bbox": {"1,2,3"}},
+		{"bbox": {"10,0,0,10"}},
+		{"lat": {"1"}, "lon": {"2"}},
+		{"lat": {"1"}, "lon": {"2"}, "radius": {"far"}},
+		{"bbox": {"0,0,1,1"}},
+	} {
+		_, err = client.SearchEvents(bad)
+		assert.Error(err, "%v", bad)
+	}
+}
+
+func (suite *ServerTester) Test18EventExport() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	assert.EqualValues("", eventExportFormat(""))
+	assert.EqualValues("", eventExportFormat("application/json, text/csv"))
+	assert.EqualValues(ContentTypeCSV, eventExportFormat("text/csv;q=0.9, application/json"))
+	assert.EqualValues(ContentTypeGeoJSON, eventExportFormat("application/vnd.geo+json"))
+
+	geometry, err := eventGeometry(map[string]interface{}{
+		"footprint": map[string]interface{}{"type": "envelope", "coordinates": []interface{}{[]interface{}{0.0, 2.0}, []interface{}{1.0, 0.0}}},
+	}, "footprint", "geo_shape")
+	assert.NoError(err)
+	assert.EqualValues("Polygon", geometry["type"])
+	assert.EqualValues([][][]float64{{{0, 0}, {1, 0}, {1, 2}, {0, 2}, {0, 0}}}, geometry["coordinates"])
+
+	geometry, err = eventGeometry(map[string]interface{}{
+		"footprint": map[string]interface{}{"type": "linestring", "coordinates": []interface{}{[]interface{}{0.0, 2.0}, []interface{}{1.0, 0.0}}},
+	}, "footprint", "geo_shape")
+	assert.NoError(err)
+	assert.EqualValues("LineString", geometry["type"])
+
+	eventType := &EventType{
+		Name: makeTestEventTypeName(),
+		Mapping: map[string]interface{}{
+			"vehicle":   elasticsearch.MappingElementTypeString,
+			"speed":     elasticsearch.MappingElementTypeDouble,
+			"location":  elasticsearch.MappingElementTypeGeoPoint,
+			"createdBy": elasticsearch.MappingElementTypeString,
+		},
+	}
+	respEventType, err := client.PostEventType(eventType)
+	assert.NoError(err)
+	eventTypeID := respEventType.EventTypeID
+
+	respEvent, err := client.PostEvent(&Event{
+		EventTypeID: eventTypeID,
+		Data: map[string]interface{}{
+			"vehicle":   "truck, red",
+			"speed":     12.5,
+			"location":  map[string]interface{}{"lat": 2.0, "lon": 1.0},
+			"createdBy": "driver",
+		},
+	})
+	assert.NoError(err)
+	eventID := respEvent.EventID
+
+	query := url.Values{"eventTypeId": {eventTypeID.String()}}
+
+	byts, err := client.ExportEvents(query, ContentTypeGeoJSON)
+	assert.NoError(err)
+	collection := &GeoJSONFeatureCollection{}
+	assert.NoError(json.Unmarshal(byts, collection))
+	assert.EqualValues("FeatureCollection", collection.Type)
+	if assert.Len(collection.Features, 1) {
+		feature := collection.Features[0]
+		assert.EqualValues(eventID, feature.ID)
+		assert.EqualValues(map[string]interface{}{"type": "Point", "coordinates": []interface{}{1.0, 2.0}}, feature.Geometry)
+		assert.EqualValues("truck, red", feature.Properties["data.vehicle"])
+		assert.EqualValues(eventType.Name, feature.Properties["eventTypeName"])
+		assert.EqualValues("test", feature.Properties["createdBy"])
+		assert.EqualValues("driver", feature.Properties["data.createdBy"])
+	}
+
+	byts, err = client.ExportEvents(query, ContentTypeCSV)
+	assert.NoError(err)
+	records, err := csv.NewReader(bytes.NewReader(byts)).ReadAll()
+	assert.NoError(err)
+	if assert.Len(records, 2) {
+		assert.EqualValues([]string{"eventId", "eventTypeId", "eventTypeName", "createdBy", "createdOn", "data.createdBy", "data.location", "data.speed", "data.vehicle"}, records[0])
+		assert.EqualValues(eventID.String(), records[1][0])
+		assert.EqualValues("test", records[1][3])
+		assert.EqualValues("driver", records[1][5])
+		assert.EqualValues(`{"lat":2,"lon":1}`, records[1][6])
+		assert.EqualValues("12.5", records[1][7])
+		assert.EqualValues("truck, red", records[1][8])
+	}
+
+	// errors stay JSON
+	_, err = client.ExportEvents(url.Values{"bbox": {"x"}}, ContentTypeCSV)
+	assert.Error(err)
+
+	err = client.DeleteEvent(eventID)
+	assert.NoError(err)
+	err = client.DeleteEventType(eventTypeID)
+	assert.NoError(err)
+}
+
+func (suite *ServerTester) Test19ExportImport() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	respEventType, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	eventTypeID := respEventType.EventTypeID
+
+	geofence, err := client.PostGeofence(makeTestGeofence())
+	assert.NoError(err)
+	geofenceID := geofence.GeofenceID
+
+	respTrigger, err := client.PostTrigger(makeTestTrigger([]piazza.Ident{eventTypeID}))
+	assert.NoError(err)
+	triggerID := respTrigger.TriggerID
+
+	respEvent, err := client.PostEvent(makeTestEvent(eventTypeID))
+	assert.NoError(err)
+	eventID := respEvent.EventID
+
+	respEvent, err = client.PostEvent(makeTestCronEvent(eventTypeID))
+	assert.NoError(err)
+	cronID := respEvent.EventID
+
+	respAlert, err := client.PostAlert(&Alert{TriggerID: triggerID, EventID: eventID, JobID: "myjob"})
+	assert.NoError(err)
+	alertID := respAlert.AlertID
+
+	cleanup := func() {
+		assert.NoError(client.DeleteAlert(alertID))
+		assert.NoError(client.DeleteTrigger(triggerID))
+		assert.NoError(client.DeleteEvent(eventID))
+		assert.NoError(client.DeleteEvent(cronID))
+		assert.NoError(client.DeleteEventType(eventTypeID))
+		assert.NoError(client.DeleteGeofence(geofenceID))
+	}
+
+	export, err := client.Export()
+	assert.NoError(err)
+	kinds := []string{}
+	decoder := json.NewDecoder(bytes.NewReader(export))
+	for decoder.More() {
+		var record ExportRecord
+		assert.NoError(decoder.Decode(&record))
+		kinds = append(kinds, record.Kind)
+	}
+	assert.EqualValues([]string{
+		ExportKindEventType, ExportKindEventType, ExportKindEventType,
+		ExportKindGeofence, ExportKindTrigger, ExportKindCron,
+		// a cron event is stored as an event as well
+		ExportKindEvent, ExportKindEvent, ExportKindAlert,
+	}, kinds)
+
+	// nothing is missing
+	report, err := client.Import(bytes.NewReader(export))
+	if !assert.NoError(err) {
+		cleanup()
+		return
+	}
+	assert.Len(report.Created, 0)
+	assert.EqualValues(3, report.Skipped[ExportKindEventType])
+	assert.EqualValues(1, report.Skipped[ExportKindAlert])
+
+	cleanup()
+
+	report, err = client.Import(bytes.NewReader(export))
+	if !assert.NoError(err) {
+		return
+	}
+	assert.EqualValues(map[string]int{
+		ExportKindEventType: 1, ExportKindGeofence: 1, ExportKindTrigger: 1,
+		ExportKindCron: 1, ExportKindEvent: 2, ExportKindAlert: 1,
+	}, report.Created)
+	assert.EqualValues(map[string]int{ExportKindEventType: 2}, report.Skipped)
+
+	trigger, err := client.GetTrigger(triggerID)
+	assert.NoError(err)
+	assert.EqualValues(eventTypeID, trigger.EventTypeID)
+	assert.EqualValues(map[string]interface{}{"match": map[string]interface{}{"num": 31.0}}, trigger.Condition)
+	event, err := client.GetEvent(eventID)
+	assert.NoError(err)
+	assert.EqualValues(17, event.Data["num"])
+	_, err = client.GetGeofence(geofenceID)
+	assert.NoError(err)
+	_, err = client.GetAlert(alertID)
+	assert.NoError(err)
+
+	_, err = client.Import(strings.NewReader(`{"kind":"nonsense","data":{}}`))
+	assert.Error(err)
+	_, err = client.Import(strings.NewReader(`{"kind":"trigger","data":{"triggerId":"x","eventTypeId":"nonsense"}}`))
+	assert.Error(err)
+	_, err = client.Import(strings.NewReader(`{"kind":"error","data":"it broke"}`))
+	assert.Error(err)
+
+	cleanup()
+}
+
+func (suite *ServerTester) Test21Purge() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	waitForPurge := func(job *PurgeJob) *PurgeJob {
+		for i := 0; i < 100 && job.Status == PurgeStatusRunning; i++ {
+			time.Sleep(50 * time.Millisecond)
+			var err error
+			job, err = client.GetPurge(job.PurgeID)
+			assert.NoError(err)
+		}
+		assert.EqualValues(PurgeStatusDone, job.Status)
+		return job
+	}
+
+	respEventType, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	eventTypeID := respEventType.EventTypeID
+
+	respTrigger, err := client.PostTrigger(makeTestTrigger([]piazza.Ident{eventTypeID}))
+	assert.NoError(err)
+	triggerID := respTrigger.TriggerID
+
+	respEvent, err := client.PostEvent(makeTestEvent(eventTypeID))
+	assert.NoError(err)
+	eventID := respEvent.EventID
+
+	_, err = client.PostEvent(makeTestCronEvent(eventTypeID))
+	assert.NoError(err)
+
+	_, err = client.PostAlert(&Alert{TriggerID: triggerID, EventID: eventID, JobID: "myjob"})
+	assert.NoError(err)
+
+	_, err = client.PostPurge(&PurgeRequest{Kinds: []string{"nonsense"}})
+	assert.Error(err)
+	_, err = client.PostPurge(&PurgeRequest{EventTypeID: "nonsense"})
+	assert.Error(err)
+	_, err = client.GetPurge("nonsense")
+	assert.Error(err)
+
+	// nothing is that old
+	before := piazza.TimeStamp(time.Now().Add(-time.Hour))
+	job, err := client.PostPurge(&PurgeRequest{CreatedBefore: &before, DryRun: true})
+	assert.NoError(err)
+	job = waitForPurge(job)
+	assert.Len(job.Deleted, 0)
+	oldID := job.PurgeID
+
+	job, err = client.PostPurge(&PurgeRequest{EventTypeID: eventTypeID, DryRun: true})
+	assert.NoError(err)
+	job = waitForPurge(job)
+	expected := map[string]int{
+		ExportKindAlert: 1, ExportKindTrigger: 1, ExportKindCron: 1,
+		ExportKindEvent: 1, ExportKindEventType: 1,
+	}
+	assert.EqualValues(expected, job.Deleted)
+	_, err = client.GetTrigger(triggerID)
+	assert.NoError(err)
+
+	job, err = client.PostPurge(&PurgeRequest{EventTypeID: eventTypeID})
+	assert.NoError(err)
+	job = waitForPurge(job)
+	assert.EqualValues(expected, job.Deleted)
+	assert.Len(job.Failed, 0)
+	assert.NotNil(job.CompletedOn)
+
+	// finished jobs are forgotten in time
+	longAgo := piazza.TimeStamp(time.Now().Add(-2 * finishedJobTTL))
+	suite.service.updatePurge(suite.service.purgeJobs[oldID], func() {
+		suite.service.purgeJobs[oldID].CompletedOn = &longAgo
+	})
+	job, err = client.PostPurge(&PurgeRequest{CreatedBefore: &before, DryRun: true})
+	assert.NoError(err)
+	waitForPurge(job)
+	_, err = client.GetPurge(oldID)
+	assert.Error(err)
+	_, err = client.GetPurge(job.PurgeID)
+	assert.NoError(err)
+}
+
+func (suite *ServerTester) Test22CascadeDelete() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	respEventType, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	eventTypeID := respEventType.EventTypeID
+
+	respTrigger, err := client.PostTrigger(makeTestTrigger([]piazza.Ident{eventTypeID}))
+	assert.NoError(err)
+	triggerID := respTrigger.TriggerID
+
+	respEvent, err := client.PostEvent(makeTestEvent(eventTypeID))
+	assert.NoError(err)
+	eventID := respEvent.EventID
+
+	respEvent, err = client.PostEvent(makeTestCronEvent(eventTypeID))
+	assert.NoError(err)
+	cronID := respEvent.EventID
+
+	respAlert, err := client.PostAlert(&Alert{TriggerID: triggerID, EventID: eventID, JobID: "myjob"})
+	assert.NoError(err)
+	alertID := respAlert.AlertID
+
+	// still in use
+	assert.Error(client.DeleteEventType(eventTypeID))
+
+	cascade, err := client.DeleteEventTypeCascade(eventTypeID, false)
+	assert.NoError(err)
+	assert.EqualValues(eventTypeID, cascade.EventTypeID)
+	assert.EqualValues(map[string][]piazza.Ident{
+		ExportKindTrigger: {triggerID},
+		ExportKindCron:    {cronID},
+		ExportKindEvent:   {eventID},
+	}, cascade.Removed)
+	assert.True(cascade.MappingRemoved)
+
+	_, err = client.GetEventType(eventTypeID)
+	assert.Error(err)
+	_, err = client.GetTrigger(triggerID)
+	assert.Error(err)
+	_, err = client.GetEvent(eventID)
+	assert.Error(err)
+
+	_, err = client.DeleteEventTypeCascade(eventTypeID, true)
+	assert.Error(err)
+
+	// without alerts=true, alerts are left alone
+	_, err = client.GetAlert(alertID)
+	assert.NoError(err)
+	assert.NoError(client.DeleteAlert(alertID))
+}
+
+func (suite *ServerTester) Test23Retention() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	eventType := makeTestEventType(makeTestEventTypeName())
+	eventType.Retention = &Retention{MaxAge: "soon"}
+	_, err := client.PostEventType(eventType)
+	assert.Error(err)
+
+	eventType.Retention = &Retention{MaxCount: 1}
+	respEventType, err := client.PostEventType(eventType)
+	assert.NoError(err)
+	eventTypeID := respEventType.EventTypeID
+	assert.EqualValues(1, respEventType.Retention.MaxCount)
+
+	respTrigger, err := client.PostTrigger(makeTestTrigger([]piazza.Ident{eventTypeID}))
+	assert.NoError(err)
+	triggerID := respTrigger.TriggerID
+
+	// far enough apart to be told apart by their timestamps
+	eventIDs := []piazza.Ident{}
+	for i := 0; i < 3; i++ {
+		respEvent, err := client.PostEvent(makeTestEvent(eventTypeID))
+		assert.NoError(err)
+		eventIDs = append(eventIDs, respEvent.EventID)
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	respAlert, err := client.PostAlert(&Alert{TriggerID: triggerID, EventID: eventIDs[0], JobID: "myjob"})
+	assert.NoError(err)
+	alertID := respAlert.AlertID
+	assert.False(respAlert.Resolved)
+
+	// the oldest event is kept for its alert
+	result, err := client.Sweep()
+	assert.NoError(err)
+	assert.EqualValues(1, result.EventsDeleted)
+	assert.EqualValues(1, result.EventsProtected)
+	assert.EqualValues(0, result.AlertsDeleted)
+	assert.Len(result.Errors, 0)
+	_, err = client.GetEvent(eventIDs[0])
+	assert.NoError(err)
+	_, err = client.GetEvent(eventIDs[1])
+	assert.Error(err)
+
+	stats, err := client.GetStats()
+	assert.NoError(err)
+	if assert.NotNil(stats.LastSweep) {
+		assert.EqualValues(1, stats.LastSweep.EventsDeleted)
+	}
+
+	_, err = client.PutEventType(eventTypeID, &EventTypeUpdate{Retention: &Retention{MaxCount: -1}})
+	assert.Error(err)
+	respEventType, err = client.PutEventType(eventTypeID, &EventTypeUpdate{Retention: &Retention{MaxCount: 1, AlertMaxAge: "1ns"}})
+	assert.NoError(err)
+	assert.EqualValues("1ns", respEventType.Retention.AlertMaxAge)
+
+	// unresolved alerts do not expire
+	result, err = client.Sweep()
+	assert.NoError(err)
+	assert.EqualValues(0, result.AlertsDeleted)
+	assert.EqualValues(1, result.EventsProtected)
+
+	respAlert, err = client.PutAlert(alertID, &AlertUpdate{Resolved: true})
+	assert.NoError(err)
+	assert.True(respAlert.Resolved)
+	assert.NotNil(respAlert.ResolvedOn)
+	_, err = client.PutAlert("nonsense", &AlertUpdate{Resolved: true})
+	assert.Error(err)
+
+	result, err = client.Sweep()
+	assert.NoError(err)
+	assert.EqualValues(1, result.AlertsDeleted)
+	assert.EqualValues(1, result.EventsDeleted)
+	assert.EqualValues(0, result.EventsProtected)
+	_, err = client.GetAlert(alertID)
+	assert.Error(err)
+	_, err = client.GetEvent(eventIDs[0])
+	assert.Error(err)
+
+	assert.NoError(client.DeleteEvent(eventIDs[2]))
+	assert.NoError(client.DeleteTrigger(triggerID))
+	assert.NoError(client.DeleteEventType(eventTypeID))
+}
+
+func (suite *ServerTester) Test24Reindex() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	waitForReindex := func(job *ReindexJob) *ReindexJob {
+		for i := 0; i < 100 && job.Status == ReindexStatusRunning; i++ {
+			time.Sleep(50 * time.Millisecond)
+			var err error
+			job, err = client.GetReindex(job.ReindexID)
+			assert.NoError(err)
+		}
+		return job
+	}
+
+	respEventType, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	eventTypeID := respEventType.EventTypeID
+
+	respTrigger, err := client.PostTrigger(makeTestTrigger([]piazza.Ident{eventTypeID}))
+	assert.NoError(err)
+	triggerID := respTrigger.TriggerID
+
+	respEvent, err := client.PostEvent(makeTestEvent(eventTypeID))
+	assert.NoError(err)
+	eventID := respEvent.EventID
+
+	_, err = client.PostReindex(&ReindexRequest{Alias: "nonsense", Index: "nonsense001"})
+	assert.Error(err)
+	_, err = client.PostReindex(&ReindexRequest{Alias: keyTriggers})
+	assert.Error(err)
+	_, err = client.PostReindex(&ReindexRequest{Alias: keyTriggers, Index: keyEvents})
+	assert.Error(err)
+	_, err = client.GetReindex("nonsense")
+	assert.Error(err)
+
+	// settings the new index cannot be created with leave the alias alone
+	job, err := client.PostReindex(&ReindexRequest{Alias: keyTriggers, Index: "triggers998", Settings: "{"})
+	assert.NoError(err)
+	job = waitForReindex(job)
+	assert.EqualValues(ReindexStatusRolledBack, job.Status)
+	assert.NotEmpty(job.Errors)
+	_, err = client.GetTrigger(triggerID)
+	assert.NoError(err)
+
+	job, err = client.PostReindex(&ReindexRequest{Alias: keyTriggers, Index: "triggers999"})
+	assert.NoError(err)
+	assert.EqualValues([]string{keyTriggers}, job.From)
+	job = waitForReindex(job)
+	assert.EqualValues(ReindexStatusDone, job.Status)
+	assert.Empty(job.Errors)
+	assert.True(job.Copied >= 1)
+
+	trigger, err := client.GetTrigger(triggerID)
+	assert.NoError(err)
+	assert.EqualValues(respTrigger.Condition, trigger.Condition)
+
+	job, err = client.PostReindex(&ReindexRequest{Alias: keyEvents, Index: "events999"})
+	assert.NoError(err)
+	job = waitForReindex(job)
+	assert.EqualValues(ReindexStatusDone, job.Status)
+	assert.Empty(job.Errors)
+
+	event, err := client.GetEvent(eventID)
+	assert.NoError(err)
+	assert.EqualValues(eventTypeID, event.EventTypeID)
+
+	// the new indices take writes as the old ones did
+	respEvent2, err := client.PostEvent(makeTestEvent(eventTypeID))
+	assert.NoError(err)
+
+	// writes wait while a reindex holds them
+	db := suite.service.aliasDB(keyTriggers)
+	db.writes.Lock()
+	deleted := make(chan struct{})
+	go func() {
+		db.Esi.DeleteByID(TriggerDBMapping, "nonsense")
+		close(deleted)
+	}()
+	select {
+	case <-deleted:
+		assert.Fail("a write did not wait for the reindex")
+	case <-time.After(50 * time.Millisecond):
+	}
+	db.writes.Unlock()
+	<-deleted
+
+	assert.NoError(client.DeleteEvent(respEvent2.EventID))
+	assert.NoError(client.DeleteEvent(eventID))
+	assert.NoError(client.DeleteTrigger(triggerID))
+	assert.NoError(client.DeleteEventType(eventTypeID))
+}
+
+func (suite *ServerTester) Test25TriggerAlerts() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	respEventType, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	eventTypeID := respEventType.EventTypeID
+
+	trigger := makeTestTrigger([]piazza.Ident{eventTypeID})
+	trigger.Condition = map[string]interface{}{
+		"query": map[string]interface{}{
+			"range": map[string]interface{}{"data.num": map[string]interface{}{"gte": 17}},
+		},
+	}
+	respTrigger, err := client.PostTrigger(trigger)
+	assert.NoError(err)
+	triggerID := respTrigger.TriggerID
+
+	_, err = client.PostTrigger(&Trigger{
+		Name:        "unparseable",
+		EventTypeID: eventTypeID,
+		Condition:   map[string]interface{}{"query": map[string]interface{}{"fuzzy": map[string]interface{}{"data.num": 17}}},
+		Job:         trigger.Job,
+	})
+	assert.Error(err)
+
+	// the event fires the trigger, and the alert records the job it ran
+	event := makeTestEvent(eventTypeID)
+	respEvent, err := client.PostEvent(event)
+	assert.NoError(err)
+	alerts, err := client.GetAlertByTrigger(triggerID)
+	assert.NoError(err)
+	assert.Len(*alerts, 1)
+	assert.EqualValues(respEvent.EventID, (*alerts)[0].EventID)
+	assert.NotEmpty((*alerts)[0].JobID)
+
+	// this one does not
+	event.Data = map[string]interface{}{"num": 16}
+	_, err = client.PostEvent(event)
+	assert.NoError(err)
+	alerts, err = client.GetAlertByTrigger(triggerID)
+	assert.NoError(err)
+	assert.Len(*alerts, 1)
+
+	// the mapping is strict about the types of fields
+	event.Data = map[string]interface{}{"num": "seventeen"}
+	_, err = client.PostEvent(event)
+	assert.Error(err)
+
+	events, err := client.QueryEvents(map[string]interface{}{
+		"query": map[string]interface{}{"term": map[string]interface{}{"eventTypeId": eventTypeID}},
+		"sort":  []interface{}{map[string]interface{}{"data." + respEventType.Name + ".num": "desc"}},
+	})
+	assert.NoError(err)
+	assert.Len(*events, 2)
+	assert.EqualValues(respEvent.EventID, (*events)[0].EventID)
+
+	alerts, err = client.QueryAlerts(map[string]interface{}{
+		"query": map[string]interface{}{"term": map[string]interface{}{"eventId": respEvent.EventID}},
+	})
+	assert.NoError(err)
+	assert.Len(*alerts, 1)
+
+	cascade, err := client.DeleteEventTypeCascade(eventTypeID, true)
+	assert.NoError(err)
+	assert.Len(cascade.Removed[ExportKindEvent], 2)
+	assert.Len(cascade.Removed[ExportKindAlert], 1)
+}
+
+func (suite *ServerTester) Test26Consistency() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+	service := suite.service
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	report, err := client.GetConsistency()
+	assert.NoError(err)
+	assert.Len(report.Problems, 0)
+
+	respEventType, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	eventTypeID := respEventType.EventTypeID
+	respUnmapped, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	respTrigger, err := client.PostTrigger(makeTestTrigger([]piazza.Ident{eventTypeID}))
+	assert.NoError(err)
+	triggerID := respTrigger.TriggerID
+	respEvent, err := client.PostEvent(makeTestEvent(eventTypeID))
+	assert.NoError(err)
+	respUnscheduled, err := client.PostEvent(makeTestCronEvent(eventTypeID))
+	assert.NoError(err)
+	respUnstored, err := client.PostEvent(makeTestCronEvent(eventTypeID))
+	assert.NoError(err)
+
+	// leave behind what a failed operation would
+	assert.NoError(service.eventDB.RemoveMapping(respUnmapped.Name, "test"))
+	_, err = service.eventDB.DeletePercolationQuery(triggerID)
+	assert.NoError(err)
+	orphanID := service.newIdent()
+	_, err = service.eventDB.AddPercolationQuery(orphanID, piazza.JsonString(`{"query":{"match_all":{}}}`))
+	assert.NoError(err)
+	service.removeCronJob(respUnscheduled.EventID)
+	_, err = service.eventDB.DeleteByID(respEventType.Name, respUnstored.EventID, "test")
+	assert.NoError(err)
+	alertID := service.newIdent()
+	assert.NoError(service.alertDB.PostData(&Alert{AlertID: alertID, TriggerID: "nosuchtrigger", EventID: respEvent.EventID, CreatedBy: "test"}))
+	unresolvedID := service.newIdent()
+	assert.NoError(service.alertDB.PostData(&Alert{AlertID: unresolvedID, TriggerID: triggerID, EventID: "nosuchevent", CreatedBy: "test"}))
+	// as retention leaves a resolved alert, which is no problem
+	resolvedID := service.newIdent()
+	assert.NoError(service.alertDB.PostData(&Alert{AlertID: resolvedID, TriggerID: triggerID, EventID: "expiredevent", Resolved: true, CreatedBy: "test"}))
+
+	expected := map[string]piazza.Ident{
+		ConsistencyEventTypeWithoutMapping:   respUnmapped.EventTypeID,
+		ConsistencyTriggerWithoutPercolation: triggerID,
+		ConsistencyPercolationWithoutTrigger: orphanID,
+		ConsistencyCronNotScheduled:          respUnscheduled.EventID,
+		ConsistencyCronWithoutEvent:          respUnstored.EventID,
+		ConsistencyAlertWithoutTrigger:       alertID,
+		ConsistencyAlertWithoutEvent:         unresolvedID,
+	}
+	found := func(report *ConsistencyReport, kind string, id piazza.Ident) *ConsistencyProblem {
+		for i := range report.Problems {
+			if report.Problems[i].Kind == kind && report.Problems[i].ID == id {
+				return &report.Problems[i]
+			}
+		}
+		return nil
+	}
+
+	// checking changes nothing
+	for i := 0; i < 2; i++ {
+		report, err = client.GetConsistency()
+		assert.NoError(err)
+		assert.False(report.Repair)
+		assert.Len(report.Errors, 0)
+		for kind, id := range expected {
+			problem := found(report, kind, id)
+			if assert.NotNil(problem, kind) {
+				assert.False(problem.Repaired, kind)
+			}
+		}
+	}
+
+	report, err = client.RepairConsistency()
+	assert.NoError(err)
+	assert.True(report.Repair)
+	assert.Len(report.Errors, 0, "%v", report.Errors)
+	for kind, id := range expected {
+		problem := found(report, kind, id)
+		if assert.NotNil(problem, kind) {
+			assert.True(problem.Repaired, kind)
+		}
+	}
+
+	report, err = client.GetConsistency()
+	assert.NoError(err)
+	assert.Len(report.Problems, 0, "%v", report.Problems)
+
+	exists, err := service.eventDB.NameExists(respUnmapped.Name, "test")
+	assert.NoError(err)
+	assert.True(exists)
+	assert.True(service.cronJobExists(respUnscheduled.EventID))
+	assert.False(service.cronJobExists(respUnstored.EventID))
+	_, err = client.GetAlert(alertID)
+	assert.Error(err)
+	_, err = client.GetAlert(unresolvedID)
+	assert.Error(err)
+	_, err = client.GetAlert(resolvedID)
+	assert.NoError(err)
+
+	_, err = client.DeleteEventTypeCascade(eventTypeID, true)
+	assert.NoError(err)
+	_, err = client.DeleteEventTypeCascade(respUnmapped.EventTypeID, true)
+	assert.NoError(err)
+}
+
+func (suite *ServerTester) Test27Lineage() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	respEventType, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	eventTypeID := respEventType.EventTypeID
+	defer func() {
+		_, err := client.DeleteEventTypeCascade(eventTypeID, true)
+		assert.NoError(err)
+	}()
+
+	trigger := makeTestTrigger([]piazza.Ident{eventTypeID})
+	trigger.Condition = map[string]interface{}{"match": map[string]interface{}{"data.num": 17}}
+	respTrigger, err := client.PostTrigger(trigger)
+	assert.NoError(err)
+	triggerID := respTrigger.TriggerID
+
+	// a run of the cron entry produces an event, which the trigger matches
+	cron := makeTestCronEvent(eventTypeID)
+	cron.CronSchedule = "0 0 0 1 1 *"
+	respCron, err := client.PostEvent(cron)
+	assert.NoError(err)
+	stored, _, err := suite.service.eventDB.GetOne(respEventType.Name, respCron.EventID, "test")
+	assert.NoError(err)
+	cronEvent{stored, respEventType.Name, suite.service}.Run()
+
+	alerts, err := client.GetAlertByTrigger(triggerID)
+	assert.NoError(err)
+	if !assert.Len(*alerts, 1) {
+		return
+	}
+	alert := (*alerts)[0]
+	assert.NotEmpty(alert.JobID)
+
+	kinds := map[piazza.Ident]string{
+		respCron.EventID: LineageKindCron,
+		alert.EventID:    LineageKindEvent,
+		triggerID:        LineageKindTrigger,
+		alert.AlertID:    LineageKindAlert,
+		alert.JobID:      LineageKindJob,
+	}
+	edges := map[LineageEdge]bool{
+		{From: respCron.EventID, To: alert.EventID, Relation: LineageProduced}: true,
+		{From: alert.EventID, To: triggerID, Relation: LineageMatched}:         true,
+		{From: triggerID, To: alert.AlertID, Relation: LineageRaised}:          true,
+		{From: alert.AlertID, To: alert.JobID, Relation: LineageStarted}:       true,
+	}
+
+	// the same graph, whichever part of it is asked about
+	for id := range kinds {
+		lineage, err := client.GetLineage(id)
+		if !assert.NoError(err) {
+			continue
+		}
+		assert.Equal(id, lineage.RootID)
+		assert.False(lineage.Truncated)
+		gotKinds := map[piazza.Ident]string{}
+		for _, node := range lineage.Nodes {
+			gotKinds[node.ID] = node.Kind
+		}
+		gotEdges := map[LineageEdge]bool{}
+		for _, edge := range lineage.Edges {
+			gotEdges[edge] = true
+		}
+		assert.Equal(kinds, gotKinds, "lineage of %s", id)
+		assert.Equal(edges, gotEdges, "lineage of %s", id)
+	}
+
+	dot, err := client.GetLineageDot(alert.JobID)
+	assert.NoError(err)
+	assert.Contains(string(dot), "digraph lineage {")
+	assert.Contains(string(dot), `"`+alert.AlertID.String()+`" -> "`+alert.JobID.String()+`" [label="started"];`)
+
+	_, err = client.GetLineage("nosuchid")
+	assert.Error(err)
+}
+
+func (suite *ServerTester) Test28Metrics() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	respEventType, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	eventTypeID := respEventType.EventTypeID
+	defer func() {
+		_, err := client.DeleteEventTypeCascade(eventTypeID, true)
+		assert.NoError(err)
+	}()
+
+	trigger := makeTestTrigger([]piazza.Ident{eventTypeID})
+	trigger.Condition = map[string]interface{}{"match": map[string]interface{}{"data.num": 17}}
+	respTrigger, err := client.PostTrigger(trigger)
+	assert.NoError(err)
+	for i := 0; i < 2; i++ {
+		_, err = client.PostEvent(makeTestEvent(eventTypeID))
+		assert.NoError(err)
+	}
+
+	byts, err := client.GetMetrics()
+	assert.NoError(err)
+	metrics := string(byts)
+
+	assert.Contains(metrics, "# TYPE pzworkflow_events_total counter\n")
+	assert.Contains(metrics, `pzworkflow_events_total{event_type="`+respEventType.Name+`"} 2`+"\n")
+	assert.Contains(metrics, `pzworkflow_trigger_firings_total{trigger_id="`+respTrigger.TriggerID.String()+`"} 2`+"\n")
+	assert.Contains(metrics, `pzworkflow_http_requests_total{method="POST",route="/trigger",code="201"}`)
+	assert.Contains(metrics, "# TYPE pzworkflow_percolation_duration_seconds histogram\n")
+	assert.Contains(metrics, `pzworkflow_percolation_duration_seconds_bucket{le="+Inf"}`)
+	assert.Contains(metrics, `pzworkflow_rabbitmq_publish_duration_seconds_count`)
+	assert.Contains(metrics, `pzworkflow_elasticsearch_duration_seconds_count{index="events",operation="AddPercolationDocument"}`)
+	assert.Contains(metrics, `pzworkflow_http_request_duration_seconds_sum{method="GET",route="/eventType/:id"}`)
+	assert.Contains(metrics, "# TYPE pzworkflow_cron_entries gauge\n")
+	assert.Contains(metrics, "pzworkflow_dispatches_in_flight 0\n")
+}
+
+func (suite *ServerTester) Test29Stats() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	respEventType, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	eventTypeID := respEventType.EventTypeID
+	defer func() {
+		_, err := client.DeleteEventTypeCascade(eventTypeID, true)
+		assert.NoError(err)
+	}()
+
+	trigger := makeTestTrigger([]piazza.Ident{eventTypeID})
+	trigger.Condition = map[string]interface{}{"match": map[string]interface{}{"data.num": 17}}
+	respTrigger, err := client.PostTrigger(trigger)
+	assert.NoError(err)
+	triggerID := respTrigger.TriggerID
+
+	triggerStats, err := client.GetTriggerStats(triggerID)
+	assert.NoError(err)
+	assert.EqualValues(0, triggerStats.Firings)
+	assert.Nil(triggerStats.LastFiredOn)
+
+	for i := 0; i < 2; i++ {
+		_, err = client.PostEvent(makeTestEvent(eventTypeID))
+		assert.NoError(err)
+	}
+
+	eventTypeStats, err := client.GetEventTypeStats(eventTypeID, 24)
+	assert.NoError(err)
+	assert.EqualValues(2, eventTypeStats.Events)
+	assert.Len(eventTypeStats.Hours, 24)
+	if len(eventTypeStats.Hours) == 24 {
+		assert.EqualValues(2, eventTypeStats.Hours[23].Events)
+		assert.EqualValues(0, eventTypeStats.Hours[0].Events)
+	}
+
+	eventTypeStats, err = client.GetEventTypeStats(eventTypeID, 3)
+	assert.NoError(err)
+	assert.Len(eventTypeStats.Hours, 3)
+
+	triggerStats, err = client.GetTriggerStats(triggerID)
+	assert.NoError(err)
+	assert.EqualValues(2, triggerStats.Firings)
+	assert.NotNil(triggerStats.LastFiredOn)
+	assert.EqualValues(0, triggerStats.DispatchFailures)
+	if assert.NotNil(triggerStats.Alerts) {
+		assert.EqualValues(2, triggerStats.Alerts.Unresolved)
+		assert.EqualValues(0, triggerStats.Alerts.Resolved)
+	}
+
+	// counts made at once all count, with or without scripts
+	statsDB := suite.service.statsDB
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(statsDB.AddFiring(triggerID, time.Now(), true))
+		}()
+	}
+	wg.Wait()
+	assert.NoError(statsDB.incrementInPlace(TriggerStatsDBMapping, triggerID.String(), map[string]int64{"dispatchFailures": 1}, nil, nil))
+	triggerStats, err = client.GetTriggerStats(triggerID)
+	assert.NoError(err)
+	assert.EqualValues(2, triggerStats.Firings)
+	assert.EqualValues(11, triggerStats.DispatchFailures)
+	assert.NotNil(triggerStats.LastFailedOn)
+
+	_, err = client.GetEventTypeStats(eventTypeID, 0)
+	assert.Error(err)
+	_, err = client.GetEventTypeStats(eventTypeID, statsMaxHours+1)
+	assert.Error(err)
+	_, err = client.GetEventTypeStats("nosuchid", 24)
+	assert.Error(err)
+	_, err = client.GetTriggerStats("nosuchid")
+	assert.Error(err)
+}
+
+// memSpanExporter keeps the spans exported to it
+type memSpanExporter struct {
+	lock  sync.Mutex
+	spans []*Span
+}
+
+func (exporter *memSpanExporter) ExportSpans(spans []*Span) error {
+	exporter.lock.Lock()
+	defer exporter.lock.Unlock()
+	exporter.spans = append(exporter.spans, spans...)
+	return nil
+}
+
+func (suite *ServerTester) Test30Tracing() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+	service := suite.service
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	respEventType, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	eventTypeID := respEventType.EventTypeID
+	defer func() {
+		_, err := client.DeleteEventTypeCascade(eventTypeID, true)
+		assert.NoError(err)
+	}()
+
+	trigger := makeTestTrigger([]piazza.Ident{eventTypeID})
+	trigger.Condition = map[string]interface{}{"match": map[string]interface{}{"data.num": 17}}
+	_, err = client.PostTrigger(trigger)
+	assert.NoError(err)
+
+	exporter := &memSpanExporter{}
+	service.tracer.setExporter(exporter)
+	defer service.tracer.setExporter(nil)
+
+	// what the job manager would be handed
+	var jobHeaders []string
+	sendJob := service.sendJob
+	service.sendJob = func(_ string, _ piazza.Ident, _ string, span *Span) error {
+		traceParent, _ := traceHeaders(span)[TraceParentHeader].(string)
+		jobHeaders = append(jobHeaders, traceParent)
+		return nil
+	}
+	defer func() { service.sendJob = sendJob }()
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	callerSpanID := "00f067aa0ba902b7"
+	byts, err := json.Marshal(makeTestEvent(eventTypeID))
+	assert.NoError(err)
+	req, err := http.NewRequest("POST", client.url+"/event", bytes.NewReader(byts))
+	assert.NoError(err)
+	req.Header.Set("Content-Type", piazza.ContentTypeJSON)
+	req.Header.Set(TraceParentHeader, "00-"+traceID+"-"+callerSpanID+"-01")
+	req.SetBasicAuth(client.h.ApiKey, "")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(err)
+	assert.NoError(resp.Body.Close())
+	assert.Equal(http.StatusCreated, resp.StatusCode)
+	responseParent := parseTraceParent(resp.Header.Get(TraceParentHeader))
+	if !assert.NotNil(responseParent) {
+		return
+	}
+	assert.Equal(traceID, responseParent.TraceID)
+
+	service.tracer.flush()
+	exporter.lock.Lock()
+	spans := exporter.spans
+	exporter.lock.Unlock()
+
+	byName := map[string]*Span{}
+	elasticsearchSpans := 0
+	for _, span := range spans {
+		// the calls to Elasticsearch are traces of their own
+		if strings.HasPrefix(span.Name, "elasticsearch ") {
+			assert.Empty(span.ParentID)
+			elasticsearchSpans++
+			continue
+		}
+		assert.Equal(traceID, span.TraceID, span.Name)
+		byName[span.Name] = span
+	}
+	assert.True(elasticsearchSpans > 0)
+
+	server := byName["POST /event"]
+	if !assert.NotNil(server) {
+		return
+	}
+	assert.Equal(callerSpanID, server.ParentID)
+	assert.Equal(responseParent.SpanID, server.SpanID)
+	assert.Equal("201", server.Attributes["http.status_code"])
+
+	percolate, dispatch, publish := byName["percolate"], byName["dispatch"], byName["amqp publish"]
+	if !assert.NotNil(percolate) || !assert.NotNil(dispatch) || !assert.NotNil(publish) {
+		return
+	}
+	assert.Equal(server.SpanID, percolate.ParentID)
+	assert.Equal(server.SpanID, dispatch.ParentID)
+	assert.Equal(dispatch.SpanID, publish.ParentID)
+	assert.Equal([]string{publish.traceParent()}, jobHeaders)
+
+	// with no exporter, there are no spans and nothing to propagate
+	service.tracer.setExporter(nil)
+	_, err = client.PostEvent(makeTestEvent(eventTypeID))
+	assert.NoError(err)
+	assert.Equal([]string{publish.traceParent(), ""}, jobHeaders)
+}
+
+func (suite *ServerTester) Test31Health() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+	service := suite.service
+
+	live, err := client.GetHealthLive()
+	assert.NoError(err)
+	assert.Equal(HealthUp, live.Status)
+	assert.Empty(live.Checks)
+
+	// the cron is not started when mocking, and nothing else is configured
+	ready, err := client.GetHealthReady()
+	assert.Error(err)
+	if assert.NotNil(ready) {
+		assert.Equal(HealthDown, ready.Status)
+		assert.Equal(HealthUp, ready.Checks["elasticsearch"].Status)
+		assert.Equal(HealthDown, ready.Checks["cron"].Status)
+		assert.Equal("not started", ready.Checks["cron"].Message)
+		assert.Equal(HealthSkipped, ready.Checks["rabbitmq"].Status)
+		assert.Equal(HealthSkipped, ready.Checks["idam"].Status)
+	}
+
+	service.cronLock.Lock()
+	service.cronStarted = true
+	service.cronLock.Unlock()
+	defer func() {
+		service.cronLock.Lock()
+		service.cronStarted = false
+		service.cronLock.Unlock()
+	}()
+
+	ready, err = client.GetHealthReady()
+	assert.NoError(err)
+	assert.Equal(HealthUp, ready.Status)
+	assert.Equal(HealthUp, ready.Checks["cron"].Status)
+	assert.Len(ready.Checks, 4)
+}
+
+func (suite *ServerTester) Test32Shutdown() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+	service := suite.service
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	respEventType, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	eventTypeID := respEventType.EventTypeID
+	defer func() {
+		_, err := client.DeleteEventTypeCascade(eventTypeID, true)
+		assert.NoError(err)
+	}()
+
+	trigger := makeTestTrigger([]piazza.Ident{eventTypeID})
+	trigger.Condition = map[string]interface{}{"match": map[string]interface{}{"data.num": 17}}
+	respTrigger, err := client.PostTrigger(trigger)
+	assert.NoError(err)
+
+	// a job that cannot be sent until released
+	sending := make(chan bool)
+	release := make(chan bool)
+	sendJob := service.sendJob
+	service.sendJob = func(string, piazza.Ident, string, *Span) error {
+		sending <- true
+		<-release
+		return nil
+	}
+	defer func() {
+		service.sendJob = sendJob
+		service.inFlight.lock.Lock()
+		service.inFlight.draining = false
+		service.inFlight.lock.Unlock()
+	}()
+
+	posted := make(chan error)
+	go func() {
+		_, err := client.PostEvent(makeTestEvent(eventTypeID))
+		posted <- err
+	}()
+	<-sending
+
+	left, err := service.Shutdown(50 * time.Millisecond)
+	assert.NoError(err)
+	stages := map[string]OutboxEntry{}
+	for _, entry := range left {
+		stages[entry.Stage] = entry
+		assert.Equal(eventTypeID, entry.EventTypeID)
+	}
+	assert.Len(left, 2)
+	assert.Equal(respTrigger.TriggerID, stages[OutboxStageMatched].TriggerID)
+	assert.Equal(stages[OutboxStageReceived].EventID, stages[OutboxStageMatched].EventID)
+
+	// no more events are let in, and the service is not ready
+	_, err = client.PostEvent(makeTestEvent(eventTypeID))
+	assert.Error(err)
+	ready, err := client.GetHealthReady()
+	assert.Error(err)
+	if assert.NotNil(ready) {
+		assert.Equal(HealthDown, ready.Checks["shutdown"].Status)
+	}
+
+	close(release)
+	assert.NoError(<-posted)
+
+	outbox, err := client.GetOutbox(100, 0)
+	assert.NoError(err)
+	assert.Len(*outbox, 2)
+	for _, entry := range *outbox {
+		assert.NotEmpty(entry.EntryID)
+		assert.NoError(client.DeleteOutboxEntry(entry.EntryID))
+		assert.Error(client.DeleteOutboxEntry(entry.EntryID))
+	}
+	outbox, err = client.GetOutbox(100, 0)
+	assert.NoError(err)
+	assert.Len(*outbox, 0)
+}
+
+func (suite *ServerTester) Test33Authorization() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+	service := suite.service
+
+	assertNoData(suite.T(), client)
+	defer assertNoData(suite.T(), client)
+
+	dir, err := ioutil.TempDir("", "pzworkflow")
+	assert.NoError(err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "policy.json")
+	policy := `{"apiKeys": {"alice-key": "alice", "bob-key": "bob", "ops-key": "ops"}, "admins": ["ops"]}`
+	assert.NoError(ioutil.WriteFile(path, []byte(policy), 0600))
+
+	authorizer, err := NewPolicyFileAuthorizer(path)
+	assert.NoError(err)
+	trusted := service.authorizer
+	service.authorizer = authorizer
+	defer func() { service.authorizer = trusted }()
+
+	alice, err := NewClient(client.url, "alice-key", client.logger)
+	assert.NoError(err)
+	bob, err := NewClient(client.url, "bob-key", client.logger)
+	assert.NoError(err)
+	ops, err := NewClient(client.url, "ops-key", client.logger)
+	assert.NoError(err)
+	mallory, err := NewClient(client.url, "mallory-key", client.logger)
+	assert.NoError(err)
+
+	// the caller owns what it creates, whoever the body says created it
+	eventType := makeTestEventType(makeTestEventTypeName())
+	eventType.CreatedBy = "bob"
+	_, err = client.PostEventType(eventType)
+	assert.Error(err)
+	_, err = mallory.PostEventType(eventType)
+	assert.Error(err)
+	respEventType, err := alice.PostEventType(eventType)
+	assert.NoError(err)
+	eventTypeID := respEventType.EventTypeID
+	assert.Equal("alice", respEventType.CreatedBy)
+	defer func() {
+		_, err := ops.DeleteEventTypeCascade(eventTypeID, true)
+		assert.NoError(err)
+		_, err = ops.GetEventTypeACL(eventTypeID)
+		assert.Error(err)
+	}()
+
+	// everyone reads it, only alice posts events of it
+	_, err = bob.GetEventType(eventTypeID)
+	assert.NoError(err)
+	_, err = bob.PostEvent(makeTestEvent(eventTypeID))
+	assert.Error(err)
+	assert.Error(bob.DeleteEventType(eventTypeID))
+
+	trigger := makeTestTrigger([]piazza.Ident{eventTypeID})
+	trigger.Condition = map[string]interface{}{"match": map[string]interface{}{"data.num": 18}}
+	respTrigger, err := bob.PostTrigger(trigger)
+	assert.NoError(err)
+	triggerID := respTrigger.TriggerID
+	assert.Equal("bob", respTrigger.CreatedBy)
+	assert.Error(alice.DeleteTrigger(triggerID))
+	assert.Error(alice.PutTrigger(triggerID, &TriggerUpdate{Enabled: false}))
+
+	// bob keeps his trigger to himself
+	_, err = alice.GetTrigger(triggerID)
+	assert.NoError(err)
+	acl, err := bob.PutTriggerACL(triggerID, &ACL{Readers: []string{}})
+	assert.NoError(err)
+	assert.Equal("bob", acl.Owner)
+	_, err = alice.GetTrigger(triggerID)
+	assert.Error(err)
+	triggers, err := alice.GetAllTriggers(100, 0)
+	assert.NoError(err)
+	for _, trigger := range *triggers {
+		assert.NotEqual(triggerID, trigger.TriggerID)
+	}
+	_, err = ops.GetTrigger(triggerID)
+	assert.NoError(err)
+
+	// alice lets bob post events, which he cannot do to her ACL
+	_, err = alice.PutEventTypeACL(eventTypeID, &ACL{Readers: []string{ACLEveryone}, Writers: []string{"bob"}})
+	assert.NoError(err)
+	_, err = bob.PutEventTypeACL(eventTypeID, &ACL{Writers: []string{ACLEveryone}})
+	assert.Error(err)
+	respEvent, err := bob.PostEvent(makeTestEvent(eventTypeID))
+	assert.NoError(err)
+	assert.Equal("bob", respEvent.CreatedBy)
+	acl, err = bob.GetEventTypeACL(eventTypeID)
+	assert.NoError(err)
+	assert.Equal("alice", acl.Owner)
+	assert.Equal([]string{"bob"}, acl.Writers)
+
+	// the lineage of bob's event leaves out the alert of his trigger
+	respAlert, err := ops.PostAlert(&Alert{TriggerID: triggerID, EventID: respEvent.EventID})
+	assert.NoError(err)
+	lineage, err := alice.GetLineage(respEvent.EventID)
+	assert.NoError(err)
+	assert.Len(lineage.Nodes, 1)
+	assert.Len(lineage.Edges, 0)
+	lineage, err = ops.GetLineage(respEvent.EventID)
+	assert.NoError(err)
+	assert.Len(lineage.Nodes, 3)
+	assert.NoError(ops.DeleteAlert(respAlert.AlertID))
+
+	// nor does her EventType take his trigger with it
+	_, err = alice.DeleteEventTypeCascade(eventTypeID, true)
+	assert.Error(err)
+	_, err = bob.GetTrigger(triggerID)
+	assert.NoError(err)
+
+	// only admins use the admin endpoints
+	_, err = alice.GetOutbox(100, 0)
+	assert.Error(err)
+	_, err = ops.GetOutbox(100, 0)
+	assert.NoError(err)
+	_, err = alice.GetNamespaceStats(DefaultNamespace, 1)
+	assert.Error(err)
+	_, err = alice.GetNamespaceUsage(DefaultNamespace)
+	assert.Error(err)
+	_, err = alice.GetMetrics()
+	assert.Error(err)
+	_, err = ops.GetNamespaceStats(DefaultNamespace, 1)
+	assert.NoError(err)
+	_, err = ops.GetMetrics()
+	assert.NoError(err)
+
+	// the header is believed only if asked for, and names nobody an admin
+	trustedAuthorizer := &TrustedAuthorizer{admins: []string{"ops"}}
+	req := httptest.NewRequest("GET", "/admin/outbox", nil)
+	caller, err := trustedAuthorizer.Identify(req)
+	assert.NoError(err)
+	assert.Equal("", caller)
+	assert.False(trustedAuthorizer.IsAdmin(caller))
+	assert.Error(trustedAuthorizer.Authorize(caller, ActionAdmin, nil))
+	req.Header.Set(CallerHeader, "ops")
+	caller, err = trustedAuthorizer.Identify(req)
+	assert.NoError(err)
+	assert.True(trustedAuthorizer.IsAdmin(caller))
+
+	// pz-idam says whose a key is
+	idam := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]string{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		if r.URL.Path == "/authn" && body["uuid"] == "alice-key" {
+			_, _ = w.Write([]byte(`{"isAuthSuccess": true, "userProfile": {"username": "alice"}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"isAuthSuccess": false}`))
+	}))
+	defer idam.Close()
+	idamAuthorizer := NewIdamAuthorizer(idam.URL, []string{"ops"})
+	req = httptest.NewRequest("GET", "/eventType", nil)
+	req.SetBasicAuth("alice-key", "")
+	caller, err = idamAuthorizer.Identify(req)
+	assert.NoError(err)
+	assert.Equal("alice", caller)
+	assert.False(idamAuthorizer.IsAdmin(caller))
+	req.SetBasicAuth("mallory-key", "")
+	_, err = idamAuthorizer.Identify(req)
+	assert.Error(err)
+	caller, err = NewIdamAuthorizer("", nil).Identify(httptest.NewRequest("GET", "/eventType", nil))
+	assert.NoError(err)
+	assert.Equal("", caller)
+}
+
+func (suite *ServerTester) Test34Namespaces() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+
+	assertNoData(suite.T(), client)
+	defer assertNoData(suite.T(), client)
+
+	// the same name in two namespaces
+	name := makeTestEventTypeName()
+	eventTypeA := makeTestEventType(name)
+	eventTypeA.Namespace = "teamA"
+	respA, err := client.PostEventType(eventTypeA)
+	assert.NoError(err)
+	eventTypeAID := respA.EventTypeID
+	assert.Equal("teamA", respA.Namespace)
+	defer func() {
+		_, err := client.DeleteEventTypeCascade(eventTypeAID, true)
+		assert.NoError(err)
+	}()
+	// more of the name than a page of hits
+	for i := 0; i < 10; i++ {
+		eventType := makeTestEventType(name)
+		eventType.Namespace = "team" + strconv.Itoa(i)
+		resp, err := client.PostEventType(eventType)
+		assert.NoError(err)
+		id := resp.EventTypeID
+		defer func() {
+			assert.NoError(client.DeleteEventType(id))
+		}()
+	}
+	eventTypeB := makeTestEventType(name)
+	eventTypeB.Namespace = "teamB"
+	respB, err := client.PostEventType(eventTypeB)
+	assert.NoError(err)
+	eventTypeBID := respB.EventTypeID
+	assert.NotEqual(eventTypeAID, eventTypeBID)
+	defer func() {
+		_, err := client.DeleteEventTypeCascade(eventTypeBID, true)
+		assert.NoError(err)
+	}()
+	_, err = client.PostEventType(eventTypeA)
+	assert.Error(err)
+	id, found, err := suite.service.eventTypeDB.GetIDByName(nil, "teamB", name, "pz-workflow")
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal(eventTypeBID, *id)
+	_, found, err = suite.service.eventTypeDB.GetIDByName(nil, DefaultNamespace, name, "pz-workflow")
+	assert.NoError(err)
+	assert.False(found)
+
+	// names and namespaces are checked
+	bad := makeTestEventType(name + "::x")
+	_, err = client.PostEventType(bad)
+	assert.Error(err)
+	bad = makeTestEventType(name)
+	bad.Namespace = "team A"
+	_, err = client.PostEventType(bad)
+	assert.Error(err)
+
+	eventTypes, err := client.GetNamespaceEventTypes("teamA", 100, 0)
+	assert.NoError(err)
+	assert.Len(*eventTypes, 1)
+	assert.Equal(eventTypeAID, (*eventTypes)[0].EventTypeID)
+	eventTypes, err = client.GetNamespaceEventTypes(DefaultNamespace, 100, 0)
+	assert.NoError(err)
+	for _, eventType := range *eventTypes {
+		assert.NotEqual(eventTypeAID, eventType.EventTypeID)
+		assert.NotEqual(eventTypeBID, eventType.EventTypeID)
+	}
+
+	// a trigger is in the namespace of its EventType
+	trigger := makeTestTrigger([]piazza.Ident{eventTypeAID})
+	respTrigger, err := client.PostTrigger(trigger)
+	assert.NoError(err)
+	triggerID := respTrigger.TriggerID
+	assert.Equal("teamA", respTrigger.Namespace)
+	defer func() {
+		assert.NoError(client.DeleteTrigger(triggerID))
+	}()
+	triggers, err := client.GetNamespaceTriggers("teamA", 100, 0)
+	assert.NoError(err)
+	assert.Len(*triggers, 1)
+	triggers, err = client.GetNamespaceTriggers("teamB", 100, 0)
+	assert.NoError(err)
+	assert.Len(*triggers, 0)
+
+	// events are searched by name within a namespace
+	_, err = client.PostEvent(makeTestEvent(eventTypeAID))
+	assert.NoError(err)
+	_, err = client.PostEvent(makeTestEvent(eventTypeAID))
+	assert.NoError(err)
+	_, err = client.PostEvent(makeTestEvent(eventTypeBID))
+	assert.NoError(err)
+	events, err := client.SearchEvents(url.Values{"namespace": {"teamA"}, "eventTypeName": {name}})
+	assert.NoError(err)
+	assert.Len(*events, 2)
+	events, err = client.SearchEvents(url.Values{"namespace": {"teamB"}})
+	assert.NoError(err)
+	assert.Len(*events, 1)
+	// there is no such type in the default namespace
+	_, err = client.SearchEvents(url.Values{"eventTypeName": {name}})
+	assert.Error(err)
+
+	stats, err := client.GetNamespaceStats("teamA", 2)
+	assert.NoError(err)
+	assert.EqualValues(1, stats.EventTypes)
+	assert.EqualValues(1, stats.Triggers)
+	assert.EqualValues(2, stats.Events)
+	assert.Len(stats.Hours, 2)
+	_, err = client.GetNamespaceStats("teamA", 0)
+	assert.Error(err)
+}
+
+func (suite *ServerTester) Test35Quotas() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+	service := suite.service
+
+	assertNoData(suite.T(), client)
+	defer assertNoData(suite.T(), client)
+
+	quotas, limiter := service.quotas, service.limiter
+	defer func() { service.quotas, service.limiter = quotas, limiter }()
+	service.quotas = &Quotas{
+		Owners:     map[string]QuotaLimits{"alice": {EventTypes: 1, Triggers: 1, Crons: 1, EventsPerSecond: 1, EventBurst: 3}},
+		Namespaces: map[string]QuotaLimits{"teamQ": {EventTypes: 1}},
+	}
+	now := time.Now()
+	service.limiter = newRateLimiter()
+	service.limiter.now = func() time.Time { return now }
+
+	authorizer := service.authorizer
+	defer func() { service.authorizer = authorizer }()
+	service.authorizer = &PolicyFileAuthorizer{policy: Policy{APIKeys: map[string]string{"test-key": "test", "alice-key": "alice"}, Admins: []string{"test"}}}
+	alice, err := NewClient(client.url, "alice-key", client.logger)
+	assert.NoError(err)
+
+	// alice may have one EventType, and teamQ one
+	eventType := makeTestEventType(makeTestEventTypeName())
+	eventType.CreatedBy = "alice"
+	respEventType, err := alice.PostEventType(eventType)
+	assert.NoError(err)
+	eventTypeID := respEventType.EventTypeID
+	defer func() {
+		_, err := client.DeleteEventTypeCascade(eventTypeID, true)
+		assert.NoError(err)
+	}()
+	respEventType, err = client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	otherID := respEventType.EventTypeID
+	defer func() {
+		assert.NoError(client.DeleteEventType(otherID))
+	}()
+	eventType = makeTestEventType(makeTestEventTypeName())
+	eventType.CreatedBy = "alice"
+	resp := service.PostEventType(eventType)
+	assert.Equal(http.StatusForbidden, resp.StatusCode)
+	assert.Contains(resp.Message, "quota exceeded")
+
+	eventType = makeTestEventType(makeTestEventTypeName())
+	eventType.Namespace = "teamQ"
+	respEventType, err = client.PostEventType(eventType)
+	assert.NoError(err)
+	teamQID := respEventType.EventTypeID
+	defer func() {
+		assert.NoError(client.DeleteEventType(teamQID))
+	}()
+	eventType = makeTestEventType(makeTestEventTypeName())
+	eventType.Namespace = "teamQ"
+	resp = service.PostEventType(eventType)
+	assert.Equal(http.StatusForbidden, resp.StatusCode)
+
+	// and one trigger
+	trigger := makeTestTrigger([]piazza.Ident{eventTypeID})
+	trigger.CreatedBy = "alice"
+	respTrigger, err := alice.PostTrigger(trigger)
+	assert.NoError(err)
+	trigger = makeTestTrigger([]piazza.Ident{eventTypeID})
+	trigger.CreatedBy = "alice"
+	resp = service.PostTrigger(trigger)
+	assert.Equal(http.StatusForbidden, resp.StatusCode)
+	assert.NoError(client.DeleteTrigger(respTrigger.TriggerID))
+
+	// and one repeating event, which is posted as an event is
+	cronEvent := makeTestCronEvent(eventTypeID)
+	cronEvent.CreatedBy = "alice"
+	respEvent, err := alice.PostEvent(cronEvent)
+	assert.NoError(err)
+	cronID := respEvent.EventID
+	defer func() {
+		assert.NoError(client.DeleteEvent(cronID))
+	}()
+	cronEvent = makeTestCronEvent(eventTypeID)
+	cronEvent.CreatedBy = "alice"
+	resp = service.PostRepeatingEvent(cronEvent)
+	assert.Equal(http.StatusForbidden, resp.StatusCode)
+
+	usage, err := client.GetOwnerUsage("alice")
+	assert.NoError(err)
+	assert.EqualValues(1, usage.EventTypes)
+	assert.EqualValues(0, usage.Triggers)
+	assert.EqualValues(1, usage.Crons)
+	assert.EqualValues(2, usage.EventTokens)
+	assert.EqualValues(1, usage.Limits.Crons)
+	usage, err = client.GetNamespaceUsage("teamQ")
+	assert.NoError(err)
+	assert.EqualValues(1, usage.EventTypes)
+
+	// alice posts events no faster than one a second, after the burst
+	event := makeTestEvent(eventTypeID)
+	event.CreatedBy = "alice"
+	_, err = alice.PostEvent(event)
+	assert.NoError(err)
+	_, err = alice.PostEvent(event)
+	assert.NoError(err)
+	resp = service.PostEvent(event, nil)
+	assert.Equal(http.StatusTooManyRequests, resp.StatusCode)
+	now = now.Add(time.Second)
+	_, err = alice.PostEvent(event)
+	assert.NoError(err)
+	resp = service.PostEvent(event, nil)
+	assert.Equal(http.StatusTooManyRequests, resp.StatusCode)
+
+	// others are not limited
+	_, err = client.PostEvent(makeTestEvent(eventTypeID))
+	assert.NoError(err)
+
+	// what has no owner is limited as the anonymous owner
+	service.quotas.Owners[quotaAnonymous] = QuotaLimits{EventsPerSecond: 1, EventBurst: 1}
+	resp = service.PostEvent(makeTestEvent(eventTypeID), nil)
+	assert.False(resp.IsError())
+	resp = service.PostEvent(makeTestEvent(eventTypeID), nil)
+	assert.Equal(http.StatusTooManyRequests, resp.StatusCode)
+	usage, err = client.GetOwnerUsage(quotaAnonymous)
+	assert.NoError(err)
+	assert.EqualValues(0, usage.EventTokens)
+
+	// and if the quotas cannot be read, nothing is
+	service.quotas = &Quotas{err: errors.New("unreadable")}
+	resp = service.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.Equal(http.StatusForbidden, resp.StatusCode)
+	resp = service.PostEvent(makeTestEvent(eventTypeID), nil)
+	assert.Equal(http.StatusForbidden, resp.StatusCode)
+}
+
+func (suite *ServerTester) Test36Audit() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+	service := suite.service
+
+	assertNoData(suite.T(), client)
+	defer assertNoData(suite.T(), client)
+
+	dir, err := ioutil.TempDir("", "pzworkflow")
+	assert.NoError(err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "policy.json")
+	policy := `{"apiKeys": {"alice-key": "alice", "ops-key": "ops"}, "admins": ["ops"]}`
+	assert.NoError(ioutil.WriteFile(path, []byte(policy), 0600))
+
+	eventType := makeTestEventType(makeTestEventTypeName())
+	respEventType, err := client.PostEventType(eventType)
+	assert.NoError(err)
+	eventTypeID := respEventType.EventTypeID
+	defer func() {
+		_, err := client.DeleteEventTypeCascade(eventTypeID, true)
+		assert.NoError(err)
+	}()
+	respTrigger, err := client.PostTrigger(makeTestTrigger([]piazza.Ident{eventTypeID}))
+	assert.NoError(err)
+	triggerID := respTrigger.TriggerID
+	defer func() {
+		assert.NoError(client.DeleteTrigger(triggerID))
+	}()
+
+	authorizer, err := NewPolicyFileAuthorizer(path)
+	assert.NoError(err)
+	trusted := service.authorizer
+	service.authorizer = authorizer
+	defer func() { service.authorizer = trusted }()
+	alice, err := NewClient(client.url, "alice-key", client.logger)
+	assert.NoError(err)
+	ops, err := NewClient(client.url, "ops-key", client.logger)
+	assert.NoError(err)
+
+	// who disabled the trigger?
+	assert.NoError(ops.PutTrigger(triggerID, &TriggerUpdate{Enabled: false}))
+	records, err := ops.GetAudit(url.Values{"resourceId": {triggerID.String()}, "action": {"updatedTrigger"}})
+	assert.NoError(err)
+	assert.Len(*records, 1)
+	if len(*records) == 1 {
+		record := (*records)[0]
+		assert.Equal("ops", record.Actor)
+		assert.Contains(record.Message, triggerID.String())
+	}
+
+	// the trigger's history, and nothing since
+	records, err = ops.GetAudit(url.Values{"resourceId": {triggerID.String()}})
+	assert.NoError(err)
+	assert.Len(*records, 4)
+	records, err = ops.GetAudit(url.Values{"actor": {"ops"}, "action": {"updatingTrigger"}})
+	assert.NoError(err)
+	assert.Len(*records, 1)
+	later := time.Now().Add(time.Hour).Format(time.RFC3339)
+	records, err = ops.GetAudit(url.Values{"resourceId": {triggerID.String()}, "after": {later}})
+	assert.NoError(err)
+	assert.Len(*records, 0)
+	_, err = ops.GetAudit(url.Values{"after": {"yesterday"}})
+	assert.Error(err)
+
+	// so do reads
+	_, err = ops.GetTrigger(triggerID)
+	assert.NoError(err)
+	records, err = ops.GetAudit(url.Values{"resourceId": {triggerID.String()}, "action": {"gettingTrigger"}, "actor": {"ops"}})
+	assert.NoError(err)
+	assert.Len(*records, 1)
+
+	// a purge finishes as whoever started it
+	job, err := ops.PostPurge(&PurgeRequest{EventTypeID: eventTypeID, DryRun: true})
+	assert.NoError(err)
+	assert.Equal("ops", job.CreatedBy)
+	for i := 0; i < 100 && job.Status == PurgeStatusRunning; i++ {
+		time.Sleep(50 * time.Millisecond)
+		job, err = ops.GetPurge(job.PurgeID)
+		assert.NoError(err)
+	}
+	records, err = ops.GetAudit(url.Values{"resourceId": {job.PurgeID.String()}, "action": {"purged"}})
+	assert.NoError(err)
+	assert.Len(*records, 1)
+	if len(*records) == 1 {
+		assert.Equal("ops", (*records)[0].Actor)
+	}
+
+	// only admins read it
+	_, err = alice.GetAudit(url.Values{})
+	assert.Error(err)
+}
+
+func (suite *ServerTester) Test37ETags() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+
+	assertNoData(suite.T(), client)
+	defer assertNoData(suite.T(), client)
+
+	eventType := makeTestEventType(makeTestEventTypeName())
+	respEventType, err := client.PostEventType(eventType)
+	assert.NoError(err)
+	eventTypeID := respEventType.EventTypeID
+	assert.EqualValues(1, respEventType.Version)
+
+	respTrigger, err := client.PostTrigger(makeTestTrigger([]piazza.Ident{eventTypeID}))
+	assert.NoError(err)
+	triggerID := respTrigger.TriggerID
+
+	respEvent, err := client.PostEvent(makeTestEvent(eventTypeID))
+	assert.NoError(err)
+	eventID := respEvent.EventID
+
+	respAlert, err := client.PostAlert(&Alert{TriggerID: triggerID, EventID: eventID, JobID: "myjob"})
+	assert.NoError(err)
+	alertID := respAlert.AlertID
+
+	defer func() {
+		assert.NoError(client.DeleteEvent(eventID))
+		assert.NoError(client.DeleteEventTypeIfMatch(eventTypeID, "*"))
+	}()
+
+	// GET says the ETag
+	req, err := http.NewRequest("GET", client.url+"/trigger/"+triggerID.String(), nil)
+	assert.NoError(err)
+	req.SetBasicAuth(client.h.ApiKey, "")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(err)
+	_ = resp.Body.Close()
+	assert.Equal(VersionETag(1), resp.Header.Get("ETag"))
+	trigger, err := client.GetTrigger(triggerID)
+	assert.NoError(err)
+	assert.EqualValues(1, trigger.Version)
+
+	// two operators read it; the second to write loses
+	etag := VersionETag(trigger.Version)
+	assert.NoError(client.PutTriggerIfMatch(triggerID, &TriggerUpdate{Enabled: false}, etag))
+	err = client.PutTriggerIfMatch(triggerID, &TriggerUpdate{Enabled: true}, etag)
+	assert.Error(err)
+	assert.Contains(err.Error(), "412")
+	trigger, err = client.GetTrigger(triggerID)
+	assert.NoError(err)
+	assert.EqualValues(2, trigger.Version)
+	assert.False(trigger.Enabled)
+
+	// without If-Match, anything goes
+	assert.NoError(client.PutTrigger(triggerID, &TriggerUpdate{Enabled: true}))
+	trigger, err = client.GetTrigger(triggerID)
+	assert.NoError(err)
+	assert.EqualValues(3, trigger.Version)
+
+	// EventTypes
+	respEventType, err = client.PutEventTypeIfMatch(eventTypeID, &EventTypeUpdate{Retention: &Retention{MaxCount: 10}}, VersionETag(1))
+	assert.NoError(err)
+	assert.EqualValues(2, respEventType.Version)
+	_, err = client.PutEventTypeIfMatch(eventTypeID, &EventTypeUpdate{Retention: &Retention{MaxCount: 20}}, VersionETag(1))
+	assert.Error(err)
+	assert.Error(client.DeleteEventTypeIfMatch(eventTypeID, VersionETag(1)))
+
+	// a change checked before another is written is refused by the index
+	stale, _, err := suite.service.eventTypeDB.GetOne(eventTypeID, "test")
+	assert.NoError(err)
+	assert.EqualValues(2, stale.Version)
+	respEventType, err = client.PutEventTypeIfMatch(eventTypeID, &EventTypeUpdate{Retention: &Retention{MaxCount: 30}}, VersionETag(2))
+	assert.NoError(err)
+	assert.EqualValues(3, respEventType.Version)
+	assert.Equal(errVersionConflict, suite.service.eventTypeDB.PutData(stale, stale.Version))
+	_, err = suite.service.eventTypeDB.deleteAtVersion(eventTypeID, stale.Version)
+	assert.Equal(errVersionConflict, err)
+	eventTypes, err := client.GetAllEventTypes(100, 0)
+	assert.NoError(err)
+	for _, et := range *eventTypes {
+		// lists do not read the versions
+		assert.EqualValues(0, et.Version)
+	}
+
+	// alerts
+	respAlert, err = client.PutAlertIfMatch(alertID, &AlertUpdate{Resolved: true}, `"7", "1"`)
+	assert.NoError(err)
+	assert.EqualValues(2, respAlert.Version)
+	assert.Error(client.DeleteAlertIfMatch(alertID, VersionETag(1)))
+	assert.NoError(client.DeleteAlertIfMatch(alertID, VersionETag(2)))
+
+	assert.Error(client.DeleteTriggerIfMatch(triggerID, VersionETag(2)))
+	assert.NoError(client.DeleteTriggerIfMatch(triggerID, VersionETag(3)))
+}
+
 func printJSON(msg string, input interface{}) {
 	if input != nil {
 		results, err := json.Marshal(input)
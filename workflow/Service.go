@@ -25,6 +25,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/streadway/amqp"
 	"github.com/venicegeo/pz-gocommon/elasticsearch"
@@ -44,18 +45,75 @@ const keyTriggers = "triggers"
 const keyAlerts = "alerts"
 const keyCrons = "crons"
 const keyTestElasticsearch = "testElasticsearch"
+const keyGeofences = "geofences"
+const keyGeofenceStates = "geofencestates"
+const keyStats = "stats"
+const keyOutbox = "outbox"
+const keyACLs = "acls"
+const keyAudit = "audit"
 
 type Service struct {
-	eventTypeDB         *EventTypeDB
-	eventDB             *EventDB
-	triggerDB           *TriggerDB
-	alertDB             *AlertDB
-	cronDB              *CronDB
+	eventTypeDB         EventTypeRepo
+	eventDB             EventRepo
+	triggerDB           TriggerRepo
+	alertDB             AlertRepo
+	cronDB              CronRepo
 	testElasticsearchDB *TestElasticsearchDB
+	geofenceDB          *GeofenceDB
+	geofenceStateDB     *GeofenceStateDB
+	statsDB             *StatsDB
+	outboxDB            OutboxRepo
+	aclDB               ACLRepo
+	auditDB             AuditRepo
 
 	stats Stats
 	sync.Mutex
 
+	// what GET /metrics reports
+	metrics *metrics
+
+	// the posted events whose triggers are being fired, which Shutdown waits for
+	inFlight *inFlight
+
+	// traces requests, and the jobs they send, to where $PZ_WORKFLOW_TRACES says
+	tracer *tracer
+
+	// says who requests are from, and what they may do
+	authorizer Authorizer
+
+	// what owners and namespaces may have, from $PZ_WORKFLOW_QUOTAS, and the
+	// token buckets of their event posting
+	quotas  *Quotas
+	limiter *rateLimiter
+
+	// serializes the read-then-write of geofence entity positions
+	geofenceLock sync.Mutex
+
+	// purges started by this instance in the last finishedJobTTL, which is
+	// all GET /admin/purge/:id knows of
+	purgeJobs map[piazza.Ident]*PurgeJob
+	purgeLock sync.Mutex
+
+	// keeps retention sweeps from overlapping
+	sweepLock sync.Mutex
+
+	// the repeating events the cron has jobs for, which the cron cannot say
+	// once a job has been removed
+	cronJobs    map[piazza.Ident]bool
+	cronStarted bool
+	cronLock    sync.Mutex
+
+	// hands the job of a fired trigger on to be run; sendToRabbitMQ, unless
+	// set before Init
+	sendJob func(jobInstance string, jobID piazza.Ident, actor string, span *Span) error
+
+	// reindexes started by this instance in the last finishedJobTTL; one
+	// runs at a time
+	indexAdmin  IndexAdmin
+	reindexJobs map[piazza.Ident]*ReindexJob
+	reindexLock sync.Mutex
+	reindexing  bool
+
 	syslogger *pzsyslog.Logger
 
 	sys *piazza.SystemConfig
@@ -82,16 +140,18 @@ func (service *Service) Init(
 	alertsIndex := (*indices)[keyAlerts]
 	cronIndex := (*indices)[keyCrons]
 	testElasticsearchIndex := (*indices)[keyTestElasticsearch]
+	geofencesIndex := (*indices)[keyGeofences]
+	geofenceStatesIndex := (*indices)[keyGeofenceStates]
+	statsIndex := (*indices)[keyStats]
+	outboxIndex := (*indices)[keyOutbox]
+	aclsIndex := (*indices)[keyACLs]
+	auditIndex := (*indices)[keyAudit]
 
 	var err error
 
-	service.syslogger = pzsyslog.NewLogger(logWriter, auditWriter, string(piazza.PzWorkflow), pen)
+	service.setup(sys, logWriter, auditWriter, pen)
 	defer service.handlePanic()
 
-	service.sys = sys
-
-	service.stats.CreatedOn = piazza.NewTimeStamp()
-
 	if service.eventTypeDB, err = NewEventTypeDB(service, eventtypesIndex); err != nil {
 		return err
 	}
@@ -116,8 +176,29 @@ func (service *Service) Init(
 		return err
 	}
 
-	service.cron = cron.New()
-	service.origin = string(sys.Name)
+	if service.geofenceDB, err = NewGeofenceDB(service, geofencesIndex); err != nil {
+		return err
+	}
+
+	if service.geofenceStateDB, err = NewGeofenceStateDB(service, geofenceStatesIndex); err != nil {
+		return err
+	}
+
+	if service.statsDB, err = NewStatsDB(service, statsIndex); err != nil {
+		return err
+	}
+
+	if service.outboxDB, err = NewOutboxDB(service, outboxIndex); err != nil {
+		return err
+	}
+
+	if service.aclDB, err = NewACLDB(service, aclsIndex); err != nil {
+		return err
+	}
+
+	if service.auditDB, err = NewAuditDB(service, auditIndex); err != nil {
+		return err
+	}
 
 	// allow the database time to settle
 	//time.Sleep(time.Second * 5)
@@ -151,6 +232,103 @@ func (service *Service) Init(
 	}
 	//log.Printf("SETUP INDEX: %t", ok)
 
+	service.postSystemEventTypes(sys)
+	return nil
+}
+
+// InitEmbedded sets the service up with its resources in a FileStore, for
+// running without Elasticsearch. Geofences, the positions of the entities in
+// them, the statistics and the test index are kept in memory, and do not
+// outlive the service.
+func (service *Service) InitEmbedded(
+	sys *piazza.SystemConfig,
+	logWriter pzsyslog.Writer,
+	auditWriter pzsyslog.Writer,
+	store *FileStore,
+	pen string,
+) error {
+	var err error
+
+	service.setup(sys, logWriter, auditWriter, pen)
+	defer service.handlePanic()
+
+	service.eventTypeDB = NewFileEventTypeRepo(service, store)
+	service.eventDB = NewFileEventRepo(service, store)
+	service.triggerDB = NewFileTriggerRepo(service, store)
+	service.alertDB = NewFileAlertRepo(service, store)
+	service.cronDB = NewFileCronRepo(service, store)
+	service.outboxDB = NewFileOutboxRepo(service, store)
+	service.aclDB = NewFileACLRepo(service, store)
+	service.auditDB = NewFileAuditRepo(service, store)
+
+	testElasticsearchIndex := NewMemIndex(keyTestElasticsearch)
+	if err = testElasticsearchIndex.SetMapping(TestElasticsearchMapping, "{}"); err != nil {
+		return err
+	}
+	if service.testElasticsearchDB, err = NewTestElasticsearchDB(service, testElasticsearchIndex); err != nil {
+		return err
+	}
+	geofencesIndex, err := NewFileIndex(store, keyGeofences, GeofenceDBMapping)
+	if err != nil {
+		return err
+	}
+	if service.geofenceDB, err = NewGeofenceDB(service, geofencesIndex); err != nil {
+		return err
+	}
+	geofenceStatesIndex, err := NewFileIndex(store, keyGeofenceStates, GeofenceStateDBMapping)
+	if err != nil {
+		return err
+	}
+	if service.geofenceStateDB, err = NewGeofenceStateDB(service, geofenceStatesIndex); err != nil {
+		return err
+	}
+	statsIndex, err := NewFileIndex(store, keyStats, EventTypeHourDBMapping, TriggerStatsDBMapping)
+	if err != nil {
+		return err
+	}
+	if service.statsDB, err = NewStatsDB(service, statsIndex); err != nil {
+		return err
+	}
+
+	service.postSystemEventTypes(sys)
+	return nil
+}
+
+// setup is what Init and InitEmbedded have in common, before the resources
+func (service *Service) setup(
+	sys *piazza.SystemConfig,
+	logWriter pzsyslog.Writer,
+	auditWriter pzsyslog.Writer,
+	pen string,
+) {
+	if auditWriter != nil {
+		auditWriter = &AuditWriter{Writer: auditWriter, service: service}
+	}
+	service.syslogger = pzsyslog.NewLogger(logWriter, auditWriter, string(piazza.PzWorkflow), pen)
+	service.sys = sys
+
+	service.stats.CreatedOn = piazza.NewTimeStamp()
+	service.metrics = newMetrics()
+	service.tracer = newTracerFromEnv()
+	service.authorizer = service.newAuthorizerFromEnv()
+	service.quotas = service.newQuotasFromEnv()
+	service.limiter = newRateLimiter()
+	service.inFlight = newInFlight()
+	service.purgeJobs = map[piazza.Ident]*PurgeJob{}
+	service.reindexJobs = map[piazza.Ident]*ReindexJob{}
+
+	service.cron = cron.New()
+	service.cronJobs = map[piazza.Ident]bool{}
+	service.origin = string(sys.Name)
+
+	if service.sendJob == nil {
+		service.sendJob = service.sendToRabbitMQ
+	}
+}
+
+// postSystemEventTypes creates the EventTypes piazza itself posts events of,
+// unless they are there already
+func (service *Service) postSystemEventTypes(sys *piazza.SystemConfig) {
 	// Ingest event type
 	ingestEventType := &EventType{Name: ingestTypeName, CreatedBy: sys.PiazzaSystem}
 	ingestEventTypeMapping := map[string]interface{}{
@@ -187,8 +365,6 @@ func (service *Service) Init(
 	} else { // something is wrong or it was already there
 		service.syslogger.Info("  ERROR creating piazza:excutionComplete eventtype: %s", postedExecutionCompletedType.StatusCode)
 	}
-
-	return nil
 }
 
 func (service *Service) newIdent() piazza.Ident {
@@ -203,7 +379,7 @@ func (service *Service) handlePanic() {
 	}
 }
 
-func (service *Service) sendToRabbitMQ(jobInstance string, jobID piazza.Ident, actor string) error {
+func (service *Service) sendToRabbitMQ(jobInstance string, jobID piazza.Ident, actor string, span *Span) error {
 	service.syslogger.Audit(actor, "creatingJob", "rabbitmq", "User [%s] is sending job [%s] to rabbitmq", actor, jobID)
 	rabbitAddress, err := service.sys.GetAddress(piazza.PzRabbitMQ)
 	if err != nil {
@@ -247,6 +423,7 @@ func (service *Service) sendToRabbitMQ(jobInstance string, jobID piazza.Ident, a
 		false,  // immediate
 		amqp.Publishing{
 			ContentType: "application/json",
+			Headers:     traceHeaders(span),
 			Body:        []byte(message),
 		})
 	if err != nil {
@@ -293,6 +470,14 @@ func (service *Service) statusBadRequest(err error) *piazza.JsonResponse {
 	}
 }
 
+func (service *Service) statusUnauthorized(err error) *piazza.JsonResponse {
+	return &piazza.JsonResponse{
+		StatusCode: http.StatusUnauthorized,
+		Message:    err.Error(),
+		Origin:     service.origin,
+	}
+}
+
 func (service *Service) statusForbidden(err error) *piazza.JsonResponse {
 	return &piazza.JsonResponse{
 		StatusCode: http.StatusForbidden,
@@ -301,6 +486,14 @@ func (service *Service) statusForbidden(err error) *piazza.JsonResponse {
 	}
 }
 
+func (service *Service) statusTooManyRequests(err error) *piazza.JsonResponse {
+	return &piazza.JsonResponse{
+		StatusCode: http.StatusTooManyRequests,
+		Message:    err.Error(),
+		Origin:     service.origin,
+	}
+}
+
 func (service *Service) statusInternalError(err error) *piazza.JsonResponse {
 	return &piazza.JsonResponse{
 		StatusCode: http.StatusInternalServerError,
@@ -309,6 +502,14 @@ func (service *Service) statusInternalError(err error) *piazza.JsonResponse {
 	}
 }
 
+func (service *Service) statusServiceUnavailable(err error) *piazza.JsonResponse {
+	return &piazza.JsonResponse{
+		StatusCode: http.StatusServiceUnavailable,
+		Message:    err.Error(),
+		Origin:     service.origin,
+	}
+}
+
 func (service *Service) statusNotFound(err error) *piazza.JsonResponse {
 	return &piazza.JsonResponse{
 		StatusCode: http.StatusNotFound,
@@ -317,17 +518,115 @@ func (service *Service) statusNotFound(err error) *piazza.JsonResponse {
 	}
 }
 
+func (service *Service) statusConflict(err error) *piazza.JsonResponse {
+	return &piazza.JsonResponse{
+		StatusCode: http.StatusConflict,
+		Message:    err.Error(),
+		Origin:     service.origin,
+	}
+}
+
 //------------------------------------------------------------------------------
 
 // GetStats TODO
 func (service *Service) GetStats() *piazza.JsonResponse {
 	defer service.handlePanic()
 	service.Lock()
-	t := service.stats
+	t := service.stats.snapshot()
 	service.Unlock()
 	return service.statusOK(t)
 }
 
+// the most hours GET /eventType/:id/stats goes back
+const statsMaxHours = 31 * 24
+
+// GetEventTypeStats returns the events of the EventType in each of the last
+// hours, the current one included
+func (service *Service) GetEventTypeStats(id piazza.Ident, params *piazza.HttpQueryParams, actor string) *piazza.JsonResponse {
+	defer service.handlePanic()
+	hours, err := params.GetAsInt("hours", 24)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	if hours < 1 || hours > statsMaxHours {
+		return service.statusBadRequest(fmt.Errorf("hours must be from 1 to %d", statsMaxHours))
+	}
+	if _, found, err := service.eventTypeDB.GetOne(id, "pz-workflow"); !found {
+		return service.statusNotFound(err)
+	}
+
+	service.syslogger.Audit(actor, "gettingEventTypeStats", id, "Service.GetEventTypeStats: User is getting stats of eventType [%s]", id)
+
+	to := time.Now().UTC().Truncate(time.Hour)
+	from := to.Add(-time.Duration(hours-1) * time.Hour)
+	counted, err := service.statsDB.GetEventTypeHours(id, from, to)
+	if err != nil {
+		service.syslogger.Audit(actor, "gettingEventTypeStatsFailure", id, "Service.GetEventTypeStats: User failed to get stats of eventType [%s]", id)
+		return service.statusInternalError(err)
+	}
+	byHour := map[time.Time]int64{}
+	for _, count := range counted {
+		byHour[time.Time(count.Hour).UTC()] = count.Events
+	}
+
+	stats := &EventTypeStats{EventTypeID: id, Hours: []EventTypeHour{}}
+	for hour := from; !hour.After(to); hour = hour.Add(time.Hour) {
+		events := byHour[hour]
+		stats.Hours = append(stats.Hours, EventTypeHour{EventTypeID: id, Hour: piazza.TimeStamp(hour), Events: events})
+		stats.Events += events
+	}
+	return service.statusOK(stats)
+}
+
+// GetTriggerStats returns the firings of the trigger and counts its alerts
+func (service *Service) GetTriggerStats(id piazza.Ident, actor string) *piazza.JsonResponse {
+	defer service.handlePanic()
+	if _, found, err := service.triggerDB.GetOne(id, "pz-workflow"); !found {
+		return service.statusNotFound(err)
+	}
+
+	service.syslogger.Audit(actor, "gettingTriggerStats", id, "Service.GetTriggerStats: User is getting stats of trigger [%s]", id)
+
+	stats, err := service.statsDB.GetTriggerStats(id)
+	if err != nil {
+		service.syslogger.Audit(actor, "gettingTriggerStatsFailure", id, "Service.GetTriggerStats: User failed to get stats of trigger [%s]", id)
+		return service.statusInternalError(err)
+	}
+	stats.Alerts = &AlertCounts{}
+	err = exportPages("alertId", termQuery("triggerId", id.String()), func(dsl string) (int, string, error) {
+		page, _, err := service.alertDB.GetAlertsByDslQuery(dsl, "pz-workflow")
+		last := ""
+		for _, alert := range page {
+			if alert.Resolved {
+				stats.Alerts.Resolved++
+			} else {
+				stats.Alerts.Unresolved++
+			}
+			last = alert.AlertID.String()
+		}
+		return len(page), last, err
+	})
+	if err != nil {
+		service.syslogger.Audit(actor, "gettingTriggerStatsFailure", id, "Service.GetTriggerStats: User failed to get stats of trigger [%s]", id)
+		return service.statusInternalError(err)
+	}
+	return service.statusOK(stats)
+}
+
+// countEvent and countFiring persist the stats; a failure to is only logged,
+// as the event itself is fine
+func (service *Service) countEvent(eventTypeID piazza.Ident) {
+	if err := service.statsDB.AddEvent(eventTypeID, time.Now()); err != nil {
+		service.syslogger.Warning("Stats error: eventType %s: %s", string(eventTypeID), err)
+	}
+}
+
+func (service *Service) countFiring(triggerID piazza.Ident, failed bool) {
+	if err := service.statsDB.AddFiring(triggerID, time.Now(), failed); err != nil {
+		service.syslogger.Warning("Stats error: trigger %s: %s", string(triggerID), err)
+	}
+}
+
 //------------------------------------------------------------------------------
 
 // GetEventType TODO
@@ -345,12 +644,12 @@ func (service *Service) GetEventType(id piazza.Ident, actor string) *piazza.Json
 	}
 	service.syslogger.Audit(actor, "gotEventType", id, "Service.GetEventType: User [%s] successfully got eventType [%s]", actor, id)
 
-	eventType.Mapping = service.removeUniqueParams(eventType.Name, eventType.Mapping)
+	eventType.Mapping = service.removeUniqueParams(eventType.typeName(), eventType.Mapping)
 	return service.statusOK(eventType)
 }
 
 // GetAllEventTypes TODO
-func (service *Service) GetAllEventTypes(params *piazza.HttpQueryParams) *piazza.JsonResponse {
+func (service *Service) GetAllEventTypes(params *piazza.HttpQueryParams, actor string) *piazza.JsonResponse {
 	defer service.handlePanic()
 	format, err := piazza.NewJsonPagination(params)
 	if err != nil {
@@ -363,24 +662,28 @@ func (service *Service) GetAllEventTypes(params *piazza.HttpQueryParams) *piazza
 	if err != nil {
 		return service.statusBadRequest(err)
 	}
+	namespace, err := namespaceParam(params)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
 
-	service.syslogger.Audit("pz-workflow", "gettingAllEventTypes", service.eventTypeDB.mapping, "Service.GetAllEventTypes: User is getting all eventTypes")
+	service.syslogger.Audit(actor, "gettingAllEventTypes", EventTypeDBMapping, "Service.GetAllEventTypes: User is getting all eventTypes")
 
 	if nameParam != "" {
 		nameParamValue := nameParam
 		var foundName bool
 		var eventtypeid *piazza.Ident
-		eventtypeid, foundName, err = service.eventTypeDB.GetIDByName(format, nameParamValue, "pz-workflow")
+		eventtypeid, foundName, err = service.eventTypeDB.GetIDByName(format, namespace, nameParamValue, "pz-workflow")
 		var foundType = false
 		var eventtype *EventType
 		if foundName && eventtypeid != nil {
 			if err != nil {
-				service.syslogger.Audit("pz-workflow", "gettingAllEventTypesFailure", service.eventTypeDB.mapping, "Service.GetAllEventTypes: User failed to get all eventTypes")
+				service.syslogger.Audit(actor, "gettingAllEventTypesFailure", EventTypeDBMapping, "Service.GetAllEventTypes: User failed to get all eventTypes")
 				return service.statusBadRequest(err)
 			}
 			eventtype, foundType, err = service.eventTypeDB.GetOne(*eventtypeid, "pz-workflow")
 			if err != nil {
-				service.syslogger.Audit("pz-workflow", "gettingAllEventTypesFailure", service.eventTypeDB.mapping, "Service.GetAllEventTypes: User failed to get all eventTypes")
+				service.syslogger.Audit(actor, "gettingAllEventTypesFailure", EventTypeDBMapping, "Service.GetAllEventTypes: User failed to get all eventTypes")
 				return service.statusInternalError(err)
 			}
 		}
@@ -389,23 +692,33 @@ func (service *Service) GetAllEventTypes(params *piazza.HttpQueryParams) *piazza
 			eventtypes = append(eventtypes, *eventtype)
 		}
 		totalHits = int64(len(eventtypes))
+	} else if namespace != "" {
+		var dsl string
+		if dsl, err = namespaceDsl(namespace, format); err != nil {
+			return service.statusBadRequest(err)
+		}
+		eventtypes, totalHits, err = service.eventTypeDB.GetEventTypesByDslQuery(dsl, "pz-workflow")
+		if err != nil {
+			service.syslogger.Audit(actor, "gettingAllEventTypesFailure", EventTypeDBMapping, "Service.GetAllEventTypes: User failed to get all eventTypes")
+			return service.statusInternalError(err)
+		}
 	} else {
 		eventtypes, totalHits, err = service.eventTypeDB.GetAll(format, "pz-workflow")
 		if err != nil {
-			service.syslogger.Audit("pz-workflow", "gettingAllEventTypesFailure", service.eventTypeDB.mapping, "Service.GetAllEventTypes: User failed to get all eventTypes")
+			service.syslogger.Audit(actor, "gettingAllEventTypesFailure", EventTypeDBMapping, "Service.GetAllEventTypes: User failed to get all eventTypes")
 			return service.statusInternalError(err)
 		}
 	}
 	if eventtypes == nil {
-		service.syslogger.Audit("pz-workflow", "gettingAllEventTypesFailure", service.eventTypeDB.mapping, "Service.GetAllEventTypes: User failed to get all eventTypes")
+		service.syslogger.Audit(actor, "gettingAllEventTypesFailure", EventTypeDBMapping, "Service.GetAllEventTypes: User failed to get all eventTypes")
 		return service.statusInternalError(errors.New("getalleventtypes returned nil"))
 	}
 	for i := 0; i < len(eventtypes); i++ {
-		eventtypes[i].Mapping = service.removeUniqueParams(eventtypes[i].Name, eventtypes[i].Mapping)
+		eventtypes[i].Mapping = service.removeUniqueParams(eventtypes[i].typeName(), eventtypes[i].Mapping)
 	}
 	resp := service.statusOK(eventtypes)
 
-	service.syslogger.Audit("pz-workflow", "gotAllEventTypes", service.eventTypeDB.mapping, "Service.GetAllEventTypes: User successfully got all eventTypes")
+	service.syslogger.Audit(actor, "gotAllEventTypes", EventTypeDBMapping, "Service.GetAllEventTypes: User successfully got all eventTypes")
 
 	format.Count = int(totalHits)
 	resp.Pagination = format
@@ -413,7 +726,7 @@ func (service *Service) GetAllEventTypes(params *piazza.HttpQueryParams) *piazza
 	return resp
 }
 
-func (service *Service) QueryEventTypes(dslString string, params *piazza.HttpQueryParams) *piazza.JsonResponse {
+func (service *Service) QueryEventTypes(dslString string, params *piazza.HttpQueryParams, actor string) *piazza.JsonResponse {
 	defer service.handlePanic()
 	format, err := piazza.NewJsonPagination(params)
 	if err != nil {
@@ -426,23 +739,23 @@ func (service *Service) QueryEventTypes(dslString string, params *piazza.HttpQue
 		return service.statusBadRequest(err)
 	}
 
-	service.syslogger.Audit("pz-workflow", "queryingEventTypes", service.eventTypeDB.mapping, "Service.QueryEventTypes: User is querying eventTypes")
+	service.syslogger.Audit(actor, "queryingEventTypes", EventTypeDBMapping, "Service.QueryEventTypes: User is querying eventTypes")
 
 	eventtypes, totalHits, err = service.eventTypeDB.GetEventTypesByDslQuery(dslString, "pz-workflow")
 	if err != nil {
-		service.syslogger.Audit("pz-workflow", "queryingEventTypesFailure", service.eventTypeDB.mapping, "Service.QueryEventTypes: User failed to query eventTypes")
+		service.syslogger.Audit(actor, "queryingEventTypesFailure", EventTypeDBMapping, "Service.QueryEventTypes: User failed to query eventTypes")
 		return service.statusBadRequest(err)
 	}
 	if eventtypes == nil {
-		service.syslogger.Audit("pz-workflow", "queryingEventTypesFailure", service.eventTypeDB.mapping, "Service.QueryEventTypes: User failed to query eventTypes")
+		service.syslogger.Audit(actor, "queryingEventTypesFailure", EventTypeDBMapping, "Service.QueryEventTypes: User failed to query eventTypes")
 		return service.statusInternalError(errors.New("queryeventtypes returned nil"))
 	}
 	for i := 0; i < len(eventtypes); i++ {
-		eventtypes[i].Mapping = service.removeUniqueParams(eventtypes[i].Name, eventtypes[i].Mapping)
+		eventtypes[i].Mapping = service.removeUniqueParams(eventtypes[i].typeName(), eventtypes[i].Mapping)
 	}
 	resp := service.statusOK(eventtypes)
 
-	service.syslogger.Audit("pz-workflow", "queriedEventTypes", service.eventTypeDB.mapping, "Service.QueryEventTypes: User successfully queried eventTypes")
+	service.syslogger.Audit(actor, "queriedEventTypes", EventTypeDBMapping, "Service.QueryEventTypes: User successfully queried eventTypes")
 
 	format.Count = int(totalHits)
 	resp.Pagination = format
@@ -453,15 +766,23 @@ func (service *Service) QueryEventTypes(dslString string, params *piazza.HttpQue
 // PostEventType TODO
 func (service *Service) PostEventType(eventType *EventType) *piazza.JsonResponse {
 	defer service.handlePanic()
+	if err := validateNamespace(eventType.Namespace); err != nil {
+		return service.statusBadRequest(err)
+	}
+	if strings.Contains(eventType.Name, namespaceSeparator) {
+		return service.statusBadRequest(fmt.Errorf("EventType names cannot contain '%s'", namespaceSeparator))
+	}
+	eventType.Namespace = namespaceOf(eventType.Namespace)
+
 	// Check if our EventType.Name already exists
-	found, err := service.eventDB.NameExists(eventType.Name, eventType.CreatedBy)
+	found, err := service.eventDB.NameExists(eventType.typeName(), eventType.CreatedBy)
 	if err != nil {
 		return service.statusInternalError(err)
 	}
 	if found {
 		return service.statusBadRequest(LoggedError("EventType Name already exists"))
 	}
-	id1, found, err := service.eventTypeDB.GetIDByName(nil, eventType.Name, eventType.CreatedBy)
+	id1, found, err := service.eventTypeDB.GetIDByName(nil, eventType.Namespace, eventType.Name, eventType.CreatedBy)
 	if err != nil {
 		return service.statusInternalError(err)
 	}
@@ -469,23 +790,30 @@ func (service *Service) PostEventType(eventType *EventType) *piazza.JsonResponse
 		return service.statusBadRequest(
 			LoggedError("EventType Name already exists under EventTypeId %s", id1))
 	}
+	if resp := service.checkQuota(quotaEventTypes, eventType.CreatedBy, eventType.Namespace); resp != nil {
+		return resp
+	}
 
 	eventType.EventTypeID = service.newIdent()
 	eventType.CreatedOn = piazza.NewTimeStamp()
 
+	if err = eventType.Retention.validate(); err != nil {
+		return service.statusBadRequest(err)
+	}
+
 	vars, err := piazza.GetVarsFromStruct(eventType.Mapping)
 	if err != nil {
 		return service.statusBadRequest(LoggedError("EventTypeDB.PostData failed: %s", err))
 	}
 	for k := range vars {
 		if strings.Contains(k, "~") {
-			return service.statusBadRequest(LoggedError("EventTypeDB.PostData failed: Variable names cannot contain '%s~': [%s]", eventType.Name, k))
+			return service.statusBadRequest(LoggedError("EventTypeDB.PostData failed: Variable names cannot contain '%s~': [%s]", eventType.typeName(), k))
 		}
 	}
 
 	response := *eventType
 
-	eventType.Mapping = service.addUniqueParams(eventType.Name, eventType.Mapping)
+	eventType.Mapping = service.addUniqueParams(eventType.typeName(), eventType.Mapping)
 
 	service.syslogger.Audit(eventType.CreatedBy, "creatingEventType", eventType.EventTypeID, "Service.PostEventType: User [%s] is creating eventType [%s]", eventType.CreatedBy, eventType.EventTypeID)
 
@@ -496,8 +824,9 @@ func (service *Service) PostEventType(eventType *EventType) *piazza.JsonResponse
 		}
 		return service.statusInternalError(err)
 	}
+	response.Version = eventType.Version
 
-	if err = service.eventDB.AddMapping(eventType.Name, eventType.Mapping, eventType.CreatedBy); err != nil {
+	if err = service.eventDB.AddMapping(eventType.typeName(), eventType.Mapping, eventType.CreatedBy); err != nil {
 		service.syslogger.Audit(eventType.CreatedBy, "creatingEventTypeFailure", eventType.EventTypeID, "Service.PostEventType: User [%s] failed to create eventType [%s]", eventType.CreatedBy, eventType.EventTypeID)
 		_, _ = service.eventTypeDB.DeleteByID(eventType.EventTypeID, eventType.CreatedBy)
 		return service.statusInternalError(err)
@@ -517,21 +846,59 @@ func IsSystemEvent(name string) bool {
 	return name == ingestTypeName || name == executeTypeName
 }
 
-// DeleteEventType TODO
-func (service *Service) DeleteEventType(id piazza.Ident) *piazza.JsonResponse {
+// PutEventType changes the retention of an EventType, if it is still at
+// the ETag ifMatch names
+func (service *Service) PutEventType(id piazza.Ident, update *EventTypeUpdate, ifMatch string, actor string) *piazza.JsonResponse {
 	defer service.handlePanic()
 	eventType, found, err := service.eventTypeDB.GetOne(id, "pz-workflow")
 	if !found {
-		service.syslogger.Audit("pz-workflow", "deletingEventTypeFailure", id, "Service.DeleteEventType: failed to get eventType [%s]", id)
 		return service.statusNotFound(err)
 	}
 	if err != nil {
-		service.syslogger.Audit("pz-workflow", "deletingEventTypeFailure", id, "Service.DeleteEventType: failed to get eventType [%s]", id)
 		return service.statusBadRequest(err)
 	}
+	if resp := service.checkETag(ifMatch, "eventType", id, eventType.Version); resp != nil {
+		return resp
+	}
+	if err = update.Retention.validate(); err != nil {
+		return service.statusBadRequest(err)
+	}
+
+	service.syslogger.Audit(actor, "updatingEventType", id, "Service.PutEventType: User is updating eventType [%s]", id)
+
+	eventType.Retention = update.Retention
+	if err = service.eventTypeDB.PutData(eventType, ifMatchVersion(ifMatch, eventType.Version)); err != nil {
+		service.syslogger.Audit(actor, "updatingEventTypeFailure", id, "Service.PutEventType: User failed to update eventType [%s]", id)
+		if err == errVersionConflict {
+			return service.versionConflict("eventType", id, ifMatch)
+		}
+		return service.statusInternalError(err)
+	}
+
+	service.syslogger.Audit(actor, "updatedEventType", id, "Service.PutEventType: User successfully updated eventType [%s] with retention=[%+v]", id, update.Retention)
+
+	return service.statusOK(eventType)
+}
+
+// DeleteEventType deletes an EventType nothing uses, if it is still at the
+// ETag ifMatch names
+func (service *Service) DeleteEventType(id piazza.Ident, ifMatch string, actor string) *piazza.JsonResponse {
+	defer service.handlePanic()
+	eventType, found, err := service.eventTypeDB.GetOne(id, "pz-workflow")
+	if !found {
+		service.syslogger.Audit(actor, "deletingEventTypeFailure", id, "Service.DeleteEventType: failed to get eventType [%s]", id)
+		return service.statusNotFound(err)
+	}
+	if err != nil {
+		service.syslogger.Audit(actor, "deletingEventTypeFailure", id, "Service.DeleteEventType: failed to get eventType [%s]", id)
+		return service.statusBadRequest(err)
+	}
+	if resp := service.checkETag(ifMatch, "eventType", id, eventType.Version); resp != nil {
+		return resp
+	}
 	// Only check for system events or "in use" if found
 	if found {
-		if eventType != nil && IsSystemEvent(eventType.Name) {
+		if eventType != nil && IsSystemEvent(eventType.typeName()) {
 			return service.statusBadRequest(errors.New("Deleting system eventTypes is prohibited"))
 		}
 
@@ -545,7 +912,7 @@ func (service *Service) DeleteEventType(id piazza.Ident) *piazza.JsonResponse {
 		}
 
 		var events []Event
-		if events, hits, err = service.eventDB.GetEventsByEventTypeID(nil, eventType.Name, id, "pz-workflow"); err != nil {
+		if events, hits, err = service.eventDB.GetEventsByEventTypeID(nil, eventType.typeName(), id, "pz-workflow"); err != nil {
 			return service.statusBadRequest(err)
 		}
 		if hits > 0 || len(events) > 0 {
@@ -553,27 +920,98 @@ func (service *Service) DeleteEventType(id piazza.Ident) *piazza.JsonResponse {
 		}
 	}
 
-	service.syslogger.Audit("pz-workflow", "deletingEventType", id, "Service.DeleteEventType: User is deleting eventType [%s]", id)
+	service.syslogger.Audit(actor, "deletingEventType", id, "Service.DeleteEventType: User is deleting eventType [%s]", id)
 
-	ok, err := service.eventTypeDB.DeleteByID(id, "pz-workflow")
+	ok, err := service.eventTypeDB.deleteAtVersion(id, ifMatchVersion(ifMatch, eventType.Version))
+	if err == errVersionConflict {
+		service.syslogger.Audit(actor, "deletingEventTypeFailure", id, "Service.DeleteEventType: User failed to delete eventType [%s]", id)
+		return service.versionConflict("eventType", id, ifMatch)
+	}
 	if !ok {
-		service.syslogger.Audit("pz-workflow", "deletingEventTypeFailure", id, "Service.DeleteEventType: User failed to delete eventType [%s]", id)
+		service.syslogger.Audit(actor, "deletingEventTypeFailure", id, "Service.DeleteEventType: User failed to delete eventType [%s]", id)
 		return service.statusNotFound(err)
 	}
 	if err != nil {
-		service.syslogger.Audit("pz-workflow", "deletingEventTypeFailure", id, "Service.DeleteEventType: User failed to delete eventType [%s]", id)
+		service.syslogger.Audit(actor, "deletingEventTypeFailure", id, "Service.DeleteEventType: User failed to delete eventType [%s]", id)
 		return service.statusBadRequest(err)
 	}
 
-	service.syslogger.Audit("pz-workflow", "deletedEventType", id, "Service.DeleteEventType: User successfully deleted eventType [%s]", id)
+	service.syslogger.Audit(actor, "deletedEventType", id, "Service.DeleteEventType: User successfully deleted eventType [%s]", id)
+
+	if err = service.statsDB.DeleteEventType(id); err != nil {
+		service.syslogger.Warning("Stats error: eventType %s: %s", string(id), err)
+	}
+	service.deleteACL(id)
 
 	return service.statusOK(nil)
 }
 
+// DeleteEventTypeCascade deletes an EventType along with the triggers, cron
+// events and events of that type, and if asked, the alerts of those
+// triggers. It stops at the first dependent that cannot be deleted.
+func (service *Service) DeleteEventTypeCascade(id piazza.Ident, withAlerts bool, ifMatch string, actor string) *piazza.JsonResponse {
+	defer service.handlePanic()
+	eventType, found, err := service.eventTypeDB.GetOne(id, "pz-workflow")
+	if !found {
+		service.syslogger.Audit(actor, "deletingEventTypeFailure", id, "Service.DeleteEventTypeCascade: failed to get eventType [%s]", id)
+		return service.statusNotFound(err)
+	}
+	if err != nil {
+		service.syslogger.Audit(actor, "deletingEventTypeFailure", id, "Service.DeleteEventTypeCascade: failed to get eventType [%s]", id)
+		return service.statusBadRequest(err)
+	}
+	if IsSystemEvent(eventType.typeName()) {
+		return service.statusBadRequest(errors.New("Deleting system eventTypes is prohibited"))
+	}
+	if resp := service.checkETag(ifMatch, "eventType", id, eventType.Version); resp != nil {
+		return resp
+	}
+
+	service.syslogger.Audit(actor, "deletingEventTypeCascade", id, "Service.DeleteEventTypeCascade: User is deleting eventType [%s] and its dependents", id)
+
+	kinds := []string{ExportKindTrigger, ExportKindCron, ExportKindEvent}
+	if withAlerts {
+		kinds = append([]string{ExportKindAlert}, kinds...)
+	}
+
+	cascade := &EventTypeCascade{EventTypeID: id, Removed: map[string][]piazza.Ident{}}
+	done := map[piazza.Ident]bool{}
+	for _, kind := range kinds {
+		ids, err := service.purgeCandidates(kind, &PurgeRequest{EventTypeID: id})
+		if err != nil {
+			service.syslogger.Audit(actor, "deletingEventTypeCascadeFailure", id, "Service.DeleteEventTypeCascade: User failed to delete eventType [%s] after removing %v", id, cascade.Removed)
+			return service.statusInternalError(err)
+		}
+		for _, depID := range ids {
+			if done[depID] {
+				continue
+			}
+			if resp := service.purgeOne(kind, depID, actor); resp.IsError() {
+				service.syslogger.Audit(actor, "deletingEventTypeCascadeFailure", id, "Service.DeleteEventTypeCascade: User failed to delete eventType [%s] after removing %v", id, cascade.Removed)
+				return resp
+			}
+			done[depID] = true
+			cascade.Removed[kind] = append(cascade.Removed[kind], depID)
+		}
+	}
+
+	if resp := service.DeleteEventType(id, ifMatch, actor); resp.IsError() {
+		service.syslogger.Audit(actor, "deletingEventTypeCascadeFailure", id, "Service.DeleteEventTypeCascade: User failed to delete eventType [%s] after removing %v", id, cascade.Removed)
+		return resp
+	}
+
+	// the EventType is gone either way; a mapping left behind only keeps its name taken
+	cascade.MappingRemoved = service.eventDB.RemoveMapping(eventType.typeName(), "pz-workflow") == nil
+
+	service.syslogger.Audit(actor, "deletedEventTypeCascade", id, "Service.DeleteEventTypeCascade: User successfully deleted eventType [%s], removing %v (mapping removed: %t)", id, cascade.Removed, cascade.MappingRemoved)
+
+	return service.statusOK(cascade)
+}
+
 //------------------------------------------------------------------------------
 
 // GetEvent TODO
-func (service *Service) GetEvent(id piazza.Ident) *piazza.JsonResponse {
+func (service *Service) GetEvent(id piazza.Ident, actor string) *piazza.JsonResponse {
 	defer service.handlePanic()
 	mapping, err := service.eventDB.lookupEventTypeNameByEventID(id, "pz-workflow")
 	if mapping == "" {
@@ -583,30 +1021,37 @@ func (service *Service) GetEvent(id piazza.Ident) *piazza.JsonResponse {
 		return service.statusBadRequest(err)
 	}
 
-	service.syslogger.Audit("pz-workflow", "gettingEvent", id, "Service.GetEvent: User is getting event [%s]", id)
+	service.syslogger.Audit(actor, "gettingEvent", id, "Service.GetEvent: User is getting event [%s]", id)
 	event, found, err := service.eventDB.GetOne(mapping, id, "pz-workflow")
 	if !found {
-		service.syslogger.Audit("pz-workflow", "gettingEventFailure", id, "Service.GetEvent: User failed to get event [%s]", id)
+		service.syslogger.Audit(actor, "gettingEventFailure", id, "Service.GetEvent: User failed to get event [%s]", id)
 		return service.statusNotFound(err)
 	}
 	if err != nil {
-		service.syslogger.Audit("pz-workflow", "gettingEventFailure", id, "Service.GetEvent: User failed to get event [%s]", id)
+		service.syslogger.Audit(actor, "gettingEventFailure", id, "Service.GetEvent: User failed to get event [%s]", id)
 		return service.statusBadRequest(err)
 	}
-	service.syslogger.Audit("pz-workflow", "gotEvent", id, "Service.GetEvent: User successfully got event [%s]", id)
+	service.syslogger.Audit(actor, "gotEvent", id, "Service.GetEvent: User successfully got event [%s]", id)
 
 	event.Data = service.removeUniqueParams(mapping, event.Data)
 	return service.statusOK(event)
 }
 
-// GetAllEvents TODO
-func (service *Service) GetAllEvents(params *piazza.HttpQueryParams) *piazza.JsonResponse {
+// GetAllEvents returns the events, optionally of one eventType. The
+// after, before, createdBy, bbox and lat/lon/radius parameters narrow the
+// search further; see eventSearch.
+func (service *Service) GetAllEvents(params *piazza.HttpQueryParams, actor string) *piazza.JsonResponse {
 	defer service.handlePanic()
 	format, err := piazza.NewJsonPagination(params)
 	if err != nil {
 		return service.statusBadRequest(err)
 	}
 
+	search, err := parseEventSearch(params)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+
 	// if both specified, "by id"" wins
 	eventTypeID, err := params.GetAsString("eventTypeId", "")
 	if err != nil {
@@ -616,12 +1061,16 @@ func (service *Service) GetAllEvents(params *piazza.HttpQueryParams) *piazza.Jso
 	if err != nil {
 		return service.statusBadRequest(err)
 	}
+	namespace, err := namespaceParam(params)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
 
 	var query string
+	var eventType *EventType
 
 	// Get the eventTypeName corresponding to the eventTypeId
 	if eventTypeID != "" {
-		var eventType *EventType
 		var found bool
 		eventType, found, err = service.eventTypeDB.GetOne(piazza.Ident(eventTypeID), "pz-workflow")
 		if !found {
@@ -630,32 +1079,52 @@ func (service *Service) GetAllEvents(params *piazza.HttpQueryParams) *piazza.Jso
 		if err != nil {
 			return service.statusBadRequest(err)
 		}
-		query = eventType.Name
+		query = eventType.typeName()
 	} else if eventTypeName != "" {
-		query = eventTypeName
+		query = qualifiedTypeName(namespace, eventTypeName)
+	} else if namespace != "" {
+		// the events of the namespace are those of its eventTypes
+		if search.eventTypeIDs, err = service.namespaceEventTypeIDs(namespace); err != nil {
+			return service.statusInternalError(err)
+		}
 	} else {
 		// no query param specified, get 'em all
 		query = ""
 	}
 
-	service.syslogger.Audit("pz-workflow", "gettingAllEvents", service.eventDB.Esi.IndexName(), "Service.GetAllEvents: User is getting all events")
+	service.syslogger.Audit(actor, "gettingAllEvents", keyEvents, "Service.GetAllEvents: User is getting all events")
 
-	events, totalHits, err := service.eventDB.GetAll(query, format, "pz-workflow")
-	if err != nil {
-		service.syslogger.Audit("pz-workflow", "gettingAllEventsFailure", service.eventDB.Esi.IndexName(), "Service.GetAllEvents: User failed to get all events")
-		return service.statusInternalError(err)
+	var events []Event
+	var totalHits int64
+	if search.isEmpty() {
+		events, totalHits, err = service.eventDB.GetAll(query, format, "pz-workflow")
+		if err != nil {
+			service.syslogger.Audit(actor, "gettingAllEventsFailure", keyEvents, "Service.GetAllEvents: User failed to get all events")
+			return service.statusInternalError(err)
+		}
+	} else {
+		var dsl string
+		if dsl, err = service.eventSearchQuery(search, query, eventType, format); err != nil {
+			service.syslogger.Audit(actor, "gettingAllEventsFailure", keyEvents, "Service.GetAllEvents: User failed to get all events")
+			return service.statusBadRequest(err)
+		}
+		events, totalHits, err = service.eventDB.GetEventsByDslQuery(query, dsl, "pz-workflow")
+		if err != nil {
+			service.syslogger.Audit(actor, "gettingAllEventsFailure", keyEvents, "Service.GetAllEvents: User failed to get all events")
+			return service.statusInternalError(err)
+		}
 	}
 	for i := 0; i < len(events); i++ {
 		eventType, found, err := service.eventTypeDB.GetOne(events[i].EventTypeID, "pz-workflow")
 		if !found || err != nil {
-			service.syslogger.Audit("pz-workflow", "gettingAllEventsFailure", service.eventDB.Esi.IndexName(), "Service.GetAllEvents: User failed to get all events")
+			service.syslogger.Audit(actor, "gettingAllEventsFailure", keyEvents, "Service.GetAllEvents: User failed to get all events")
 			return service.statusInternalError(err)
 		}
-		events[i].Data = service.removeUniqueParams(eventType.Name, events[i].Data)
+		events[i].Data = service.removeUniqueParams(eventType.typeName(), events[i].Data)
 	}
 	resp := service.statusOK(events)
 
-	service.syslogger.Audit("pz-workflow", "gotAllEvents", service.eventDB.Esi.IndexName(), "Service.GetAllEvents: User successfully got all events")
+	service.syslogger.Audit(actor, "gotAllEvents", keyEvents, "Service.GetAllEvents: User successfully got all events")
 
 	format.Count = int(totalHits)
 	resp.Pagination = format
@@ -663,6 +1132,39 @@ func (service *Service) GetAllEvents(params *piazza.HttpQueryParams) *piazza.Jso
 	return resp
 }
 
+// eventSearchQuery renders the search as a query DSL string, paginated as
+// the request asks. Spatial searches look up the eventType by name when
+// only the name was given.
+func (service *Service) eventSearchQuery(search *eventSearch, eventTypeName string, eventType *EventType, format *piazza.JsonPagination) (string, error) {
+	var mapping map[string]interface{}
+	if search.isSpatial() && eventTypeName != "" {
+		if eventType == nil {
+			namespace, name := splitTypeName(eventTypeName)
+			id, found, err := service.eventTypeDB.GetIDByName(nil, namespace, name, "pz-workflow")
+			if err != nil {
+				return "", err
+			}
+			if !found || id == nil {
+				return "", fmt.Errorf("eventType %s could not be found", eventTypeName)
+			}
+			if eventType, found, err = service.eventTypeDB.GetOne(*id, "pz-workflow"); !found || err != nil {
+				return "", fmt.Errorf("eventType %s could not be found", eventTypeName)
+			}
+		}
+		mapping = service.removeUniqueParams(eventType.typeName(), eventType.Mapping)
+	}
+
+	query, err := search.query(eventTypeName, mapping)
+	if err != nil {
+		return "", err
+	}
+	byts, err := json.Marshal(query)
+	if err != nil {
+		return "", err
+	}
+	return format.SyncPagination(string(byts))
+}
+
 // PostRepeatingEvent deals with events that have a "CronSchedule" field specified.
 // This field is checked for validity, and then set up to repeat at the interval
 // specified by the CronSchedule.
@@ -682,17 +1184,23 @@ func (service *Service) PostRepeatingEvent(event *Event) *piazza.JsonResponse {
 	if _, err = cron.Parse(event.CronSchedule); err != nil {
 		return service.statusBadRequest(err)
 	}
+	if resp := service.checkQuota(quotaCrons, event.CreatedBy, namespaceOf(eventType.Namespace)); resp != nil {
+		return resp
+	}
+	if resp := service.checkEventRate(event.CreatedBy, namespaceOf(eventType.Namespace)); resp != nil {
+		return resp
+	}
 
 	event.EventID = service.newIdent()
 	event.CreatedOn = piazza.NewTimeStamp()
 
 	response := *event
 
-	event.Data = service.addUniqueParams(eventType.Name, event.Data)
+	event.Data = service.addUniqueParams(eventType.typeName(), event.Data)
 
 	service.syslogger.Audit(event.CreatedBy, "creatingCronEvent", event.EventID, "Service.PostRepeatingEvent: User [%s] is creating cron event [%s]", event.CreatedBy, event.EventID)
 
-	if err = service.cron.AddJob(event.CronSchedule, cronEvent{event, eventType.Name, service}); err != nil {
+	if err = service.addCronJob(event, eventType.typeName()); err != nil {
 		service.syslogger.Audit(event.CreatedBy, "creatingCronEventFailure", event.EventID, "Service.PostRepeatingEvent: User [%s] failed to create cron event [%s]", event.CreatedBy, event.EventID)
 		return service.statusInternalError(err)
 	}
@@ -702,41 +1210,125 @@ func (service *Service) PostRepeatingEvent(event *Event) *piazza.JsonResponse {
 		return service.statusInternalError(err)
 	}
 
-	if err = service.eventDB.PostData(event, eventType.Name); err != nil {
+	if err = service.eventDB.PostData(event, eventType.typeName()); err != nil {
 		service.syslogger.Audit(event.CreatedBy, "creatingCronEventFailure", event.EventID, "Service.PostRepeatingEvent: User [%s] failed to create cron event [%s]", event.CreatedBy, event.EventID)
 		// If we fail, need to also remove from cronDB
 		// We don't check for errors here because if we've reached this point,
 		// the eventID will be in the cronDB
 		_, _ = service.cronDB.DeleteByID(event.EventID, event.CreatedBy)
-		service.cron.Remove(event.EventID.String())
+		service.removeCronJob(event.EventID)
 		return service.statusInternalError(err)
 	}
 
 	service.syslogger.Audit(event.CreatedBy, "createdCronEvent", event.EventID, "Service.PostRepeatingEvent: User [%s] successfully created cron event [%s] on schedule [%s]", event.CreatedBy, event.EventID, event.CronSchedule)
 
 	service.stats.IncrEvents()
+	service.metrics.inc(metricEvents, "event_type", eventType.typeName())
+	service.countEvent(eventTypeID)
 
 	return service.statusCreated(&response)
 }
 
 // PostEvent TODO
-func (service *Service) PostEvent(event *Event) *piazza.JsonResponse {
+// verifyEventReadyToPost checks the event's data against its EventType's
+// mapping, as any EventRepo needs before storing it
+func (service *Service) verifyEventReadyToPost(event *Event) error {
+	eventTypeJson := service.GetEventType(event.EventTypeID, event.CreatedBy)
+	eventTypeObj := eventTypeJson.Data
+	eventType, ok := eventTypeObj.(*EventType)
+	if !ok {
+		return LoggedError("EventDB.PostData failed: unable to obtain specified eventtype")
+	}
+	eventTypeMapping := eventType.Mapping
+	eventTypeMappingVars, err := piazza.GetVarsFromStruct(eventTypeMapping)
+	if err != nil {
+		return LoggedError("EventDB.PostData failed: %s", err)
+	}
+	exclude := map[string]bool{}
+	for k, v := range eventTypeMappingVars {
+		if fmt.Sprint(v) == string(elasticsearch.MappingElementTypeGeoPoint) || fmt.Sprint(v) == string(elasticsearch.MappingElementTypeGeoShape) {
+			exclude[k] = false
+		}
+	}
+	eventdata := service.removeUniqueParams(eventType.typeName(), event.Data)
+	eventDataVars, err := piazza.GetVarsFromStructSkip(eventdata, exclude)
+	if err != nil {
+		return LoggedError("EventDB.PostData failed: %s", err)
+	}
+	if len(eventTypeMappingVars) > len(eventDataVars) {
+		notFound := []string{}
+		for k, _ := range eventTypeMappingVars {
+			if _, ok := eventDataVars[k]; !ok {
+				notFound = append(notFound, k)
+			}
+		}
+		return LoggedError("EventDB.PostData failed: the variables %s were specified in the EventType but were not found in the Event", notFound)
+	} else if len(eventTypeMappingVars) < len(eventDataVars) {
+		extra := []string{}
+		for k, _ := range eventDataVars {
+			if _, ok := eventTypeMappingVars[k]; !ok {
+				extra = append(extra, k)
+			}
+		}
+		return LoggedError("EventDB.PostData failed: the variables %s were not specified in the EventType but were found in the Event", extra)
+	}
+	for k, v := range eventTypeMappingVars {
+		for k2, v2 := range eventDataVars {
+			if k2 == k {
+				if !elasticsearch.IsValidArrayTypeMapping(v) {
+					if piazza.ValueIsValidArray(v2) {
+						return LoggedError("EventDB.PostData failed: an array was passed into the non-array field %s", k)
+					}
+				} else {
+					if !piazza.ValueIsValidArray(v2) {
+						return LoggedError("EventDB.PostData failed: a non-array was pasted into the array field %s", k)
+					}
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// PostEvent posts the event; what it does is traced under parent, the
+// span of the request if there is one
+func (service *Service) PostEvent(event *Event, parent *Span) *piazza.JsonResponse {
+	return service.postEvent(event, true, parent)
+}
+
+// postEvent posts the event, at the rate its owner and namespace are limited
+// to if limited; the events of a repeating event are limited by how many of
+// those there may be instead
+func (service *Service) postEvent(event *Event, limited bool, parent *Span) *piazza.JsonResponse {
 	defer service.handlePanic()
 	eventType, found, err := service.eventTypeDB.GetOne(event.EventTypeID, event.CreatedBy)
 	if err != nil || !found {
 		return service.statusBadRequest(err)
 	}
+	if limited {
+		if resp := service.checkEventRate(event.CreatedBy, namespaceOf(eventType.Namespace)); resp != nil {
+			return resp
+		}
+	}
 
 	event.EventID = service.newIdent()
 	event.CreatedOn = piazza.NewTimeStamp()
 
+	// once stored, the event's triggers are fired before a shutdown completes
+	received := &OutboxEntry{Stage: OutboxStageReceived, EventID: event.EventID, EventTypeID: eventType.EventTypeID, CreatedBy: event.CreatedBy}
+	if !service.inFlight.admit(received) {
+		return service.statusServiceUnavailable(errors.New("pz-workflow is shutting down"))
+	}
+	defer service.inFlight.done(received)
+
 	response := *event
 
-	event.Data = service.addUniqueParams(eventType.Name, event.Data)
+	event.Data = service.addUniqueParams(eventType.typeName(), event.Data)
 
 	service.syslogger.Audit(event.CreatedBy, "creatingEvent", event.EventID, "Service.PostEvent: User [%s] is creating event [%s]", event.CreatedBy, event.EventID)
 
-	if err = service.eventDB.PostData(event, eventType.Name); err != nil {
+	if err = service.eventDB.PostData(event, eventType.typeName()); err != nil {
 		service.syslogger.Audit(event.CreatedBy, "creatingEventFailure", event.EventID, "Service.PostEvent: User [%s] failed to create event [%s]", event.CreatedBy, event.EventID)
 		return service.statusBadRequest(err)
 	}
@@ -745,7 +1337,13 @@ func (service *Service) PostEvent(event *Event) *piazza.JsonResponse {
 
 	{
 		// Find triggers associated with event
-		triggerIDs, err1 := service.eventDB.PercolateEventData(eventType.Name, event.Data, event.EventID, event.CreatedBy)
+		start := time.Now()
+		span := service.tracer.start("percolate", SpanKindInternal, parent)
+		span.set("event.id", event.EventID.String())
+		span.set("event_type", eventType.typeName())
+		triggerIDs, err1 := service.eventDB.PercolateEventData(eventType.typeName(), event.Data, event.EventID, event.CreatedBy)
+		span.end(err1)
+		service.metrics.since(metricPercolation, start)
 		if err1 != nil {
 			return service.statusBadRequest(err1)
 		}
@@ -759,6 +1357,16 @@ func (service *Service) PostEvent(event *Event) *piazza.JsonResponse {
 			waitGroup.Add(1)
 			go func(triggerID piazza.Ident) {
 				defer waitGroup.Done()
+				service.metrics.dispatchStarted()
+				defer service.metrics.dispatchDone()
+
+				dispatch := service.tracer.start("dispatch", SpanKindInternal, parent)
+				dispatch.set("trigger.id", triggerID.String())
+				defer dispatch.end(nil)
+
+				firing := &OutboxEntry{Stage: OutboxStageMatched, EventID: event.EventID, EventTypeID: eventType.EventTypeID, TriggerID: triggerID, CreatedBy: event.CreatedBy}
+				service.inFlight.trackFiring(firing)
+				defer service.inFlight.done(firing)
 
 				trigger, found, err2 := service.triggerDB.GetOne(triggerID, event.CreatedBy)
 				if err2 != nil {
@@ -782,6 +1390,19 @@ func (service *Service) PostEvent(event *Event) *piazza.JsonResponse {
 					return
 				}
 
+				if trigger.Geofence != nil {
+					data, _ := event.Data[eventType.typeName()].(map[string]interface{})
+					matched, err3 := service.evaluateGeofence(trigger, eventType, data, true)
+					if err3 != nil {
+						// As with a missing trigger, the event itself is fine
+						service.syslogger.Warning("Geofence error: Trigger %s on event %s: %s", string(triggerID), string(event.EventID), err3)
+						return
+					}
+					if !matched {
+						return
+					}
+				}
+
 				// jobID gets sent through Kafka as the key
 				job := trigger.Job
 				jobID := service.newIdent()
@@ -796,38 +1417,54 @@ func (service *Service) PostEvent(event *Event) *piazza.JsonResponse {
 				idamURL, err5 := service.sys.GetURL(piazza.PzIdam)
 				service.syslogger.Info("Requesting pz-idam url: %s", idamURL)
 				if err5 == nil { //Mocking
-					service.syslogger.Audit("pz-workflow", "createJobRequestAccess", "pz-idam", "User [%s] POSTed event [%s] requesting access to trigger [%s] created by [%s]", event.CreatedBy, event.EventID, trigger.TriggerID, trigger.CreatedBy)
-					auth, err6 := piazza.RequestAuthZAccess(idamURL, eventType.CreatedBy)
-					service.syslogger.Info("Pz-idam authoriazation for user [%s]: %t", eventType.CreatedBy, auth)
+					service.syslogger.Audit(event.CreatedBy, "createJobRequestAccess", "pz-idam", "User [%s] POSTed event [%s] requesting access to trigger [%s] created by [%s]", event.CreatedBy, event.EventID, trigger.TriggerID, trigger.CreatedBy)
+					start := time.Now()
+					authorize := service.tracer.start("idam authorize", SpanKindClient, dispatch)
+					auth, err6 := piazza.RequestAuthZAccess(idamURL, trigger.CreatedBy)
+					authorize.set("idam.authorized", strconv.FormatBool(auth))
+					authorize.end(err6)
+					service.metrics.since(metricIdam, start)
+					service.syslogger.Info("Pz-idam authoriazation for user [%s]: %t", trigger.CreatedBy, auth)
 					if err6 != nil {
+						service.countFiring(triggerID, true)
 						results[triggerID] = service.statusInternalError(err6)
-						service.syslogger.Audit("pz-workflow", "createJobRequestAccessFailure", "pz-idam", "Event [%s] firing trigger [%s] could not get access to create job", event.EventID, trigger.TriggerID)
+						service.syslogger.Audit(event.CreatedBy, "createJobRequestAccessFailure", "pz-idam", "Event [%s] firing trigger [%s] could not get access to create job", event.EventID, trigger.TriggerID)
 						return
 					} else if !auth {
 						results[triggerID] = service.statusForbidden(errors.New("Access to create job denied"))
-						service.syslogger.Audit("pz-workflow", "createJobRequestAccessDenied", "pz-idam", "Event [%s] firing trigger [%s] was denied access to create job", event.EventID, trigger.TriggerID)
+						service.syslogger.Audit(event.CreatedBy, "createJobRequestAccessDenied", "pz-idam", "Event [%s] firing trigger [%s] was denied access to create job", event.EventID, trigger.TriggerID)
 						return
 					}
 				}
 
-				service.syslogger.Audit("pz-workflow", "createJobRequestAccessGranted", "pz-idam", "Event [%s] firing trigger [%s] was granted access to create job", event.EventID, trigger.TriggerID)
+				service.syslogger.Audit(event.CreatedBy, "createJobRequestAccessGranted", "pz-idam", "Event [%s] firing trigger [%s] was granted access to create job", event.EventID, trigger.TriggerID)
 				service.syslogger.Info("job [%s] submission by event [%s] using trigger [%s]: %s\n", jobID, event.EventID, triggerID, jobString)
 
 				// Not very robust,  need to find a better way
-				for key, value := range event.Data[eventType.Name].(map[string]interface{}) {
+				for key, value := range event.Data[eventType.typeName()].(map[string]interface{}) {
 					jobString = strings.Replace(jobString, "$"+key, fmt.Sprintf("%v", value), -1)
 				}
 
 				//log.Printf("JOB ID: %s", jobID)
 				//log.Printf("JOB STRING: %s", jobString)
 
-				err7 := service.sendToRabbitMQ(jobString, jobID, trigger.CreatedBy)
+				start := time.Now()
+				publish := service.tracer.start("amqp publish", SpanKindProducer, dispatch)
+				publish.set("messaging.system", "rabbitmq")
+				publish.set("job.id", jobID.String())
+				err7 := service.sendJob(jobString, jobID, trigger.CreatedBy, publish)
+				publish.end(err7)
+				service.metrics.since(metricRabbitMQPublish, start)
 				if err7 != nil {
+					service.countFiring(triggerID, true)
 					results[triggerID] = service.statusInternalError(err7)
 					return
 				}
+				service.countFiring(triggerID, false)
+				service.inFlight.setStage(firing, OutboxStagePublished, jobID)
 
 				service.stats.IncrTriggerJobs()
+				service.metrics.inc(metricTriggerFirings, "trigger_id", triggerID.String())
 
 				alert := Alert{EventID: event.EventID, TriggerID: triggerID, JobID: jobID, CreatedBy: trigger.CreatedBy}
 				if resp := service.PostAlert(&alert); resp.IsError() {
@@ -849,11 +1486,13 @@ func (service *Service) PostEvent(event *Event) *piazza.JsonResponse {
 	}
 
 	service.stats.IncrEvents()
+	service.metrics.inc(metricEvents, "event_type", eventType.typeName())
+	service.countEvent(eventType.EventTypeID)
 
 	return service.statusCreated(&response)
 }
 
-func (service *Service) QueryEvents(jsonString string, params *piazza.HttpQueryParams) *piazza.JsonResponse {
+func (service *Service) QueryEvents(jsonString string, params *piazza.HttpQueryParams, actor string) *piazza.JsonResponse {
 	defer service.handlePanic()
 	format, err := piazza.NewJsonPagination(params)
 	if err != nil {
@@ -869,6 +1508,10 @@ func (service *Service) QueryEvents(jsonString string, params *piazza.HttpQueryP
 	if err != nil {
 		return service.statusBadRequest(err)
 	}
+	namespace, err := namespaceParam(params)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
 
 	var query string
 
@@ -883,9 +1526,19 @@ func (service *Service) QueryEvents(jsonString string, params *piazza.HttpQueryP
 		if err != nil {
 			return service.statusBadRequest(err)
 		}
-		query = eventType.Name
+		query = eventType.typeName()
 	} else if eventTypeName != "" {
-		query = eventTypeName
+		query = qualifiedTypeName(namespace, eventTypeName)
+	} else if namespace != "" {
+		// the events of the namespace are those of its eventTypes
+		var ids []piazza.Ident
+		if ids, err = service.namespaceEventTypeIDs(namespace); err != nil {
+			return service.statusInternalError(err)
+		}
+		filter := map[string]interface{}{"terms": map[string]interface{}{"eventTypeId": ids}}
+		if jsonString, err = scopeDsl(jsonString, filter); err != nil {
+			return service.statusBadRequest(err)
+		}
 	} else {
 		// no query param specified, get 'em all
 		query = ""
@@ -895,16 +1548,16 @@ func (service *Service) QueryEvents(jsonString string, params *piazza.HttpQueryP
 		return service.statusBadRequest(err)
 	}
 
-	service.syslogger.Audit("pz-workflow", "queryingEvents", service.eventDB.Esi.IndexName(), "Service.QueryEvents: User is querying events")
+	service.syslogger.Audit(actor, "queryingEvents", keyEvents, "Service.QueryEvents: User is querying events")
 
 	events, totalHits, err := service.eventDB.GetEventsByDslQuery(query, jsonString, "pz-workflow")
 	if err != nil {
-		service.syslogger.Audit("pz-workflow", "queryingEventsFailure", service.eventDB.Esi.IndexName(), "Service.QueryEvents: User failed to query events")
+		service.syslogger.Audit(actor, "queryingEventsFailure", keyEvents, "Service.QueryEvents: User failed to query events")
 		return service.statusBadRequest(err)
 	}
 	resp := service.statusOK(events)
 
-	service.syslogger.Audit("pz-workflow", "queriedEvents", service.eventDB.Esi.IndexName(), "Service.QueryEvents: User successfully queried events")
+	service.syslogger.Audit(actor, "queriedEvents", keyEvents, "Service.QueryEvents: User successfully queried events")
 
 	format.Count = int(totalHits)
 	resp.Pagination = format
@@ -912,7 +1565,7 @@ func (service *Service) QueryEvents(jsonString string, params *piazza.HttpQueryP
 	return resp
 }
 
-func (service *Service) DeleteEvent(id piazza.Ident) *piazza.JsonResponse {
+func (service *Service) DeleteEvent(id piazza.Ident, actor string) *piazza.JsonResponse {
 	defer service.handlePanic()
 	mapping, err := service.eventDB.lookupEventTypeNameByEventID(id, "pz-workflow")
 	if mapping == "" {
@@ -926,18 +1579,18 @@ func (service *Service) DeleteEvent(id piazza.Ident) *piazza.JsonResponse {
 		return service.statusBadRequest(errors.New("Deleting system events is prohibited"))
 	}
 
-	service.syslogger.Audit("pz-workflow", "deletingEvent", id, "Service.DeleteEvent: User is deleteing event [%s]", id)
+	service.syslogger.Audit(actor, "deletingEvent", id, "Service.DeleteEvent: User is deleteing event [%s]", id)
 
 	ok, err := service.eventDB.DeleteByID(mapping, id, "pz-workflow")
 	if !ok {
-		service.syslogger.Audit("pz-workflow", "deletingEventFailure", id, "Service.DeleteEvent: User failed to delete event [%s]", id)
+		service.syslogger.Audit(actor, "deletingEventFailure", id, "Service.DeleteEvent: User failed to delete event [%s]", id)
 		return service.statusNotFound(err)
 	}
 	if err != nil {
-		service.syslogger.Audit("pz-workflow", "deletingEventFailure", id, "Service.DeleteEvent: User failed to delete event [%s]", id)
+		service.syslogger.Audit(actor, "deletingEventFailure", id, "Service.DeleteEvent: User failed to delete event [%s]", id)
 		return service.statusBadRequest(err)
 	}
-	service.syslogger.Audit("pz-workflow", "deletedCronEvent", id, "Service.DeleteEvent: User successfully deleted event [%s]", id)
+	service.syslogger.Audit(actor, "deletedCronEvent", id, "Service.DeleteEvent: User successfully deleted event [%s]", id)
 
 	// If it's a cron event, remove from cronDB, stop cronjob
 	ok, err = service.cronDB.itemExists(id, "pz-workflow")
@@ -945,18 +1598,18 @@ func (service *Service) DeleteEvent(id piazza.Ident) *piazza.JsonResponse {
 		return service.statusBadRequest(err)
 	}
 	if ok {
-		service.syslogger.Audit("pz-workflow", "deletingCronEvent", id, "Service.DeleteEvent: User is deleting cron event [%s]", id)
+		service.syslogger.Audit(actor, "deletingCronEvent", id, "Service.DeleteEvent: User is deleting cron event [%s]", id)
 		ok, err := service.cronDB.DeleteByID(id, "pz-workflow")
 		if !ok {
-			service.syslogger.Audit("pz-workflow", "deletingCronEventFailure", id, "Service.DeleteEvent: User failed to delete cron event [%s]", id)
+			service.syslogger.Audit(actor, "deletingCronEventFailure", id, "Service.DeleteEvent: User failed to delete cron event [%s]", id)
 			return service.statusNotFound(err)
 		}
 		if err != nil {
-			service.syslogger.Audit("pz-workflow", "deletingCronEventFailure", id, "Service.DeleteEvent: User failed to delete cron event [%s]", id)
+			service.syslogger.Audit(actor, "deletingCronEventFailure", id, "Service.DeleteEvent: User failed to delete cron event [%s]", id)
 			return service.statusBadRequest(err)
 		}
-		service.syslogger.Audit("pz-workflow", "deletedCronEvent", id, "Service.DeleteEvent: User successfully deleted cron event [%s]", id)
-		service.cron.Remove(id.String())
+		service.syslogger.Audit(actor, "deletedCronEvent", id, "Service.DeleteEvent: User successfully deleted cron event [%s]", id)
+		service.removeCronJob(id)
 	}
 
 	return service.statusOK(nil)
@@ -964,44 +1617,59 @@ func (service *Service) DeleteEvent(id piazza.Ident) *piazza.JsonResponse {
 
 //------------------------------------------------------------------------------
 
-func (service *Service) GetTrigger(id piazza.Ident) *piazza.JsonResponse {
+func (service *Service) GetTrigger(id piazza.Ident, actor string) *piazza.JsonResponse {
 	defer service.handlePanic()
-	service.syslogger.Audit("pz-workflow", "gettingTrigger", id, "Service.GetTrigger: User is getting trigger [%s]", id)
+	service.syslogger.Audit(actor, "gettingTrigger", id, "Service.GetTrigger: User is getting trigger [%s]", id)
 	trigger, found, err := service.triggerDB.GetOne(id, "pz-workflow")
 	if !found {
-		service.syslogger.Audit("pz-workflow", "gettingTriggerFailure", id, "Service.GetTrigger: User failed to get trigger [%s]", id)
+		service.syslogger.Audit(actor, "gettingTriggerFailure", id, "Service.GetTrigger: User failed to get trigger [%s]", id)
 		return service.statusNotFound(err)
 	}
 	if err != nil {
-		service.syslogger.Audit("pz-workflow", "gettingTriggerFailure", id, "Service.GetTrigger: User failed to get trigger [%s]", id)
+		service.syslogger.Audit(actor, "gettingTriggerFailure", id, "Service.GetTrigger: User failed to get trigger [%s]", id)
 		return service.statusBadRequest(err)
 	}
 	eventType, found, err := service.eventTypeDB.GetOne(trigger.EventTypeID, "pz-workflow")
 	if err != nil || !found {
-		service.syslogger.Audit("pz-workflow", "gettingTriggerFailure", id, "Service.GetTrigger: User failed to get trigger [%s]", id)
+		service.syslogger.Audit(actor, "gettingTriggerFailure", id, "Service.GetTrigger: User failed to get trigger [%s]", id)
 		return service.statusBadRequest(err)
 	}
-	service.syslogger.Audit("pz-workflow", "gotTrigger", id, "Service.GetTrigger: User successfully got trigger [%s]", id)
+	service.syslogger.Audit(actor, "gotTrigger", id, "Service.GetTrigger: User successfully got trigger [%s]", id)
 
-	trigger.Condition = service.removeUniqueParams(eventType.Name, trigger.Condition)
+	trigger.Condition = service.removeUniqueParams(eventType.typeName(), trigger.Condition)
 	return service.statusOK(trigger)
 }
 
-func (service *Service) GetAllTriggers(params *piazza.HttpQueryParams) *piazza.JsonResponse {
+func (service *Service) GetAllTriggers(params *piazza.HttpQueryParams, actor string) *piazza.JsonResponse {
 	defer service.handlePanic()
 	format, err := piazza.NewJsonPagination(params)
 	if err != nil {
 		return service.statusBadRequest(err)
 	}
 
-	service.syslogger.Audit("pz-workflow", "gettingAllTriggers", service.triggerDB.mapping, "Service.GetAllTriggers: User is getting all triggers")
+	namespace, err := namespaceParam(params)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+
+	service.syslogger.Audit(actor, "gettingAllTriggers", TriggerDBMapping, "Service.GetAllTriggers: User is getting all triggers")
 
-	triggers, totalHits, err := service.triggerDB.GetAll(format, "pz-workflow")
+	var triggers []Trigger
+	var totalHits int64
+	if namespace != "" {
+		var dsl string
+		if dsl, err = namespaceDsl(namespace, format); err != nil {
+			return service.statusBadRequest(err)
+		}
+		triggers, totalHits, err = service.triggerDB.GetTriggersByDslQuery(dsl, "pz-workflow")
+	} else {
+		triggers, totalHits, err = service.triggerDB.GetAll(format, "pz-workflow")
+	}
 	if err != nil {
-		service.syslogger.Audit("pz-workflow", "gettingAllTriggersFailure", service.triggerDB.mapping, "Service.GetAllTriggers: User failed to get all triggers")
+		service.syslogger.Audit(actor, "gettingAllTriggersFailure", TriggerDBMapping, "Service.GetAllTriggers: User failed to get all triggers")
 		return service.statusInternalError(err)
 	} else if triggers == nil {
-		service.syslogger.Audit("pz-workflow", "gettingAllTriggersFailure", service.triggerDB.mapping, "Service.GetAllTriggers: User failed to get all triggers")
+		service.syslogger.Audit(actor, "gettingAllTriggersFailure", TriggerDBMapping, "Service.GetAllTriggers: User failed to get all triggers")
 		return service.statusInternalError(errors.New("GetAllTriggers returned nil"))
 	}
 	for i := 0; i < len(triggers); i++ {
@@ -1010,11 +1678,11 @@ func (service *Service) GetAllTriggers(params *piazza.HttpQueryParams) *piazza.J
 			continue //v Old implementation
 			//return service.statusBadRequest(err)
 		}
-		triggers[i].Condition = service.removeUniqueParams(eventType.Name, triggers[i].Condition)
+		triggers[i].Condition = service.removeUniqueParams(eventType.typeName(), triggers[i].Condition)
 	}
 	resp := service.statusOK(triggers)
 
-	service.syslogger.Audit("pz-workflow", "gotAllTriggers", service.triggerDB.mapping, "Service.GetAllTriggers: User successfully got all triggers")
+	service.syslogger.Audit(actor, "gotAllTriggers", TriggerDBMapping, "Service.GetAllTriggers: User successfully got all triggers")
 
 	format.Count = int(totalHits)
 	resp.Pagination = format
@@ -1022,39 +1690,39 @@ func (service *Service) GetAllTriggers(params *piazza.HttpQueryParams) *piazza.J
 	return resp
 }
 
-func (service *Service) QueryTriggers(dslString string, params *piazza.HttpQueryParams) *piazza.JsonResponse {
+func (service *Service) QueryTriggers(dslString string, params *piazza.HttpQueryParams, actor string) *piazza.JsonResponse {
 	defer service.handlePanic()
 	format, err := piazza.NewJsonPagination(params)
 	if err != nil {
 		return service.statusBadRequest(err)
 	}
 
-	service.syslogger.Audit("pz-workflow", "queryingTriggers", service.triggerDB.mapping, "Service.QueryTriggers: User is querying triggers")
+	service.syslogger.Audit(actor, "queryingTriggers", TriggerDBMapping, "Service.QueryTriggers: User is querying triggers")
 
 	dslString, err = format.SyncPagination(dslString)
 	if err != nil {
-		service.syslogger.Audit("pz-workflow", "queryingTriggersFailure", service.triggerDB.mapping, "Service.QueryTriggers: syncPagination failed")
+		service.syslogger.Audit(actor, "queryingTriggersFailure", TriggerDBMapping, "Service.QueryTriggers: syncPagination failed")
 		return service.statusBadRequest(err)
 	}
 	triggers, totalHits, err := service.triggerDB.GetTriggersByDslQuery(dslString, "pz-workflow")
 	if err != nil {
-		service.syslogger.Audit("pz-workflow", "queryingTriggersFailure", service.triggerDB.mapping, "Service.QueryTriggers: User failed to query triggers")
+		service.syslogger.Audit(actor, "queryingTriggersFailure", TriggerDBMapping, "Service.QueryTriggers: User failed to query triggers")
 		return service.statusBadRequest(err)
 	} else if triggers == nil {
-		service.syslogger.Audit("pz-workflow", "queryingTriggersFailure", service.triggerDB.mapping, "Service.QueryTriggers: User failed to query triggers")
+		service.syslogger.Audit(actor, "queryingTriggersFailure", TriggerDBMapping, "Service.QueryTriggers: User failed to query triggers")
 		return service.statusInternalError(errors.New("QueryTriggers returned nil"))
 	}
 	for i := 0; i < len(triggers); i++ {
 		eventType, found, err := service.eventTypeDB.GetOne(triggers[i].EventTypeID, "pz-workflow")
 		if err != nil || !found {
-			service.syslogger.Audit("pz-workflow", "queryingTriggersFailure", service.triggerDB.mapping, "Service.QueryTriggers: User failed to query triggers")
+			service.syslogger.Audit(actor, "queryingTriggersFailure", TriggerDBMapping, "Service.QueryTriggers: User failed to query triggers")
 			return service.statusBadRequest(err)
 		}
-		triggers[i].Condition = service.removeUniqueParams(eventType.Name, triggers[i].Condition)
+		triggers[i].Condition = service.removeUniqueParams(eventType.typeName(), triggers[i].Condition)
 	}
 	resp := service.statusOK(triggers)
 
-	service.syslogger.Audit("pz-workflow", "queriedTriggers", service.triggerDB.mapping, "Service.QueryTriggers: User successfully queried triggers")
+	service.syslogger.Audit(actor, "queriedTriggers", TriggerDBMapping, "Service.QueryTriggers: User successfully queried triggers")
 
 	format.Count = int(totalHits)
 	resp.Pagination = format
@@ -1080,10 +1748,17 @@ func (service *Service) PostTrigger(trigger *Trigger) *piazza.JsonResponse {
 			return service.statusBadRequest(fmt.Errorf("TriggerDB.PostData failed: eventType %s could not be found", trigger.EventTypeID))
 		}
 		eventType = et
+		trigger.Namespace = namespaceOf(et.Namespace)
 	}
-	fixedQuery, ok := handleUniqueParams(trigger.Condition, eventType.Name, func(eventTypeName string, key string) string {
-		return strings.Replace(key, "data.", "data."+eventTypeName+".", 1)
-	}).(map[string]interface{})
+	if resp := service.checkQuota(quotaTriggers, trigger.CreatedBy, trigger.Namespace); resp != nil {
+		return resp
+	}
+	if trigger.Geofence != nil {
+		if err = service.validateGeofenceCondition(trigger.Geofence, eventType); err != nil {
+			return service.statusBadRequest(fmt.Errorf("TriggerDB.PostData failed: %s", err))
+		}
+	}
+	fixedQuery, ok := prefixCondition(trigger.Condition, eventType.typeName())
 	if !ok {
 		return service.statusBadRequest(fmt.Errorf("TriggerEB.PostData failed: failed to parse query"))
 	}
@@ -1096,6 +1771,7 @@ func (service *Service) PostTrigger(trigger *Trigger) *piazza.JsonResponse {
 		service.syslogger.Audit(trigger.CreatedBy, "creatingTriggerFailure", trigger.TriggerID, "Service.PostTrigger: User [%s] failed to create trigger [%s]", trigger.CreatedBy, trigger.TriggerID)
 		return service.statusBadRequest(err)
 	}
+	response.Version = trigger.Version
 
 	service.syslogger.Audit(trigger.CreatedBy, "createdTrigger", trigger.TriggerID, "Service.PostTrigger: User [%s] successfully created trigger [%s]", trigger.CreatedBy, trigger.TriggerID)
 
@@ -1104,7 +1780,18 @@ func (service *Service) PostTrigger(trigger *Trigger) *piazza.JsonResponse {
 	return service.statusCreated(&response)
 }
 
-func (service *Service) PutTrigger(id piazza.Ident, update *TriggerUpdate) *piazza.JsonResponse {
+// prefixCondition points the "data." variables of a trigger condition at
+// the eventType's own part of the event data
+func prefixCondition(condition map[string]interface{}, eventTypeName string) (map[string]interface{}, bool) {
+	fixedQuery, ok := handleUniqueParams(condition, eventTypeName, func(eventTypeName string, key string) string {
+		return strings.Replace(key, "data.", "data."+eventTypeName+".", 1)
+	}).(map[string]interface{})
+	return fixedQuery, ok
+}
+
+// PutTrigger enables or disables a trigger, if it is still at the ETag
+// ifMatch names
+func (service *Service) PutTrigger(id piazza.Ident, update *TriggerUpdate, ifMatch string, actor string) *piazza.JsonResponse {
 	defer service.handlePanic()
 	trigger, found, err := service.triggerDB.GetOne(id, "pz-workflow")
 	if !found {
@@ -1113,58 +1800,149 @@ func (service *Service) PutTrigger(id piazza.Ident, update *TriggerUpdate) *piaz
 	if err != nil {
 		return service.statusBadRequest(err)
 	}
+	if resp := service.checkETag(ifMatch, "trigger", id, trigger.Version); resp != nil {
+		return resp
+	}
 
-	service.syslogger.Audit("pz-workflow", "updatingTrigger", id, "Service.PutTrigger: User is updating trigger [%s]", id)
+	service.syslogger.Audit(actor, "updatingTrigger", id, "Service.PutTrigger: User is updating trigger [%s]", id)
 
-	if _, err = service.triggerDB.PutTrigger(trigger, update, "pz-workflow"); err != nil {
-		service.syslogger.Audit("pz-workflow", "updatingTriggerFailure", id, "Service.PutTrigger: User failed to update trigger [%s]", id)
+	if _, err = service.triggerDB.PutTrigger(trigger, update, ifMatchVersion(ifMatch, trigger.Version), "pz-workflow"); err != nil {
+		service.syslogger.Audit(actor, "updatingTriggerFailure", id, "Service.PutTrigger: User failed to update trigger [%s]", id)
+		if err == errVersionConflict {
+			return service.versionConflict("trigger", id, ifMatch)
+		}
 		return service.statusBadRequest(err)
 	}
 
-	service.syslogger.Audit("pz-workflow", "updatedTrigger", id, "Service.PutTrigger: User successfully updated trigger [%s] with enabled=[%v]", id, update.Enabled)
+	service.syslogger.Audit(actor, "updatedTrigger", id, "Service.PutTrigger: User successfully updated trigger [%s] with enabled=[%v]", id, update.Enabled)
 
 	return service.statusPutOK("Updated trigger")
 }
 
-func (service *Service) DeleteTrigger(id piazza.Ident) *piazza.JsonResponse {
+// TestTrigger tells whether the event would fire the trigger. Nothing is
+// stored, no job is sent and geofence positions are left as they are.
+func (service *Service) TestTrigger(id piazza.Ident, event *Event, actor string) *piazza.JsonResponse {
+	defer service.handlePanic()
+	trigger, found, err := service.triggerDB.GetOne(id, "pz-workflow")
+	if !found {
+		return service.statusNotFound(err)
+	}
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	eventType, found, err := service.eventTypeDB.GetOne(event.EventTypeID, "pz-workflow")
+	if !found || err != nil {
+		return service.statusBadRequest(fmt.Errorf("eventType %s could not be found", event.EventTypeID))
+	}
+
+	service.syslogger.Audit(actor, "testingTrigger", id, "Service.TestTrigger: User is testing trigger [%s]", id)
+
+	if event.Data == nil {
+		event.Data = map[string]interface{}{}
+	}
+	nested := &Event{EventTypeID: event.EventTypeID, Data: service.addUniqueParams(eventType.typeName(), event.Data), CreatedBy: event.CreatedBy}
+	if err = service.verifyEventReadyToPost(nested); err != nil {
+		service.syslogger.Audit(actor, "testingTriggerFailure", id, "Service.TestTrigger: User failed to test trigger [%s]", id)
+		return service.statusBadRequest(err)
+	}
+
+	result := &TriggerTestResult{TriggerID: id}
+	switch {
+	case eventType.EventTypeID != trigger.EventTypeID:
+		result.Reason = "the event is not of the trigger's eventType"
+	case !trigger.Enabled:
+		result.Reason = "the trigger is disabled"
+	default:
+		triggerIDs, err := service.eventDB.PercolateEventData(eventType.typeName(), nested.Data, "", event.CreatedBy)
+		if err != nil {
+			service.syslogger.Audit(actor, "testingTriggerFailure", id, "Service.TestTrigger: User failed to test trigger [%s]", id)
+			return service.statusBadRequest(err)
+		}
+		for _, triggerID := range *triggerIDs {
+			result.Matched = result.Matched || triggerID == id
+		}
+		if !result.Matched {
+			result.Reason = "the condition does not match"
+			break
+		}
+		if trigger.Geofence != nil {
+			if result.Matched, err = service.evaluateGeofence(trigger, eventType, event.Data, false); err != nil {
+				result.Reason = err.Error()
+			} else if !result.Matched {
+				result.Reason = "the geofence condition does not hold"
+			}
+		}
+	}
+
+	service.syslogger.Audit(actor, "testedTrigger", id, "Service.TestTrigger: User successfully tested trigger [%s]", id)
+
+	return service.statusOK(result)
+}
+
+// DeleteTrigger deletes a trigger, if it is still at the ETag ifMatch names
+func (service *Service) DeleteTrigger(id piazza.Ident, ifMatch string, actor string) *piazza.JsonResponse {
 	defer service.handlePanic()
-	service.syslogger.Audit("pz-workflow", "deletingTrigger", id, "Service.DeleteTrigger: User is deleting trigger [%s]", id)
+	var version int64
+	if ifMatch != "" {
+		trigger, found, err := service.triggerDB.GetOne(id, "pz-workflow")
+		if !found {
+			return service.statusNotFound(err)
+		}
+		if err != nil {
+			return service.statusBadRequest(err)
+		}
+		if resp := service.checkETag(ifMatch, "trigger", id, trigger.Version); resp != nil {
+			return resp
+		}
+		version = ifMatchVersion(ifMatch, trigger.Version)
+	}
 
-	ok, err := service.triggerDB.DeleteTrigger(id, "pz-workflow")
+	service.syslogger.Audit(actor, "deletingTrigger", id, "Service.DeleteTrigger: User is deleting trigger [%s]", id)
+
+	ok, err := service.triggerDB.DeleteTrigger(id, version, "pz-workflow")
+	if err == errVersionConflict {
+		service.syslogger.Audit(actor, "deletingTriggerFailure", id, "Service.DeleteTrigger: User failed to delete trigger [%s]", id)
+		return service.versionConflict("trigger", id, ifMatch)
+	}
 	if !ok {
-		service.syslogger.Audit("pz-workflow", "deletingTriggerFailure", id, "Service.DeleteTrigger: User failed to delete trigger [%s]", id)
+		service.syslogger.Audit(actor, "deletingTriggerFailure", id, "Service.DeleteTrigger: User failed to delete trigger [%s]", id)
 		return service.statusNotFound(err)
 	}
 	if err != nil {
-		service.syslogger.Audit("pz-workflow", "deletingTriggerFailure", id, "Service.DeleteTrigger: User failed to delete trigger [%s]", id)
+		service.syslogger.Audit(actor, "deletingTriggerFailure", id, "Service.DeleteTrigger: User failed to delete trigger [%s]", id)
 		return service.statusBadRequest(err)
 	}
 
-	service.syslogger.Audit("pz-workflow", "deletedTrigger", id, "Service.DeleteTrigger: User successfully deleted trigger [%s]", id)
+	service.syslogger.Audit(actor, "deletedTrigger", id, "Service.DeleteTrigger: User successfully deleted trigger [%s]", id)
+
+	if err = service.statsDB.DeleteTrigger(id); err != nil {
+		service.syslogger.Warning("Stats error: trigger %s: %s", string(id), err)
+	}
+	service.deleteACL(id)
 
 	return service.statusOK(nil)
 }
 
 //---------------------------------------------------------------------
 
-func (service *Service) GetAlert(id piazza.Ident) *piazza.JsonResponse {
+func (service *Service) GetAlert(id piazza.Ident, actor string) *piazza.JsonResponse {
 	defer service.handlePanic()
-	service.syslogger.Audit("pz-workflow", "gettingAlert", id, "Service.GetAlert: User is getting alert [%s]", id)
+	service.syslogger.Audit(actor, "gettingAlert", id, "Service.GetAlert: User is getting alert [%s]", id)
 	alert, found, err := service.alertDB.GetOne(id, "pz-workflow")
 	if !found {
-		service.syslogger.Audit("pz-workflow", "gettingAlertFailure", id, "Service.GetAlert: User failed to get alert [%s]", id)
+		service.syslogger.Audit(actor, "gettingAlertFailure", id, "Service.GetAlert: User failed to get alert [%s]", id)
 		return service.statusNotFound(err)
 	}
 	if err != nil {
-		service.syslogger.Audit("pz-workflow", "gettingAlertFailure", id, "Service.GetAlert: User failed to get alert [%s]", id)
+		service.syslogger.Audit(actor, "gettingAlertFailure", id, "Service.GetAlert: User failed to get alert [%s]", id)
 		return service.statusBadRequest(err)
 	}
-	service.syslogger.Audit("pz-workflow", "gotAlert", id, "Service.GetAlert: User successfully got alert [%s]", id)
+	service.syslogger.Audit(actor, "gotAlert", id, "Service.GetAlert: User successfully got alert [%s]", id)
 
 	return service.statusOK(alert)
 }
 
-func (service *Service) GetAllAlerts(params *piazza.HttpQueryParams) *piazza.JsonResponse {
+func (service *Service) GetAllAlerts(params *piazza.HttpQueryParams, actor string) *piazza.JsonResponse {
 	defer service.handlePanic()
 	triggerID, err := params.GetAsID("triggerId", "")
 	if err != nil {
@@ -1179,28 +1957,28 @@ func (service *Service) GetAllAlerts(params *piazza.HttpQueryParams) *piazza.Jso
 	var alerts []Alert
 	var totalHits int64
 
-	service.syslogger.Audit("pz-workflow", "gettingAllAlerts", service.alertDB.mapping, "Service.GetAllAlerts: User is getting all alerts")
+	service.syslogger.Audit(actor, "gettingAllAlerts", AlertDBMapping, "Service.GetAllAlerts: User is getting all alerts")
 
 	if triggerID != "" && piazza.ValidUuid(triggerID.String()) {
 		alerts, totalHits, err = service.alertDB.GetAllByTrigger(format, triggerID, "pz-workflow")
 		if err != nil {
-			service.syslogger.Audit("pz-workflow", "gettingAllAlertsFailure", service.alertDB.mapping, "Service.GetAllAlerts: User failed to get all alerts")
+			service.syslogger.Audit(actor, "gettingAllAlertsFailure", AlertDBMapping, "Service.GetAllAlerts: User failed to get all alerts")
 			return service.statusInternalError(err)
 		} else if alerts == nil {
-			service.syslogger.Audit("pz-workflow", "gettingAllAlertsFailure", service.alertDB.mapping, "Service.GetAllAlerts: User failed to get all alerts")
+			service.syslogger.Audit(actor, "gettingAllAlertsFailure", AlertDBMapping, "Service.GetAllAlerts: User failed to get all alerts")
 			return service.statusInternalError(errors.New("GetAllAlerts returned nil"))
 		}
 	} else if triggerID == "" {
 		alerts, totalHits, err = service.alertDB.GetAll(format, "pz-workflow")
 		if err != nil {
-			service.syslogger.Audit("pz-workflow", "gettingAllAlertsFailure", service.alertDB.mapping, "Service.GetAllAlerts: User failed to get all alerts")
+			service.syslogger.Audit(actor, "gettingAllAlertsFailure", AlertDBMapping, "Service.GetAllAlerts: User failed to get all alerts")
 			return service.statusInternalError(err)
 		} else if alerts == nil {
-			service.syslogger.Audit("pz-workflow", "gettingAllAlertsFailure", service.alertDB.mapping, "Service.GetAllAlerts: User failed to get all alerts")
+			service.syslogger.Audit(actor, "gettingAllAlertsFailure", AlertDBMapping, "Service.GetAllAlerts: User failed to get all alerts")
 			return service.statusInternalError(errors.New("GetAllAlerts returned nil"))
 		}
 	} else {
-		service.syslogger.Audit("pz-workflow", "gettingAllAlertsFailure", service.alertDB.mapping, "Service.GetAllAlerts: User failed to get all alerts")
+		service.syslogger.Audit(actor, "gettingAllAlertsFailure", AlertDBMapping, "Service.GetAllAlerts: User failed to get all alerts")
 		return service.statusBadRequest(errors.New("Malformed triggerId query parameter"))
 	}
 
@@ -1210,7 +1988,7 @@ func (service *Service) GetAllAlerts(params *piazza.HttpQueryParams) *piazza.Jso
 	if inflate {
 		alertExts, err := service.inflateAlerts(alerts)
 		if err != nil {
-			service.syslogger.Audit("pz-workflow", "gettingAllAlertsFailure", service.alertDB.mapping, "Service.GetAllAlerts: User failed to get all alerts")
+			service.syslogger.Audit(actor, "gettingAllAlertsFailure", AlertDBMapping, "Service.GetAllAlerts: User failed to get all alerts")
 			return service.statusInternalError(err)
 		}
 		resp = service.statusOK(*alertExts)
@@ -1218,7 +1996,7 @@ func (service *Service) GetAllAlerts(params *piazza.HttpQueryParams) *piazza.Jso
 		resp = service.statusOK(alerts)
 	}
 
-	service.syslogger.Audit("pz-workflow", "gotAllAlerts", service.alertDB.mapping, "Service.GetAllAlerts: User successfully got all alerts")
+	service.syslogger.Audit(actor, "gotAllAlerts", AlertDBMapping, "Service.GetAllAlerts: User successfully got all alerts")
 
 	format.Count = int(totalHits)
 	resp.Pagination = format
@@ -1226,7 +2004,7 @@ func (service *Service) GetAllAlerts(params *piazza.HttpQueryParams) *piazza.Jso
 	return resp
 }
 
-func (service *Service) QueryAlerts(dslString string, params *piazza.HttpQueryParams) *piazza.JsonResponse {
+func (service *Service) QueryAlerts(dslString string, params *piazza.HttpQueryParams, actor string) *piazza.JsonResponse {
 	defer service.handlePanic()
 	format, err := piazza.NewJsonPagination(params)
 	if err != nil {
@@ -1236,19 +2014,19 @@ func (service *Service) QueryAlerts(dslString string, params *piazza.HttpQueryPa
 	var alerts []Alert
 	var totalHits int64
 
-	service.syslogger.Audit("pz-workflow", "queryingAlerts", service.alertDB.mapping, "Service.QueryAlerts: User is querying alerts")
+	service.syslogger.Audit(actor, "queryingAlerts", AlertDBMapping, "Service.QueryAlerts: User is querying alerts")
 
 	dslString, err = format.SyncPagination(dslString)
 	if err != nil {
-		service.syslogger.Audit("pz-workflow", "queryingAlertsFailure", service.alertDB.mapping, "Service.QueryAlerts: syncPagination failed")
+		service.syslogger.Audit(actor, "queryingAlertsFailure", AlertDBMapping, "Service.QueryAlerts: syncPagination failed")
 		return service.statusBadRequest(err)
 	}
 	alerts, totalHits, err = service.alertDB.GetAlertsByDslQuery(dslString, "pz-workflow")
 	if err != nil {
-		service.syslogger.Audit("pz-workflow", "queryingAlertsFailure", service.alertDB.mapping, "Service.QueryAlerts: User failed to query alerts")
+		service.syslogger.Audit(actor, "queryingAlertsFailure", AlertDBMapping, "Service.QueryAlerts: User failed to query alerts")
 		return service.statusBadRequest(err)
 	} else if alerts == nil {
-		service.syslogger.Audit("pz-workflow", "queryingAlertsFailure", service.alertDB.mapping, "Service.QueryAlerts: User failed to query alerts")
+		service.syslogger.Audit(actor, "queryingAlertsFailure", AlertDBMapping, "Service.QueryAlerts: User failed to query alerts")
 		return service.statusInternalError(errors.New("QueryAlerts returned nil"))
 	}
 
@@ -1258,7 +2036,7 @@ func (service *Service) QueryAlerts(dslString string, params *piazza.HttpQueryPa
 	if inflate {
 		alertExts, err := service.inflateAlerts(alerts)
 		if err != nil {
-			service.syslogger.Audit("pz-workflow", "queryingAlertsFailure", service.alertDB.mapping, "Service.QueryAlerts: User failed to query alerts")
+			service.syslogger.Audit(actor, "queryingAlertsFailure", AlertDBMapping, "Service.QueryAlerts: User failed to query alerts")
 			return service.statusInternalError(err)
 		}
 		resp = service.statusOK(*alertExts)
@@ -1266,7 +2044,7 @@ func (service *Service) QueryAlerts(dslString string, params *piazza.HttpQueryPa
 		resp = service.statusOK(alerts)
 	}
 
-	service.syslogger.Audit("pz-workflow", "queriedAlerts", service.alertDB.mapping, "Service.QueryAlerts: User successfully queried alerts")
+	service.syslogger.Audit(actor, "queriedAlerts", AlertDBMapping, "Service.QueryAlerts: User successfully queried alerts")
 
 	format.Count = int(totalHits)
 	resp.Pagination = format
@@ -1314,12 +2092,14 @@ func (service *Service) inflateAlert(alert Alert) (*AlertExt, error) {
 		event = &Event{EventID: alert.EventID}
 	}
 	alertExt := &AlertExt{
-		AlertID:   alert.AlertID,
-		Trigger:   *trigger,
-		Event:     *event,
-		JobID:     alert.JobID,
-		CreatedBy: alert.CreatedBy,
-		CreatedOn: alert.CreatedOn,
+		AlertID:    alert.AlertID,
+		Trigger:    *trigger,
+		Event:      *event,
+		JobID:      alert.JobID,
+		CreatedBy:  alert.CreatedBy,
+		CreatedOn:  alert.CreatedOn,
+		Resolved:   alert.Resolved,
+		ResolvedOn: alert.ResolvedOn,
 	}
 	return alertExt, nil
 }
@@ -1344,22 +2124,80 @@ func (service *Service) PostAlert(alert *Alert) *piazza.JsonResponse {
 	return service.statusCreated(alert)
 }
 
-// DeleteAlert TODO
-func (service *Service) DeleteAlert(id piazza.Ident) *piazza.JsonResponse {
+// PutAlert marks an alert resolved, or not, if it is still at the ETag
+// ifMatch names. Only resolved alerts expire, and only they let the
+// retention sweeper delete their event.
+func (service *Service) PutAlert(id piazza.Ident, update *AlertUpdate, ifMatch string, actor string) *piazza.JsonResponse {
 	defer service.handlePanic()
-	service.syslogger.Audit("pz-workflow", "deletingAlert", id, "Service.DeleteAlert: User is deleteing alert [%s]", id)
+	alert, found, err := service.alertDB.GetOne(id, "pz-workflow")
+	if !found {
+		return service.statusNotFound(err)
+	}
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	if resp := service.checkETag(ifMatch, "alert", id, alert.Version); resp != nil {
+		return resp
+	}
+
+	service.syslogger.Audit(actor, "updatingAlert", id, "Service.PutAlert: User is updating alert [%s]", id)
 
-	ok, err := service.alertDB.DeleteByID(id, "pz-workflow")
+	if update.Resolved != alert.Resolved {
+		alert.Resolved = update.Resolved
+		alert.ResolvedOn = nil
+		if alert.Resolved {
+			now := piazza.NewTimeStamp()
+			alert.ResolvedOn = &now
+		}
+	}
+	if err = service.alertDB.PutData(alert, ifMatchVersion(ifMatch, alert.Version)); err != nil {
+		service.syslogger.Audit(actor, "updatingAlertFailure", id, "Service.PutAlert: User failed to update alert [%s]", id)
+		if err == errVersionConflict {
+			return service.versionConflict("alert", id, ifMatch)
+		}
+		return service.statusInternalError(err)
+	}
+
+	service.syslogger.Audit(actor, "updatedAlert", id, "Service.PutAlert: User successfully updated alert [%s] with resolved=[%v]", id, update.Resolved)
+
+	return service.statusOK(alert)
+}
+
+// DeleteAlert deletes an alert, if it is still at the ETag ifMatch names
+func (service *Service) DeleteAlert(id piazza.Ident, ifMatch string, actor string) *piazza.JsonResponse {
+	defer service.handlePanic()
+	var version int64
+	if ifMatch != "" {
+		alert, found, err := service.alertDB.GetOne(id, "pz-workflow")
+		if !found {
+			return service.statusNotFound(err)
+		}
+		if err != nil {
+			return service.statusBadRequest(err)
+		}
+		if resp := service.checkETag(ifMatch, "alert", id, alert.Version); resp != nil {
+			return resp
+		}
+		version = ifMatchVersion(ifMatch, alert.Version)
+	}
+
+	service.syslogger.Audit(actor, "deletingAlert", id, "Service.DeleteAlert: User is deleteing alert [%s]", id)
+
+	ok, err := service.alertDB.deleteAtVersion(id, version)
+	if err == errVersionConflict {
+		service.syslogger.Audit(actor, "deletingAlertFailure", id, "Service.DeleteAlert: User failed to delete alert [%s]", id)
+		return service.versionConflict("alert", id, ifMatch)
+	}
 	if !ok {
-		service.syslogger.Audit("pz-workflow", "deletingAlertFailure", id, "Service.DeleteAlert: User failed to delete alert [%s]", id)
+		service.syslogger.Audit(actor, "deletingAlertFailure", id, "Service.DeleteAlert: User failed to delete alert [%s]", id)
 		return service.statusNotFound(err)
 	}
 	if err != nil {
-		service.syslogger.Audit("pz-workflow", "deletingAlertFailure", id, "Service.DeleteAlert: User failed to delete alert [%s]", id)
+		service.syslogger.Audit(actor, "deletingAlertFailure", id, "Service.DeleteAlert: User failed to delete alert [%s]", id)
 		return service.statusBadRequest(err)
 	}
 
-	service.syslogger.Audit("pz-workflow", "deletedAlert", id, "Service.DeleteAlert: User successfully deleted alert [%s]", id)
+	service.syslogger.Audit(actor, "deletedAlert", id, "Service.DeleteAlert: User successfully deleted alert [%s]", id)
 
 	return service.statusOK(nil)
 }
@@ -1378,6 +2216,162 @@ func (service *Service) removeUniqueParams(uniqueKey string, inputObj map[string
 
 //---------------------------------------------------------------------
 
+func (service *Service) GetGeofence(id piazza.Ident, actor string) *piazza.JsonResponse {
+	defer service.handlePanic()
+	service.syslogger.Audit(actor, "gettingGeofence", id, "Service.GetGeofence: User is getting geofence [%s]", id)
+	geofence, found, err := service.geofenceDB.GetOne(id, "pz-workflow")
+	if !found {
+		service.syslogger.Audit(actor, "gettingGeofenceFailure", id, "Service.GetGeofence: User failed to get geofence [%s]", id)
+		return service.statusNotFound(err)
+	}
+	if err != nil {
+		service.syslogger.Audit(actor, "gettingGeofenceFailure", id, "Service.GetGeofence: User failed to get geofence [%s]", id)
+		return service.statusBadRequest(err)
+	}
+	service.syslogger.Audit(actor, "gotGeofence", id, "Service.GetGeofence: User successfully got geofence [%s]", id)
+
+	return service.statusOK(geofence)
+}
+
+func (service *Service) GetAllGeofences(params *piazza.HttpQueryParams, actor string) *piazza.JsonResponse {
+	defer service.handlePanic()
+	format, err := piazza.NewJsonPagination(params)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+
+	service.syslogger.Audit(actor, "gettingAllGeofences", service.geofenceDB.mapping, "Service.GetAllGeofences: User is getting all geofences")
+
+	geofences, totalHits, err := service.geofenceDB.GetAll(format, "pz-workflow")
+	if err != nil {
+		service.syslogger.Audit(actor, "gettingAllGeofencesFailure", service.geofenceDB.mapping, "Service.GetAllGeofences: User failed to get all geofences")
+		return service.statusInternalError(err)
+	} else if geofences == nil {
+		service.syslogger.Audit(actor, "gettingAllGeofencesFailure", service.geofenceDB.mapping, "Service.GetAllGeofences: User failed to get all geofences")
+		return service.statusInternalError(errors.New("GetAllGeofences returned nil"))
+	}
+	resp := service.statusOK(geofences)
+
+	service.syslogger.Audit(actor, "gotAllGeofences", service.geofenceDB.mapping, "Service.GetAllGeofences: User successfully got all geofences")
+
+	format.Count = int(totalHits)
+	resp.Pagination = format
+
+	return resp
+}
+
+func (service *Service) PostGeofence(geofence *Geofence) *piazza.JsonResponse {
+	defer service.handlePanic()
+	polygons, err := parseGeofenceGeometry(geofence.Geometry)
+	if err != nil {
+		return service.statusBadRequest(LoggedError("GeofenceDB.PostData failed: %s", err))
+	}
+	geofence.Bbox = geoPolygonsBbox(polygons)
+
+	geofence.GeofenceID = service.newIdent()
+	geofence.CreatedOn = piazza.NewTimeStamp()
+
+	service.syslogger.Audit(geofence.CreatedBy, "creatingGeofence", geofence.GeofenceID, "Service.PostGeofence: User [%s] is creating geofence [%s]", geofence.CreatedBy, geofence.GeofenceID)
+
+	if err = service.geofenceDB.PostData(geofence); err != nil {
+		service.syslogger.Audit(geofence.CreatedBy, "creatingGeofenceFailure", geofence.GeofenceID, "Service.PostGeofence: User [%s] failed to create geofence [%s]", geofence.CreatedBy, geofence.GeofenceID)
+		return service.statusInternalError(err)
+	}
+
+	service.syslogger.Audit(geofence.CreatedBy, "createdGeofence", geofence.GeofenceID, "Service.PostGeofence: User [%s] successfully created geofence [%s]", geofence.CreatedBy, geofence.GeofenceID)
+
+	return service.statusCreated(geofence)
+}
+
+// PutGeofence replaces the name and geometry of a geofence, and re-registers
+// the percolation queries of the triggers that refer to it
+func (service *Service) PutGeofence(id piazza.Ident, update *Geofence, actor string) *piazza.JsonResponse {
+	defer service.handlePanic()
+	geofence, found, err := service.geofenceDB.GetOne(id, "pz-workflow")
+	if !found {
+		return service.statusNotFound(err)
+	}
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	polygons, err := parseGeofenceGeometry(update.Geometry)
+	if err != nil {
+		return service.statusBadRequest(LoggedError("GeofenceDB.PutData failed: %s", err))
+	}
+
+	geofence.Name = update.Name
+	geofence.Geometry = update.Geometry
+	geofence.Bbox = geoPolygonsBbox(polygons)
+
+	service.syslogger.Audit(actor, "updatingGeofence", id, "Service.PutGeofence: User is updating geofence [%s]", id)
+
+	if err = service.geofenceDB.PutData(geofence); err != nil {
+		service.syslogger.Audit(actor, "updatingGeofenceFailure", id, "Service.PutGeofence: User failed to update geofence [%s]", id)
+		return service.statusInternalError(err)
+	}
+
+	triggers, err := service.triggerDB.GetTriggersByGeofenceID(id, "pz-workflow")
+	if err != nil {
+		service.syslogger.Audit(actor, "updatingGeofenceFailure", id, "Service.PutGeofence: User failed to update triggers of geofence [%s]", id)
+		return service.statusInternalError(err)
+	}
+	for i := range triggers {
+		trigger := &triggers[i]
+		eventType, found, err := service.eventTypeDB.GetOne(trigger.EventTypeID, "pz-workflow")
+		if !found || err != nil {
+			service.syslogger.Audit(actor, "updatingGeofenceFailure", id, "Service.PutGeofence: User failed to update trigger [%s] of geofence [%s]", trigger.TriggerID, id)
+			return service.statusInternalError(fmt.Errorf("eventType %s of trigger %s could not be found", trigger.EventTypeID, trigger.TriggerID))
+		}
+		condition, ok := prefixCondition(trigger.Condition, eventType.typeName())
+		if !ok {
+			return service.statusInternalError(fmt.Errorf("failed to parse query of trigger %s", trigger.TriggerID))
+		}
+		if err = service.refreshPercolation(trigger, condition); err != nil {
+			service.syslogger.Audit(actor, "updatingGeofenceFailure", id, "Service.PutGeofence: User failed to update trigger [%s] of geofence [%s]", trigger.TriggerID, id)
+			return service.statusInternalError(err)
+		}
+	}
+
+	service.syslogger.Audit(actor, "updatedGeofence", id, "Service.PutGeofence: User successfully updated geofence [%s] and its [%d] triggers", id, len(triggers))
+
+	return service.statusOK(geofence)
+}
+
+func (service *Service) DeleteGeofence(id piazza.Ident, actor string) *piazza.JsonResponse {
+	defer service.handlePanic()
+	if _, found, err := service.geofenceDB.GetOne(id, "pz-workflow"); !found {
+		service.syslogger.Audit(actor, "deletingGeofenceFailure", id, "Service.DeleteGeofence: failed to get geofence [%s]", id)
+		return service.statusNotFound(err)
+	}
+
+	triggers, err := service.triggerDB.GetTriggersByGeofenceID(id, "pz-workflow")
+	if err != nil {
+		return service.statusInternalError(err)
+	}
+	if len(triggers) > 0 {
+		return service.statusForbidden(errors.New("Deleting geofences that are in use is prohibited"))
+	}
+
+	service.syslogger.Audit(actor, "deletingGeofence", id, "Service.DeleteGeofence: User is deleting geofence [%s]", id)
+
+	ok, err := service.geofenceDB.DeleteByID(id, "pz-workflow")
+	if !ok {
+		service.syslogger.Audit(actor, "deletingGeofenceFailure", id, "Service.DeleteGeofence: User failed to delete geofence [%s]", id)
+		return service.statusNotFound(err)
+	}
+	if err != nil {
+		service.syslogger.Audit(actor, "deletingGeofenceFailure", id, "Service.DeleteGeofence: User failed to delete geofence [%s]", id)
+		return service.statusBadRequest(err)
+	}
+
+	service.syslogger.Audit(actor, "deletedGeofence", id, "Service.DeleteGeofence: User successfully deleted geofence [%s]", id)
+	service.deleteACL(id)
+
+	return service.statusOK(nil)
+}
+
+//---------------------------------------------------------------------
+
 // InitCron TODO
 func (service *Service) InitCron() error {
 	defer service.handlePanic()
@@ -1396,13 +2390,16 @@ func (service *Service) InitCron() error {
 			if !found || err != nil {
 				return LoggedError("WorkflowService.InitCron: Unable to retrieve event type for cron event %#v", e)
 			}
-			if err = service.cron.AddJob(e.CronSchedule, cronEvent{&e, eventType.Name, service}); err != nil {
+			if err = service.addCronJob(&e, eventType.typeName()); err != nil {
 				return LoggedError("WorkflowService.InitCron: Unable to register cron event %#v", e)
 			}
 		}
 	}
 
 	service.cron.Start()
+	service.cronLock.Lock()
+	service.cronStarted = true
+	service.cronLock.Unlock()
 
 	return nil
 }
@@ -1424,13 +2421,38 @@ func (c cronEvent) Run() {
 		CreatedOn:   piazza.NewTimeStamp(),
 		CreatedBy:   c.EventID.String(),
 	}
-	c.service.PostEvent(ev)
+	c.service.postEvent(ev, false, nil)
 }
 
 func (c cronEvent) Key() string {
 	return c.EventID.String()
 }
 
+// addCronJob schedules the repeating event, whose data is nested under the
+// name of its EventType
+func (service *Service) addCronJob(event *Event, eventTypeName string) error {
+	if err := service.cron.AddJob(event.CronSchedule, cronEvent{event, eventTypeName, service}); err != nil {
+		return err
+	}
+	service.cronLock.Lock()
+	service.cronJobs[event.EventID] = true
+	service.cronLock.Unlock()
+	return nil
+}
+
+func (service *Service) removeCronJob(id piazza.Ident) {
+	service.cron.Remove(id.String())
+	service.cronLock.Lock()
+	delete(service.cronJobs, id)
+	service.cronLock.Unlock()
+}
+
+func (service *Service) cronJobExists(id piazza.Ident) bool {
+	service.cronLock.Lock()
+	defer service.cronLock.Unlock()
+	return service.cronJobs[id]
+}
+
 //---------------------------------------------------------------------
 
 func (service *Service) TestElasticsearchVersion() *piazza.JsonResponse {
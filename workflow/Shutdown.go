@@ -0,0 +1,181 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// ShutdownTimeout is how long Kit.Stop waits for the triggers being fired
+var ShutdownTimeout = 30 * time.Second
+
+// inFlight is the work of the posted events not yet done: an entry for each
+// event, until its triggers have all been fired, and one for each trigger
+// being fired. Once draining, no more events are let in.
+type inFlight struct {
+	lock     sync.Mutex
+	draining bool
+	entries  map[*OutboxEntry]bool
+}
+
+func newInFlight() *inFlight {
+	return &inFlight{entries: map[*OutboxEntry]bool{}}
+}
+
+// admit tracks a posted event, unless draining
+func (f *inFlight) admit(entry *OutboxEntry) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.draining {
+		return false
+	}
+	f.track(entry)
+	return true
+}
+
+// track tracks the firing of a trigger by an admitted event, which goes on
+// while draining
+func (f *inFlight) track(entry *OutboxEntry) {
+	entry.StartedOn = piazza.NewTimeStamp()
+	f.entries[entry] = true
+}
+
+func (f *inFlight) trackFiring(entry *OutboxEntry) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.track(entry)
+}
+
+func (f *inFlight) setStage(entry *OutboxEntry, stage string, jobID piazza.Ident) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	entry.Stage = stage
+	entry.JobID = jobID
+}
+
+func (f *inFlight) done(entry *OutboxEntry) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.entries, entry)
+}
+
+func (f *inFlight) isDraining() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.draining
+}
+
+// drain lets no more events in, and waits until the work is done or the
+// timeout passes. It returns copies of the entries left.
+func (f *inFlight) drain(timeout time.Duration) []OutboxEntry {
+	f.lock.Lock()
+	f.draining = true
+	f.lock.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		f.lock.Lock()
+		if len(f.entries) == 0 || !time.Now().Before(deadline) {
+			left := []OutboxEntry{}
+			for entry := range f.entries {
+				left = append(left, *entry)
+			}
+			f.lock.Unlock()
+			return left
+		}
+		f.lock.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+//---------------------------------------------------------------------------
+
+// Shutdown stops the cron, lets no more events in, and waits up to timeout
+// for the triggers being fired. What is left unfinished goes into the
+// outbox, which is returned.
+func (service *Service) Shutdown(timeout time.Duration) ([]OutboxEntry, error) {
+	service.cronLock.Lock()
+	service.cron.Stop()
+	service.cronStarted = false
+	service.cronLock.Unlock()
+
+	left := service.inFlight.drain(timeout)
+	if len(left) == 0 {
+		return left, nil
+	}
+
+	service.syslogger.Warning("Shutdown error: %d unfinished when the service stopped, see GET /admin/outbox", len(left))
+	var err error
+	for i := range left {
+		entry := &left[i]
+		entry.EntryID = service.newIdent()
+		entry.CreatedOn = piazza.NewTimeStamp()
+		if err1 := service.outboxDB.PostData(entry); err1 != nil {
+			err = err1
+			continue
+		}
+		service.syslogger.Audit("pz-workflow", "createdOutboxEntry", entry.EntryID, "Service.Shutdown: event [%s] left %s, in outbox entry [%s]", entry.EventID, entry.Stage, entry.EntryID)
+	}
+	return left, err
+}
+
+// GetOutbox returns the work shutdowns left unfinished
+func (service *Service) GetOutbox(params *piazza.HttpQueryParams, actor string) *piazza.JsonResponse {
+	defer service.handlePanic()
+	format, err := piazza.NewJsonPagination(params)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+
+	service.syslogger.Audit(actor, "gettingOutbox", keyOutbox, "Service.GetOutbox: User is getting the outbox")
+
+	entries, totalHits, err := service.outboxDB.GetAll(format, "pz-workflow")
+	if err != nil {
+		service.syslogger.Audit(actor, "gettingOutboxFailure", keyOutbox, "Service.GetOutbox: User failed to get the outbox")
+		return service.statusInternalError(err)
+	} else if entries == nil {
+		service.syslogger.Audit(actor, "gettingOutboxFailure", keyOutbox, "Service.GetOutbox: User failed to get the outbox")
+		return service.statusInternalError(errors.New("GetOutbox returned nil"))
+	}
+
+	resp := service.statusOK(entries)
+	format.Count = int(totalHits)
+	resp.Pagination = format
+	return resp
+}
+
+// DeleteOutboxEntry dismisses an entry, once the work has been redone or
+// need not be
+func (service *Service) DeleteOutboxEntry(id piazza.Ident, actor string) *piazza.JsonResponse {
+	defer service.handlePanic()
+	service.syslogger.Audit(actor, "deletingOutboxEntry", id, "Service.DeleteOutboxEntry: User is deleting outbox entry [%s]", id)
+
+	found, err := service.outboxDB.DeleteByID(id, "pz-workflow")
+	if err != nil {
+		service.syslogger.Audit(actor, "deletingOutboxEntryFailure", id, "Service.DeleteOutboxEntry: User failed to delete outbox entry [%s]", id)
+		return service.statusBadRequest(err)
+	}
+	if !found {
+		service.syslogger.Audit(actor, "deletingOutboxEntryFailure", id, "Service.DeleteOutboxEntry: User failed to delete outbox entry [%s]", id)
+		return service.statusNotFound(errors.New("outbox entry " + id.String() + " not found"))
+	}
+
+	service.syslogger.Audit(actor, "deletedOutboxEntry", id, "Service.DeleteOutboxEntry: User successfully deleted outbox entry [%s]", id)
+	return service.statusOK(nil)
+}
@@ -0,0 +1,253 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// StatsDB keeps the counts of the events of each EventType, by hour, and of
+// the firings of each trigger. A count is incremented by a scripted upsert,
+// which Elasticsearch applies atomically. Where inline scripts are not
+// allowed, it is read, incremented and written back instead, under a lock
+// that only serializes the writes of this instance.
+type StatsDB struct {
+	*ResourceDB
+	lock sync.Mutex
+}
+
+func NewStatsDB(service *Service, esi elasticsearch.IIndex) (*StatsDB, error) {
+	rdb, err := NewResourceDB(service, esi)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsDB{ResourceDB: rdb}, nil
+}
+
+func eventTypeHourID(eventTypeID piazza.Ident, hour time.Time) string {
+	return eventTypeID.String() + ":" + hour.Format("2006010215")
+}
+
+// get reads a document into obj, and says whether there was one
+func (db *StatsDB) get(mapping string, id string, obj interface{}) (bool, error) {
+	ok, err := db.Esi.ItemExists(mapping, id)
+	if err != nil || !ok {
+		return false, err
+	}
+	getResult, err := db.Esi.GetByID(mapping, id)
+	if err != nil {
+		return false, err
+	}
+	if getResult == nil || getResult.Source == nil {
+		return false, nil
+	}
+	return getResult.Found, json.Unmarshal(*getResult.Source, obj)
+}
+
+// statsUpdateResponse is what an update answers, as far as StatsDB reads it
+type statsUpdateResponse struct {
+	ID    string      `json:"_id"`
+	Error interface{} `json:"error"`
+}
+
+// increment adds counts to the fields of the document and sets others, in
+// one request; upsert is the document as it is if there was none
+func (db *StatsDB) increment(mapping string, id string, counts map[string]int64, set map[string]interface{}, upsert interface{}) error {
+	params := map[string]interface{}{}
+	statements := []string{}
+	for field, n := range counts {
+		statements = append(statements, fmt.Sprintf("ctx._source.%s += %s", field, field))
+		params[field] = n
+	}
+	for field, v := range set {
+		statements = append(statements, fmt.Sprintf("ctx._source.%s = %s", field, field))
+		params[field] = v
+	}
+	sort.Strings(statements)
+	update := map[string]interface{}{
+		"script": map[string]interface{}{"inline": strings.Join(statements, "; "), "params": params},
+		"upsert": upsert,
+	}
+	endpoint := fmt.Sprintf("/%s/%s/%s/_update?retry_on_conflict=%d", db.Esi.IndexName(), mapping, id, statsUpdateRetries)
+	out := &statsUpdateResponse{}
+	if err := db.Esi.DirectAccess("POST", endpoint, update, out); err != nil {
+		return err
+	}
+	if out.Error == nil {
+		return nil
+	}
+	return db.incrementInPlace(mapping, id, counts, set, upsert)
+}
+
+// statsUpdateRetries is how often Elasticsearch tries an update again when
+// another changes the document under it
+const statsUpdateRetries = 5
+
+// incrementInPlace is increment for an Elasticsearch that runs no scripts
+func (db *StatsDB) incrementInPlace(mapping string, id string, counts map[string]int64, set map[string]interface{}, upsert interface{}) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	doc := map[string]interface{}{}
+	found, err := db.get(mapping, id, &doc)
+	if err != nil {
+		return err
+	}
+	if !found {
+		_, err = db.Esi.PutData(mapping, id, upsert)
+		return err
+	}
+	for field, n := range counts {
+		count, _ := doc[field].(float64)
+		doc[field] = int64(count) + n
+	}
+	for field, v := range set {
+		doc[field] = v
+	}
+	_, err = db.Esi.PutData(mapping, id, doc)
+	return err
+}
+
+// AddEvent counts an event of the EventType, in the hour of at
+func (db *StatsDB) AddEvent(eventTypeID piazza.Ident, at time.Time) error {
+	hour := at.UTC().Truncate(time.Hour)
+	upsert := &EventTypeHour{EventTypeID: eventTypeID, Hour: piazza.TimeStamp(hour), Events: 1}
+	counts := map[string]int64{"events": 1}
+	if err := db.increment(EventTypeHourDBMapping, eventTypeHourID(eventTypeID, hour), counts, nil, upsert); err != nil {
+		return LoggedError("StatsDB.AddEvent failed: %s", err)
+	}
+	return nil
+}
+
+// AddFiring counts a job sent for the trigger, or one that could not be
+func (db *StatsDB) AddFiring(triggerID piazza.Ident, at time.Time, failed bool) error {
+	on := piazza.TimeStamp(at)
+	upsert := &TriggerStats{TriggerID: triggerID}
+	var counts map[string]int64
+	var set map[string]interface{}
+	if failed {
+		upsert.DispatchFailures, upsert.LastFailedOn = 1, &on
+		counts, set = map[string]int64{"dispatchFailures": 1}, map[string]interface{}{"lastFailedOn": on}
+	} else {
+		upsert.Firings, upsert.LastFiredOn = 1, &on
+		counts, set = map[string]int64{"firings": 1}, map[string]interface{}{"lastFiredOn": on}
+	}
+	if err := db.increment(TriggerStatsDBMapping, triggerID.String(), counts, set, upsert); err != nil {
+		return LoggedError("StatsDB.AddFiring failed: %s", err)
+	}
+	return nil
+}
+
+// GetEventTypeHours returns the counts of the hours from from until to that
+// had events, oldest first
+func (db *StatsDB) GetEventTypeHours(eventTypeID piazza.Ident, from time.Time, to time.Time) ([]EventTypeHour, error) {
+	hours := []EventTypeHour{}
+	exists, err := db.Esi.TypeExists(EventTypeHourDBMapping)
+	if err != nil || !exists {
+		return hours, err
+	}
+
+	query, err := json.Marshal(map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must": []interface{}{
+					map[string]interface{}{"term": map[string]interface{}{"eventTypeId": eventTypeID}},
+					map[string]interface{}{"range": map[string]interface{}{"hour": map[string]interface{}{
+						"gte": piazza.TimeStamp(from),
+						"lte": piazza.TimeStamp(to),
+					}}},
+				},
+			},
+		},
+		"sort": []interface{}{map[string]interface{}{"hour": "asc"}},
+		"size": int(to.Sub(from)/time.Hour) + 1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	searchResult, err := db.Esi.SearchByJSON(EventTypeHourDBMapping, string(query))
+	if err != nil {
+		return nil, LoggedError("StatsDB.GetEventTypeHours failed: %s", err)
+	}
+	if searchResult != nil && searchResult.GetHits() != nil {
+		for _, hit := range *searchResult.GetHits() {
+			var hour EventTypeHour
+			if err := json.Unmarshal(*hit.Source, &hour); err != nil {
+				return nil, err
+			}
+			hours = append(hours, hour)
+		}
+	}
+	return hours, nil
+}
+
+// GetTriggerStats returns the trigger's counts, which are zero until it fires
+func (db *StatsDB) GetTriggerStats(triggerID piazza.Ident) (*TriggerStats, error) {
+	stats := &TriggerStats{TriggerID: triggerID}
+	if _, err := db.get(TriggerStatsDBMapping, triggerID.String(), stats); err != nil {
+		return nil, LoggedError("StatsDB.GetTriggerStats failed: %s", err)
+	}
+	return stats, nil
+}
+
+// DeleteEventType forgets the counts of the EventType
+func (db *StatsDB) DeleteEventType(eventTypeID piazza.Ident) error {
+	exists, err := db.Esi.TypeExists(EventTypeHourDBMapping)
+	if err != nil || !exists {
+		return err
+	}
+	ids := []string{}
+	err = exportPages("_uid", termQuery("eventTypeId", eventTypeID.String()), func(dsl string) (int, string, error) {
+		searchResult, err := db.Esi.SearchByJSON(EventTypeHourDBMapping, dsl)
+		if err != nil || searchResult == nil || searchResult.GetHits() == nil {
+			return 0, "", err
+		}
+		last := ""
+		for _, hit := range *searchResult.GetHits() {
+			ids = append(ids, hit.ID)
+			last = EventTypeHourDBMapping + "#" + hit.ID
+		}
+		return len(*searchResult.GetHits()), last, nil
+	})
+	if err != nil {
+		return LoggedError("StatsDB.DeleteEventType failed: %s", err)
+	}
+	for _, id := range ids {
+		if _, err = db.Esi.DeleteByID(EventTypeHourDBMapping, id); err != nil {
+			return LoggedError("StatsDB.DeleteEventType failed: %s", err)
+		}
+	}
+	return nil
+}
+
+// DeleteTrigger forgets the counts of the trigger
+func (db *StatsDB) DeleteTrigger(triggerID piazza.Ident) error {
+	exists, err := db.Esi.ItemExists(TriggerStatsDBMapping, triggerID.String())
+	if err != nil || !exists {
+		return err
+	}
+	if _, err = db.Esi.DeleteByID(TriggerStatsDBMapping, triggerID.String()); err != nil {
+		return LoggedError("StatsDB.DeleteTrigger failed: %s", err)
+	}
+	return nil
+}
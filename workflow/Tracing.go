@@ -0,0 +1,395 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/streadway/amqp"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// TraceParentHeader carries the trace context, in the W3C Trace Context
+// format, on HTTP requests and responses and on the AMQP messages of jobs
+const TraceParentHeader = "traceparent"
+
+// The kinds of span, numbered as OTLP numbers them
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+	SpanKindClient   = 3
+	SpanKindProducer = 4
+)
+
+// Span is a timed operation of a trace. IDs are in hex, as in traceparent.
+type Span struct {
+	TraceID    string            `json:"traceId"`
+	SpanID     string            `json:"spanId"`
+	ParentID   string            `json:"parentSpanId,omitempty"`
+	Name       string            `json:"name"`
+	Kind       int               `json:"kind"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+
+	tracer *tracer
+}
+
+// SpanExporter sends finished spans on, a batch at a time
+type SpanExporter interface {
+	ExportSpans(spans []*Span) error
+}
+
+//---------------------------------------------------------------------------
+
+// tracer starts spans and exports them once they end. A span's parent is
+// handed to it: a request's span goes from the handler to the service
+// methods that trace what they do for it. The calls to Elasticsearch are
+// made through IIndex, which carries no span, so each is a trace of its own.
+type tracer struct {
+	lock     sync.Mutex
+	exporter SpanExporter
+	pending  []*Span
+}
+
+// spans are exported every tracerFlushInterval, or once there are
+// tracerBatchSize of them; past tracerMaxPending, they are dropped
+const (
+	tracerFlushInterval = 5 * time.Second
+	tracerBatchSize     = 512
+	tracerMaxPending    = 8 * tracerBatchSize
+)
+
+func newTracer(exporter SpanExporter) *tracer {
+	t := &tracer{exporter: exporter}
+	go func() {
+		for range time.Tick(tracerFlushInterval) {
+			t.flush()
+		}
+	}()
+	return t
+}
+
+// newTracerFromEnv exports to where $PZ_WORKFLOW_TRACES says: "stdout", or
+// "otlp" for the collector at $OTEL_EXPORTER_OTLP_ENDPOINT. Otherwise, there
+// are no spans.
+func newTracerFromEnv() *tracer {
+	switch os.Getenv("PZ_WORKFLOW_TRACES") {
+	case "stdout":
+		return newTracer(&StdoutSpanExporter{Writer: os.Stdout})
+	case "otlp":
+		return newTracer(NewOtlpSpanExporter(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")))
+	}
+	return newTracer(nil)
+}
+
+// setExporter changes where spans go; nil stops tracing
+func (t *tracer) setExporter(exporter SpanExporter) {
+	t.flush()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.exporter = exporter
+}
+
+// start starts a span, which is nil if there is no exporter. Without a
+// parent, it starts a trace.
+func (t *tracer) start(name string, kind int, parent *Span) *Span {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.exporter == nil {
+		return nil
+	}
+	span := &Span{
+		SpanID: newTraceID(8),
+		Name:   name,
+		Kind:   kind,
+		Start:  time.Now(),
+		tracer: t,
+	}
+	if parent != nil {
+		span.TraceID = parent.TraceID
+		span.ParentID = parent.SpanID
+	} else {
+		span.TraceID = newTraceID(16)
+	}
+	return span
+}
+
+// startRemote starts a span continuing the trace of a traceparent, or a new
+// trace if it is not a valid one
+func (t *tracer) startRemote(name string, kind int, traceParent string) *Span {
+	return t.start(name, kind, parseTraceParent(traceParent))
+}
+
+// flush exports the finished spans
+func (t *tracer) flush() {
+	t.lock.Lock()
+	exporter := t.exporter
+	spans := t.pending
+	t.pending = nil
+	t.lock.Unlock()
+
+	if exporter == nil || len(spans) == 0 {
+		return
+	}
+	if err := exporter.ExportSpans(spans); err != nil {
+		log.Printf("Tracing error: %d spans not exported: %s", len(spans), err)
+	}
+}
+
+// set adds an attribute
+func (span *Span) set(key string, value string) {
+	if span == nil {
+		return
+	}
+	if span.Attributes == nil {
+		span.Attributes = map[string]string{}
+	}
+	span.Attributes[key] = value
+}
+
+// end ends the span, which failed if err is not nil
+func (span *Span) end(err error) {
+	if span == nil {
+		return
+	}
+	span.End = time.Now()
+	if err != nil {
+		span.Error = err.Error()
+	}
+
+	t := span.tracer
+	t.lock.Lock()
+	full := len(t.pending) >= tracerBatchSize
+	if len(t.pending) < tracerMaxPending {
+		t.pending = append(t.pending, span)
+	}
+	t.lock.Unlock()
+
+	if full {
+		go t.flush()
+	}
+}
+
+// traceParent is the span as the parent of a span elsewhere
+func (span *Span) traceParent() string {
+	if span == nil {
+		return ""
+	}
+	return "00-" + span.TraceID + "-" + span.SpanID + "-01"
+}
+
+// parseTraceParent is a parent span for a traceparent, or nil
+func parseTraceParent(traceParent string) *Span {
+	parts := strings.Split(strings.TrimSpace(traceParent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		!isTraceID(parts[1], 16) || !isTraceID(parts[2], 8) {
+		return nil
+	}
+	return &Span{TraceID: parts[1], SpanID: parts[2]}
+}
+
+// isTraceID says whether s is the hex of a nonzero ID of n bytes
+func isTraceID(s string, n int) bool {
+	byts, err := hex.DecodeString(s)
+	if err != nil || len(byts) != n {
+		return false
+	}
+	for _, b := range byts {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func newTraceID(n int) string {
+	byts := make([]byte, n)
+	if _, err := rand.Read(byts); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(byts)
+}
+
+//---------------------------------------------------------------------------
+
+// requestSpanKey is where trace keeps the request's span in its gin.Context
+const requestSpanKey = "pz-workflow.span"
+
+// trace puts each request in a span, under its route, continuing the trace
+// of its traceparent. The response's traceparent is the request's span.
+func (server *Server) trace(route piazza.RouteData) gin.HandlerFunc {
+	handler := route.Handler
+	return func(c *gin.Context) {
+		span := server.service.tracer.startRemote(route.Verb+" "+route.Path, SpanKindServer, c.Request.Header.Get(TraceParentHeader))
+		if span != nil {
+			span.set("http.method", route.Verb)
+			span.set("http.route", route.Path)
+			c.Header(TraceParentHeader, span.traceParent())
+			c.Set(requestSpanKey, span)
+		}
+		handler(c)
+		if span != nil {
+			status := c.Writer.Status()
+			span.set("http.status_code", strconv.Itoa(status))
+			var err error
+			if status >= http.StatusInternalServerError {
+				err = fmt.Errorf("%d %s", status, http.StatusText(status))
+			}
+			span.end(err)
+		}
+	}
+}
+
+// requestSpan is the span trace put the request in, or nil
+func requestSpan(c *gin.Context) *Span {
+	span, _ := c.Get(requestSpanKey)
+	out, _ := span.(*Span)
+	return out
+}
+
+// traceHeaders are the AMQP headers that let the job manager continue the
+// trace of the span
+func traceHeaders(span *Span) amqp.Table {
+	if span == nil {
+		return nil
+	}
+	return amqp.Table{TraceParentHeader: span.traceParent()}
+}
+
+//---------------------------------------------------------------------------
+
+// StdoutSpanExporter writes each span as a line of JSON
+type StdoutSpanExporter struct {
+	Writer io.Writer
+	lock   sync.Mutex
+}
+
+func (exporter *StdoutSpanExporter) ExportSpans(spans []*Span) error {
+	exporter.lock.Lock()
+	defer exporter.lock.Unlock()
+	encoder := json.NewEncoder(exporter.Writer)
+	for _, span := range spans {
+		if err := encoder.Encode(span); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OtlpSpanExporter posts spans to an OpenTelemetry collector, in the JSON
+// encoding of OTLP/HTTP
+type OtlpSpanExporter struct {
+	URL    string
+	client *http.Client
+}
+
+// NewOtlpSpanExporter exports to the collector at endpoint, by default the
+// one on this host
+func NewOtlpSpanExporter(endpoint string) *OtlpSpanExporter {
+	if endpoint == "" {
+		endpoint = "http://localhost:4318"
+	}
+	return &OtlpSpanExporter{
+		URL:    strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type otlpAttribute struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string                 `json:"traceId"`
+	SpanID            string                 `json:"spanId"`
+	ParentSpanID      string                 `json:"parentSpanId,omitempty"`
+	Name              string                 `json:"name"`
+	Kind              int                    `json:"kind"`
+	StartTimeUnixNano string                 `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string                 `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute        `json:"attributes,omitempty"`
+	Status            map[string]interface{} `json:"status,omitempty"`
+}
+
+func otlpAttributes(attributes map[string]string) []otlpAttribute {
+	out := []otlpAttribute{}
+	for key, value := range attributes {
+		out = append(out, otlpAttribute{Key: key, Value: map[string]string{"stringValue": value}})
+	}
+	return out
+}
+
+func (exporter *OtlpSpanExporter) ExportSpans(spans []*Span) error {
+	out := []otlpSpan{}
+	for _, span := range spans {
+		o := otlpSpan{
+			TraceID:           span.TraceID,
+			SpanID:            span.SpanID,
+			ParentSpanID:      span.ParentID,
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.Attributes),
+		}
+		if span.Error != "" {
+			// STATUS_CODE_ERROR
+			o.Status = map[string]interface{}{"code": 2, "message": span.Error}
+		}
+		out = append(out, o)
+	}
+	byts, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]string{"service.name": string(piazza.PzWorkflow)}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": string(piazza.PzWorkflow)},
+				"spans": out,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := exporter.client.Post(exporter.URL, piazza.ContentTypeJSON, bytes.NewReader(byts))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s answered %s", exporter.URL, resp.Status)
+	}
+	return nil
+}
@@ -40,81 +40,134 @@ func NewTriggerDB(service *Service, esi elasticsearch.IIndex) (*TriggerDB, error
 }
 
 func (db *TriggerDB) PostData(trigger *Trigger) error {
-	{ //CHECK SERVICE EXISTS
-		serviceID := trigger.Job.JobType.Data["serviceId"]
-		strServiceID, ok := serviceID.(string)
-		if !ok {
-			return LoggedError("TriggerDB.PostData failed: serviceId field not of type string")
-		}
-		if domain := os.Getenv("DOMAIN"); domain != "" {
-			serviceControllerURL := "https://pz-servicecontroller." + domain
-			// TODO:
-			// if err is nil, we have a servicecontroller to talk to
-			// if err is not nil, we'll assume we are mocking (which means
-			// we have no servicecontroller client to mock)
-			response, err := http.Get(fmt.Sprintf("%s/service/%s", serviceControllerURL, strServiceID))
-			if err != nil {
-				return LoggedError("TriggerDB.PostData failed to make request to ServiceController: %s", err)
-			}
-			// On error, this should close on it's own
-			defer func() {
-				err = response.Body.Close()
-				if err != nil {
-					panic(err) // TODO: defer doesn't handle errs well
-				}
-			}()
-			if response.StatusCode != 200 {
-				return LoggedError("TriggerDB.PostData failed: serviceID %s does not exist", strServiceID)
-			}
-		}
+	if err := checkTriggerService(trigger); err != nil {
+		return err
 	}
 
 	//log.Printf("Query: %v", wrapper)
-	body, err := json.Marshal(trigger.Condition)
+	body, err := db.service.percolationQuery(trigger.Condition, trigger.EventTypeID)
 	if err != nil {
 		return err
 	}
 
 	//log.Printf("Posting percolation query: %s", body)
-	indexResult, err := db.service.eventDB.Esi.AddPercolationQuery(trigger.TriggerID.String(), piazza.JsonString(body))
+	percolationID, err := db.service.eventDB.AddPercolationQuery(trigger.TriggerID, body)
 	if err != nil {
-		var errMessage string
-		if strings.Contains(err.Error(), "elastic: Error 500 (Internal Server Error): failed to parse query") {
-			errMessage = fmt.Sprintf("TriggerDB.PostData addpercquery failed: elastic failed to parse query. Common causes: [Variables do not start with 'data.' or are not found at your specified path, invalid perc query structure].")
-		} else {
-			errMessage = fmt.Sprintf("TriggerDB.PostData addpercquery failed [unknown cause]: %s ", err)
-		}
-		return LoggedError(errMessage)
-	}
-	if indexResult == nil {
-		return LoggedError("TriggerDB.PostData addpercquery failed: no indexResult")
-	}
-	if !indexResult.Created {
-		return LoggedError("TriggerDB.PostData addpercquery failed: not created")
+		return percolationError(err)
 	}
 
-	//log.Printf("percolation query added: ID: %s, Type: %s, Index: %s", indexResult.Id, indexResult.Type, indexResult.Index)
-	//log.Printf("percolation id: %s", indexResult.Id)
-	trigger.PercolationID = piazza.Ident(indexResult.ID)
+	//log.Printf("percolation id: %s", percolationID)
+	trigger.PercolationID = percolationID
 
 	trigger.Condition = encodeCondition(trigger.Condition).(map[string]interface{})
 
+	// the index gives the version
+	trigger.Version = 0
 	indexResult2, err := db.Esi.PostData(db.mapping, trigger.TriggerID.String(), trigger)
 	if err != nil {
-		_, _ = db.service.eventDB.Esi.DeletePercolationQuery(trigger.TriggerID.String())
+		_, _ = db.service.eventDB.DeletePercolationQuery(trigger.TriggerID)
 		return LoggedError("TriggerDB.PostData failed: %s", err)
 	}
 	if !indexResult2.Created {
-		_, _ = db.service.eventDB.Esi.DeletePercolationQuery(trigger.TriggerID.String())
+		_, _ = db.service.eventDB.DeletePercolationQuery(trigger.TriggerID)
 		return LoggedError("TriggerDB.PostData failed: not created")
 	}
+	trigger.Version = int64(indexResult2.Version)
+
+	return nil
+}
 
+// checkTriggerService makes sure the service the trigger's job runs exists,
+// when there is a servicecontroller to ask
+func checkTriggerService(trigger *Trigger) error {
+	serviceID := trigger.Job.JobType.Data["serviceId"]
+	strServiceID, ok := serviceID.(string)
+	if !ok {
+		return LoggedError("TriggerDB.PostData failed: serviceId field not of type string")
+	}
+	if domain := os.Getenv("DOMAIN"); domain != "" {
+		serviceControllerURL := "https://pz-servicecontroller." + domain
+		// TODO:
+		// if err is nil, we have a servicecontroller to talk to
+		// if err is not nil, we'll assume we are mocking (which means
+		// we have no servicecontroller client to mock)
+		response, err := http.Get(fmt.Sprintf("%s/service/%s", serviceControllerURL, strServiceID))
+		if err != nil {
+			return LoggedError("TriggerDB.PostData failed to make request to ServiceController: %s", err)
+		}
+		// On error, this should close on it's own
+		defer func() {
+			err = response.Body.Close()
+			if err != nil {
+				panic(err) // TODO: defer doesn't handle errs well
+			}
+		}()
+		if response.StatusCode != 200 {
+			return LoggedError("TriggerDB.PostData failed: serviceID %s does not exist", strServiceID)
+		}
+	}
 	return nil
 }
 
-func (db *TriggerDB) PutTrigger(trigger *Trigger, update *TriggerUpdate, actor string) (*Trigger, error) {
+// percolationError explains why a percolation query was refused
+func percolationError(err error) error {
+	var errMessage string
+	if strings.Contains(err.Error(), "elastic: Error 500 (Internal Server Error): failed to parse query") {
+		errMessage = fmt.Sprintf("TriggerDB.PostData addpercquery failed: elastic failed to parse query. Common causes: [Variables do not start with 'data.' or are not found at your specified path, invalid perc query structure].")
+	} else {
+		errMessage = fmt.Sprintf("TriggerDB.PostData addpercquery failed [unknown cause]: %s ", err)
+	}
+	return LoggedError(errMessage)
+}
+
+// percolationQuery is what gets registered for a trigger: its condition, with
+// any geofence references replaced by the geofences' current geometry
+func (service *Service) percolationQuery(condition map[string]interface{}, eventTypeID piazza.Ident) (piazza.JsonString, error) {
+	query, err := service.expandGeofenceRefs(condition, eventTypeID)
+	if err != nil {
+		return "", LoggedError("TriggerDB.PostData failed: %s", err)
+	}
+	body, err := json.Marshal(query)
+	if err != nil {
+		return "", err
+	}
+	return piazza.JsonString(body), nil
+}
+
+// refreshPercolation registers the trigger's percolation query again, so that
+// it picks up changes to the geofences it refers to. The condition is given
+// with the eventType prefix applied.
+func (service *Service) refreshPercolation(trigger *Trigger, condition map[string]interface{}) error {
+	body, err := service.percolationQuery(condition, trigger.EventTypeID)
+	if err != nil {
+		return err
+	}
+	if _, err = service.eventDB.AddPercolationQuery(trigger.TriggerID, body); err != nil {
+		return LoggedError("TriggerDB.RefreshPercolation failed: %s", err)
+	}
+	return nil
+}
+
+// addPercolation registers the trigger's percolation query with the given
+// events index, which is not the current one while reindexing
+func (db *TriggerDB) addPercolation(esi elasticsearch.IIndex, trigger *Trigger, condition map[string]interface{}) error {
+	body, err := db.service.percolationQuery(condition, trigger.EventTypeID)
+	if err != nil {
+		return err
+	}
+	if _, err = esi.AddPercolationQuery(trigger.TriggerID.String(), body); err != nil {
+		return LoggedError("TriggerDB.RefreshPercolation failed: %s", err)
+	}
+	return nil
+}
+
+// PutTrigger writes the update of the trigger over the version of it, or
+// over any if that is 0, and gives it the version it now is
+func (db *TriggerDB) PutTrigger(trigger *Trigger, update *TriggerUpdate, version int64, actor string) (*Trigger, error) {
 	trigger.Enabled = update.Enabled
-	strTrigger, err := piazza.StructInterfaceToString(*trigger)
+	stored := *trigger
+	stored.Version = 0
+	strTrigger, err := piazza.StructInterfaceToString(stored)
 	if err != nil {
 		return trigger, LoggedError("TriggerDB.PutData failed: %s", err)
 	}
@@ -128,10 +181,14 @@ func (db *TriggerDB) PutTrigger(trigger *Trigger, update *TriggerUpdate, actor s
 	}
 	fixedTrigger := handleDotTilde(mapTrigger, func(in string) string { return strings.Replace(in, ".", "~", -1) })
 
-	_, err = db.Esi.PutData(db.mapping, trigger.TriggerID.String(), fixedTrigger)
+	newVersion, err := db.putVersioned(db.mapping, trigger.TriggerID, fixedTrigger, version)
+	if err == errVersionConflict {
+		return trigger, err
+	}
 	if err != nil {
 		return trigger, LoggedError("TriggerDB.PutData failed: %s", err)
 	}
+	trigger.Version = newVersion
 	return trigger, nil
 }
 
@@ -204,23 +261,20 @@ func (db *TriggerDB) GetTriggersByDslQuery(dslString string, actor string) ([]Tr
 }
 
 func (db *TriggerDB) GetOne(id piazza.Ident, actor string) (*Trigger, bool, error) {
-	getResult, err := db.Esi.GetByID(db.mapping, id.String())
+	src, version, found, err := db.getVersioned(db.mapping, id)
 	if err != nil {
 		return nil, false, LoggedError("TriggerDB.GetOne failed: %s", err)
 	}
-	if getResult == nil {
-		return nil, false, LoggedError("TriggerDB.GetOne failed: no getResult")
-	}
 
-	src := getResult.Source
 	var trigger Trigger
 	if err = json.Unmarshal(*src, &trigger); err != nil {
-		return nil, getResult.Found, LoggedError("TriggerDB.GetOne failed: %s", err)
+		return nil, found, LoggedError("TriggerDB.GetOne failed: %s", err)
 	}
+	trigger.Version = version
 
 	trigger.Condition = decodeCondition(trigger.Condition).(map[string]interface{})
 
-	return &trigger, getResult.Found, nil
+	return &trigger, found, nil
 }
 
 func (db *TriggerDB) GetTriggersByEventTypeID(format *piazza.JsonPagination, id piazza.Ident, actor string) ([]Trigger, int64, error) {
@@ -254,7 +308,18 @@ func (db *TriggerDB) GetTriggersByEventTypeID(format *piazza.JsonPagination, id
 	return triggers, searchResult.TotalHits(), nil
 }
 
-func (db *TriggerDB) DeleteTrigger(id piazza.Ident, actor string) (bool, error) {
+// GetTriggersByGeofenceID returns the triggers that refer to the geofence
+func (db *TriggerDB) GetTriggersByGeofenceID(id piazza.Ident, actor string) ([]Trigger, error) {
+	return getTriggersByGeofenceID(db, id, actor)
+}
+
+func (db *TriggerDB) itemExists(id piazza.Ident, actor string) (bool, error) {
+	return db.Esi.ItemExists(db.mapping, id.String())
+}
+
+// DeleteTrigger deletes the trigger at the version, or at any if that is 0,
+// with its percolation query
+func (db *TriggerDB) DeleteTrigger(id piazza.Ident, version int64, actor string) (bool, error) {
 	trigger, found, err := db.GetOne(id, actor)
 	if err != nil {
 		return found, err
@@ -263,26 +328,23 @@ func (db *TriggerDB) DeleteTrigger(id piazza.Ident, actor string) (bool, error)
 		return false, nil
 	}
 
-	deleteResult, err := db.Esi.DeleteByID(db.mapping, string(id))
-	if err != nil {
-		return deleteResult.Found, LoggedError("TriggerDB.DeleteById failed: %s", err)
+	found, err = db.deleteVersioned(db.mapping, id, version)
+	if err == errVersionConflict {
+		return found, err
 	}
-	if deleteResult == nil {
-		return false, LoggedError("TriggerDB.DeleteById failed: no deleteResult")
+	if err != nil {
+		return found, LoggedError("TriggerDB.DeleteById failed: %s", err)
 	}
-	if !deleteResult.Found {
+	if !found {
 		return false, nil
 	}
 
-	deleteResult2, err := db.service.eventDB.Esi.DeletePercolationQuery(string(trigger.PercolationID))
+	found, err = db.service.eventDB.DeletePercolationQuery(trigger.PercolationID)
 	if err != nil {
-		return deleteResult2.Found, LoggedError("TriggerDB.DeleteById percquery failed: %s", err)
-	}
-	if deleteResult2 == nil {
-		return false, LoggedError("TriggerDB.DeleteById percquery failed: no deleteResult")
+		return found, LoggedError("TriggerDB.DeleteById percquery failed: %s", err)
 	}
 
-	return deleteResult2.Found, nil
+	return found, nil
 }
 
 func encodeCondition(in interface{}) interface{} {
@@ -15,9 +15,11 @@
 package workflow
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"sync/atomic"
 
 	"github.com/venicegeo/pz-gocommon/gocommon"
 )
@@ -44,12 +46,15 @@ type Trigger struct {
 	TriggerID     piazza.Ident           `json:"triggerId"`
 	Name          string                 `json:"name" binding:"required"`
 	EventTypeID   piazza.Ident           `json:"eventTypeId" binding:"required"`
+	Namespace     string                 `json:"namespace"`
 	Condition     map[string]interface{} `json:"condition" binding:"required"`
 	Job           JobRequest             `json:"job" binding:"required"`
 	PercolationID piazza.Ident           `json:"percolationId"`
 	CreatedBy     string                 `json:"createdBy"`
 	CreatedOn     piazza.TimeStamp       `json:"createdOn"`
 	Enabled       bool                   `json:"enabled"`
+	Geofence      *GeofenceCondition     `json:"geofence,omitempty"`
+	Version       int64                  `json:"version,omitempty"`
 }
 type TriggerUpdate struct {
 	Enabled bool `json:"enabled"`
@@ -58,6 +63,14 @@ type TriggerUpdate struct {
 // TriggerList is a list of triggers
 type TriggerList []Trigger
 
+// TriggerTestResult tells whether an event would fire a trigger, and if not,
+// why not
+type TriggerTestResult struct {
+	TriggerID piazza.Ident `json:"triggerId"`
+	Matched   bool         `json:"matched"`
+	Reason    string       `json:"reason,omitempty"`
+}
+
 //-EVENT------------------------------------------------------------------------
 
 const EventDBMapping string = "_default_"
@@ -85,14 +98,43 @@ const EventTypeDBMapping string = "EventType"
 type EventType struct {
 	EventTypeID piazza.Ident           `json:"eventTypeId"`
 	Name        string                 `json:"name" binding:"required"`
+	Namespace   string                 `json:"namespace"`
 	Mapping     map[string]interface{} `json:"mapping" binding:"required"`
 	CreatedBy   string                 `json:"createdBy"`
 	CreatedOn   piazza.TimeStamp       `json:"createdOn"`
+	Retention   *Retention             `json:"retention,omitempty"`
+	Version     int64                  `json:"version,omitempty"`
+}
+
+// EventTypeUpdate is what PUT /eventType/:id may change; a nil Retention
+// keeps events forever
+type EventTypeUpdate struct {
+	Retention *Retention `json:"retention"`
+}
+
+// Retention limits how long the events of an EventType, and the resolved
+// alerts of its triggers, are kept. The ages are durations such as "720h";
+// the counts keep only the newest. Zero means no limit. Events referred to
+// by unresolved alerts are kept regardless.
+type Retention struct {
+	MaxAge        string `json:"maxAge,omitempty"`
+	MaxCount      int    `json:"maxCount,omitempty"`
+	AlertMaxAge   string `json:"alertMaxAge,omitempty"`
+	AlertMaxCount int    `json:"alertMaxCount,omitempty"`
 }
 
 // EventTypeList is a list of EventTypes
 type EventTypeList []EventType
 
+// EventTypeCascade lists, by ExportKind, the ids of what a cascading delete
+// of an EventType removed along with it. MappingRemoved is false when the
+// events index would not give up the EventType's mapping.
+type EventTypeCascade struct {
+	EventTypeID    piazza.Ident              `json:"eventTypeId"`
+	Removed        map[string][]piazza.Ident `json:"removed"`
+	MappingRemoved bool                      `json:"mappingRemoved"`
+}
+
 //-ALERT------------------------------------------------------------------------
 
 // AlertDBMapping is the name of the Elasticsearch type to which Alerts are added
@@ -100,40 +142,434 @@ const AlertDBMapping string = "Alert"
 
 // Alert is a notification, automatically created when a Trigger happens
 type Alert struct {
-	AlertID   piazza.Ident     `json:"alertId"`
-	TriggerID piazza.Ident     `json:"triggerId"`
-	EventID   piazza.Ident     `json:"eventId"`
-	JobID     piazza.Ident     `json:"jobId"`
-	CreatedBy string           `json:"createdBy"`
-	CreatedOn piazza.TimeStamp `json:"createdOn"`
+	AlertID    piazza.Ident      `json:"alertId"`
+	TriggerID  piazza.Ident      `json:"triggerId"`
+	EventID    piazza.Ident      `json:"eventId"`
+	JobID      piazza.Ident      `json:"jobId"`
+	CreatedBy  string            `json:"createdBy"`
+	CreatedOn  piazza.TimeStamp  `json:"createdOn"`
+	Resolved   bool              `json:"resolved"`
+	ResolvedOn *piazza.TimeStamp `json:"resolvedOn,omitempty"`
+	Version    int64             `json:"version,omitempty"`
 }
 
 type AlertExt struct {
-	AlertID   piazza.Ident     `json:"alertId"`
-	Trigger   Trigger          `json:"trigger" binding:"required"`
-	Event     Event            `json:"event" binding:"required"`
-	JobID     piazza.Ident     `json:"jobId"`
-	CreatedBy string           `json:"createdBy"`
-	CreatedOn piazza.TimeStamp `json:"createdOn"`
+	AlertID    piazza.Ident      `json:"alertId"`
+	Trigger    Trigger           `json:"trigger" binding:"required"`
+	Event      Event             `json:"event" binding:"required"`
+	JobID      piazza.Ident      `json:"jobId"`
+	CreatedBy  string            `json:"createdBy"`
+	CreatedOn  piazza.TimeStamp  `json:"createdOn"`
+	Resolved   bool              `json:"resolved"`
+	ResolvedOn *piazza.TimeStamp `json:"resolvedOn,omitempty"`
+}
+
+// AlertUpdate is what PUT /alert/:id may change
+type AlertUpdate struct {
+	Resolved bool `json:"resolved"`
 }
 
 //-CRON-------------------------------------------------------------------------
 
 const CronDBMapping = "Cron"
 
+//-GEOFENCE---------------------------------------------------------------------
+
+// GeofenceDBMapping is the name of the Elasticsearch type to which Geofences are added
+const GeofenceDBMapping string = "Geofence"
+
+// GeofenceStateDBMapping is the name of the Elasticsearch type holding the
+// last known position of each entity tracked by a geofence trigger
+const GeofenceStateDBMapping string = "GeofenceState"
+
+// The relations a GeofenceCondition can test for
+const (
+	GeofenceRelationEnter      = "enter"
+	GeofenceRelationExit       = "exit"
+	GeofenceRelationInside     = "inside"
+	GeofenceRelationIntersects = "intersects"
+)
+
+// Geofence is a named area of interest, given as a GeoJSON Polygon or MultiPolygon.
+// Bbox is computed by the service, as [minX, minY, maxX, maxY].
+//
+// Besides the GeofenceCondition of a Trigger, a Trigger's Condition may refer
+// to a geofence in place of coordinates, with a clause of the form
+//
+//	{"geofence": {"data.<field>": "<geofenceId>"}}
+//
+// or
+//
+//	{"geofence": {"data.<field>": {"geofenceId": "<geofenceId>", "relation": "within"}}}
+//
+// where the field is a geo_point or geo_shape variable and the relation one of
+// intersects (the default), within or disjoint. Updating the geofence updates
+// every Trigger that refers to it.
+type Geofence struct {
+	GeofenceID piazza.Ident           `json:"geofenceId"`
+	Name       string                 `json:"name" binding:"required"`
+	Geometry   map[string]interface{} `json:"geometry" binding:"required"`
+	Bbox       []float64              `json:"bbox"`
+	CreatedBy  string                 `json:"createdBy"`
+	CreatedOn  piazza.TimeStamp       `json:"createdOn"`
+}
+
+// GeofenceList is a list of geofences
+type GeofenceList []Geofence
+
+// GeofenceCondition restricts a Trigger to events whose location stands in
+// the given relation to a Geofence.
+// Field names the geo_point or geo_shape variable of the EventType to test; if
+// empty, the first such variable is used, falling back to the minX/minY/maxX/maxY
+// bounding box carried by ingest events.
+// EntityKey names the variable identifying the tracked entity, and is required
+// for the enter and exit relations.
+type GeofenceCondition struct {
+	GeofenceID piazza.Ident `json:"geofenceId"`
+	Field      string       `json:"field"`
+	Relation   string       `json:"relation"`
+	EntityKey  string       `json:"entityKey,omitempty"`
+}
+
+// GeofenceState records whether an entity was inside a trigger's geofence
+// the last time it was seen
+type GeofenceState struct {
+	TriggerID piazza.Ident     `json:"triggerId"`
+	Entity    string           `json:"entity"`
+	Inside    bool             `json:"inside"`
+	UpdatedOn piazza.TimeStamp `json:"updatedOn"`
+}
+
+//-EXPORT-----------------------------------------------------------------------
+
+// The media types GET /event and POST /event/query can answer with, besides JSON
+const (
+	ContentTypeGeoJSON = "application/geo+json"
+	ContentTypeCSV     = "text/csv"
+)
+
+// GeoJSONFeature is an event as a GeoJSON Feature. Geometry is null when the
+// event has no location.
+type GeoJSONFeature struct {
+	Type       string                 `json:"type"`
+	ID         piazza.Ident           `json:"id"`
+	Geometry   interface{}            `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// GeoJSONFeatureCollection is a list of events as GeoJSON
+type GeoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []GeoJSONFeature `json:"features"`
+}
+
+//-LINEAGE----------------------------------------------------------------------
+
+// ContentTypeGraphviz is the media type GET /lineage/:id can answer with,
+// besides JSON
+const ContentTypeGraphviz = "text/vnd.graphviz"
+
+// The kinds of LineageNode. A cron node is the repeating event that
+// produced the events it points to.
+const (
+	LineageKindEvent   = "event"
+	LineageKindCron    = "cron"
+	LineageKindTrigger = "trigger"
+	LineageKindAlert   = "alert"
+	LineageKindJob     = "job"
+)
+
+// The relations of LineageEdge, read from From to To
+const (
+	LineageProduced = "produced"
+	LineageMatched  = "matched"
+	LineageRaised   = "raised"
+	LineageStarted  = "started"
+)
+
+// LineageNode is one resource of a Lineage. The label is the name of an
+// event's EventType or of a trigger.
+type LineageNode struct {
+	ID    piazza.Ident `json:"id"`
+	Kind  string       `json:"kind"`
+	Label string       `json:"label,omitempty"`
+}
+
+// LineageEdge connects two nodes of a Lineage
+type LineageEdge struct {
+	From     piazza.Ident `json:"from"`
+	To       piazza.Ident `json:"to"`
+	Relation string       `json:"relation"`
+}
+
+// Lineage is the graph of events, triggers, alerts and jobs connected to
+// RootID. Truncated says some were left out to keep it to a readable size.
+type Lineage struct {
+	RootID    piazza.Ident  `json:"rootId"`
+	Nodes     []LineageNode `json:"nodes"`
+	Edges     []LineageEdge `json:"edges"`
+	Truncated bool          `json:"truncated"`
+}
+
+//-ADMIN------------------------------------------------------------------------
+
+// ContentTypeNDJSON is the media type of GET /admin/export and POST /admin/import
+const ContentTypeNDJSON = "application/x-ndjson"
+
+// The kinds of ExportRecord, in the order they are exported and need to be imported
+const (
+	ExportKindEventType = "eventType"
+	ExportKindGeofence  = "geofence"
+	ExportKindTrigger   = "trigger"
+	ExportKindCron      = "cron"
+	ExportKindEvent     = "event"
+	ExportKindAlert     = "alert"
+
+	// ends an export that failed part way; Data is the error message
+	ExportKindError = "error"
+)
+
+// ExportRecord is one line of an export. Events and cron entries carry
+// their data un-nested, and triggers their decoded conditions, as the API
+// returns them.
+type ExportRecord struct {
+	Kind string          `json:"kind"`
+	Data json.RawMessage `json:"data"`
+}
+
+// ImportReport counts, by kind, the records an import created and those it
+// skipped because a resource with the same id already exists
+type ImportReport struct {
+	Created map[string]int `json:"created"`
+	Skipped map[string]int `json:"skipped"`
+}
+
+// The states of a PurgeJob
+const (
+	PurgeStatusRunning = "running"
+	PurgeStatusDone    = "done"
+	PurgeStatusFailed  = "failed"
+)
+
+// PurgeRequest selects what POST /admin/purge deletes. Each filter that is
+// set must match; Kinds, which defaults to all of them, takes ExportKind
+// names. Alerts match an EventType through their trigger.
+type PurgeRequest struct {
+	CreatedBy     string            `json:"createdBy,omitempty"`
+	CreatedBefore *piazza.TimeStamp `json:"createdBefore,omitempty"`
+	EventTypeID   piazza.Ident      `json:"eventTypeId,omitempty"`
+	Kinds         []string          `json:"kinds,omitempty"`
+	DryRun        bool              `json:"dryRun"`
+}
+
+// PurgeJob is the progress of a purge. Stage is the kind being deleted, and
+// Deleted counts, by kind, what has been deleted, or on a dry run what
+// would be.
+type PurgeJob struct {
+	PurgeID     piazza.Ident      `json:"purgeId"`
+	Request     PurgeRequest      `json:"request"`
+	Status      string            `json:"status"`
+	Stage       string            `json:"stage,omitempty"`
+	Deleted     map[string]int    `json:"deleted"`
+	Failed      map[string]int    `json:"failed"`
+	Errors      []string          `json:"errors,omitempty"`
+	CreatedBy   string            `json:"createdBy"`
+	CreatedOn   piazza.TimeStamp  `json:"createdOn"`
+	CompletedOn *piazza.TimeStamp `json:"completedOn,omitempty"`
+}
+
+// The states of a ReindexJob
+const (
+	ReindexStatusRunning    = "running"
+	ReindexStatusDone       = "done"
+	ReindexStatusRolledBack = "rolledBack"
+	ReindexStatusFailed     = "failed"
+)
+
+// ReindexRequest moves an alias, such as "triggers", onto a new index.
+// Settings default to those of the alias's latest migration.
+type ReindexRequest struct {
+	Alias    string `json:"alias"`
+	Index    string `json:"index"`
+	Settings string `json:"settings,omitempty"`
+}
+
+// ReindexJob is the progress of a reindex. From is the index the alias was
+// on, and Copied counts the documents written to the new one. A reindex
+// that fails is rolled back, leaving the alias where it was; it is only
+// "failed" if the rollback fails too.
+type ReindexJob struct {
+	ReindexID   piazza.Ident      `json:"reindexId"`
+	Request     ReindexRequest    `json:"request"`
+	Status      string            `json:"status"`
+	Stage       string            `json:"stage,omitempty"`
+	From        []string          `json:"from"`
+	Copied      int               `json:"copied"`
+	Errors      []string          `json:"errors,omitempty"`
+	CreatedBy   string            `json:"createdBy"`
+	CreatedOn   piazza.TimeStamp  `json:"createdOn"`
+	CompletedOn *piazza.TimeStamp `json:"completedOn,omitempty"`
+}
+
+// The kinds of ConsistencyProblem, and what a repair does about each
+const (
+	// the mapping is added
+	ConsistencyEventTypeWithoutMapping = "eventTypeWithoutMapping"
+	// the trigger is deleted
+	ConsistencyTriggerWithoutEventType = "triggerWithoutEventType"
+	// the trigger's query is registered again
+	ConsistencyTriggerWithoutPercolation = "triggerWithoutPercolation"
+	// the query is deleted
+	ConsistencyPercolationWithoutTrigger = "percolationWithoutTrigger"
+	// the cron entry is deleted
+	ConsistencyCronWithoutEvent = "cronWithoutEvent"
+	// the repeating event is scheduled
+	ConsistencyCronNotScheduled = "cronNotScheduled"
+	// the alert is deleted; a resolved alert without its event is not a
+	// problem, as retention expires such events
+	ConsistencyAlertWithoutTrigger = "alertWithoutTrigger"
+	ConsistencyAlertWithoutEvent   = "alertWithoutEvent"
+)
+
+// ConsistencyProblem is something left behind by an operation that failed
+// part way. ID is that of the resource, or of the percolation query.
+type ConsistencyProblem struct {
+	Kind     string       `json:"kind"`
+	ID       piazza.Ident `json:"id"`
+	Detail   string       `json:"detail"`
+	Repaired bool         `json:"repaired"`
+}
+
+// ConsistencyReport is what GET /admin/consistency found, or what
+// POST /admin/consistency/repair found and repaired. Whether a repeating
+// event is scheduled is a question for the instance answering.
+type ConsistencyReport struct {
+	Repair    bool                 `json:"repair"`
+	Problems  []ConsistencyProblem `json:"problems"`
+	Errors    []string             `json:"errors,omitempty"`
+	CheckedOn piazza.TimeStamp     `json:"checkedOn"`
+}
+
 //-- Stats ------------------------------------------------------------
 
+// Stats are the counts since the service started. The counters are
+// incremented atomically; LastSweep is set under the service's lock.
 type Stats struct {
 	CreatedOn        piazza.TimeStamp `json:"createdOn"`
-	NumEventTypes    int              `json:"numEventTypes"`
-	NumEvents        int              `json:"numEvents"`
-	NumTriggers      int              `json:"numTriggers"`
-	NumAlerts        int              `json:"numAlerts"`
-	NumTriggeredJobs int              `json:"numTriggeredJobs"`
+	NumEventTypes    int64            `json:"numEventTypes"`
+	NumEvents        int64            `json:"numEvents"`
+	NumTriggers      int64            `json:"numTriggers"`
+	NumAlerts        int64            `json:"numAlerts"`
+	NumTriggeredJobs int64            `json:"numTriggeredJobs"`
+	LastSweep        *SweepResult     `json:"lastSweep,omitempty"`
+}
+
+// EventTypeHourDBMapping and TriggerStatsDBMapping are the names of the
+// Elasticsearch types of the persisted statistics
+const (
+	EventTypeHourDBMapping string = "EventTypeHour"
+	TriggerStatsDBMapping  string = "TriggerStats"
+)
+
+// EventTypeHour is the number of events of an EventType posted in the hour
+// starting at Hour
+type EventTypeHour struct {
+	EventTypeID piazza.Ident     `json:"eventTypeId"`
+	Hour        piazza.TimeStamp `json:"hour"`
+	Events      int64            `json:"events"`
+}
+
+// EventTypeStats is GET /eventType/:id/stats: the events of each of the
+// last hours, oldest first, and their total
+type EventTypeStats struct {
+	EventTypeID piazza.Ident    `json:"eventTypeId"`
+	Events      int64           `json:"events"`
+	Hours       []EventTypeHour `json:"hours"`
+}
+
+// NamespaceHour is the events posted in an hour to the EventTypes of a
+// namespace
+type NamespaceHour struct {
+	Hour   piazza.TimeStamp `json:"hour"`
+	Events int64            `json:"events"`
+}
+
+// NamespaceStats is GET /namespace/:id/stats: how many EventTypes and
+// triggers the namespace has, and its events of each of the last hours
+type NamespaceStats struct {
+	Namespace  string          `json:"namespace"`
+	EventTypes int64           `json:"eventTypes"`
+	Triggers   int64           `json:"triggers"`
+	Events     int64           `json:"events"`
+	Hours      []NamespaceHour `json:"hours"`
+}
+
+// QuotaLimits caps what an owner, or a namespace, may have, and how fast it
+// may post events. Zero is no limit.
+type QuotaLimits struct {
+	EventTypes      int64   `json:"eventTypes"`
+	Triggers        int64   `json:"triggers"`
+	Crons           int64   `json:"crons"`
+	EventsPerSecond float64 `json:"eventsPerSecond"`
+	EventBurst      int64   `json:"eventBurst"`
+}
+
+// Usage is GET /usage/owner/:id and /usage/namespace/:id: what the owner or
+// namespace has, the events it may post at once, and its limits
+type Usage struct {
+	Owner       string      `json:"owner,omitempty"`
+	Namespace   string      `json:"namespace,omitempty"`
+	EventTypes  int64       `json:"eventTypes"`
+	Triggers    int64       `json:"triggers"`
+	Crons       int64       `json:"crons"`
+	EventTokens float64     `json:"eventTokens"`
+	Limits      QuotaLimits `json:"limits"`
+}
+
+// TriggerStats is GET /trigger/:id/stats. Firings counts the jobs sent, and
+// DispatchFailures those that could not be; the alerts are counted when
+// asked for rather than stored.
+type TriggerStats struct {
+	TriggerID        piazza.Ident      `json:"triggerId"`
+	Firings          int64             `json:"firings"`
+	LastFiredOn      *piazza.TimeStamp `json:"lastFiredOn,omitempty"`
+	DispatchFailures int64             `json:"dispatchFailures"`
+	LastFailedOn     *piazza.TimeStamp `json:"lastFailedOn,omitempty"`
+	Alerts           *AlertCounts      `json:"alerts,omitempty"`
+}
+
+// AlertCounts are the alerts of a trigger, by status
+type AlertCounts struct {
+	Resolved   int64 `json:"resolved"`
+	Unresolved int64 `json:"unresolved"`
+}
+
+// SweepResult is what one pass of the retention sweeper deleted.
+// EventsProtected counts the expired events kept for an unresolved alert.
+type SweepResult struct {
+	StartedOn       piazza.TimeStamp `json:"startedOn"`
+	CompletedOn     piazza.TimeStamp `json:"completedOn"`
+	EventsDeleted   int              `json:"eventsDeleted"`
+	EventsProtected int              `json:"eventsProtected"`
+	AlertsDeleted   int              `json:"alertsDeleted"`
+	Errors          []string         `json:"errors,omitempty"`
 }
 
-func (stats *Stats) incrCounter(counter *int) {
-	*counter++
+func (stats *Stats) incrCounter(counter *int64) {
+	atomic.AddInt64(counter, 1)
+}
+
+// snapshot reads the counters while they may be being incremented
+func (stats *Stats) snapshot() Stats {
+	return Stats{
+		CreatedOn:        stats.CreatedOn,
+		NumEventTypes:    atomic.LoadInt64(&stats.NumEventTypes),
+		NumEvents:        atomic.LoadInt64(&stats.NumEvents),
+		NumTriggers:      atomic.LoadInt64(&stats.NumTriggers),
+		NumAlerts:        atomic.LoadInt64(&stats.NumAlerts),
+		NumTriggeredJobs: atomic.LoadInt64(&stats.NumTriggeredJobs),
+		LastSweep:        stats.LastSweep,
+	}
 }
 
 func (stats *Stats) IncrEventTypes() {
@@ -156,6 +592,79 @@ func (stats *Stats) IncrTriggerJobs() {
 	stats.incrCounter(&stats.NumTriggeredJobs)
 }
 
+//-- Outbox -----------------------------------------------------------
+
+// OutboxDBMapping is the name of the Elasticsearch type of the outbox
+const OutboxDBMapping string = "OutboxEntry"
+
+// The stages a shutdown can leave the work of a posted event at: the event
+// is stored but its triggers are not all fired; a trigger fired but its job
+// was not sent; or the job was sent but its alert not posted.
+const (
+	OutboxStageReceived  = "received"
+	OutboxStageMatched   = "matched"
+	OutboxStagePublished = "published"
+)
+
+// OutboxEntry is work a shutdown left unfinished, for an operator to redo or
+// dismiss. StartedOn is when the work started, CreatedOn when it was given up.
+type OutboxEntry struct {
+	EntryID     piazza.Ident     `json:"entryId"`
+	Stage       string           `json:"stage"`
+	EventID     piazza.Ident     `json:"eventId"`
+	EventTypeID piazza.Ident     `json:"eventTypeId"`
+	TriggerID   piazza.Ident     `json:"triggerId,omitempty"`
+	JobID       piazza.Ident     `json:"jobId,omitempty"`
+	CreatedBy   string           `json:"createdBy"`
+	StartedOn   piazza.TimeStamp `json:"startedOn"`
+	CreatedOn   piazza.TimeStamp `json:"createdOn"`
+}
+
+//-- ACL --------------------------------------------------------------
+
+// ACLDBMapping is the name of the Elasticsearch type of the ACLs
+const ACLDBMapping string = "ACL"
+
+// ACLEveryone, as a reader or writer, is every caller
+const ACLEveryone = "*"
+
+// ACL says who may do what to an EventType, trigger or geofence: the owner
+// anything, including change the ACL; writers change and delete it; readers
+// see it. The events of an EventType, and the alerts of a trigger, go by its
+// ACL. Until one is set, the creator owns the resource and everyone reads it.
+type ACL struct {
+	ResourceID piazza.Ident `json:"resourceId"`
+	Owner      string       `json:"owner"`
+	Readers    []string     `json:"readers"`
+	Writers    []string     `json:"writers"`
+}
+
+//-- Health -----------------------------------------------------------
+
+// The statuses of a HealthReport and of its checks. A dependency that is not
+// configured, as when mocking, is skipped, and does not make the service
+// unready.
+const (
+	HealthUp      = "up"
+	HealthDown    = "down"
+	HealthSkipped = "skipped"
+)
+
+// HealthCheck is the status of one dependency, and how long checking took
+type HealthCheck struct {
+	Status   string  `json:"status"`
+	Message  string  `json:"message,omitempty"`
+	Duration float64 `json:"durationMs"`
+}
+
+// HealthReport is GET /health/live and GET /health/ready. Liveness checks
+// no dependencies.
+type HealthReport struct {
+	Status    string                 `json:"status"`
+	Checks    map[string]HealthCheck `json:"checks,omitempty"`
+	CheckedOn piazza.TimeStamp       `json:"checkedOn"`
+}
+
 //-UTILITY----------------------------------------------------------------------
 
 // LoggedError logs the error's message and creates an error
@@ -165,6 +674,23 @@ func LoggedError(mssg string, args ...interface{}) error {
 	return errors.New(str)
 }
 
+//-- Audit ------------------------------------------------------------
+
+// AuditDBMapping is the name of the Elasticsearch type of the audit store
+const AuditDBMapping string = "AuditRecord"
+
+// AuditRecord is an audit message, as GET /audit returns it. Actor is who
+// acted: the caller of a request, or pz-workflow itself.
+type AuditRecord struct {
+	AuditID    piazza.Ident     `json:"auditId"`
+	Actor      string           `json:"actor"`
+	Action     string           `json:"action"`
+	ResourceID string           `json:"resourceId"`
+	Message    string           `json:"message"`
+	HostName   string           `json:"hostName"`
+	CreatedOn  piazza.TimeStamp `json:"createdOn"`
+}
+
 //-INIT-------------------------------------------------------------------------
 
 func init() {
@@ -174,10 +700,28 @@ func init() {
 	piazza.JsonResponseDataTypes["[]workflow.Event"] = "event-list"
 	piazza.JsonResponseDataTypes["*workflow.Trigger"] = "trigger"
 	piazza.JsonResponseDataTypes["[]workflow.Trigger"] = "trigger-list"
+	piazza.JsonResponseDataTypes["*workflow.TriggerTestResult"] = "triggertest"
 	piazza.JsonResponseDataTypes["*workflow.Alert"] = "alert"
 	piazza.JsonResponseDataTypes["[]workflow.Alert"] = "alert-list"
 	piazza.JsonResponseDataTypes["[]workflow.AlertExt"] = "alertext-list"
+	piazza.JsonResponseDataTypes["*workflow.Geofence"] = "geofence"
+	piazza.JsonResponseDataTypes["[]workflow.Geofence"] = "geofence-list"
+	piazza.JsonResponseDataTypes["*workflow.EventTypeCascade"] = "eventtypecascade"
+	piazza.JsonResponseDataTypes["*workflow.Lineage"] = "lineage"
+	piazza.JsonResponseDataTypes["*workflow.ImportReport"] = "importreport"
+	piazza.JsonResponseDataTypes["*workflow.PurgeJob"] = "purgejob"
+	piazza.JsonResponseDataTypes["*workflow.ReindexJob"] = "reindexjob"
+	piazza.JsonResponseDataTypes["*workflow.ConsistencyReport"] = "consistencyreport"
 	piazza.JsonResponseDataTypes["workflow.Stats"] = "workflowstats"
+	piazza.JsonResponseDataTypes["*workflow.SweepResult"] = "sweepresult"
+	piazza.JsonResponseDataTypes["*workflow.EventTypeStats"] = "eventtypestats"
+	piazza.JsonResponseDataTypes["*workflow.TriggerStats"] = "triggerstats"
+	piazza.JsonResponseDataTypes["*workflow.NamespaceStats"] = "namespacestats"
+	piazza.JsonResponseDataTypes["*workflow.Usage"] = "usage"
+	piazza.JsonResponseDataTypes["[]workflow.AuditRecord"] = "auditrecord-list"
+	piazza.JsonResponseDataTypes["*workflow.HealthReport"] = "health"
+	piazza.JsonResponseDataTypes["[]workflow.OutboxEntry"] = "outboxentry-list"
+	piazza.JsonResponseDataTypes["*workflow.ACL"] = "acl"
 	piazza.JsonResponseDataTypes["*workflow.TestElasticsearchBody"] = "testelasticsearch"
 	piazza.JsonResponseDataTypes["[]workflow.TestElasticsearchBody"] = "testelasticsearch-list"
 }